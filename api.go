@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type statusResponse struct {
+	Mode       string        `json:"mode"`
+	Paused     bool          `json:"paused"`
+	DryRun     bool          `json:"dryRun"`
+	Export     float64       `json:"export"`
+	LastUpdate time.Time     `json:"lastUpdate"`
+	NextStart  time.Time     `json:"nextStart"`
+	Reading    *powerReading `json:"reading,omitempty"`
+	Today      dailyStats    `json:"today"`
+}
+
+type deviceResponse struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Power     float64    `json:"power"`
+	Threshold float64    `json:"threshold"`
+	Waiting   bool       `json:"waiting"`
+	Deadline  *time.Time `json:"deadline,omitempty"`
+	LastStart *time.Time `json:"lastStart,omitempty"`
+	SkipUntil *time.Time `json:"skipUntil,omitempty"`
+}
+
+func (m modeEnum) String() string {
+	switch m {
+	case ManualMode:
+		return "manual"
+	case AutoSingleMode:
+		return "single"
+	case AutoAllMode:
+		return "all"
+	default:
+		return "unknown"
+	}
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+
+	return &t
+}
+
+// endOfDay returns midnight following t in the local time zone.
+func endOfDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, t.Location())
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("error writing HTTP response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, errUnknownDevice):
+		status = http.StatusNotFound
+	case errors.Is(err, errNotWaiting):
+		status = http.StatusConflict
+	}
+
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func (s *server) handleStatus(w http.ResponseWriter, _ *http.Request) {
+	s.mu.Lock()
+	s.today.rollover(time.Now())
+	resp := statusResponse{
+		Mode:       s.mode.String(),
+		Paused:     s.paused,
+		DryRun:     s.dryRun,
+		Export:     s.available,
+		LastUpdate: s.lastUpdate,
+		NextStart:  s.nextStart,
+		Today:      s.today,
+	}
+	resp.Reading = s.reading
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *server) handleDevices(w http.ResponseWriter, _ *http.Request) {
+	s.mu.Lock()
+	resp := make([]deviceResponse, 0, len(s.devices))
+	for i := range s.devices {
+		d := &s.devices[i]
+		resp = append(resp, deviceResponse{
+			ID:        d.ID,
+			Name:      d.Name,
+			Power:     d.Power,
+			Threshold: d.threshold(),
+			Waiting:   d.waiting,
+			Deadline:  optionalTime(d.deadline),
+			LastStart: optionalTime(d.lastStart),
+			SkipUntil: optionalTime(d.skipUntil),
+		})
+	}
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *server) handleStart(w http.ResponseWriter, r *http.Request) {
+	if err := s.forceStart(r.PathValue("id")); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) handleSkip(w http.ResponseWriter, r *http.Request) {
+	if err := s.skipDevice(r.PathValue("id"), endOfDay(time.Now())); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) handleUnskip(w http.ResponseWriter, r *http.Request) {
+	if err := s.skipDevice(r.PathValue("id"), time.Time{}); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) handlePause(paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		s.setPaused(paused)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *server) handler() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/status", s.handleStatus)
+	mux.HandleFunc("GET /api/devices", s.handleDevices)
+	mux.HandleFunc("POST /api/devices/{id}/start", s.handleStart)
+	mux.HandleFunc("POST /api/devices/{id}/skip", s.handleSkip)
+	mux.HandleFunc("DELETE /api/devices/{id}/skip", s.handleUnskip)
+	mux.HandleFunc("POST /api/automation/pause", s.handlePause(true))
+	mux.HandleFunc("POST /api/automation/resume", s.handlePause(false))
+	mux.Handle("GET /metrics", promhttp.Handler())
+
+	return mux
+}
+
+// listenAndServe serves the HTTP status and control API and the Prometheus
+// metrics on the given address.
+func (s *server) listenAndServe(address string) {
+	log.Printf("HTTP API listening on %s", address)
+	hs := &http.Server{
+		Addr:              address,
+		Handler:           s.handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if err := hs.ListenAndServe(); err != nil {
+		log.Printf("HTTP API error: %v", err)
+	}
+}
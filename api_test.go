@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ingmarstein/miele-go/miele"
+)
+
+// serveAPI sends a request to the API of srv and returns the response.
+func serveAPI(t *testing.T, srv *server, method, path string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	srv.handler().ServeHTTP(w, httptest.NewRequest(method, path, nil))
+
+	return w
+}
+
+func decodeAPI(t *testing.T, w *httptest.ResponseRecorder, v any) {
+	t.Helper()
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if err := json.NewDecoder(w.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newAPITestServer(t *testing.T) (*fakeMiele, *fakeProvider, *server) {
+	f := newFakeMiele(t)
+	f.add("washer", "Washing Machine", miele.DEVICE_TYPE_WASHING_MACHINE, true)
+	f.add("dryer", "Tumble Dryer", miele.DEVICE_TYPE_TUMBLE_DRYER, false)
+
+	pp := &fakeProvider{power: 100}
+	srv := newTestServer(f, ManualMode, 0, []device{
+		{ID: "washer", Name: "Washing Machine", Power: 300},
+		{ID: "dryer", Name: "Tumble Dryer", Power: 1000},
+	}, pp, 0)
+
+	return f, pp, srv
+}
+
+func TestAPIStatus(t *testing.T) {
+	_, _, srv := newAPITestServer(t)
+	refresh(t, srv)
+
+	var status statusResponse
+	decodeAPI(t, serveAPI(t, srv, http.MethodGet, "/api/status"), &status)
+	if status.Mode != "manual" || status.Paused || status.Export != 100 || status.LastUpdate.IsZero() {
+		t.Errorf("status = %+v", status)
+	}
+	// the fake provider reports no details
+	if status.Reading != nil {
+		t.Errorf("reading = %+v, want none", status.Reading)
+	}
+}
+
+func TestAPIDevices(t *testing.T) {
+	_, _, srv := newAPITestServer(t)
+	refresh(t, srv)
+
+	var devices []deviceResponse
+	decodeAPI(t, serveAPI(t, srv, http.MethodGet, "/api/devices"), &devices)
+	if len(devices) != 2 {
+		t.Fatalf("got %d devices, want 2", len(devices))
+	}
+	if d := devices[0]; d.ID != "washer" || d.Power != 300 || d.Threshold != 300 || !d.Waiting || d.Deadline == nil || d.LastStart != nil || d.SkipUntil != nil {
+		t.Errorf("washer = %+v", d)
+	}
+	if d := devices[1]; d.ID != "dryer" || d.Waiting || d.Deadline != nil {
+		t.Errorf("dryer = %+v", d)
+	}
+}
+
+func TestAPIStart(t *testing.T) {
+	f, _, srv := newAPITestServer(t)
+	refresh(t, srv)
+
+	for _, tt := range []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodPost, "/api/devices/unknown/start", http.StatusNotFound},
+		{http.MethodPost, "/api/devices/dryer/start", http.StatusConflict},
+		{http.MethodGet, "/api/devices/washer/start", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/api/devices/washer/start", http.StatusNoContent},
+	} {
+		if w := serveAPI(t, srv, tt.method, tt.path); w.Code != tt.want {
+			t.Errorf("%s %s = %d, want %d", tt.method, tt.path, w.Code, tt.want)
+		}
+	}
+	// the surplus doesn't suffice, but starting was requested explicitly
+	checkStarted(t, f, "washer")
+}
+
+func TestAPISkip(t *testing.T) {
+	f, pp, srv := newAPITestServer(t)
+
+	for _, tt := range []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodPost, "/api/devices/unknown/skip", http.StatusNotFound},
+		{http.MethodDelete, "/api/devices/unknown/skip", http.StatusNotFound},
+		{http.MethodPut, "/api/devices/washer/skip", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/api/devices/washer/skip", http.StatusNoContent},
+	} {
+		if w := serveAPI(t, srv, tt.method, tt.path); w.Code != tt.want {
+			t.Errorf("%s %s = %d, want %d", tt.method, tt.path, w.Code, tt.want)
+		}
+	}
+
+	var devices []deviceResponse
+	decodeAPI(t, serveAPI(t, srv, http.MethodGet, "/api/devices"), &devices)
+	if devices[0].SkipUntil == nil {
+		t.Errorf("washer = %+v, want skipped", devices[0])
+	}
+
+	// a skipped device isn't started despite the surplus
+	pp.power = 500
+	refresh(t, srv)
+	checkStarted(t, f)
+
+	if w := serveAPI(t, srv, http.MethodDelete, "/api/devices/washer/skip"); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE /api/devices/washer/skip = %d", w.Code)
+	}
+	refresh(t, srv)
+	checkStarted(t, f, "washer")
+}
+
+func TestAPIPause(t *testing.T) {
+	f, pp, srv := newAPITestServer(t)
+
+	if w := serveAPI(t, srv, http.MethodGet, "/api/automation/pause"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /api/automation/pause = %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+	if w := serveAPI(t, srv, http.MethodPost, "/api/automation/pause"); w.Code != http.StatusNoContent {
+		t.Fatalf("POST /api/automation/pause = %d", w.Code)
+	}
+
+	var status statusResponse
+	decodeAPI(t, serveAPI(t, srv, http.MethodGet, "/api/status"), &status)
+	if !status.Paused {
+		t.Error("automation not paused")
+	}
+
+	// no device is started while paused
+	pp.power = 500
+	refresh(t, srv)
+	checkStarted(t, f)
+
+	if w := serveAPI(t, srv, http.MethodPost, "/api/automation/resume"); w.Code != http.StatusNoContent {
+		t.Fatalf("POST /api/automation/resume = %d", w.Code)
+	}
+	refresh(t, srv)
+	checkStarted(t, f, "washer")
+}
@@ -0,0 +1,618 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultConfigFile = "devices.json"
+
+	ProviderInverter     = "inverter"
+	ProviderSolarManager = "solarmanager"
+	ProviderMQTT         = "mqtt"
+	ProviderFronius      = "fronius"
+	ProviderSunSpec      = "sunspec"
+	ProviderShelly       = "shelly"
+	ProviderP1           = "p1"
+	ProviderSML          = "sml"
+)
+
+// config holds all settings of mielesolar. Each value is taken from the
+// first of the following sources which provides it:
+//
+//  1. command line flags
+//  2. environment variables
+//  3. the configuration file
+//  4. the defaults from defaultConfig
+type config struct {
+	Miele struct {
+		ClientID     string `json:"clientId"`
+		ClientSecret string `json:"clientSecret"`
+		Username     string `json:"username"`
+		Password     string `json:"password"`
+		VG           string `json:"vg"`
+		Events       bool   `json:"events"`
+		Resync       int    `json:"resync"` // minutes
+	} `json:"miele"`
+
+	// Provider selects the source of the power export. If empty, it is
+	// derived from the provider settings.
+	Provider string `json:"provider"`
+	Inverter struct {
+		Address   string `json:"address"`
+		Port      int    `json:"port"`
+		ModbusID  int    `json:"modbusId"`
+		Transport string `json:"transport"`
+		BaudRate  int    `json:"baudRate"`
+		Parity    string `json:"parity"`
+		StopBits  int    `json:"stopBits"`
+	} `json:"inverter"`
+	Inverters    []inverterConfig `json:"inverters"`
+	SolarManager struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		ID       string `json:"id"`
+	} `json:"solarManager"`
+	Fronius struct {
+		Address string `json:"address"`
+	} `json:"fronius"`
+	Shelly struct {
+		Address   string `json:"address"`
+		Invert    bool   `json:"invert"`
+		WebSocket bool   `json:"websocket"`
+	} `json:"shelly"`
+	P1 struct {
+		Address  string `json:"address"`
+		BaudRate int    `json:"baudRate"`
+	} `json:"p1"`
+	SML struct {
+		Address  string `json:"address"`
+		BaudRate int    `json:"baudRate"`
+	} `json:"sml"`
+	MQTT struct {
+		Broker    string `json:"broker"`
+		Username  string `json:"username"`
+		Password  string `json:"password"`
+		Topic     string `json:"topic"`
+		Path      string `json:"path"`
+		Invert    bool   `json:"invert"`
+		Timeout   int    `json:"timeout"` // seconds
+		Prefix    string `json:"prefix"`
+		Discovery string `json:"discovery"`
+	} `json:"mqtt"`
+
+	Interval int              `json:"interval"` // seconds
+	Auto     int              `json:"auto"`
+	AutoMode string           `json:"autoMode"`
+	Delay    int              `json:"delay"`   // seconds
+	Sustain  int              `json:"sustain"` // minutes
+	Deadline deadlinePolicy   `json:"deadline"`
+	DryRun   bool             `json:"dryRun"`
+	Verbose  bool             `json:"verbose"`
+	HTTP     string           `json:"http"`
+	State    string           `json:"state"`
+	History  string           `json:"history"`
+	Notify   []notifierConfig `json:"notify"`
+	Devices  []device         `json:"devices"`
+
+	file string // path of the configuration file
+}
+
+// inverterConfig configures one of several inverters. Port, modbusId and
+// transport default to the settings of inverter if omitted.
+type inverterConfig struct {
+	Address   string `json:"address"`
+	Port      int    `json:"port"`
+	ModbusID  int    `json:"modbusId"`
+	Transport string `json:"transport"`
+}
+
+func defaultConfig() *config {
+	c := config{
+		Interval: 5,
+		AutoMode: "single",
+		Delay:    300,
+		Deadline: deadlinePolicy{Policy: DeadlineNone, Margin: 15, Ramp: 60},
+	}
+	c.Miele.VG = "de-CH"
+	c.Miele.Resync = 15
+	c.Inverter.Port = 502
+	c.Inverter.ModbusID = 1
+	c.Inverter.Transport = TransportTCP
+	c.Inverter.BaudRate = 9600
+	c.Inverter.Parity = ParityNone
+	c.Inverter.StopBits = 1
+	c.P1.BaudRate = 115200
+	c.SML.BaudRate = 9600
+	c.MQTT.Timeout = 60
+	c.MQTT.Discovery = "homeassistant"
+
+	return &c
+}
+
+// option maps a command line flag and an environment variable to a
+// configuration value.
+type option struct {
+	flag  string
+	env   string
+	usage string
+	value func(c *config) any // returns a pointer to the value
+}
+
+var options = []option{
+	{"client-id", "MIELE_CLIENT_ID", "Miele 3rd Party API client ID", func(c *config) any { return &c.Miele.ClientID }},
+	{"client-secret", "MIELE_CLIENT_SECRET", "Miele 3rd Party API client secret", func(c *config) any { return &c.Miele.ClientSecret }},
+	{"user", "MIELE_USERNAME", "Miele@Home user name", func(c *config) any { return &c.Miele.Username }},
+	{"password", "MIELE_PASSWORD", "Miele@Home password", func(c *config) any { return &c.Miele.Password }},
+	{"vg", "MIELE_VG", "Country selector", func(c *config) any { return &c.Miele.VG }},
+	{"events", "MIELE_EVENTS", "Track the state of Miele devices using the event stream instead of polling", func(c *config) any { return &c.Miele.Events }},
+	{"resync", "RESYNC_INTERVAL", "Interval in minutes to resynchronize all Miele devices when using -events", func(c *config) any { return &c.Miele.Resync }},
+	{"provider", "PROVIDER", "Source of the power export: \"inverter\", \"sunspec\", \"solarmanager\", \"mqtt\", \"fronius\", \"shelly\", \"p1\" or \"sml\". Derived from the provider settings if empty", func(c *config) any { return &c.Provider }},
+	{"inverter", "INVERTER_ADDRESS", "Inverter address or IP, or serial device for -transport rtu. Separate several inverters with commas, each optionally followed by :port and /modbus-id", func(c *config) any { return &c.Inverter.Address }},
+	{"port", "INVERTER_PORT", "MODBUS over TCP port", func(c *config) any { return &c.Inverter.Port }},
+	{"modbus-id", "INVERTER_MODBUS_ID", "Inverter MODBUS device ID", func(c *config) any { return &c.Inverter.ModbusID }},
+	{"transport", "INVERTER_TRANSPORT", "MODBUS transport: \"tcp\", \"rtu\" (serial) or \"rtuovertcp\"", func(c *config) any { return &c.Inverter.Transport }},
+	{"baud-rate", "INVERTER_BAUD_RATE", "Baud rate of the serial line for MODBUS RTU", func(c *config) any { return &c.Inverter.BaudRate }},
+	{"parity", "INVERTER_PARITY", "Parity of the serial line for MODBUS RTU: \"none\", \"even\" or \"odd\"", func(c *config) any { return &c.Inverter.Parity }},
+	{"stop-bits", "INVERTER_STOP_BITS", "Stop bits of the serial line for MODBUS RTU", func(c *config) any { return &c.Inverter.StopBits }},
+	{"fronius", "FRONIUS_ADDRESS", "Fronius inverter or Datamanager address for the local Solar API", func(c *config) any { return &c.Fronius.Address }},
+	{"shelly", "SHELLY_ADDRESS", "Shelly energy meter address at the grid connection point", func(c *config) any { return &c.Shelly.Address }},
+	{"shelly-invert", "SHELLY_INVERT", "Invert the sign of the Shelly power, i.e. positive values indicate export to the grid", func(c *config) any { return &c.Shelly.Invert }},
+	{"shelly-websocket", "SHELLY_WEBSOCKET", "Receive Shelly status changes over a WebSocket connection instead of polling (Gen2 or newer)", func(c *config) any { return &c.Shelly.WebSocket }},
+	{"p1", "P1_ADDRESS", "Serial device or host:port (e.g. ser2net) of the P1 port of a DSMR smart meter", func(c *config) any { return &c.P1.Address }},
+	{"p1-baud-rate", "P1_BAUD_RATE", "Baud rate of the P1 port: 115200 for DSMR 4 and 5, 9600 for older meters", func(c *config) any { return &c.P1.BaudRate }},
+	{"sml", "SML_ADDRESS", "Serial device or host:port of the optical head of a smart meter emitting SML", func(c *config) any { return &c.SML.Address }},
+	{"sml-baud-rate", "SML_BAUD_RATE", "Baud rate of the optical head of the SML meter", func(c *config) any { return &c.SML.BaudRate }},
+	{"solarmanager-username", "SOLARMANAGER_USERNAME", "SolarManager username", func(c *config) any { return &c.SolarManager.Username }},
+	{"solarmanager-password", "SOLARMANAGER_PASSWORD", "SolarManager password", func(c *config) any { return &c.SolarManager.Password }},
+	{"solarmanager-id", "SOLARMANAGER_ID", "SolarManager ID", func(c *config) any { return &c.SolarManager.ID }},
+	{"mqtt-broker", "MQTT_BROKER", "MQTT broker URL, e.g. \"tcp://localhost:1883\"", func(c *config) any { return &c.MQTT.Broker }},
+	{"mqtt-username", "MQTT_USERNAME", "MQTT username", func(c *config) any { return &c.MQTT.Username }},
+	{"mqtt-password", "MQTT_PASSWORD", "MQTT password", func(c *config) any { return &c.MQTT.Password }},
+	{"mqtt-topic", "MQTT_TOPIC", "MQTT topic providing the surplus power", func(c *config) any { return &c.MQTT.Topic }},
+	{"mqtt-path", "MQTT_PATH", "Dot-separated path of the value in a JSON payload, e.g. \"site.gridPower\". Plain numeric payload if empty", func(c *config) any { return &c.MQTT.Path }},
+	{"mqtt-invert", "MQTT_INVERT", "Invert the sign of the MQTT value, e.g. if positive values indicate power drawn from the grid", func(c *config) any { return &c.MQTT.Invert }},
+	{"mqtt-timeout", "MQTT_TIMEOUT", "Seconds after which the last MQTT value is considered stale", func(c *config) any { return &c.MQTT.Timeout }},
+	{"mqtt-prefix", "MQTT_PREFIX", "Topic prefix to publish the state to MQTT, e.g. \"mielesolar\". Disabled if empty", func(c *config) any { return &c.MQTT.Prefix }},
+	{"mqtt-discovery", "MQTT_DISCOVERY_PREFIX", "Home Assistant MQTT discovery prefix. Disabled if empty", func(c *config) any { return &c.MQTT.Discovery }},
+	{"interval", "INTERVAL", "Polling interval in seconds", func(c *config) any { return &c.Interval }},
+	{"auto", "AUTO", "Automatically start waiting devices if a minimum amount of power is available", func(c *config) any { return &c.Auto }},
+	{"auto-mode", "AUTO_MODE", "How many devices to start when the amount of power specified by -auto is available. Valid values: \"single\" or \"all\"", func(c *config) any { return &c.AutoMode }},
+	{"delay", "DELAY", "Delay in seconds between the start of devices", func(c *config) any { return &c.Delay }},
+	{"sustain", "SUSTAIN", "Number of minutes the surplus power must be sustained before a device is started", func(c *config) any { return &c.Sustain }},
+	{"deadline", "DEADLINE", "How to handle the end of the SmartStart window. Valid values: \"none\", \"start\" or \"ramp\"", func(c *config) any { return &c.Deadline.Policy }},
+	{"deadline-margin", "DEADLINE_MARGIN", "Minutes before the end of the SmartStart window at which devices are started regardless of the surplus", func(c *config) any { return &c.Deadline.Margin }},
+	{"deadline-ramp", "DEADLINE_RAMP", "Minutes before the deadline margin during which the required surplus is lowered progressively", func(c *config) any { return &c.Deadline.Ramp }},
+	{"dry-run", "DRY_RUN", "Log which devices would be started without actually starting them", func(c *config) any { return &c.DryRun }},
+	{"verbose", "VERBOSE", "Verbose mode", func(c *config) any { return &c.Verbose }},
+	{"http", "HTTP_ADDRESS", "Listen address of the HTTP status and control API, e.g. \":8080\". Disabled if empty", func(c *config) any { return &c.HTTP }},
+	{"state", "STATE_FILE", "File to persist the runtime state across restarts, e.g. \"state.json\". Disabled if empty", func(c *config) any { return &c.State }},
+	{"history", "HISTORY_FILE", "File to record the history of events, e.g. \"history.jsonl\". Disabled if empty", func(c *config) any { return &c.History }},
+}
+
+func findOption(name string) *option {
+	for i := range options {
+		if options[i].flag == name {
+			return &options[i]
+		}
+	}
+
+	return nil
+}
+
+// set parses s and assigns it to the configuration value.
+func (o *option) set(c *config, s string) error {
+	switch p := o.value(c).(type) {
+	case *string:
+		*p = s
+	case *int:
+		v, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", s)
+		}
+		*p = v
+	case *bool:
+		v, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", s)
+		}
+		*p = v
+	}
+
+	return nil
+}
+
+// registerFlags defines a flag for every option and returns the flag
+// selecting the configuration file.
+func registerFlags(fs *flag.FlagSet) *string {
+	def := defaultConfig()
+	for _, o := range options {
+		usage := fmt.Sprintf("%s [$%s]", o.usage, o.env)
+		switch p := o.value(def).(type) {
+		case *string:
+			fs.String(o.flag, *p, usage)
+		case *int:
+			fs.Int(o.flag, *p, usage)
+		case *bool:
+			fs.Bool(o.flag, *p, usage)
+		}
+	}
+
+	return fs.String("config", defaultConfigFile, "Configuration file [$CONFIG_FILE]")
+}
+
+// loadConfigFile reads the configuration file into c. For compatibility, the
+// file may also contain just the list of devices.
+func loadConfigFile(c *config, name string) error {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(data, &c.Devices); err != nil {
+			return fmt.Errorf("error parsing %s: %v", name, err)
+		}
+		return nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("error parsing %s: %v", name, err)
+	}
+
+	return nil
+}
+
+// parseConfig parses the command line arguments and builds the configuration
+// from all sources in the order of precedence documented on config.
+func parseConfig(fs *flag.FlagSet, args []string, getenv func(string) string) (*config, error) {
+	configFile := registerFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	c := defaultConfig()
+	c.file = *configFile
+	if !set["config"] {
+		if v := getenv("CONFIG_FILE"); v != "" {
+			c.file = v
+		}
+	}
+	var errs []error
+	if err := loadConfigFile(c, c.file); err != nil {
+		// the default file is optional, e.g. in automatic mode
+		if !errors.Is(err, os.ErrNotExist) || c.file != defaultConfigFile {
+			errs = append(errs, err)
+		} else {
+			c.file = ""
+		}
+	}
+
+	for i := range options {
+		o := &options[i]
+		v, err := lookupEnv(o, getenv)
+		if err != nil {
+			errs = append(errs, err)
+		} else if v != "" {
+			if err := o.set(c, v); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", o.env, err))
+			}
+		}
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if o := findOption(f.Name); o != nil {
+			if err := o.set(c, f.Value.String()); err != nil {
+				errs = append(errs, fmt.Errorf("-%s: %v", f.Name, err))
+			}
+		}
+	})
+	if err := c.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return c, nil
+}
+
+// source describes where a value can be configured.
+func source(key, flagName string) string {
+	if o := findOption(flagName); o != nil {
+		return fmt.Sprintf("%s (-%s, $%s)", key, o.flag, o.env)
+	}
+
+	return key
+}
+
+// provider returns the configured source of the power export.
+func (c *config) provider() string {
+	switch {
+	case c.Provider != "":
+		return c.Provider
+	case c.SolarManager.Username != "":
+		return ProviderSolarManager
+	case c.MQTT.Topic != "":
+		return ProviderMQTT
+	case c.Fronius.Address != "":
+		return ProviderFronius
+	case c.Shelly.Address != "":
+		return ProviderShelly
+	case c.P1.Address != "":
+		return ProviderP1
+	case c.SML.Address != "":
+		return ProviderSML
+	default:
+		return ProviderInverter
+	}
+}
+
+// inverters returns the configured inverters, either from the inverters list
+// or from the comma-separated inverter address, where each entry has the form
+// host[:port][/modbusId], or device[/modbusId] for MODBUS RTU. It returns no
+// inverters if they are to be searched on the local network.
+func (c *config) inverters() ([]inverterTarget, error) {
+	transports := []string{TransportTCP, TransportRTU, TransportRTUOverTCP}
+	if !slices.Contains(transports, c.Inverter.Transport) {
+		return nil, fmt.Errorf("invalid %s %q", source("inverter.transport", "transport"), c.Inverter.Transport)
+	}
+
+	list := c.Inverters
+	if len(list) == 0 {
+		for _, entry := range strings.Split(c.Inverter.Address, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			ic, err := parseInverter(entry, c.Inverter.Transport)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s entry %q: %v", source("inverter.address", "inverter"), entry, err)
+			}
+			list = append(list, ic)
+		}
+	}
+	if len(list) == 0 && c.Inverter.Transport != TransportTCP {
+		return nil, fmt.Errorf("%s is required for the %s transport", source("inverter.address", "inverter"), c.Inverter.Transport)
+	}
+
+	var targets []inverterTarget
+	for i, ic := range list {
+		transport := cmp.Or(ic.Transport, c.Inverter.Transport)
+		port := cmp.Or(ic.Port, c.Inverter.Port)
+		id := cmp.Or(ic.ModbusID, c.Inverter.ModbusID)
+		switch {
+		case ic.Address == "":
+			return nil, fmt.Errorf("inverters[%d]: address is required", i)
+		case !slices.Contains(transports, transport):
+			return nil, fmt.Errorf("inverters[%d] (%s): invalid transport %q", i, ic.Address, transport)
+		case port <= 0 || port > 65535:
+			return nil, fmt.Errorf("inverters[%d] (%s): invalid port %d", i, ic.Address, port)
+		case id < 0 || id > 247:
+			return nil, fmt.Errorf("inverters[%d] (%s): invalid modbusId %d", i, ic.Address, id)
+		}
+		t := inverterTarget{Transport: transport, Address: ic.Address, UnitID: id}
+		if transport != TransportRTU {
+			t.Address = net.JoinHostPort(ic.Address, strconv.Itoa(port))
+		}
+		if transport != TransportTCP {
+			t.Serial = serialSettings{
+				BaudRate: uint(c.Inverter.BaudRate),
+				Parity:   c.Inverter.Parity,
+				StopBits: uint(c.Inverter.StopBits),
+			}
+		}
+		for _, other := range targets {
+			if other == t {
+				return nil, fmt.Errorf("inverters[%d]: duplicate inverter %s", i, t)
+			}
+		}
+		targets = append(targets, t)
+	}
+
+	return targets, nil
+}
+
+// parseInverter parses an inverter address of the form host[:port][/modbusId],
+// or device[/modbusId] for MODBUS RTU.
+func parseInverter(s, transport string) (inverterConfig, error) {
+	var ic inverterConfig
+	if transport == TransportRTU {
+		// the device is a path, e.g. /dev/ttyUSB0 or /dev/ttyUSB0/2
+		ic.Address = s
+		if i := strings.LastIndexByte(s, '/'); i > 0 {
+			if n, err := strconv.Atoi(s[i+1:]); err == nil && n > 0 {
+				ic.Address, ic.ModbusID = s[:i], n
+			}
+		}
+		return ic, nil
+	}
+
+	host, id, ok := strings.Cut(s, "/")
+	if ok {
+		n, err := strconv.Atoi(id)
+		if err != nil || n <= 0 {
+			return ic, fmt.Errorf("invalid modbus ID %q", id)
+		}
+		ic.ModbusID = n
+	}
+	ic.Address = host
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		n, err := strconv.Atoi(port)
+		if err != nil || n <= 0 {
+			return ic, fmt.Errorf("invalid port %q", port)
+		}
+		ic.Address, ic.Port = h, n
+	}
+
+	return ic, nil
+}
+
+func (c *config) mode() modeEnum {
+	switch {
+	case c.Auto == 0:
+		return ManualMode
+	case c.AutoMode == "all":
+		return AutoAllMode
+	default:
+		return AutoSingleMode
+	}
+}
+
+func (c *config) interval() time.Duration {
+	return time.Duration(c.Interval) * time.Second
+}
+
+// validate reports all problems with the configuration.
+func (c *config) validate() error {
+	var errs []error
+	require := func(value, key, flagName string) {
+		if value == "" {
+			errs = append(errs, fmt.Errorf("%s is required", source(key, flagName)))
+		}
+	}
+	positive := func(value int, key, flagName string) {
+		if value <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be positive", source(key, flagName)))
+		}
+	}
+	notNegative := func(value int, key, flagName string) {
+		if value < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative", source(key, flagName)))
+		}
+	}
+
+	require(c.Miele.ClientID, "miele.clientId", "client-id")
+	require(c.Miele.ClientSecret, "miele.clientSecret", "client-secret")
+	require(c.Miele.Username, "miele.username", "user")
+	require(c.Miele.Password, "miele.password", "password")
+	require(c.Miele.VG, "miele.vg", "vg")
+	positive(c.Miele.Resync, "miele.resync", "resync")
+
+	switch c.Provider {
+	case "":
+		// settings from which the provider is derived
+		settings := []struct {
+			set           bool
+			key, flagName string
+		}{
+			{c.Inverter.Address != "" || len(c.Inverters) > 0, "inverter.address", "inverter"},
+			{c.SolarManager.Username != "", "solarManager.username", "solarmanager-username"},
+			{c.MQTT.Topic != "", "mqtt.topic", "mqtt-topic"},
+			{c.Fronius.Address != "", "fronius.address", "fronius"},
+			{c.Shelly.Address != "", "shelly.address", "shelly"},
+			{c.P1.Address != "", "p1.address", "p1"},
+			{c.SML.Address != "", "sml.address", "sml"},
+		}
+		var names []string
+		for _, s := range settings {
+			if s.set {
+				names = append(names, source(s.key, s.flagName))
+			}
+		}
+		if len(names) > 1 {
+			errs = append(errs, fmt.Errorf("%s and %s are mutually exclusive unless %s is set",
+				strings.Join(names[:len(names)-1], ", "), names[len(names)-1], source("provider", "provider")))
+		}
+	case ProviderInverter, ProviderSunSpec, ProviderSolarManager, ProviderMQTT, ProviderFronius, ProviderShelly, ProviderP1, ProviderSML:
+	default:
+		errs = append(errs, fmt.Errorf("invalid %s %q", source("provider", "provider"), c.Provider))
+	}
+	switch c.provider() {
+	case ProviderInverter, ProviderSunSpec:
+		if c.Inverter.Port <= 0 || c.Inverter.Port > 65535 {
+			errs = append(errs, fmt.Errorf("invalid %s %d", source("inverter.port", "port"), c.Inverter.Port))
+		}
+		if c.Inverter.ModbusID < 0 || c.Inverter.ModbusID > 247 {
+			errs = append(errs, fmt.Errorf("invalid %s %d", source("inverter.modbusId", "modbus-id"), c.Inverter.ModbusID))
+		}
+		positive(c.Inverter.BaudRate, "inverter.baudRate", "baud-rate")
+		if !slices.Contains([]string{ParityNone, ParityEven, ParityOdd}, c.Inverter.Parity) {
+			errs = append(errs, fmt.Errorf("invalid %s %q", source("inverter.parity", "parity"), c.Inverter.Parity))
+		}
+		if c.Inverter.StopBits != 1 && c.Inverter.StopBits != 2 {
+			errs = append(errs, fmt.Errorf("invalid %s %d", source("inverter.stopBits", "stop-bits"), c.Inverter.StopBits))
+		}
+		if c.Inverter.Address != "" && len(c.Inverters) > 0 {
+			errs = append(errs, fmt.Errorf("%s and inverters are mutually exclusive", source("inverter.address", "inverter")))
+		} else if _, err := c.inverters(); err != nil {
+			errs = append(errs, err)
+		} else if c.provider() == ProviderSunSpec && c.Inverter.Address == "" && len(c.Inverters) == 0 {
+			// inverters are only discovered on the network by SolarEdge's mDNS service
+			errs = append(errs, fmt.Errorf("%s or inverters is required for provider %q", source("inverter.address", "inverter"), ProviderSunSpec))
+		}
+	case ProviderSolarManager:
+		require(c.SolarManager.Username, "solarManager.username", "solarmanager-username")
+		require(c.SolarManager.Password, "solarManager.password", "solarmanager-password")
+		require(c.SolarManager.ID, "solarManager.id", "solarmanager-id")
+	case ProviderMQTT:
+		require(c.MQTT.Topic, "mqtt.topic", "mqtt-topic")
+		positive(c.MQTT.Timeout, "mqtt.timeout", "mqtt-timeout")
+	case ProviderFronius:
+		require(c.Fronius.Address, "fronius.address", "fronius")
+	case ProviderShelly:
+		require(c.Shelly.Address, "shelly.address", "shelly")
+	case ProviderP1:
+		require(c.P1.Address, "p1.address", "p1")
+		positive(c.P1.BaudRate, "p1.baudRate", "p1-baud-rate")
+	case ProviderSML:
+		require(c.SML.Address, "sml.address", "sml")
+		positive(c.SML.BaudRate, "sml.baudRate", "sml-baud-rate")
+	}
+	if (c.provider() == ProviderMQTT || c.MQTT.Prefix != "") && c.MQTT.Broker == "" {
+		errs = append(errs, fmt.Errorf("%s is required to read from or publish to MQTT", source("mqtt.broker", "mqtt-broker")))
+	}
+
+	positive(c.Interval, "interval", "interval")
+	notNegative(c.Auto, "auto", "auto")
+	notNegative(c.Delay, "delay", "delay")
+	notNegative(c.Sustain, "sustain", "sustain")
+	if c.AutoMode != "single" && c.AutoMode != "all" {
+		errs = append(errs, fmt.Errorf("invalid %s %q", source("autoMode", "auto-mode"), c.AutoMode))
+	}
+	if err := c.Deadline.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("deadline: %v", err))
+	}
+
+	if c.Auto == 0 && len(c.Devices) == 0 {
+		errs = append(errs, fmt.Errorf("either %s or devices must be configured", source("auto", "auto")))
+	}
+	ids := make(map[string]bool)
+	for i, d := range c.Devices {
+		if d.ID == "" {
+			errs = append(errs, fmt.Errorf("devices[%d]: id is required", i))
+		} else if ids[d.ID] {
+			errs = append(errs, fmt.Errorf("devices[%d]: duplicate id %s", i, d.ID))
+		}
+		ids[d.ID] = true
+		if d.Power < 0 || d.Threshold < 0 || d.Sustain < 0 {
+			errs = append(errs, fmt.Errorf("devices[%d] (%s): power, threshold and sustain must not be negative", i, d.Name))
+		}
+		if err := d.Deadline.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("devices[%d] (%s): %v", i, d.Name, err))
+		}
+	}
+
+	for i := range c.Notify {
+		for _, err := range c.Notify[i].validate() {
+			errs = append(errs, fmt.Errorf("notify[%d] (%s): %v", i, c.Notify[i].Type, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
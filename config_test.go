@@ -0,0 +1,269 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const testCredentials = `"miele": {"clientId": "id", "clientSecret": "secret", "username": "user", "password": "pass"}`
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+
+	name := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(name, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return name
+}
+
+func testParseConfig(args []string, env map[string]string) (*config, error) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	return parseConfig(fs, args, func(key string) string { return env[key] })
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	name := writeConfig(t, `{
+		`+testCredentials+`,
+		"inverter": {"address": "192.168.1.10", "port": 1502},
+		"interval": 10,
+		"delay": 60,
+		"auto": 500,
+		"deadline": {"policy": "ramp", "margin": 5, "ramp": 30}
+	}`)
+
+	cfg, err := testParseConfig([]string{"-config", name, "-delay", "120"}, map[string]string{
+		"INVERTER_PORT": "502",
+		"DELAY":         "90",
+		"DEADLINE":      "start",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name      string
+		got, want any
+	}{
+		{"file", cfg.Inverter.Address, "192.168.1.10"},
+		{"file", cfg.Interval, 10},
+		{"env over file", cfg.Inverter.Port, 502},
+		{"flag over env", cfg.Delay, 120},
+		{"env over file", cfg.Deadline.Policy, DeadlineStart},
+		{"file", cfg.Deadline.Margin, 5},
+		{"default", cfg.AutoMode, "single"},
+		{"default", cfg.Miele.VG, "de-CH"},
+		{"default", cfg.Inverter.ModbusID, 1},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+	if cfg.mode() != AutoSingleMode || cfg.provider() != ProviderInverter {
+		t.Errorf("mode = %v, provider = %s", cfg.mode(), cfg.provider())
+	}
+}
+
+func TestConfigLegacyDeviceList(t *testing.T) {
+	name := writeConfig(t, `[{"id": "000123", "name": "Washing Machine", "power": 200}]`)
+
+	cfg, err := testParseConfig(nil, map[string]string{
+		"CONFIG_FILE":         name,
+		"MIELE_CLIENT_ID":     "id",
+		"MIELE_CLIENT_SECRET": "secret",
+		"MIELE_USERNAME":      "user",
+		"MIELE_PASSWORD":      "pass",
+		"MQTT_BROKER":         "tcp://localhost:1883",
+		"MQTT_TOPIC":          "power",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Devices) != 1 || cfg.Devices[0].ID != "000123" || cfg.mode() != ManualMode {
+		t.Errorf("unexpected devices: %+v", cfg.Devices)
+	}
+	if cfg.provider() != ProviderMQTT {
+		t.Errorf("provider = %s, want %s", cfg.provider(), ProviderMQTT)
+	}
+}
+
+func TestConfigMissingFile(t *testing.T) {
+	// the default configuration file is optional
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Chdir(wd) })
+
+	if _, err := testParseConfig([]string{"-auto", "500", "-client-id", "id", "-client-secret", "secret", "-user", "user", "-password", "pass"}, nil); err != nil {
+		t.Errorf("unexpected error without default configuration file: %v", err)
+	}
+
+	if _, err := testParseConfig([]string{"-config", "missing.json"}, nil); err == nil {
+		t.Error("expected error for missing configuration file")
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	name := writeConfig(t, `{
+		"provider": "mqtt",
+		"interval": 0,
+		"autoMode": "some",
+		"devices": [
+			{"id": "1", "power": 100},
+			{"id": "1", "power": -1, "deadline": {"policy": "later"}},
+			{"power": 100}
+		]
+	}`)
+
+	// invalid environment variables are reported along with the validation
+	// errors
+	_, err := testParseConfig([]string{"-config", name, "-mqtt-prefix", "mielesolar"}, map[string]string{"INVERTER_PORT": "abc", "AUTO": "x"})
+	if err == nil {
+		t.Fatal("expected errors")
+	}
+	for _, want := range []string{"INVERTER_PORT", "AUTO", "interval (-interval, $INTERVAL) must be positive"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("missing error %q in:\n%v", want, err)
+		}
+	}
+
+	_, err = testParseConfig([]string{"-config", name, "-mqtt-prefix", "mielesolar"}, nil)
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	for _, want := range []string{
+		"miele.clientId (-client-id, $MIELE_CLIENT_ID) is required",
+		"miele.password (-password, $MIELE_PASSWORD) is required",
+		"mqtt.topic (-mqtt-topic, $MQTT_TOPIC) is required",
+		"mqtt.broker (-mqtt-broker, $MQTT_BROKER) is required",
+		"interval (-interval, $INTERVAL) must be positive",
+		`invalid autoMode (-auto-mode, $AUTO_MODE) "some"`,
+		"devices[1]: duplicate id 1",
+		"devices[1] (): power, threshold and sustain must not be negative",
+		`devices[1] (): invalid deadline policy "later"`,
+		"devices[2]: id is required",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("missing error %q in:\n%v", want, err)
+		}
+	}
+
+	name = writeConfig(t, `{`+testCredentials+`, "auto": 500, "unknown": true}`)
+	if _, err := testParseConfig([]string{"-config", name}, nil); err == nil || !strings.Contains(err.Error(), "unknown") {
+		t.Errorf("expected error for unknown key, got %v", err)
+	}
+}
+
+func TestConfigProviders(t *testing.T) {
+	base := []string{"-auto", "500", "-client-id", "id", "-client-secret", "secret", "-user", "user", "-password", "pass", "-config", writeConfig(t, "{}")}
+
+	for _, tt := range []struct {
+		args []string
+		ok   bool
+	}{
+		{[]string{"-inverter", "inverter.local", "-mqtt-topic", "power", "-mqtt-broker", "tcp://broker"}, false},
+		{[]string{"-provider", "mqtt", "-inverter", "inverter.local", "-mqtt-topic", "power", "-mqtt-broker", "tcp://broker"}, true},
+		{[]string{"-provider", "solarmanager"}, false},
+		{[]string{"-solarmanager-username", "user", "-solarmanager-password", "pass", "-solarmanager-id", "1"}, true},
+		{[]string{"-provider", "other"}, false},
+		{[]string{"-port", "0"}, false},
+		{[]string{"-fronius", "192.168.1.20"}, true},
+		{[]string{"-fronius", "192.168.1.20", "-inverter", "inverter.local"}, false},
+		{[]string{"-provider", "fronius"}, false},
+		{[]string{"-provider", "sunspec", "-inverter", "192.168.1.30", "-port", "502"}, true},
+		{[]string{"-provider", "sunspec", "-transport", "rtu", "-inverter", "/dev/ttyUSB0/3"}, true},
+		{[]string{"-provider", "sunspec"}, false},
+		{[]string{"-shelly", "192.168.1.40", "-shelly-websocket"}, true},
+		{[]string{"-shelly", "192.168.1.40", "-fronius", "192.168.1.20"}, false},
+		{[]string{"-provider", "shelly"}, false},
+		{[]string{"-p1", "/dev/ttyUSB0"}, true},
+		{[]string{"-p1", "ser2net.local:2001", "-p1-baud-rate", "0"}, false},
+		{[]string{"-p1", "/dev/ttyUSB0", "-shelly", "192.168.1.40"}, false},
+		{[]string{"-provider", "p1"}, false},
+		{[]string{"-sml", "ir-head.local:8888"}, true},
+		{[]string{"-sml", "/dev/ttyUSB1", "-p1", "/dev/ttyUSB0"}, false},
+		{[]string{"-provider", "sml"}, false},
+		{[]string{"-provider", "sunspec", "-inverter", "192.168.1.30", "-parity", "mark"}, false},
+	} {
+		_, err := testParseConfig(append(base, tt.args...), nil)
+		if (err == nil) != tt.ok {
+			t.Errorf("%v: unexpected result %v", tt.args, err)
+		}
+	}
+}
+
+func TestConfigExclusiveProviders(t *testing.T) {
+	_, err := testParseConfig([]string{"-config", writeConfig(t, "{"+testCredentials+`, "auto": 500}`), "-fronius", "192.168.1.20", "-sml", "/dev/ttyUSB1"}, nil)
+	want := "fronius.address (-fronius, $FRONIUS_ADDRESS) and sml.address (-sml, $SML_ADDRESS) are mutually exclusive unless provider (-provider, $PROVIDER) is set"
+	if err == nil || err.Error() != want {
+		t.Errorf("got error %v, want %q", err, want)
+	}
+}
+
+func TestConfigInverters(t *testing.T) {
+	tcp := func(address string, id int) inverterTarget {
+		return inverterTarget{Transport: TransportTCP, Address: address, UnitID: id}
+	}
+	serial := serialSettings{BaudRate: 19200, Parity: ParityEven, StopBits: 1}
+	for _, tt := range []struct {
+		name    string
+		args    []string
+		content string
+		want    []inverterTarget
+	}{
+		{"discovery", nil, "{}", nil},
+		{"single", []string{"-inverter", "192.168.1.10"}, "{}", []inverterTarget{tcp("192.168.1.10:502", 1)}},
+		{"list", []string{"-inverter", "192.168.1.10, 192.168.1.10/2,inverter.local:1502/3,[fe80::1]:1502", "-modbus-id", "5"}, "{}",
+			[]inverterTarget{tcp("192.168.1.10:502", 5), tcp("192.168.1.10:502", 2), tcp("inverter.local:1502", 3), tcp("[fe80::1]:1502", 5)}},
+		{"file", nil, `{"inverter": {"port": 1502}, "inverters": [{"address": "192.168.1.10"}, {"address": "192.168.1.11", "port": 502, "modbusId": 2}]}`,
+			[]inverterTarget{tcp("192.168.1.10:1502", 1), tcp("192.168.1.11:502", 2)}},
+		{"rtu", []string{"-transport", "rtu", "-inverter", "/dev/ttyUSB0,/dev/ttyUSB0/2", "-baud-rate", "19200", "-parity", "even"}, "{}",
+			[]inverterTarget{{TransportRTU, "/dev/ttyUSB0", 1, serial}, {TransportRTU, "/dev/ttyUSB0", 2, serial}}},
+		{"rtu over tcp", nil, `{"inverter": {"baudRate": 19200, "parity": "even"}, "inverters": [{"address": "gateway", "port": 8899, "transport": "rtuovertcp"}, {"address": "192.168.1.10"}]}`,
+			[]inverterTarget{{TransportRTUOverTCP, "gateway:8899", 1, serial}, tcp("192.168.1.10:502", 1)}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			name := writeConfig(t, tt.content)
+			cfg, err := testParseConfig(append([]string{"-config", name, "-auto", "500", "-client-id", "id", "-client-secret", "secret", "-user", "user", "-password", "pass"}, tt.args...), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := cfg.inverters()
+			if err != nil || !slices.Equal(got, tt.want) {
+				t.Errorf("inverters() = %v, %v; want %v", got, err, tt.want)
+			}
+		})
+	}
+
+	base := []string{"-auto", "500", "-client-id", "id", "-client-secret", "secret", "-user", "user", "-password", "pass"}
+	for _, tt := range []struct {
+		args    []string
+		content string
+		want    string
+	}{
+		{[]string{"-inverter", "192.168.1.10/x"}, "{}", `invalid modbus ID "x"`},
+		{[]string{"-inverter", "192.168.1.10:http"}, "{}", `invalid port "http"`},
+		{[]string{"-inverter", "192.168.1.10/248"}, "{}", "invalid modbusId 248"},
+		{[]string{"-inverter", "192.168.1.10,192.168.1.10:502"}, "{}", "duplicate inverter 192.168.1.10:502/1"},
+		{[]string{"-inverter", "192.168.1.10"}, `{"inverters": [{"address": "192.168.1.11"}]}`, "mutually exclusive"},
+		{nil, `{"inverters": [{"port": 502}]}`, "inverters[0]: address is required"},
+		{[]string{"-transport", "rtu"}, "{}", "inverter.address (-inverter, $INVERTER_ADDRESS) is required for the rtu transport"},
+		{[]string{"-transport", "udp"}, "{}", `invalid inverter.transport (-transport, $INVERTER_TRANSPORT) "udp"`},
+		{[]string{"-transport", "rtu", "-inverter", "/dev/ttyUSB0", "-parity", "mark", "-stop-bits", "3"}, "{}", `invalid inverter.parity (-parity, $INVERTER_PARITY) "mark"`},
+		{[]string{"-transport", "rtu", "-inverter", "/dev/ttyUSB0", "-stop-bits", "3"}, "{}", "invalid inverter.stopBits (-stop-bits, $INVERTER_STOP_BITS) 3"},
+	} {
+		_, err := testParseConfig(append(base, append([]string{"-config", writeConfig(t, tt.content)}, tt.args...)...), nil)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%v %s: got error %v, want %q", tt.args, tt.content, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	// DeadlineNone leaves the device waiting for surplus power. Miele starts
+	// the device on its own once the SmartStart window ends.
+	DeadlineNone = "none"
+	// DeadlineStart starts the device unconditionally once the end of the
+	// SmartStart window is closer than the margin.
+	DeadlineStart = "start"
+	// DeadlineRamp progressively lowers the required surplus as the end of
+	// the SmartStart window approaches and starts unconditionally at the margin.
+	DeadlineRamp = "ramp"
+)
+
+// deadlinePolicy describes how a device is scheduled as the latest start time
+// of its SmartStart window approaches.
+type deadlinePolicy struct {
+	Policy string `json:"policy,omitempty"`
+	Margin int    `json:"margin,omitempty"` // minutes before the latest start
+	Ramp   int    `json:"ramp,omitempty"`   // minutes during which the required surplus is lowered
+}
+
+func (dp deadlinePolicy) validate() error {
+	switch dp.Policy {
+	case "", DeadlineNone, DeadlineStart, DeadlineRamp:
+	default:
+		return fmt.Errorf("invalid deadline policy %q", dp.Policy)
+	}
+	if dp.Margin < 0 || dp.Ramp < 0 {
+		return fmt.Errorf("deadline margin and ramp must not be negative")
+	}
+
+	return nil
+}
+
+// orDefault returns the policy, or def if no policy has been configured.
+func (dp deadlinePolicy) orDefault(def deadlinePolicy) deadlinePolicy {
+	if dp.Policy == "" {
+		return def
+	}
+
+	return dp
+}
+
+// startDeadline returns the latest start time reported by Miele as the
+// remaining [hours, minutes] until a SmartStart program starts by itself.
+func startDeadline(now time.Time, startTime []int) time.Time {
+	if len(startTime) != 2 || startTime[0]+startTime[1] <= 0 {
+		return time.Time{}
+	}
+
+	return now.Add(time.Duration(startTime[0])*time.Hour + time.Duration(startTime[1])*time.Minute)
+}
+
+// requiredSurplus returns the surplus power needed to start the device at the
+// given time and whether the device must be started regardless of the surplus
+// because its deadline is imminent.
+func (dp deadlinePolicy) requiredSurplus(threshold float64, deadline, now time.Time) (required float64, force bool) {
+	if deadline.IsZero() || dp.Policy == "" || dp.Policy == DeadlineNone {
+		return threshold, false
+	}
+
+	margin := time.Duration(dp.Margin) * time.Minute
+	remaining := deadline.Sub(now)
+	if remaining <= margin {
+		return math.Inf(-1), true
+	}
+
+	if dp.Policy == DeadlineRamp && dp.Ramp > 0 {
+		ramp := time.Duration(dp.Ramp) * time.Minute
+		if remaining < margin+ramp {
+			return threshold * float64(remaining-margin) / float64(ramp), false
+		}
+	}
+
+	return threshold, false
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestStartDeadline(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		startTime []int
+		want      time.Time
+	}{
+		{[]int{2, 30}, now.Add(2*time.Hour + 30*time.Minute)},
+		{[]int{0, 5}, now.Add(5 * time.Minute)},
+		{[]int{0, 0}, time.Time{}},
+		{nil, time.Time{}},
+		{[]int{1}, time.Time{}},
+	}
+	for _, tt := range tests {
+		if got := startDeadline(now, tt.startTime); !got.Equal(tt.want) {
+			t.Errorf("startDeadline(%v) = %v, want %v", tt.startTime, got, tt.want)
+		}
+	}
+}
+
+func TestRequiredSurplus(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	in := func(m float64) time.Time { return now.Add(time.Duration(m * float64(time.Minute))) }
+
+	tests := []struct {
+		name     string
+		policy   deadlinePolicy
+		deadline time.Time
+		want     float64
+		force    bool
+	}{
+		{"no policy", deadlinePolicy{}, in(1), 1000, false},
+		{"none", deadlinePolicy{Policy: DeadlineNone, Margin: 10}, in(1), 1000, false},
+		{"no deadline", deadlinePolicy{Policy: DeadlineStart, Margin: 10}, time.Time{}, 1000, false},
+		{"start before margin", deadlinePolicy{Policy: DeadlineStart, Margin: 10}, in(11), 1000, false},
+		{"start at margin", deadlinePolicy{Policy: DeadlineStart, Margin: 10}, in(10), math.Inf(-1), true},
+		{"start within margin", deadlinePolicy{Policy: DeadlineStart, Margin: 10}, in(5), math.Inf(-1), true},
+		{"start past deadline", deadlinePolicy{Policy: DeadlineStart, Margin: 10}, in(-5), math.Inf(-1), true},
+		{"start at deadline without margin", deadlinePolicy{Policy: DeadlineStart}, in(0), math.Inf(-1), true},
+		{"start ignores ramp", deadlinePolicy{Policy: DeadlineStart, Margin: 10, Ramp: 30}, in(25), 1000, false},
+		{"ramp before window", deadlinePolicy{Policy: DeadlineRamp, Margin: 10, Ramp: 30}, in(45), 1000, false},
+		{"ramp at window start", deadlinePolicy{Policy: DeadlineRamp, Margin: 10, Ramp: 30}, in(40), 1000, false},
+		{"ramp halfway", deadlinePolicy{Policy: DeadlineRamp, Margin: 10, Ramp: 30}, in(25), 500, false},
+		{"ramp near margin", deadlinePolicy{Policy: DeadlineRamp, Margin: 10, Ramp: 30}, in(13), 100, false},
+		{"ramp at margin", deadlinePolicy{Policy: DeadlineRamp, Margin: 10, Ramp: 30}, in(10), math.Inf(-1), true},
+		{"ramp without window", deadlinePolicy{Policy: DeadlineRamp, Margin: 10}, in(11), 1000, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, force := tt.policy.requiredSurplus(1000, tt.deadline, now)
+			if force != tt.force || got != tt.want && math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("requiredSurplus() = %v, %v; want %v, %v", got, force, tt.want, tt.force)
+			}
+		})
+	}
+}
@@ -0,0 +1,313 @@
+// Package dsmr parses the telegrams which DSMR smart meters emit on their P1
+// port, as specified by the Dutch Smart Meter Requirements 4 and 5 and the
+// Belgian e-MUCS derivative.
+package dsmr
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// OBIS codes of the values used by mielesolar.
+const (
+	OBISVersion        = "1-3:0.2.8"  // P1 version
+	OBISVersionBE      = "0-0:96.1.4" // e-MUCS version
+	OBISTimestamp      = "0-0:1.0.0"
+	OBISEquipmentID    = "0-0:96.1.1"
+	OBISPowerDelivered = "1-0:1.7.0" // power delivered to the client, i.e. imported from the grid
+	OBISPowerReceived  = "1-0:2.7.0" // power received from the client, i.e. exported to the grid
+)
+
+// OBIS codes of the per-phase values of L1, L2 and L3.
+var (
+	OBISPhasePowerDelivered = [3]string{"1-0:21.7.0", "1-0:41.7.0", "1-0:61.7.0"}
+	OBISPhasePowerReceived  = [3]string{"1-0:22.7.0", "1-0:42.7.0", "1-0:62.7.0"}
+	OBISPhaseVoltage        = [3]string{"1-0:32.7.0", "1-0:52.7.0", "1-0:72.7.0"}
+	OBISPhaseCurrent        = [3]string{"1-0:31.7.0", "1-0:51.7.0", "1-0:71.7.0"}
+)
+
+// MaxTelegramSize limits the size of a telegram. Larger telegrams are
+// discarded to cope with streams lacking the end of a telegram.
+const MaxTelegramSize = 16 * 1024
+
+var (
+	ErrChecksum = errors.New("checksum mismatch")
+	ErrTooLarge = errors.New("telegram too large")
+)
+
+// Value is a value of a COSEM object with its optional unit, e.g. "01.193"
+// and "kW".
+type Value struct {
+	Raw  string
+	Unit string
+}
+
+// Float parses the value as a number.
+func (v Value) Float() (float64, error) {
+	return strconv.ParseFloat(v.Raw, 64)
+}
+
+// Object is a line of a telegram, identified by its OBIS reference. Most
+// objects have a single value, but e.g. the power failure log and gas
+// readings have several.
+type Object struct {
+	OBIS   string
+	Values []Value
+}
+
+// Telegram is a parsed P1 telegram.
+type Telegram struct {
+	Header  string // identification of the meter, without the leading '/'
+	Objects []Object
+	// Checksummed is false for telegrams of DSMR 2.2 and 3 meters, which
+	// don't transmit a checksum.
+	Checksummed bool
+}
+
+// Object returns the object with the given OBIS reference.
+func (t *Telegram) Object(obis string) (Object, bool) {
+	for _, o := range t.Objects {
+		if o.OBIS == obis {
+			return o, true
+		}
+	}
+
+	return Object{}, false
+}
+
+// Value returns the last value of the object with the given OBIS reference,
+// which is the measurement for objects with a timestamp.
+func (t *Telegram) Value(obis string) (Value, bool) {
+	o, ok := t.Object(obis)
+	if !ok || len(o.Values) == 0 {
+		return Value{}, false
+	}
+
+	return o.Values[len(o.Values)-1], true
+}
+
+// Power returns the power of the given OBIS reference in W. Meters report
+// power in kW.
+func (t *Telegram) Power(obis string) (float64, bool) {
+	v, ok := t.Value(obis)
+	if !ok {
+		return 0, false
+	}
+	f, err := v.Float()
+	if err != nil {
+		return 0, false
+	}
+
+	switch v.Unit {
+	case "kW":
+		return f * 1000, true
+	case "W":
+		return f, true
+	default:
+		return 0, false
+	}
+}
+
+// Float returns the numeric value of the given OBIS reference, e.g. a
+// voltage or current.
+func (t *Telegram) Float(obis string) (float64, bool) {
+	v, ok := t.Value(obis)
+	if !ok {
+		return 0, false
+	}
+	f, err := v.Float()
+
+	return f, err == nil
+}
+
+// Version returns the P1 version, e.g. "50" for DSMR 5.0.
+func (t *Telegram) Version() string {
+	for _, obis := range []string{OBISVersion, OBISVersionBE} {
+		if v, ok := t.Value(obis); ok {
+			return v.Raw
+		}
+	}
+
+	return ""
+}
+
+// ParseError describes a malformed telegram.
+type ParseError struct {
+	Line int
+	Msg  string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+// checksum computes the CRC16 of a telegram (polynomial 0xA001, LSB first).
+func checksum(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b)
+		for range 8 {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+
+	return crc
+}
+
+// Parse parses a complete telegram from the '/' of the header up to the line
+// with the '!' and the checksum.
+func Parse(data []byte) (*Telegram, error) {
+	if len(data) == 0 || data[0] != '/' {
+		return nil, &ParseError{1, "missing header"}
+	}
+	end := bytes.LastIndexByte(data, '!')
+	if end == -1 {
+		return nil, &ParseError{bytes.Count(data, []byte("\n")) + 1, "missing end of telegram"}
+	}
+
+	t := Telegram{}
+	if crc := strings.TrimSpace(string(data[end+1:])); crc != "" {
+		want, err := strconv.ParseUint(crc, 16, 16)
+		if err != nil || len(crc) != 4 {
+			return nil, &ParseError{bytes.Count(data[:end], []byte("\n")) + 1, fmt.Sprintf("invalid checksum %q", crc)}
+		}
+		if got := checksum(data[:end+1]); got != uint16(want) {
+			return nil, fmt.Errorf("%w: got %04X, want %04X", ErrChecksum, got, want)
+		}
+		t.Checksummed = true
+	}
+
+	lines := strings.Split(string(data[:end]), "\n")
+	t.Header = strings.TrimSpace(lines[0][1:])
+	for i, line := range lines[1:] {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		var o *Object
+		if line[0] == '(' {
+			// continuation of the previous object, e.g. the gas reading of
+			// DSMR 2.2 meters
+			if len(t.Objects) == 0 {
+				return nil, &ParseError{i + 2, "value without OBIS reference"}
+			}
+			o = &t.Objects[len(t.Objects)-1]
+		} else {
+			n := strings.IndexByte(line, '(')
+			if n <= 0 || !validOBIS(line[:n]) {
+				return nil, &ParseError{i + 2, fmt.Sprintf("invalid line %q", line)}
+			}
+			t.Objects = append(t.Objects, Object{OBIS: line[:n]})
+			o = &t.Objects[len(t.Objects)-1]
+			line = line[n:]
+		}
+
+		for line != "" {
+			if line[0] != '(' {
+				return nil, &ParseError{i + 2, fmt.Sprintf("unexpected %q", line)}
+			}
+			n := strings.IndexByte(line, ')')
+			if n == -1 {
+				return nil, &ParseError{i + 2, "missing ')'"}
+			}
+			raw, unit, _ := strings.Cut(line[1:n], "*")
+			o.Values = append(o.Values, Value{Raw: raw, Unit: unit})
+			line = line[n+1:]
+		}
+	}
+
+	return &t, nil
+}
+
+// validOBIS reports whether s looks like an OBIS reference, e.g. "1-0:1.7.0"
+// or "0-0:C.1.0".
+func validOBIS(s string) bool {
+	for _, c := range []byte(s) {
+		switch {
+		case c >= '0' && c <= '9', c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z':
+		case c == '-', c == ':', c == '.', c == '*', c == '&':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// Reader reads telegrams from a stream, e.g. a serial port.
+type Reader struct {
+	r *bufio.Reader
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{bufio.NewReaderSize(r, 4096)}
+}
+
+// Read returns the next telegram. Data preceding the start of a telegram is
+// skipped, so reading can start in the middle of the stream. If a telegram
+// is interrupted by the start of another, the incomplete one is discarded.
+// Malformed telegrams are reported with a *ParseError, ErrChecksum or
+// ErrTooLarge, after which reading can continue. Other errors come from the
+// underlying reader.
+func (r *Reader) Read() (*Telegram, error) {
+	data, err := r.next()
+	if err != nil {
+		return nil, err
+	}
+
+	return Parse(data)
+}
+
+func (r *Reader) next() ([]byte, error) {
+	// skip to the start of a telegram
+	for {
+		_, err := r.r.ReadSlice('/')
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return nil, err
+		}
+	}
+
+	data := []byte{'/'}
+	for {
+		chunk, err := r.r.ReadSlice('!')
+		data = append(data, chunk...)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return nil, err
+		}
+		if len(data) > MaxTelegramSize {
+			return nil, ErrTooLarge
+		}
+	}
+
+	crc, err := r.r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return nil, ErrTooLarge
+	}
+	if err != nil {
+		return nil, err
+	}
+	data = append(data, crc...)
+
+	// restart at the header of a telegram following an interrupted one
+	if i := bytes.LastIndex(data, []byte("\n/")); i != -1 {
+		data = data[i+1:]
+	}
+
+	return data, nil
+}
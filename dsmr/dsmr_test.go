@@ -0,0 +1,222 @@
+package dsmr
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readTelegram(t testing.TB, name string) []byte {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func TestChecksum(t *testing.T) {
+	if got := checksum([]byte("123456789")); got != 0xBB3D {
+		t.Errorf("checksum = %04X, want BB3D", got)
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, tt := range []struct {
+		file        string
+		header      string
+		version     string
+		checksummed bool
+		delivered   float64
+		received    float64
+		phases      [3]float64 // received minus delivered
+		voltages    [3]float64
+	}{
+		{"dsmr5.txt", "XMX5LGF0010444209470", "50", true, 0, 1234, [3]float64{512, 400, 322}, [3]float64{231, 230.5, 229.8}},
+		{"dsmr4.txt", "KFM5KAIFA-METER", "42", true, 870, 0, [3]float64{-210, -350, -310}, [3]float64{}},
+		{"fluvius.txt", `FLU5\253769484_A`, "50217", true, 0, 480, [3]float64{160, 160, 160}, [3]float64{234.6, 233.9, 235.1}},
+		{"dsmr22.txt", `ISk5\2MT382-1004`, "", false, 540, 0, [3]float64{}, [3]float64{}},
+	} {
+		t.Run(tt.file, func(t *testing.T) {
+			telegram, err := Parse(readTelegram(t, tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if telegram.Header != tt.header || telegram.Version() != tt.version || telegram.Checksummed != tt.checksummed {
+				t.Errorf("header = %q, version = %q, checksummed = %v", telegram.Header, telegram.Version(), telegram.Checksummed)
+			}
+
+			delivered, ok1 := telegram.Power(OBISPowerDelivered)
+			received, ok2 := telegram.Power(OBISPowerReceived)
+			if !ok1 || !ok2 || math.Abs(delivered-tt.delivered) > 1e-9 || math.Abs(received-tt.received) > 1e-9 {
+				t.Errorf("delivered = %v, received = %v; want %v and %v", delivered, received, tt.delivered, tt.received)
+			}
+
+			for i := range 3 {
+				d, ok1 := telegram.Power(OBISPhasePowerDelivered[i])
+				r, ok2 := telegram.Power(OBISPhasePowerReceived[i])
+				if tt.phases[i] != 0 && (!ok1 || !ok2 || math.Abs(r-d-tt.phases[i]) > 1e-9) {
+					t.Errorf("L%d power = %v, want %v", i+1, r-d, tt.phases[i])
+				}
+				if v, ok := telegram.Float(OBISPhaseVoltage[i]); ok != (tt.voltages[i] != 0) || v != tt.voltages[i] {
+					t.Errorf("L%d voltage = %v, want %v", i+1, v, tt.voltages[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParseObjects(t *testing.T) {
+	telegram, err := Parse(readTelegram(t, "dsmr5.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the power failure log has several values
+	o, ok := telegram.Object("1-0:99.97.0")
+	if !ok || len(o.Values) != 6 || o.Values[5] != (Value{"0000000213", "s"}) {
+		t.Errorf("power failure log = %+v", o)
+	}
+	// the gas reading is preceded by its timestamp
+	if v, ok := telegram.Value("0-1:24.2.1"); !ok || v != (Value{"02567.312", "m3"}) {
+		t.Errorf("gas = %+v", v)
+	}
+	if v, ok := telegram.Value("0-0:96.13.0"); !ok || v != (Value{}) {
+		t.Errorf("empty message = %+v, %v", v, ok)
+	}
+
+	// DSMR 2.2 continues the gas reading on the next line
+	telegram, err = Parse(readTelegram(t, "dsmr22.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := telegram.Value("0-1:24.3.0"); !ok || v.Raw != "00123.456" {
+		t.Errorf("gas = %+v", v)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	valid := string(readTelegram(t, "dsmr5.txt"))
+	var parseErr *ParseError
+
+	for _, tt := range []struct {
+		name string
+		data string
+	}{
+		{"empty", ""},
+		{"no header", strings.TrimPrefix(valid, "/")},
+		{"no end", valid[:strings.IndexByte(valid, '!')]},
+		{"invalid checksum", strings.Replace(valid, "!AFBE", "!XYZ1", 1)},
+		{"short checksum", strings.Replace(valid, "!AFBE", "!AFB", 1)},
+		{"missing parenthesis", "/XMX5\r\n\r\n1-0:1.7.0(00.000*kW\r\n!\r\n"},
+		{"missing OBIS", "/XMX5\r\n\r\n(00.000*kW)\r\n!\r\n"},
+		{"trailing garbage", "/XMX5\r\n\r\n1-0:1.7.0(00.000*kW)x\r\n!\r\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Parse([]byte(tt.data)); !errors.As(err, &parseErr) {
+				t.Errorf("Parse() = %v, want a parse error", err)
+			}
+		})
+	}
+
+	corrupted := strings.Replace(valid, "1-0:2.7.0(01.234*kW)", "1-0:2.7.0(91.234*kW)", 1)
+	if _, err := Parse([]byte(corrupted)); !errors.Is(err, ErrChecksum) {
+		t.Errorf("Parse() = %v, want %v", err, ErrChecksum)
+	}
+}
+
+func TestReader(t *testing.T) {
+	dsmr4, dsmr5 := readTelegram(t, "dsmr4.txt"), readTelegram(t, "dsmr5.txt")
+	corrupted := bytes.Replace(dsmr5, []byte("(01.234*kW)"), []byte("(01.235*kW)"), 1)
+
+	var stream bytes.Buffer
+	// the reader starts in the middle of a telegram
+	stream.Write(dsmr5[len(dsmr5)/2:])
+	stream.Write(dsmr4)
+	// a telegram is interrupted by the next one
+	stream.Write(dsmr5[:len(dsmr5)/3])
+	stream.Write(dsmr5)
+	stream.Write(corrupted)
+	stream.Write(dsmr4)
+
+	r := NewReader(&stream)
+	for i, want := range []string{"KFM5KAIFA-METER", "XMX5LGF0010444209470", "", "KFM5KAIFA-METER"} {
+		telegram, err := r.Read()
+		if want == "" {
+			if !errors.Is(err, ErrChecksum) {
+				t.Errorf("telegram %d: got %v, want %v", i, err, ErrChecksum)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("telegram %d: %v", i, err)
+		}
+		if telegram.Header != want {
+			t.Errorf("telegram %d: header = %q, want %q", i, telegram.Header, want)
+		}
+	}
+	if _, err := r.Read(); err != io.EOF {
+		t.Errorf("got %v, want EOF", err)
+	}
+}
+
+func TestReaderTooLarge(t *testing.T) {
+	data := append([]byte("/XMX5\r\n"), bytes.Repeat([]byte("1-0:1.7.0(00.000*kW)\r\n"), MaxTelegramSize/20)...)
+	data = append(data, readTelegram(t, "dsmr4.txt")...)
+	// the '/' of the header of the valid telegram is preceded by a newline
+	r := NewReader(bytes.NewReader(bytes.Replace(data, []byte("\r\n/KFM"), []byte("\r\nx/KFM"), 1)))
+
+	if _, err := r.Read(); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("got %v, want %v", err, ErrTooLarge)
+	}
+	if telegram, err := r.Read(); err != nil || telegram.Header != "KFM5KAIFA-METER" {
+		t.Errorf("got %v, %v; want the following telegram", telegram, err)
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	for _, name := range []string{"dsmr5.txt", "dsmr4.txt", "fluvius.txt", "dsmr22.txt"} {
+		f.Add(readTelegram(f, name))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		telegram, err := Parse(data)
+		if err != nil {
+			return
+		}
+		for _, o := range telegram.Objects {
+			if o.OBIS == "" || strings.ContainsAny(o.OBIS, "()\r\n") {
+				t.Errorf("invalid OBIS reference %q", o.OBIS)
+			}
+		}
+		telegram.Power(OBISPowerDelivered)
+		telegram.Version()
+	})
+}
+
+func FuzzReader(f *testing.F) {
+	f.Add(append(readTelegram(f, "dsmr4.txt"), readTelegram(f, "dsmr5.txt")...))
+	f.Add([]byte("garbage/XMX5\r\n!\r\n/"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := NewReader(bytes.NewReader(data))
+		// every telegram consumes at least its '/'
+		for range len(data) + 1 {
+			telegram, err := r.Read()
+			if err == nil && telegram == nil {
+				t.Fatal("nil telegram without error")
+			}
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return
+			}
+		}
+		t.Fatal("reader does not make progress")
+	})
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ingmarstein/miele-go/miele"
+	"golang.org/x/oauth2"
+)
+
+const (
+	mieleBaseURL       = "https://api.mcs3.miele.com"
+	mieleTimeout       = 30 * time.Second // of requests except for the event stream
+	eventIdleTimeout   = 5 * time.Minute
+	minReconnectDelay  = 5 * time.Second
+	maxReconnectDelay  = 5 * time.Minute
+	maxEventSize       = 1 << 20
+	mieleTokenEndpoint = "/thirdparty/token"
+	mieleEventEndpoint = "/v1/devices/all/events"
+)
+
+// appliance is the subset of the state of a Miele appliance used to decide
+// whether it can be started.
+type appliance struct {
+	ID                string
+	Name              string
+	Type              int
+	Status            int
+	FullRemoteControl bool
+	StartTime         []int // remaining [hours, minutes] of the SmartStart window
+}
+
+// waiting reports whether the appliance waits to be started by SmartStart.
+func (a appliance) waiting() bool {
+	return a.Status == int(miele.DEVICE_STATUS_PROGRAMMED_WAITING_TO_START) && a.FullRemoteControl
+}
+
+// supported reports whether mielesolar starts this type of appliance in
+// automatic mode.
+func (a appliance) supported() bool {
+	// https://www.miele.com/developer/swagger-ui/put_additional_info.html
+	switch a.Type {
+	case int(miele.DEVICE_TYPE_WASHING_MACHINE),
+		int(miele.DEVICE_TYPE_TUMBLE_DRYER),
+		int(miele.DEVICE_TYPE_DISHWASHER),
+		int(miele.DEVICE_TYPE_WASHER_DRYER):
+		return true
+	default:
+		return false
+	}
+}
+
+type mieleValue struct {
+	ValueRaw int `json:"value_raw"`
+}
+
+// mieleDevice is the JSON representation of a device in the Miele 3rd Party
+// API as sent in "devices" events.
+type mieleDevice struct {
+	Ident struct {
+		Type             mieleValue `json:"type"`
+		DeviceName       string     `json:"deviceName"`
+		DeviceIdentLabel struct {
+			FabNumber string `json:"fabNumber"`
+		} `json:"deviceIdentLabel"`
+	} `json:"ident"`
+	State struct {
+		Status       mieleValue `json:"status"`
+		StartTime    []int      `json:"startTime"`
+		RemoteEnable struct {
+			FullRemoteControl bool `json:"fullRemoteControl"`
+		} `json:"remoteEnable"`
+	} `json:"state"`
+}
+
+func (md mieleDevice) appliance(id string) appliance {
+	if md.Ident.DeviceIdentLabel.FabNumber != "" {
+		id = md.Ident.DeviceIdentLabel.FabNumber
+	}
+
+	return appliance{
+		ID:                id,
+		Name:              md.Ident.DeviceName,
+		Type:              md.Ident.Type.ValueRaw,
+		Status:            md.State.Status.ValueRaw,
+		FullRemoteControl: md.State.RemoteEnable.FullRemoteControl,
+		StartTime:         md.State.StartTime,
+	}
+}
+
+// mieleTokenSource obtains access tokens for the Miele 3rd Party API using
+// the resource owner password credentials grant.
+type mieleTokenSource struct {
+	hc                                    *http.Client
+	tokenURL                              string
+	clientID, clientSecret, vg, user, pwd string
+}
+
+func (ts *mieleTokenSource) Token() (*oauth2.Token, error) {
+	form := url.Values{
+		"grant_type":    {"password"},
+		"client_id":     {ts.clientID},
+		"client_secret": {ts.clientSecret},
+		"username":      {ts.user},
+		"password":      {ts.pwd},
+		"vg":            {ts.vg},
+	}
+	resp, err := ts.hc.PostForm(ts.tokenURL, form)
+	if err != nil {
+		return nil, fmt.Errorf("error requesting token: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error requesting token: %s", resp.Status)
+	}
+
+	var body struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		TokenType    string `json:"token_type"`
+		ExpiresIn    int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("error decoding token: %v", err)
+	}
+
+	return &oauth2.Token{
+		AccessToken:  body.AccessToken,
+		RefreshToken: body.RefreshToken,
+		TokenType:    body.TokenType,
+		Expiry:       time.Now().Add(time.Duration(body.ExpiresIn) * time.Second),
+	}, nil
+}
+
+// newMieleHTTPClient returns an HTTP client which authenticates requests to
+// the Miele 3rd Party API.
+func newMieleHTTPClient(baseURL, clientID, clientSecret, vg, username, password string) *http.Client {
+	ts := &mieleTokenSource{
+		hc:           &http.Client{Timeout: mieleTimeout},
+		tokenURL:     baseURL + mieleTokenEndpoint,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		vg:           vg,
+		user:         username,
+		pwd:          password,
+	}
+
+	return oauth2.NewClient(context.Background(), oauth2.ReuseTokenSource(nil, ts))
+}
+
+// deviceTracker keeps an in-memory model of all appliances which is updated
+// from the Miele event stream. A full resync is performed periodically and
+// whenever the stream is (re)connected as events may have been missed.
+type deviceTracker struct {
+	hc       *http.Client
+	eventURL string
+	interval time.Duration
+	fetch    func() ([]appliance, error)
+
+	mu         sync.Mutex
+	appliances map[string]appliance
+	synced     bool
+}
+
+// newDeviceTracker creates a tracker using the authenticated HTTP client for
+// the event stream and fetch to resync all appliances every interval.
+func newDeviceTracker(hc *http.Client, baseURL string, interval time.Duration, fetch func() ([]appliance, error)) *deviceTracker {
+	return &deviceTracker{
+		hc:         hc,
+		eventURL:   baseURL + mieleEventEndpoint,
+		interval:   interval,
+		fetch:      fetch,
+		appliances: make(map[string]appliance),
+	}
+}
+
+// run processes events and resyncs periodically until ctx is cancelled.
+func (t *deviceTracker) run(ctx context.Context) {
+	go t.resyncLoop(ctx)
+
+	delay := minReconnectDelay
+	for ctx.Err() == nil {
+		start := time.Now()
+		err := t.stream(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(start) > maxReconnectDelay {
+			delay = minReconnectDelay
+		}
+		log.Printf("Miele event stream interrupted: %v, reconnecting in %v", err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+		delay = min(2*delay, maxReconnectDelay)
+	}
+}
+
+func (t *deviceTracker) resyncLoop(ctx context.Context) {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	for {
+		t.resync()
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// resync replaces the model with the current state of all appliances.
+func (t *deviceTracker) resync() {
+	appliances, err := t.fetch()
+	if err != nil {
+		log.Printf("error resyncing Miele devices: %v", err)
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.appliances = make(map[string]appliance, len(appliances))
+	for _, a := range appliances {
+		t.appliances[a.ID] = a
+	}
+	t.synced = true
+}
+
+// stream reads events until the connection fails or ctx is cancelled.
+func (t *deviceTracker) stream(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, t.eventURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := t.hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	log.Println("Connected to Miele event stream")
+	// events may have been missed while disconnected
+	t.resync()
+
+	// cancel the request if the server stops sending events (including pings)
+	idle := time.AfterFunc(eventIdleTimeout, cancel)
+	defer idle.Stop()
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), maxEventSize)
+	var event string
+	var data []string
+	for scanner.Scan() {
+		idle.Reset(eventIdleTimeout)
+		line := scanner.Text()
+		switch {
+		case line == "":
+			t.handleEvent(event, strings.Join(data, "\n"))
+			event, data = "", nil
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return fmt.Errorf("connection closed")
+}
+
+func (t *deviceTracker) handleEvent(event, data string) {
+	if event != "devices" || data == "" {
+		return
+	}
+
+	var devices map[string]mieleDevice
+	if err := json.Unmarshal([]byte(data), &devices); err != nil {
+		log.Printf("error decoding Miele device event: %v", err)
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for id, d := range devices {
+		a := d.appliance(id)
+		t.appliances[a.ID] = a
+	}
+}
+
+// list returns all known appliances.
+func (t *deviceTracker) list() ([]appliance, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.synced {
+		return nil, fmt.Errorf("device state not yet synchronized")
+	}
+
+	appliances := make([]appliance, 0, len(t.appliances))
+	for _, a := range t.appliances {
+		appliances = append(appliances, a)
+	}
+	slices.SortFunc(appliances, func(a, b appliance) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+
+	return appliances, nil
+}
+
+// get returns the appliance with the given ID.
+func (t *deviceTracker) get(id string) (appliance, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.synced {
+		return appliance{}, fmt.Errorf("device state not yet synchronized")
+	}
+	a, ok := t.appliances[id]
+	if !ok {
+		return appliance{}, errUnknownDevice
+	}
+
+	return a, nil
+}
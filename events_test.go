@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ingmarstein/miele-go/miele"
+)
+
+func waitForAppliance(t *testing.T, tracker *deviceTracker, id string, cond func(appliance) bool) appliance {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if a, err := tracker.get(id); err == nil && cond(a) {
+			return a
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("appliance %s did not reach the expected state", id)
+
+	return appliance{}
+}
+
+func TestDeviceTracker(t *testing.T) {
+	events := make(chan string)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != mieleEventEndpoint || r.Header.Get("Accept") != "text/event-stream" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case e := <-events:
+				fmt.Fprint(w, e)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+	defer ts.Close()
+
+	fetch := func() ([]appliance, error) {
+		return []appliance{{ID: "000123", Name: "Dishwasher", Status: int(miele.DEVICE_STATUS_OFF)}}, nil
+	}
+	tracker := newDeviceTracker(ts.Client(), ts.URL, time.Hour, fetch)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go tracker.run(ctx)
+
+	events <- "event: ping\ndata: ping\n\n"
+	a := waitForAppliance(t, tracker, "000123", func(appliance) bool { return true })
+	if a.waiting() {
+		t.Error("appliance should not be waiting")
+	}
+
+	events <- fmt.Sprintf("event: devices\ndata: {\"000123\": {\"ident\": {\"type\": {\"value_raw\": %d}, \"deviceName\": \"Dishwasher\", \"deviceIdentLabel\": {\"fabNumber\": \"000123\"}},\n"+
+		"data: \"state\": {\"status\": {\"value_raw\": %d}, \"startTime\": [2, 30], \"remoteEnable\": {\"fullRemoteControl\": true}}}}\n\n",
+		miele.DEVICE_TYPE_DISHWASHER, miele.DEVICE_STATUS_PROGRAMMED_WAITING_TO_START)
+	waitForAppliance(t, tracker, "000123", appliance.waiting)
+
+	list, err := tracker.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || !list[0].waiting() || !list[0].supported() || list[0].StartTime[1] != 30 {
+		t.Errorf("unexpected appliances: %+v", list)
+	}
+
+	if _, err := tracker.get("000456"); err != errUnknownDevice {
+		t.Errorf("get() error = %v, want %v", err, errUnknownDevice)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/ingmarstein/miele-go/miele"
+)
+
+const fakeMieleToken = "fake-access-token"
+
+// fakeMiele is an in-process fake of the Miele 3rd Party API endpoints used
+// by mielesolar. Appliances which are waiting to start begin running when
+// they receive ACTION_START.
+type fakeMiele struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	devices map[string]*mieleDevice
+	starts  []string // IDs of started appliances in order
+}
+
+func newFakeMiele(t *testing.T) *fakeMiele {
+	f := &fakeMiele{devices: make(map[string]*mieleDevice)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /thirdparty/token", f.handleToken)
+	mux.HandleFunc("GET /v1/devices", f.authorized(f.handleListDevices))
+	mux.HandleFunc("GET /v1/devices/{id}/state", f.authorized(f.handleDeviceState))
+	mux.HandleFunc("PUT /v1/devices/{id}/actions", f.authorized(f.handleDeviceAction))
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+
+	return f
+}
+
+// add adds an appliance. It can be started remotely if waiting is set.
+func (f *fakeMiele) add(id, name string, typ miele.DeviceType, waiting bool) {
+	var d mieleDevice
+	d.Ident.Type.ValueRaw = int(typ)
+	d.Ident.DeviceName = name
+	d.Ident.DeviceIdentLabel.FabNumber = id
+	d.State.Status.ValueRaw = int(miele.DEVICE_STATUS_OFF)
+	if waiting {
+		d.State.Status.ValueRaw = int(miele.DEVICE_STATUS_PROGRAMMED_WAITING_TO_START)
+		d.State.RemoteEnable.FullRemoteControl = true
+		d.State.StartTime = []int{8, 0}
+	}
+
+	f.mu.Lock()
+	f.devices[id] = &d
+	f.mu.Unlock()
+}
+
+// started returns the IDs of all started appliances in order.
+func (f *fakeMiele) started() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]string(nil), f.starts...)
+}
+
+// httpClient returns an HTTP client authenticating with the fake.
+func (f *fakeMiele) httpClient() *http.Client {
+	return newMieleHTTPClient(f.URL, "client-id", "client-secret", "de-CH", "user@example.com", "secret")
+}
+
+// client returns the production mieleAPI implementation talking to the fake.
+func (f *fakeMiele) client() mieleAdapter {
+	return newMieleAdapter(f.httpClient(), f.URL, false)
+}
+
+func (f *fakeMiele) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.PostFormValue("grant_type") != "password" || r.PostFormValue("client_id") != "client-id" {
+		http.Error(w, "invalid client", http.StatusUnauthorized)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token":  fakeMieleToken,
+		"refresh_token": "fake-refresh-token",
+		"token_type":    "Bearer",
+		"expires_in":    3600,
+	})
+}
+
+func (f *fakeMiele) authorized(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+fakeMieleToken {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func (f *fakeMiele) handleListDevices(w http.ResponseWriter, _ *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, f.devices)
+}
+
+func (f *fakeMiele) handleDeviceState(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	d, ok := f.devices[r.PathValue("id")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, d.State)
+}
+
+func (f *fakeMiele) handleDeviceAction(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ProcessAction int `json:"processAction"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id := r.PathValue("id")
+	d, ok := f.devices[id]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if req.ProcessAction != int(miele.ACTION_START) || d.State.Status.ValueRaw != int(miele.DEVICE_STATUS_PROGRAMMED_WAITING_TO_START) {
+		http.Error(w, "action not supported in the current state", http.StatusBadRequest)
+		return
+	}
+
+	d.State.Status.ValueRaw = int(miele.DEVICE_STATUS_RUNNING)
+	d.State.StartTime = nil
+	f.starts = append(f.starts, id)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeShelly simulates the local API of a Shelly energy meter. Gen2 devices
+// serve either an EM component with three phases or EM1 components with one
+// channel each.
+type fakeShelly struct {
+	gen int
+
+	mu      sync.Mutex
+	phases  []float64 // EM phases or EM1 channels
+	em1     bool
+	invalid bool // report the power as unavailable
+	down    bool // fail all requests
+	polls   int
+	conns   []*websocket.Conn
+	notify  chan struct{} // signaled when a WebSocket client subscribed
+}
+
+func newFakeShelly(t *testing.T, gen int, phases ...float64) (*fakeShelly, *httptest.Server) {
+	t.Helper()
+
+	fs := &fakeShelly{gen: gen, phases: phases, notify: make(chan struct{}, 10)}
+	ts := httptest.NewServer(fs)
+	t.Cleanup(func() {
+		fs.closeConns()
+		ts.Close()
+	})
+
+	return fs, ts
+}
+
+// configure changes the fake while it is serving requests.
+func (fs *fakeShelly) configure(f func(fs *fakeShelly)) {
+	fs.mu.Lock()
+	f(fs)
+	fs.mu.Unlock()
+}
+
+func (fs *fakeShelly) set(phases ...float64) {
+	fs.mu.Lock()
+	fs.phases = phases
+	fs.mu.Unlock()
+}
+
+// components returns the Gen2 energy meter components by key.
+func (fs *fakeShelly) components() map[string]any {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	c := make(map[string]any)
+	if fs.em1 {
+		for i, p := range fs.phases {
+			status := map[string]any{"id": i, "act_power": p, "voltage": 230.1}
+			if fs.invalid {
+				status["act_power"] = nil
+			}
+			c["em1:"+strconv.Itoa(i)] = status
+		}
+		return c
+	}
+
+	status := map[string]any{"id": 0, "a_act_power": fs.phases[0], "b_act_power": fs.phases[1], "c_act_power": fs.phases[2],
+		"total_act_power": fs.phases[0] + fs.phases[1] + fs.phases[2]}
+	if fs.invalid {
+		status = map[string]any{"id": 0, "a_act_power": nil, "b_act_power": nil, "c_act_power": nil, "total_act_power": nil,
+			"errors": []string{"power_meter_failure"}}
+	}
+	c["em:0"] = status
+
+	return c
+}
+
+func (fs *fakeShelly) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fs.mu.Lock()
+	down := fs.down
+	fs.mu.Unlock()
+	if down {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	var v any
+	switch {
+	case r.URL.Path == "/shelly" && fs.gen == 1:
+		v = map[string]any{"type": "SHEM-3", "mac": "AABBCCDDEEFF", "fw": "20230913-114244/v1.14.0-gcb84623"}
+	case r.URL.Path == "/shelly":
+		v = map[string]any{"gen": fs.gen, "id": "shellypro3em-aabbccddeeff", "model": "SPEM-003CEBEU", "app": "Pro3EM", "ver": "1.4.4"}
+	case r.URL.Path == "/status" && fs.gen == 1:
+		fs.mu.Lock()
+		var meters []map[string]any
+		for _, p := range fs.phases {
+			meters = append(meters, map[string]any{"power": p, "is_valid": !fs.invalid, "voltage": 230.1})
+		}
+		fs.polls++
+		fs.mu.Unlock()
+		v = map[string]any{"emeters": meters, "total_power": 0}
+	case r.URL.Path == "/rpc/Shelly.GetStatus" && fs.gen > 1:
+		c := fs.components()
+		c["sys"] = map[string]any{"uptime": 1234}
+		v = c
+	case (r.URL.Path == "/rpc/EM.GetStatus" || r.URL.Path == "/rpc/EM1.GetStatus") && fs.gen > 1:
+		kind := "em"
+		if strings.HasPrefix(r.URL.Path, "/rpc/EM1") {
+			kind = "em1"
+		}
+		status, ok := fs.components()[kind+":"+r.URL.Query().Get("id")]
+		if !ok {
+			http.Error(w, `{"code":-105,"message":"Argument 'id', value 1 not found!"}`, http.StatusInternalServerError)
+			return
+		}
+		fs.mu.Lock()
+		fs.polls++
+		fs.mu.Unlock()
+		v = status
+	case r.URL.Path == "/rpc" && fs.gen > 1:
+		fs.serveWebSocket(w, r)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// serveWebSocket answers the first request with the full status. Further
+// notifications are sent by notifyStatus.
+func (fs *fakeShelly) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	var upgrader websocket.Upgrader
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	var req struct {
+		ID     int    `json:"id"`
+		Src    string `json:"src"`
+		Method string `json:"method"`
+	}
+	if err := conn.ReadJSON(&req); err != nil || req.Src == "" || req.Method != "Shelly.GetStatus" {
+		_ = conn.Close()
+		return
+	}
+
+	result := fs.components()
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	_ = conn.WriteJSON(map[string]any{"id": req.ID, "src": "shellypro3em-aabbccddeeff", "dst": req.Src, "result": result})
+	fs.conns = append(fs.conns, conn)
+	fs.notify <- struct{}{}
+}
+
+// notifyStatus sends a NotifyStatus notification with the given components
+// to all WebSocket clients.
+func (fs *fakeShelly) notifyStatus(params map[string]any) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	params["ts"] = 1700000000.12
+	for _, conn := range fs.conns {
+		_ = conn.WriteJSON(map[string]any{"src": "shellypro3em-aabbccddeeff", "dst": "mielesolar", "method": "NotifyStatus", "params": params})
+	}
+}
+
+func (fs *fakeShelly) closeConns() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for _, conn := range fs.conns {
+		_ = conn.Close()
+	}
+	fs.conns = nil
+}
+
+func (fs *fakeShelly) pollCount() int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.polls
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// froniusProvider reads the power flow of a Fronius inverter or Datamanager
+// using the local Solar API v1.
+type froniusProvider struct {
+	hc      *http.Client
+	baseURL string
+	last    powerReading
+}
+
+// froniusResponse is the envelope of all Solar API responses.
+type froniusResponse[T any] struct {
+	Body struct {
+		Data T `json:"Data"`
+	} `json:"Body"`
+	Head struct {
+		Status struct {
+			Code        int    `json:"Code"`
+			Reason      string `json:"Reason"`
+			UserMessage string `json:"UserMessage"`
+		} `json:"Status"`
+	} `json:"Head"`
+}
+
+// froniusPowerFlow is the data of GetPowerFlowRealtimeData. Values are null
+// if the corresponding component is not installed.
+type froniusPowerFlow struct {
+	Site struct {
+		Mode          string   `json:"Mode"`
+		MeterLocation string   `json:"Meter_Location"`
+		PGrid         *float64 `json:"P_Grid"` // positive values indicate import from the grid
+		PAkku         *float64 `json:"P_Akku"` // positive values indicate discharging
+		PLoad         *float64 `json:"P_Load"`
+		PPV           *float64 `json:"P_PV"`
+	} `json:"Site"`
+	Inverters map[string]struct {
+		DT  int      `json:"DT"`
+		P   *float64 `json:"P"` // AC power
+		SOC *float64 `json:"SOC"`
+	} `json:"Inverters"`
+	Version string `json:"Version"`
+}
+
+type froniusInverterInfo struct {
+	CustomName string  `json:"CustomName"`
+	DT         int     `json:"DT"`
+	PVPower    float64 `json:"PVPower"`
+	StatusCode int     `json:"StatusCode"`
+	UniqueID   string  `json:"UniqueID"`
+}
+
+type froniusMeterInfo struct {
+	Details struct {
+		Manufacturer string `json:"Manufacturer"`
+		Model        string `json:"Model"`
+		Serial       string `json:"Serial"`
+	} `json:"Details"`
+	Location float64 `json:"Meter_Location_Current"`
+}
+
+type froniusAPIVersion struct {
+	APIVersion         int    `json:"APIVersion"`
+	BaseURL            string `json:"BaseURL"`
+	CompatibilityRange string `json:"CompatibilityRange"`
+}
+
+func newFroniusProvider(address string) *froniusProvider {
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+
+	return &froniusProvider{
+		hc:      &http.Client{Timeout: 10 * time.Second},
+		baseURL: strings.TrimSuffix(address, "/"),
+	}
+}
+
+func (fp *froniusProvider) Open() error {
+	return nil
+}
+
+func (fp *froniusProvider) Close() error {
+	fp.hc.CloseIdleConnections()
+	return nil
+}
+
+// get decodes the JSON response to a Solar API request.
+func (fp *froniusProvider) get(path string, v any) error {
+	resp, err := fp.hc.Get(fp.baseURL + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func froniusGet[T any](fp *froniusProvider, path string) (T, error) {
+	var r froniusResponse[T]
+	if err := fp.get(path, &r); err != nil {
+		return r.Body.Data, fmt.Errorf("error requesting %s: %v", path, err)
+	}
+	if s := r.Head.Status; s.Code != 0 {
+		return r.Body.Data, fmt.Errorf("error requesting %s: status %d: %s", path, s.Code, strings.TrimSpace(s.Reason+" "+s.UserMessage))
+	}
+
+	return r.Body.Data, nil
+}
+
+func (fp *froniusProvider) Init() {
+	var version froniusAPIVersion
+	if err := fp.get("/solar_api/GetAPIVersion.cgi", &version); err != nil {
+		log.Printf("failed to get Fronius API version: %v", err)
+	} else {
+		log.Printf("Fronius Solar API version: %d", version.APIVersion)
+		log.Printf("Fronius firmware compatibility range: %s", version.CompatibilityRange)
+	}
+
+	inverters, err := froniusGet[map[string]froniusInverterInfo](fp, "/solar_api/v1/GetInverterInfo.cgi")
+	if err != nil {
+		log.Printf("failed to get Fronius inverter info: %v", err)
+	}
+	for _, id := range sortedKeys(inverters) {
+		inverter := inverters[id]
+		log.Printf("Inverter %s name: %s", id, inverter.CustomName)
+		log.Printf("Inverter %s device type: %d", id, inverter.DT)
+		log.Printf("Inverter %s unique ID: %s", id, inverter.UniqueID)
+		log.Printf("Inverter %s PV power: %.0f W", id, inverter.PVPower)
+		log.Printf("Inverter %s status: %d", id, inverter.StatusCode)
+	}
+
+	meters, err := froniusGet[map[string]froniusMeterInfo](fp, "/solar_api/v1/GetMeterRealtimeData.cgi?Scope=System")
+	if err != nil {
+		log.Printf("failed to get Fronius meter info: %v", err)
+	}
+	for _, id := range sortedKeys(meters) {
+		meter := meters[id]
+		log.Printf("Meter %s Manufacturer: %s", id, meter.Details.Manufacturer)
+		log.Printf("Meter %s Model: %s", id, meter.Details.Model)
+		log.Printf("Meter %s Serial: %s", id, meter.Details.Serial)
+		log.Printf("Meter %s location: %.0f", id, meter.Location)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	return keys
+}
+
+func (fp *froniusProvider) CurrentPowerExport() (float64, error) {
+	flow, err := froniusGet[froniusPowerFlow](fp, "/solar_api/v1/GetPowerFlowRealtimeData.fcgi")
+	if err != nil {
+		return 0, err
+	}
+
+	site := flow.Site
+	if site.PGrid == nil {
+		return 0, errors.New("no meter available")
+	}
+	// meter power = balance of production and consumption
+	// positive values indicate a surplus -> export to grid
+	meterPower := -*site.PGrid
+	log.Printf("Meter AC Power: %f", meterPower)
+
+	var batteryPower float64
+	if site.PAkku != nil {
+		batteryPower = -*site.PAkku
+		log.Printf("Battery Power: %f", batteryPower)
+	}
+
+	var pvPower, acPower float64
+	if site.PPV != nil {
+		pvPower = *site.PPV
+	}
+	for _, inverter := range flow.Inverters {
+		if inverter.P != nil {
+			acPower += *inverter.P
+		}
+	}
+	log.Printf("Inverter DC Power: %f", pvPower)
+	log.Printf("Inverter AC Power: %f", acPower)
+
+	// If the system has batteries installed, consider the amount of energy flowing into them
+	// as surplus. That is, prioritize Miele appliances higher than the batteries.
+	powerExport := meterPower + batteryPower
+
+	fp.last = powerReading{
+		Time:         time.Now(),
+		PVPower:      pvPower,
+		ACPower:      acPower,
+		MeterPower:   meterPower,
+		BatteryPower: batteryPower,
+		Export:       powerExport,
+	}
+
+	return powerExport, nil
+}
+
+func (fp *froniusProvider) LastReading() powerReading {
+	return fp.last
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// froniusServer serves recorded Solar API responses. The power flow is read
+// from GetPowerFlowRealtimeData_<flow>.json.
+func froniusServer(t *testing.T, flow string) *httptest.Server {
+	t.Helper()
+
+	files := map[string]string{
+		"/solar_api/GetAPIVersion.cgi":                "GetAPIVersion.json",
+		"/solar_api/v1/GetInverterInfo.cgi":           "GetInverterInfo.json",
+		"/solar_api/v1/GetMeterRealtimeData.cgi":      "GetMeterRealtimeData.json",
+		"/solar_api/v1/GetPowerFlowRealtimeData.fcgi": "GetPowerFlowRealtimeData_" + flow + ".json",
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, ok := files[r.URL.Path]
+		if flow == "error" {
+			name, ok = "error.json", true
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		data, err := os.ReadFile(filepath.Join("testdata", "fronius", name))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(data)
+	}))
+	t.Cleanup(ts.Close)
+
+	return ts
+}
+
+func TestFroniusProvider(t *testing.T) {
+	for _, tt := range []struct {
+		flow string
+		want powerReading
+	}{
+		// battery charging with 1205.8 W and exporting 1312.5 W
+		{"gen24", powerReading{PVPower: 5102.5869140625, ACPower: 3820.3154296875, MeterPower: 1312.5, BatteryPower: 1205.8101806640625, Export: 1312.5 + 1205.8101806640625}},
+		// two inverters without battery, importing 410.42 W
+		{"symo", powerReading{PVPower: 600, ACPower: 600, MeterPower: -410.42, Export: -410.42}},
+	} {
+		t.Run(tt.flow, func(t *testing.T) {
+			ts := froniusServer(t, tt.flow)
+			fp := newFroniusProvider(strings.TrimPrefix(ts.URL, "http://"))
+
+			got, err := fp.CurrentPowerExport()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want.Export {
+				t.Errorf("CurrentPowerExport() = %v, want %v", got, tt.want.Export)
+			}
+			r := fp.LastReading()
+			r.Time = tt.want.Time
+			if !reflect.DeepEqual(r, tt.want) {
+				t.Errorf("LastReading() = %+v, want %+v", r, tt.want)
+			}
+		})
+	}
+}
+
+func TestFroniusProviderErrors(t *testing.T) {
+	for _, flow := range []string{"nometer", "error", "missing"} {
+		ts := froniusServer(t, flow)
+		fp := newFroniusProvider(ts.URL)
+		if got, err := fp.CurrentPowerExport(); err == nil {
+			t.Errorf("%s: CurrentPowerExport() = %v, expected error", flow, got)
+		}
+	}
+}
+
+func TestFroniusProviderInit(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	ts := froniusServer(t, "gen24")
+	newFroniusProvider(ts.URL + "/").Init()
+	for _, want := range []string{
+		"Fronius firmware compatibility range: 1.7-7",
+		"Inverter 1 name: Symo GEN24 8.0",
+		"Inverter 1 unique ID: 12345678",
+		"Meter 0 Model: Smart Meter TS 65A-3",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("missing %q in log:\n%s", want, buf.String())
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ingmarstein/miele-go/miele"
+)
+
+const (
+	historyMaxSize = 1 << 20 // bytes after which the history file is rotated
+	historyFiles   = 5       // rotated files to keep in addition to the current one
+)
+
+const (
+	EventWaiting       = "waiting"
+	EventDelayed       = "delayed"
+	EventStart         = "start"
+	EventStarted       = "started"
+	EventStartFailed   = "start_failed"
+	EventFinished      = "finished"
+	EventProviderError = "provider_error"
+	EventReconnect     = "reconnect"
+
+	EventProviderDown     = "provider_down"
+	EventProviderRestored = "provider_restored"
+)
+
+// historyEvent records a decision or an error together with the power
+// reading it was based on.
+type historyEvent struct {
+	Time     time.Time     `json:"time"`
+	Type     string        `json:"type"`
+	Device   string        `json:"device,omitempty"`
+	Name     string        `json:"name,omitempty"`
+	Power    float64       `json:"power,omitempty"`    // configured power of the device
+	Surplus  float64       `json:"surplus"`            // last power export
+	Required float64       `json:"required,omitempty"` // surplus required to start the device
+	Reading  *powerReading `json:"reading,omitempty"`
+	Reason   string        `json:"reason,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	DryRun   bool          `json:"dryRun,omitempty"`
+}
+
+func (e historyEvent) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s  %-14s", e.Time.Local().Format(time.DateTime), e.Type)
+	if e.Device != "" {
+		fmt.Fprintf(&b, "  %s (%s)  surplus: %.0f W", e.Name, e.Device, e.Surplus)
+	}
+	if e.Reason != "" {
+		fmt.Fprintf(&b, "  %s", e.Reason)
+	}
+	if e.Error != "" {
+		fmt.Fprintf(&b, "  error: %s", e.Error)
+	}
+	if e.DryRun {
+		b.WriteString("  (dry run)")
+	}
+
+	return b.String()
+}
+
+// historyLog appends events as JSON lines to a file which is rotated once it
+// exceeds maxSize.
+type historyLog struct {
+	mu      sync.Mutex
+	name    string
+	maxSize int64
+	f       *os.File
+	size    int64
+}
+
+func openHistory(name string) (*historyLog, error) {
+	h := historyLog{name: name, maxSize: historyMaxSize}
+	if err := h.open(); err != nil {
+		return nil, err
+	}
+
+	return &h, nil
+}
+
+func (h *historyLog) open() error {
+	f, err := os.OpenFile(h.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	h.f, h.size = f, fi.Size()
+
+	return nil
+}
+
+// rotate renames name to name.1, name.1 to name.2 and so on, dropping the
+// oldest file, and opens a new file.
+func (h *historyLog) rotate() error {
+	if err := h.f.Close(); err != nil {
+		return err
+	}
+	for i := historyFiles - 1; i > 0; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", h.name, i), fmt.Sprintf("%s.%d", h.name, i+1))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.Rename(h.name, h.name+".1"); err != nil {
+		return err
+	}
+
+	return h.open()
+}
+
+func (h *historyLog) record(e historyEvent) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("error encoding history event: %v", err)
+		return
+	}
+	data = append(data, '\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.size > 0 && h.size+int64(len(data)) > h.maxSize {
+		if err := h.rotate(); err != nil {
+			log.Printf("error rotating history: %v", err)
+		}
+	}
+	n, err := h.f.Write(data)
+	h.size += int64(n)
+	if err != nil {
+		log.Printf("error writing history: %v", err)
+	}
+}
+
+func (h *historyLog) close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.f.Close()
+}
+
+// readHistory returns the events of the history file and its rotated files,
+// oldest first. Lines which cannot be decoded, e.g. after a crash during a
+// write, are skipped.
+func readHistory(name string) ([]historyEvent, error) {
+	var events []historyEvent
+	files := []string{name}
+	for i := 1; i <= historyFiles; i++ {
+		files = append([]string{fmt.Sprintf("%s.%d", name, i)}, files...)
+	}
+
+	for _, file := range files {
+		f, err := os.Open(file)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		for line := 1; scanner.Scan(); line++ {
+			var e historyEvent
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				log.Printf("skipping invalid history entry %s:%d: %v", file, line, err)
+				continue
+			}
+			events = append(events, e)
+		}
+		err = scanner.Err()
+		_ = f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return events, nil
+}
+
+// record adds an event to the history and sends notifications if enabled.
+// The caller must hold s.mu.
+func (s *server) record(e historyEvent) {
+	if s.history == nil && s.notifiers == nil {
+		return
+	}
+
+	e.Time = time.Now()
+	e.DryRun = e.DryRun || s.dryRun && (e.Type == EventStart || e.Type == EventStarted)
+	if e.Reading == nil {
+		e.Reading = s.reading
+	}
+	if s.history != nil {
+		s.history.record(e)
+	}
+	if s.notifiers != nil {
+		s.notifiers.notify(e)
+	}
+}
+
+// deviceEvent returns an event of the given type for a device.
+func (s *server) deviceEvent(typ string, d *device) historyEvent {
+	return historyEvent{
+		Type:    typ,
+		Device:  d.ID,
+		Name:    d.Name,
+		Power:   d.Power,
+		Surplus: s.available,
+	}
+}
+
+// trackAppliance records when an appliance starts waiting and when a started
+// appliance finishes. wasWaiting is the previous state of the device.
+func (s *server) trackAppliance(d *device, a appliance, wasWaiting bool) {
+	if a.waiting() && !wasWaiting {
+		e := s.deviceEvent(EventWaiting, d)
+		if deadline := startDeadline(time.Now(), a.StartTime); !deadline.IsZero() {
+			e.Reason = "deadline " + deadline.Format(time.Kitchen)
+		}
+		s.record(e)
+	}
+
+	running := a.Status == int(miele.DEVICE_STATUS_RUNNING)
+	if s.running[a.ID] && !running && !d.lastStart.IsZero() {
+		s.record(s.deviceEvent(EventFinished, d))
+	}
+	if s.running == nil {
+		s.running = make(map[string]bool)
+	}
+	s.running[a.ID] = running
+}
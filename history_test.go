@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ingmarstein/miele-go/miele"
+)
+
+func TestHistoryRecording(t *testing.T) {
+	f := newFakeMiele(t)
+	f.add("washer", "Washing Machine", miele.DEVICE_TYPE_WASHING_MACHINE, true)
+	f.add("dryer", "Tumble Dryer", miele.DEVICE_TYPE_TUMBLE_DRYER, true)
+
+	cfg := defaultConfig()
+	cfg.Devices = []device{{ID: "washer", Name: "Washing Machine", Power: 300}, {ID: "dryer", Name: "Tumble Dryer", Power: 200}}
+	cfg.Delay = 3600
+	cfg.History = filepath.Join(t.TempDir(), "history.jsonl")
+	srv := newServer(cfg, f.client(), &fakeProvider{power: 1000})
+
+	refresh(t, srv)
+	refresh(t, srv) // the delayed start is recorded only once
+	f.add("washer", "Washing Machine", miele.DEVICE_TYPE_WASHING_MACHINE, false)
+	refresh(t, srv)
+
+	// the dryer has been started elsewhere since the last refresh
+	if err := srv.mc.start("dryer"); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.forceStart("dryer"); err == nil {
+		t.Error("expected error starting a running device")
+	}
+	srv.close()
+
+	events, err := readHistory(cfg.History)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var types []string
+	for _, e := range events {
+		types = append(types, e.Type+" "+e.Device)
+	}
+	want := []string{
+		"waiting washer", "waiting dryer",
+		"start washer", "started washer", "delayed dryer",
+		"finished washer",
+		"start dryer", "start_failed dryer",
+	}
+	if !slices.Equal(types, want) {
+		t.Fatalf("got events %v, want %v", types, want)
+	}
+	if e := events[3]; e.Surplus != 1000 || e.Required != 300 || e.Power != 300 || e.Reason != "surplus: 1000.000000" {
+		t.Errorf("unexpected started event %+v", e)
+	}
+	if e := events[7]; e.Error == "" {
+		t.Errorf("missing error in %+v", e)
+	}
+}
+
+func TestHistoryRotation(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "history.jsonl")
+	h, err := openHistory(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.maxSize = 1000
+
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	n := 200
+	for i := range n {
+		h.record(historyEvent{Time: start.Add(time.Duration(i) * time.Minute), Type: EventWaiting, Device: fmt.Sprint(i)})
+	}
+	if err := h.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := readHistory(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) == 0 || len(events) >= n {
+		t.Fatalf("got %d events, want the oldest to be dropped", len(events))
+	}
+	for i := 1; i < len(events); i++ {
+		if !events[i].Time.After(events[i-1].Time) {
+			t.Fatalf("events out of order at %d: %v, %v", i, events[i-1].Time, events[i].Time)
+		}
+	}
+	if last := events[len(events)-1]; last.Device != fmt.Sprint(n-1) {
+		t.Errorf("last event = %+v, want device %d", last, n-1)
+	}
+}
+
+func TestDailyReport(t *testing.T) {
+	day := time.Date(2024, 6, 1, 11, 0, 0, 0, time.Local)
+	at := func(h float64) time.Time { return day.Add(time.Duration(h * float64(time.Hour))) }
+	events := []historyEvent{
+		{Time: at(0), Type: EventWaiting, Device: "dw", Name: "Dishwasher"},
+		{Time: at(0.5), Type: EventStarted, Device: "dw", Name: "Dishwasher", Power: 1000, Surplus: 800},
+		{Time: at(1), Type: EventStarted, Device: "wm", Name: "Washing Machine", Power: 500, Surplus: 1500},
+		{Time: at(1.5), Type: EventProviderError},
+		{Time: at(2.5), Type: EventFinished, Device: "dw", Name: "Dishwasher"},
+		{Time: at(3), Type: EventStartFailed, Device: "dw", Name: "Dishwasher"},
+		// the next day, finishing a start of the previous day
+		{Time: at(13), Type: EventStarted, Device: "dw", Name: "Dishwasher", Power: 1000, Surplus: -100},
+		{Time: at(14), Type: EventFinished, Device: "wm", Name: "Washing Machine"},
+	}
+
+	reports := dailyReports(events)
+	if len(reports) != 2 {
+		t.Fatalf("got %d reports, want 2", len(reports))
+	}
+	r := reports[0]
+	if r.Date != "2024-06-01" || r.Failures != 1 || r.ProviderErrors != 1 || len(r.Devices) != 2 {
+		t.Fatalf("unexpected report %+v", r)
+	}
+	dw, wm := r.Devices[0], r.Devices[1]
+	if dw.Starts != 1 || dw.Runtime != 2*time.Hour || dw.Energy != 1600 || dw.Unfinished != 0 {
+		t.Errorf("unexpected dishwasher report %+v", dw)
+	}
+	if wm.Starts != 1 || wm.Runtime != 13*time.Hour || wm.Energy != 6500 {
+		t.Errorf("unexpected washing machine report %+v", wm)
+	}
+	if dw := reports[1].Devices[0]; dw.Starts != 1 || dw.Unfinished != 1 || dw.Energy != 0 {
+		t.Errorf("unexpected report of the second day %+v", dw)
+	}
+
+	var buf bytes.Buffer
+	r.write(&buf)
+	for _, want := range []string{
+		"2024-06-01: 2 starts, 1 failed, 1 provider errors, estimated self-consumption 8.10 kWh",
+		"Dishwasher (dw): 1 starts, average surplus at start 800 W, runtime 2h0m0s, self-consumed 1.60 kWh",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("missing %q in report:\n%s", want, buf.String())
+		}
+	}
+
+	if got := filterHistory(events, 2*time.Hour, "dw", at(14)); len(got) != 1 || got[0].Type != EventStarted {
+		t.Errorf("filterHistory = %+v", got)
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqttPublisher publishes the state of mielesolar and the known devices to
+// MQTT and announces them using Home Assistant MQTT discovery. Commands
+// received on the command topics are passed to the server.
+type mqttPublisher struct {
+	c               mqtt.Client
+	broker          string
+	prefix          string
+	discoveryPrefix string
+	srv             *server
+	announced       map[string]bool
+}
+
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer,omitempty"`
+	ViaDevice    string   `json:"via_device,omitempty"`
+}
+
+type haConfig struct {
+	Name              string   `json:"name"`
+	UniqueID          string   `json:"unique_id"`
+	StateTopic        string   `json:"state_topic,omitempty"`
+	CommandTopic      string   `json:"command_topic,omitempty"`
+	AvailabilityTopic string   `json:"availability_topic"`
+	DeviceClass       string   `json:"device_class,omitempty"`
+	StateClass        string   `json:"state_class,omitempty"`
+	Unit              string   `json:"unit_of_measurement,omitempty"`
+	PayloadOn         string   `json:"payload_on,omitempty"`
+	PayloadOff        string   `json:"payload_off,omitempty"`
+	PayloadPress      string   `json:"payload_press,omitempty"`
+	Device            haDevice `json:"device"`
+}
+
+const (
+	payloadOn     = "ON"
+	payloadOff    = "OFF"
+	payloadPress  = "PRESS"
+	payloadOnline = "online"
+)
+
+// newMQTTPublisher creates a publisher using topics below prefix. Discovery
+// messages are published below discoveryPrefix unless it is empty.
+func newMQTTPublisher(broker, username, password, prefix, discoveryPrefix string) *mqttPublisher {
+	p := mqttPublisher{
+		broker:          broker,
+		prefix:          strings.TrimSuffix(prefix, "/"),
+		discoveryPrefix: strings.TrimSuffix(discoveryPrefix, "/"),
+		announced:       make(map[string]bool),
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(fmt.Sprintf("mielesolar-publisher-%d", time.Now().UnixNano())).
+		SetUsername(username).
+		SetPassword(password).
+		SetConnectTimeout(mqttConnectTimeout).
+		SetAutoReconnect(true).
+		SetWill(p.topic("status"), "offline", 0, true).
+		SetOnConnectHandler(p.onConnect)
+	p.c = mqtt.NewClient(opts)
+
+	return &p
+}
+
+func (p *mqttPublisher) topic(parts ...string) string {
+	return p.prefix + "/" + strings.Join(parts, "/")
+}
+
+// open connects to the broker and routes commands to srv.
+func (p *mqttPublisher) open(srv *server) error {
+	p.srv = srv
+
+	token := p.c.Connect()
+	if !token.WaitTimeout(mqttConnectTimeout) {
+		return fmt.Errorf("timeout connecting to MQTT broker %s", p.broker)
+	}
+	if err := token.Error(); err != nil {
+		return fmt.Errorf("error connecting to MQTT broker %s: %v", p.broker, err)
+	}
+
+	return nil
+}
+
+func (p *mqttPublisher) close() {
+	p.c.Publish(p.topic("status"), 0, true, "offline").WaitTimeout(time.Second)
+	p.c.Disconnect(250)
+}
+
+func (p *mqttPublisher) onConnect(c mqtt.Client) {
+	c.Publish(p.topic("status"), 0, true, payloadOnline)
+	// (re)announce all entities, e.g. after a restart of the broker
+	p.srv.mu.Lock()
+	p.announced = make(map[string]bool)
+	p.srv.mu.Unlock()
+
+	filters := map[string]byte{
+		p.topic("automation", "set"):    0,
+		p.topic("device", "+", "start"): 0,
+	}
+	token := c.SubscribeMultiple(filters, p.handleCommand)
+	if !token.WaitTimeout(mqttConnectTimeout) {
+		log.Println("timeout subscribing to MQTT command topics")
+		return
+	}
+	if err := token.Error(); err != nil {
+		log.Printf("error subscribing to MQTT command topics: %v", err)
+	}
+}
+
+func (p *mqttPublisher) handleCommand(_ mqtt.Client, msg mqtt.Message) {
+	payload := strings.TrimSpace(string(msg.Payload()))
+
+	if msg.Topic() == p.topic("automation", "set") {
+		switch strings.ToUpper(payload) {
+		case payloadOn:
+			p.srv.setPaused(false)
+		case payloadOff:
+			p.srv.setPaused(true)
+		default:
+			log.Printf("invalid MQTT automation command: %q", payload)
+		}
+		return
+	}
+
+	id := strings.TrimSuffix(strings.TrimPrefix(msg.Topic(), p.topic("device")+"/"), "/start")
+	if err := p.srv.forceStart(id); err != nil {
+		log.Printf("error starting device %s via MQTT: %v", id, err)
+	}
+}
+
+func (p *mqttPublisher) publish(topic string, retained bool, payload any) {
+	var data []byte
+	switch v := payload.(type) {
+	case string:
+		data = []byte(v)
+	default:
+		var err error
+		if data, err = json.Marshal(v); err != nil {
+			log.Printf("error encoding MQTT message for %s: %v", topic, err)
+			return
+		}
+	}
+
+	p.c.Publish(topic, 0, retained, data)
+}
+
+func (p *mqttPublisher) bridgeDevice() haDevice {
+	return haDevice{
+		Identifiers: []string{p.prefix},
+		Name:        "mielesolar",
+	}
+}
+
+func (p *mqttPublisher) announce(component, objectID string, config haConfig) {
+	if p.discoveryPrefix == "" || p.announced[component+objectID] {
+		return
+	}
+
+	config.UniqueID = p.prefix + "_" + objectID
+	config.AvailabilityTopic = p.topic("status")
+	p.publish(strings.Join([]string{p.discoveryPrefix, component, p.prefix, objectID, "config"}, "/"), true, config)
+	p.announced[component+objectID] = true
+}
+
+func formatTimestamp(t time.Time) string {
+	if t.IsZero() {
+		return "None"
+	}
+
+	return t.Format(time.RFC3339)
+}
+
+func formatSwitch(on bool) string {
+	if on {
+		return payloadOn
+	}
+
+	return payloadOff
+}
+
+// publishState publishes the current state of the server. The caller must
+// hold s.mu.
+func (p *mqttPublisher) publishState(s *server) {
+	if !p.c.IsConnectionOpen() {
+		return
+	}
+
+	bridge := p.bridgeDevice()
+	p.announce("sensor", "power_export", haConfig{
+		Name:        "Power export",
+		StateTopic:  p.topic("power", "export"),
+		DeviceClass: "power",
+		StateClass:  "measurement",
+		Unit:        "W",
+		Device:      bridge,
+	})
+	p.announce("sensor", "battery_power", haConfig{
+		Name:        "Battery power",
+		StateTopic:  p.topic("power", "battery"),
+		DeviceClass: "power",
+		StateClass:  "measurement",
+		Unit:        "W",
+		Device:      bridge,
+	})
+	p.announce("sensor", "next_start", haConfig{
+		Name:        "Next start",
+		StateTopic:  p.topic("next_start"),
+		DeviceClass: "timestamp",
+		Device:      bridge,
+	})
+	p.announce("switch", "automation", haConfig{
+		Name:         "Automation",
+		StateTopic:   p.topic("automation"),
+		CommandTopic: p.topic("automation", "set"),
+		PayloadOn:    payloadOn,
+		PayloadOff:   payloadOff,
+		Device:       bridge,
+	})
+
+	p.publish(p.topic("power", "export"), true, fmt.Sprintf("%.0f", s.available))
+	if s.reading != nil {
+		p.publish(p.topic("power", "battery"), true, fmt.Sprintf("%.0f", s.reading.BatteryPower))
+	}
+	p.publish(p.topic("next_start"), true, formatTimestamp(s.nextStart))
+	p.publish(p.topic("automation"), true, formatSwitch(!s.paused))
+
+	for i := range s.devices {
+		d := &s.devices[i]
+		dev := haDevice{
+			Identifiers:  []string{p.prefix + "_" + d.ID},
+			Name:         d.Name,
+			Manufacturer: "Miele",
+			ViaDevice:    p.prefix,
+		}
+		p.announce("binary_sensor", d.ID+"_waiting", haConfig{
+			Name:       "Waiting to start",
+			StateTopic: p.topic("device", d.ID, "waiting"),
+			PayloadOn:  payloadOn,
+			PayloadOff: payloadOff,
+			Device:     dev,
+		})
+		p.announce("sensor", d.ID+"_last_start", haConfig{
+			Name:        "Last start",
+			StateTopic:  p.topic("device", d.ID, "last_start"),
+			DeviceClass: "timestamp",
+			Device:      dev,
+		})
+		p.announce("button", d.ID+"_start", haConfig{
+			Name:         "Start",
+			CommandTopic: p.topic("device", d.ID, "start"),
+			PayloadPress: payloadPress,
+			Device:       dev,
+		})
+
+		p.publish(p.topic("device", d.ID, "waiting"), true, formatSwitch(d.waiting))
+		p.publish(p.topic("device", d.ID, "last_start"), true, formatTimestamp(d.lastStart))
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestMQTTPublisher(t *testing.T) {
+	b := newTestBroker(t)
+	srv := &server{
+		devices: []device{
+			{ID: "000123", Name: "Washing Machine", Power: 500, waiting: true},
+		},
+		available: 1234,
+		nextStart: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC),
+	}
+
+	p := newMQTTPublisher(b.url(), "", "", "mielesolar", "homeassistant")
+	if err := p.open(srv); err != nil {
+		t.Fatal(err)
+	}
+	defer p.close()
+	srv.publisher = p
+	b.waitSubscribed("mielesolar/automation/set")
+
+	srv.mu.Lock()
+	srv.publishState()
+	srv.mu.Unlock()
+
+	for topic, want := range map[string]string{
+		"mielesolar/status":                   "online",
+		"mielesolar/power/export":             "1234",
+		"mielesolar/next_start":               "2024-06-01T12:00:00Z",
+		"mielesolar/automation":               "ON",
+		"mielesolar/device/000123/waiting":    "ON",
+		"mielesolar/device/000123/last_start": "None",
+	} {
+		if got := string(b.waitMessage(topic)); got != want {
+			t.Errorf("%s = %q, want %q", topic, got, want)
+		}
+	}
+
+	var config haConfig
+	if err := json.Unmarshal(b.waitMessage("homeassistant/button/mielesolar/000123_start/config"), &config); err != nil {
+		t.Fatal(err)
+	}
+	if config.CommandTopic != "mielesolar/device/000123/start" || config.AvailabilityTopic != "mielesolar/status" {
+		t.Errorf("unexpected discovery config: %+v", config)
+	}
+
+	b.publish("mielesolar/automation/set", []byte("OFF"))
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		srv.mu.Lock()
+		paused := srv.paused
+		srv.mu.Unlock()
+		if paused {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("automation not paused")
+}
@@ -2,67 +2,114 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"flag"
-	"fmt"
 	"log"
+	"net"
 	"os"
+	"os/signal"
+	"slices"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 	_ "time/tzdata"
 
 	"github.com/grandcat/zeroconf"
-	"github.com/ingmarstein/miele-go/miele"
-)
-
-var (
-	inverterAddress      = flag.String("inverter", defaultString("INVERTER_ADDRESS", ""), "Inverter address or IP")
-	inverterPort         = flag.Int("port", defaultInt("INVERTER_PORT", 502), "MODBUS over TCP port")
-	inverterModbusID     = flag.Int("modbus-id", defaultInt("INVERTER_MODBUS_ID", 1), "Inverter MODBUS device ID")
-	pollInterval         = flag.Int("interval", 5, "Polling interval in seconds")
-	configFile           = flag.String("config", "devices.json", "Device config file")
-	clientID             = flag.String("client-id", os.Getenv("MIELE_CLIENT_ID"), "Miele 3rd Party API client ID")
-	clientSecret         = flag.String("client-secret", os.Getenv("MIELE_CLIENT_SECRET"), "Miele 3rd Party API client secret")
-	username             = flag.String("user", os.Getenv("MIELE_USERNAME"), "Miele@Home user name")
-	password             = flag.String("password", os.Getenv("MIELE_PASSWORD"), "Miele@Home password")
-	vg                   = flag.String("vg", "de-CH", "Country selector")
-	autoPower            = flag.Int("auto", 0, "Automatically start waiting devices if a minimum amount of power is available")
-	autoMode             = flag.String("auto-mode", "single", "How many devices to start when the amount of power specified by -auto is available. Valid values: \"single\" or \"all\"")
-	verbose              = flag.Bool("verbose", false, "Verbose mode")
-	startDelay           = flag.Int("delay", defaultInt("DELAY", 300), "Delay in seconds between the start of devices")
-	solarManagerUsername = flag.String("solarmanager-username", os.Getenv("SOLARMANAGER_USERNAME"), "SolarManager username")
-	solarManagerPassword = flag.String("solarmanager-password", os.Getenv("SOLARMANAGER_PASSWORD"), "SolarManager password")
-	solarManagerID       = flag.String("solarmanager-id", os.Getenv("SOLARMANAGER_ID"), "SolarManager ID")
 )
 
 const (
 	SCAN_TIMEOUT = 60 * time.Second
+	SCAN_SETTLE  = 5 * time.Second // time to wait for further inverters after the first one
 )
 
-func defaultString(key, value string) string {
-	if v := os.Getenv(key); v != "" {
-		return v
+// discoverInverters searches the local network for SolarEdge inverters. It
+// collects all inverters which announce themselves shortly after the first
+// one and exits if none is found.
+func discoverInverters(port, modbusID int) []inverterTarget {
+	entries := make(chan *zeroconf.ServiceEntry)
+	log.Println("Searching for inverters on the local network")
+	resolver, err := zeroconf.NewResolver(nil)
+	if err != nil {
+		log.Fatalln("Failed to initialize resolver:", err.Error())
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), SCAN_TIMEOUT)
+	defer cancel()
 
-	return value
-}
+	err = resolver.Browse(ctx, "_solaredge-modbus._tcp", "local.", entries)
+	if err != nil {
+		log.Fatalln("Failed to browse:", err.Error())
+	}
 
-func defaultInt(key string, value int) int {
-	if v := os.Getenv(key); v != "" {
-		if i, err := strconv.Atoi(v); err == nil {
-			return i
+	var targets []inverterTarget
+	var settle <-chan time.Time
+	for {
+		select {
+		case entry := <-entries:
+			if len(entry.AddrIPv4) == 0 {
+				continue
+			}
+			id := modbusID
+			for _, txt := range entry.Text {
+				if strings.HasPrefix(txt, "MODBUS_ID=") {
+					id, err = strconv.Atoi(strings.TrimPrefix(txt, "MODBUS_ID="))
+					if err != nil {
+						log.Fatalf("Invalid MODBUS_ID from mDNS: %s\n", txt)
+					}
+				}
+			}
+			t := inverterTarget{Address: net.JoinHostPort(entry.AddrIPv4[0].String(), strconv.Itoa(port)), UnitID: id}
+			if slices.Contains(targets, t) {
+				continue
+			}
+			log.Printf("Found inverter: %s\n", t)
+			targets = append(targets, t)
+			if settle == nil {
+				settle = time.After(SCAN_SETTLE)
+			}
+
+		case <-settle:
+			return targets
+
+		case <-ctx.Done():
+			if len(targets) == 0 {
+				log.Println("No inverter found on the local network")
+				os.Exit(1)
+			}
+			return targets
 		}
 	}
-
-	return value
 }
 
 type device struct {
-	ID      string  `json:"id"`
-	Name    string  `json:"name"`
-	Power   float64 `json:"power"`
-	waiting bool
+	ID        string         `json:"id"`
+	Name      string         `json:"name"`
+	Power     float64        `json:"power"`
+	Threshold float64        `json:"threshold,omitempty"` // surplus required to start, defaults to Power
+	Sustain   int            `json:"sustain,omitempty"`   // minutes, defaults to -sustain
+	Deadline  deadlinePolicy `json:"deadline,omitempty"`
+	waiting   bool
+	deadline  time.Time // latest start time of the SmartStart window
+	lastStart time.Time
+	skipUntil time.Time
+}
+
+// threshold returns the amount of surplus power required to start the device.
+func (d *device) threshold() float64 {
+	if d.Threshold > 0 {
+		return d.Threshold
+	}
+
+	return d.Power
+}
+
+// sustainDuration returns how long the surplus must be available before the
+// device is started. Devices without an explicit value use the global default.
+func (d *device) sustainDuration(def time.Duration) time.Duration {
+	if d.Sustain > 0 {
+		return time.Duration(d.Sustain) * time.Minute
+	}
+
+	return def
 }
 
 // https://medium.com/@mhcbinder/using-local-time-in-a-golang-docker-container-built-from-scratch-2900af02fbaf
@@ -79,108 +126,97 @@ func updateTimezone() {
 func main() {
 	updateTimezone()
 
-	flag.Parse()
-
-	if *clientID == "" || *clientSecret == "" || *username == "" || *password == "" {
-		flag.Usage()
-		os.Exit(1)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "simulate":
+			runSimulator(os.Args[2:])
+			return
+		case "history":
+			runHistory(os.Args[2:])
+			return
+		}
 	}
 
-	if *autoPower != 0 && *configFile != "" {
-		log.Println("WARNING: configuration file is ignored in automatic mode")
-	} else if *autoPower == 0 && *configFile == "" {
-		log.Println("Either -auto or -config must be specified")
-		flag.Usage()
-		os.Exit(1)
+	redactor := newRedactingWriter(os.Stderr)
+	log.SetOutput(redactor)
+
+	cfg, err := parseConfig(flag.CommandLine, os.Args[1:], os.Getenv)
+	if err != nil {
+		log.Fatalf("invalid configuration:\n%v", err)
+	}
+	redactor.add(cfg.secrets()...)
+	if cfg.Auto != 0 && len(cfg.Devices) > 0 {
+		log.Println("WARNING: configured devices are ignored in automatic mode")
 	}
 
-	var inverterUnitID = *inverterModbusID
-	if len(*inverterAddress) == 0 && len(*solarManagerUsername) == 0 {
-		entries := make(chan *zeroconf.ServiceEntry)
-		log.Println("Searching for inverter on the local network")
-		resolver, err := zeroconf.NewResolver(nil)
-		if err != nil {
-			log.Fatalln("Failed to initialize resolver:", err.Error())
+	var inverters []inverterTarget
+	if cfg.provider() == ProviderInverter || cfg.provider() == ProviderSunSpec {
+		// the configuration has been validated
+		inverters, _ = cfg.inverters()
+		if len(inverters) == 0 {
+			inverters = discoverInverters(cfg.Inverter.Port, cfg.Inverter.ModbusID)
 		}
-		ctx, cancel := context.WithTimeout(context.Background(), SCAN_TIMEOUT)
-		defer cancel()
+	}
+
+	hc := newMieleHTTPClient(mieleBaseURL, cfg.Miele.ClientID, cfg.Miele.ClientSecret, cfg.Miele.VG, cfg.Miele.Username, cfg.Miele.Password)
 
-		err = resolver.Browse(ctx, "_solaredge-modbus._tcp", "local.", entries)
+	var pp PvProvider
+	switch cfg.provider() {
+	case ProviderInverter:
+		pp, err = newModbusProvider(inverters...)
 		if err != nil {
-			log.Fatalln("Failed to browse:", err.Error())
+			log.Fatal(err)
 		}
-		select {
-		case entry := <-entries:
-			*inverterAddress = entry.AddrIPv4[0].String()
-			log.Printf("Found inverter: %s\n", *inverterAddress)
-			for _, txt := range entry.Text {
-				if strings.HasPrefix(txt, "MODBUS_ID=") {
-					inverterUnitID, err = strconv.Atoi(strings.TrimPrefix(txt, "MODBUS_ID="))
-					if err != nil {
-						log.Fatalf("Invalid MODBUS_ID from mDNS: %s\n", txt)
-					}
-				}
-			}
-
-		case <-ctx.Done():
-			log.Println("No inverter found on the local network")
-			os.Exit(1)
+	case ProviderSunSpec:
+		pp, err = newSunSpecProvider(inverters...)
+		if err != nil {
+			log.Fatal(err)
 		}
-	}
-	if len(*inverterAddress) > 0 && len(*solarManagerUsername) > 0 {
-		log.Println("-inverter and -solarmanager-username are mutually exclusive")
-		flag.Usage()
-		os.Exit(1)
+	case ProviderMQTT:
+		pp = newMQTTProvider(cfg.MQTT.Broker, cfg.MQTT.Username, cfg.MQTT.Password, cfg.MQTT.Topic, cfg.MQTT.Path, cfg.MQTT.Invert, time.Duration(cfg.MQTT.Timeout)*time.Second)
+	case ProviderSolarManager:
+		pp = newSolarManagerProvider(cfg.SolarManager.Username, cfg.SolarManager.Password, cfg.SolarManager.ID)
+	case ProviderFronius:
+		pp = newFroniusProvider(cfg.Fronius.Address)
+	case ProviderShelly:
+		pp = newShellyProvider(cfg.Shelly.Address, cfg.Shelly.Invert, cfg.Shelly.WebSocket)
+	case ProviderP1:
+		pp = newP1Provider(cfg.P1.Address, cfg.P1.BaudRate)
+	case ProviderSML:
+		pp = newSMLProvider(cfg.SML.Address, cfg.SML.BaudRate)
 	}
 
-	var mode modeEnum
-	switch *autoMode {
-	case "single":
-		mode = AutoSingleMode
-	case "all":
-		mode = AutoAllMode
-	default:
-		flag.Usage()
-		os.Exit(1)
+	srv := newServer(cfg, newMieleAdapter(hc, mieleBaseURL, cfg.Verbose), pp)
+	if cfg.DryRun {
+		log.Println("Dry run: devices will not be started")
 	}
+	srv.init()
 
-	var devices []device
-	if *autoPower == 0 {
-		mode = ManualMode
-		configData, err := os.ReadFile(*configFile)
-		if err != nil {
-			log.Fatalf("error reading %s: %v", *configFile, err)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go srv.watchConfig(context.Background(), cfg.file, configPollInterval, hup, func() (*config, error) {
+		cfg, err := parseConfig(flag.NewFlagSet(os.Args[0], flag.ContinueOnError), os.Args[1:], os.Getenv)
+		if err == nil {
+			redactor.add(cfg.secrets()...)
 		}
-		if err := json.Unmarshal(configData, &devices); err != nil {
-			log.Fatalf("error parsing device config: %v", err)
-		}
-	}
+		return cfg, err
+	})
 
-	mieleClient, err := miele.NewClientWithAuth(*clientID, *clientSecret, *vg, *username, *password)
-	if err != nil {
-		log.Fatal(err)
+	if cfg.Miele.Events {
+		srv.trackEvents(hc, mieleBaseURL, time.Duration(cfg.Miele.Resync)*time.Minute)
 	}
 
-	var pp PvProvider
-	if len(*inverterAddress) > 0 {
-		var err error
-		pp, err = newModbusProvider(fmt.Sprintf("%s:%d", *inverterAddress, *inverterPort), inverterUnitID)
-		if err != nil {
+	if cfg.MQTT.Prefix != "" {
+		srv.publisher = newMQTTPublisher(cfg.MQTT.Broker, cfg.MQTT.Username, cfg.MQTT.Password, cfg.MQTT.Prefix, cfg.MQTT.Discovery)
+		if err := srv.publisher.open(srv); err != nil {
 			log.Fatal(err)
 		}
-	} else {
-		pp = newSolarManagerProvider(*solarManagerUsername, *solarManagerPassword, *solarManagerID)
+		defer srv.publisher.close()
 	}
 
-	srv := newServer(
-		mode,
-		*autoPower,
-		devices,
-		*verbose,
-		mieleClient,
-		pp,
-		time.Duration(*startDelay)*time.Second)
-	srv.init()
+	if cfg.HTTP != "" {
+		go srv.listenAndServe(cfg.HTTP)
+	}
 
 	defer srv.close()
 	srv.serve()
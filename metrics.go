@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "mielesolar"
+
+var (
+	pvPowerGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "pv_power_watts",
+		Help:      "Solar production (inverter DC power).",
+	})
+	acPowerGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "ac_power_watts",
+		Help:      "Inverter production after conversion to AC.",
+	})
+	meterPowerGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "meter_power_watts",
+		Help:      "Grid meter power, positive values indicate export to the grid.",
+	})
+	batteryPowerGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "battery_power_watts",
+		Help:      "Battery power, positive values indicate charging.",
+	})
+	exportGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "power_export_watts",
+		Help:      "Surplus power available to start appliances.",
+	})
+	lastReadingGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "last_reading_timestamp_seconds",
+		Help:      "Time of the last reading. The power gauges keep their values while no appliance is waiting as the power export is not read then.",
+	})
+	phasePowerGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "meter_phase_power_watts",
+		Help:      "Grid meter power per phase, positive values indicate export to the grid.",
+	}, []string{"phase"})
+	phaseVoltageGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "meter_phase_voltage_volts",
+		Help:      "Grid voltage per phase.",
+	}, []string{"phase"})
+	phaseCurrentGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "meter_phase_current_amperes",
+		Help:      "Grid current per phase.",
+	}, []string{"phase"})
+	mieleErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "miele_api_errors_total",
+		Help:      "Number of failed Miele 3rd Party API requests.",
+	})
+	readErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "read_errors_total",
+		Help:      "Number of errors reading the power export from the inverter (e.g. over MODBUS).",
+	})
+	reconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "reconnects_total",
+		Help:      "Number of attempts to reconnect to the inverter.",
+	})
+	deviceStarts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "device_starts_total",
+		Help:      "Number of appliances started.",
+	}, []string{"device"})
+	dryRunStarts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "dry_run_starts_total",
+		Help:      "Number of appliances which would have been started in dry-run mode.",
+	}, []string{"device"})
+	pollDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "poll_duration_seconds",
+		Help:      "Duration of polling the appliances and the inverter.",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	})
+)
+
+// recordReading updates the power gauges from a reading.
+func recordReading(r powerReading) {
+	pvPowerGauge.Set(r.PVPower)
+	acPowerGauge.Set(r.ACPower)
+	meterPowerGauge.Set(r.MeterPower)
+	batteryPowerGauge.Set(r.BatteryPower)
+	exportGauge.Set(r.Export)
+	lastReadingGauge.Set(float64(r.Time.UnixNano()) / 1e9)
+	for i, phase := range r.Phases {
+		label := fmt.Sprintf("L%d", i+1)
+		phasePowerGauge.WithLabelValues(label).Set(phase.Power)
+		phaseVoltageGauge.WithLabelValues(label).Set(phase.Voltage)
+		phaseCurrentGauge.WithLabelValues(label).Set(phase.Current)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ingmarstein/miele-go/miele"
+)
+
+// readingFakeProvider reports the details of a fixed reading.
+type readingFakeProvider struct {
+	fakeProvider
+	reading powerReading
+}
+
+func (p *readingFakeProvider) CurrentPowerExport() (float64, error) {
+	return p.reading.Export, p.err
+}
+
+func (p *readingFakeProvider) LastReading() powerReading {
+	return p.reading
+}
+
+// scrapeMetrics returns the samples served at /metrics by name including
+// their labels, e.g. `mielesolar_meter_phase_power_watts{phase="L1"}`.
+func scrapeMetrics(t *testing.T, srv *server) map[string]float64 {
+	t.Helper()
+
+	w := serveAPI(t, srv, http.MethodGet, "/metrics")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+
+	metrics := make(map[string]float64)
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		if i < 0 {
+			continue
+		}
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("invalid sample %q: %v", line, err)
+		}
+		metrics[line[:i]] = v
+	}
+
+	return metrics
+}
+
+func TestMetrics(t *testing.T) {
+	f := newFakeMiele(t)
+	f.add("washer", "Washing Machine", miele.DEVICE_TYPE_WASHING_MACHINE, true)
+
+	reading := powerReading{
+		Time:         time.Now().Truncate(time.Second),
+		PVPower:      3000,
+		ACPower:      2900,
+		MeterPower:   400,
+		BatteryPower: 100,
+		Export:       500,
+		Phases:       []phaseReading{{Power: 200, Voltage: 230, Current: 1}, {Power: 100, Voltage: 231, Current: 0.5}},
+	}
+	pp := &readingFakeProvider{reading: reading}
+	cfg := defaultConfig()
+	cfg.Devices = []device{{ID: "washer", Name: "Washing Machine", Power: 300}}
+	srv := newServer(cfg, f.client(), pp)
+
+	before := scrapeMetrics(t, srv)
+	refresh(t, srv)
+	checkStarted(t, f, "washer")
+
+	got := scrapeMetrics(t, srv)
+	for name, want := range map[string]float64{
+		"mielesolar_pv_power_watts":                                3000,
+		"mielesolar_ac_power_watts":                                2900,
+		"mielesolar_meter_power_watts":                             400,
+		"mielesolar_battery_power_watts":                           100,
+		"mielesolar_power_export_watts":                            500,
+		"mielesolar_last_reading_timestamp_seconds":                float64(reading.Time.Unix()),
+		`mielesolar_meter_phase_power_watts{phase="L1"}`:           200,
+		`mielesolar_meter_phase_voltage_volts{phase="L2"}`:         231,
+		`mielesolar_meter_phase_current_amperes{phase="L2"}`:       0.5,
+		`mielesolar_device_starts_total{device="Washing Machine"}`: before[`mielesolar_device_starts_total{device="Washing Machine"}`] + 1,
+		"mielesolar_read_errors_total":                             before["mielesolar_read_errors_total"],
+	} {
+		if got[name] != want {
+			t.Errorf("%s = %v, want %v", name, got[name], want)
+		}
+	}
+
+	// a failed reading leaves the gauges unchanged
+	f.add("washer", "Washing Machine", miele.DEVICE_TYPE_WASHING_MACHINE, true)
+	pp.err = errors.New("timeout")
+	if err := srv.refresh(); err == nil {
+		t.Error("expected provider error")
+	}
+	got = scrapeMetrics(t, srv)
+	if want := before["mielesolar_read_errors_total"] + 1; got["mielesolar_read_errors_total"] != want {
+		t.Errorf("mielesolar_read_errors_total = %v, want %v", got["mielesolar_read_errors_total"], want)
+	}
+	if got["mielesolar_power_export_watts"] != 500 {
+		t.Errorf("mielesolar_power_export_watts = %v, want 500", got["mielesolar_power_export_watts"])
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/ingmarstein/miele-go/miele"
+)
+
+// mieleAPI is the subset of the Miele 3rd Party API used by the server.
+type mieleAPI interface {
+	// list returns the state of all appliances.
+	list() ([]appliance, error)
+	// get returns the state of the appliance with the given ID. Only the
+	// fields describing the state are set.
+	get(id string) (appliance, error)
+	// start starts the program of a waiting appliance.
+	start(id string) error
+}
+
+// mieleAdapter implements mieleAPI using requests to the Miele 3rd Party API
+// at baseURL. hc must authenticate the requests (see newMieleHTTPClient).
+type mieleAdapter struct {
+	hc      *http.Client
+	baseURL string
+	verbose bool
+}
+
+// newMieleAdapter returns an adapter for the API at baseURL whose requests
+// time out after mieleTimeout.
+func newMieleAdapter(hc *http.Client, baseURL string, verbose bool) mieleAdapter {
+	c := *hc
+	c.Timeout = mieleTimeout
+
+	return mieleAdapter{hc: &c, baseURL: baseURL, verbose: verbose}
+}
+
+func (m mieleAdapter) do(method, path string, body, result any) error {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, m.baseURL+path, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := m.hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if m.verbose {
+		log.Printf("%s %s: %s", method, path, resp.Status)
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s %s: unexpected status: %s", method, path, resp.Status)
+	}
+	if result == nil {
+		return nil
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("%s %s: error decoding response: %v", method, path, err)
+	}
+
+	return nil
+}
+
+func (m mieleAdapter) list() ([]appliance, error) {
+	var devices map[string]mieleDevice
+	if err := m.do(http.MethodGet, "/v1/devices", nil, &devices); err != nil {
+		return nil, err
+	}
+
+	appliances := make([]appliance, 0, len(devices))
+	for id, d := range devices {
+		appliances = append(appliances, d.appliance(id))
+	}
+
+	return appliances, nil
+}
+
+func (m mieleAdapter) get(id string) (appliance, error) {
+	var d mieleDevice
+	if err := m.do(http.MethodGet, "/v1/devices/"+id+"/state", nil, &d.State); err != nil {
+		return appliance{}, err
+	}
+
+	return d.appliance(id), nil
+}
+
+func (m mieleAdapter) start(id string) error {
+	return m.do(http.MethodPut, "/v1/devices/"+id+"/actions", map[string]int{"processAction": int(miele.ACTION_START)}, nil)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/ingmarstein/miele-go/miele"
+)
+
+func TestMieleAdapter(t *testing.T) {
+	f := newFakeMiele(t)
+	f.add("washer", "Washing Machine", miele.DEVICE_TYPE_WASHING_MACHINE, true)
+	f.add("dryer", "Tumble Dryer", miele.DEVICE_TYPE_TUMBLE_DRYER, false)
+	mc := f.client()
+
+	want := []appliance{
+		{ID: "dryer", Name: "Tumble Dryer", Type: int(miele.DEVICE_TYPE_TUMBLE_DRYER), Status: int(miele.DEVICE_STATUS_OFF)},
+		{ID: "washer", Name: "Washing Machine", Type: int(miele.DEVICE_TYPE_WASHING_MACHINE), Status: int(miele.DEVICE_STATUS_PROGRAMMED_WAITING_TO_START), FullRemoteControl: true, StartTime: []int{8, 0}},
+	}
+	got, err := mc.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.SortFunc(got, func(a, b appliance) int { return strings.Compare(a.ID, b.ID) })
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("list() = %+v, want %+v", got, want)
+	}
+
+	wantState := appliance{ID: "washer", Status: want[1].Status, FullRemoteControl: true, StartTime: []int{8, 0}}
+	if a, err := mc.get("washer"); err != nil || !reflect.DeepEqual(a, wantState) {
+		t.Errorf("get() = %+v, %v; want %+v", a, err, wantState)
+	}
+	if _, err := mc.get("oven"); err == nil {
+		t.Error("expected error getting an unknown appliance")
+	}
+
+	if err := mc.start("washer"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mc.start("dryer"); err == nil {
+		t.Error("expected error starting an appliance which isn't waiting")
+	}
+	if got := f.started(); !slices.Equal(got, []string{"washer"}) {
+		t.Errorf("started = %v, want [washer]", got)
+	}
+	if a, err := mc.get("washer"); err != nil || a.Status != int(miele.DEVICE_STATUS_RUNNING) {
+		t.Errorf("get() = %+v, %v; want running", a, err)
+	}
+
+	if mc.hc.Timeout != mieleTimeout {
+		t.Errorf("timeout = %v, want %v", mc.hc.Timeout, mieleTimeout)
+	}
+}
@@ -1,152 +1,512 @@
 package main
 
 import (
+	"cmp"
+	"errors"
 	"fmt"
 	solaredge "github.com/ingmarstein/mielesolar/modbus"
 	"github.com/simonvetter/modbus"
 	"log"
-	"math"
+	"slices"
 	"time"
 )
 
-type modbusProvider struct {
-	c              *modbus.ModbusClient
-	hasBattery     bool
-	inverterUnitID int
+const (
+	TransportTCP        = "tcp"        // MODBUS TCP
+	TransportRTU        = "rtu"        // MODBUS RTU over a serial line, e.g. an RS485 USB adapter
+	TransportRTUOverTCP = "rtuovertcp" // MODBUS RTU frames over TCP, e.g. through an Ethernet gateway
+
+	ParityNone = "none"
+	ParityEven = "even"
+	ParityOdd  = "odd"
+)
+
+// serialSettings configures the serial line of MODBUS RTU. The baud rate also
+// determines the frame delays of RTU over TCP.
+type serialSettings struct {
+	BaudRate uint
+	Parity   string
+	StopBits uint
 }
 
-func newModbusProvider(address string, unitID int) (*modbusProvider, error) {
-	p := modbusProvider{
-		inverterUnitID: unitID,
+func (s serialSettings) parity() uint {
+	switch s.Parity {
+	case ParityEven:
+		return modbus.PARITY_EVEN
+	case ParityOdd:
+		return modbus.PARITY_ODD
+	default:
+		return modbus.PARITY_NONE
 	}
+}
 
-	var err error
-	p.c, err = modbus.NewClient(&modbus.ClientConfiguration{
-		URL:     "tcp://" + address,
-		Timeout: 10 * time.Second,
-	})
-	if err != nil {
-		return nil, fmt.Errorf("error creating client: %v", err)
+// inverterTarget identifies an inverter by its MODBUS address and unit ID.
+// The followers of a leader/follower setup share the address of the leader,
+// as do several inverters on the same RS485 bus.
+type inverterTarget struct {
+	Transport string // defaults to TransportTCP
+	Address   string // host:port or serial device
+	UnitID    int
+	Serial    serialSettings
+}
+
+func (t inverterTarget) url() string {
+	return cmp.Or(t.Transport, TransportTCP) + "://" + t.Address
+}
+
+func (t inverterTarget) String() string {
+	if t.Transport == "" || t.Transport == TransportTCP {
+		return fmt.Sprintf("%s/%d", t.Address, t.UnitID)
 	}
 
-	return &p, err
+	return fmt.Sprintf("%s/%d", t.url(), t.UnitID)
 }
 
-func (mp *modbusProvider) Open() error {
-	if err := mp.c.Open(); err != nil {
+// modbusConn is a MODBUS connection shared by all inverters at the same
+// address.
+type modbusConn struct {
+	c    *modbus.ModbusClient
+	open bool
+}
+
+func (conn *modbusConn) connect() error {
+	if conn.open {
+		return nil
+	}
+	if err := conn.c.Open(); err != nil {
 		return err
 	}
+	conn.open = true
+
+	return nil
+}
 
-	if err := mp.c.SetUnitId(uint8(mp.inverterUnitID)); err != nil {
+// use connects if necessary and addresses subsequent requests to the given
+// unit.
+func (conn *modbusConn) use(unitID int) error {
+	if err := conn.connect(); err != nil {
+		return err
+	}
+	if err := conn.c.SetUnitId(uint8(unitID)); err != nil {
 		return fmt.Errorf("error setting unit ID: %v", err)
 	}
 
 	return nil
 }
 
-func (mp *modbusProvider) Close() error {
-	if err := mp.c.Close(); err != nil {
+func (conn *modbusConn) close() error {
+	if !conn.open {
+		return nil
+	}
+	conn.open = false
+
+	return conn.c.Close()
+}
+
+// inverterUnit holds the meters and batteries discovered on an inverter.
+type inverterUnit struct {
+	inverterTarget
+	conn       *modbusConn
+	discovered bool
+	meters     []solaredge.MeterModel
+	batteries  []int // indices of the connected batteries
+}
+
+// use connects to the inverter if necessary and addresses subsequent
+// requests to it.
+func (u *inverterUnit) use() error {
+	return u.conn.use(u.UnitID)
+}
+
+// modbusProvider reads the power export from one or more SolarEdge
+// inverters. The production of all inverters is summed up while the export
+// is read from the meter at the grid connection point, whichever inverter
+// hosts it.
+type modbusProvider struct {
+	conns     []*modbusConn
+	units     []*inverterUnit
+	meterUnit *inverterUnit // inverter hosting the meter at the grid connection point
+	meter     int           // index of that meter
+	last      powerReading
+}
+
+func newModbusProvider(targets ...inverterTarget) (*modbusProvider, error) {
+	var p modbusProvider
+
+	conns, err := newModbusConns(targets)
+	if err != nil {
+		return nil, err
+	}
+	for i, t := range targets {
+		p.units = append(p.units, &inverterUnit{inverterTarget: t, conn: conns[i]})
+	}
+	p.conns = uniqueConns(conns)
+
+	return &p, nil
+}
+
+// newModbusConns creates the connections to the targets. Targets at the same
+// address share a connection.
+func newModbusConns(targets []inverterTarget) ([]*modbusConn, error) {
+	byURL := make(map[string]*modbusConn)
+	conns := make([]*modbusConn, len(targets))
+	for i, t := range targets {
+		conn := byURL[t.url()]
+		if conn == nil {
+			c, err := modbus.NewClient(&modbus.ClientConfiguration{
+				URL:      t.url(),
+				Timeout:  10 * time.Second,
+				Speed:    t.Serial.BaudRate,
+				DataBits: 8,
+				Parity:   t.Serial.parity(),
+				StopBits: t.Serial.StopBits,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("error creating client: %v", err)
+			}
+			conn = &modbusConn{c: c}
+			byURL[t.url()] = conn
+		}
+		conns[i] = conn
+	}
+
+	return conns, nil
+}
+
+// uniqueConns removes repeated connections, keeping the order.
+func uniqueConns(conns []*modbusConn) []*modbusConn {
+	var unique []*modbusConn
+	for _, conn := range conns {
+		if !slices.Contains(unique, conn) {
+			unique = append(unique, conn)
+		}
+	}
+
+	return unique
+}
+
+// openConns connects to all inverters. It only fails if none of them is
+// reachable as an inverter may be asleep. Such inverters are connected on
+// the next read.
+func openConns(conns []*modbusConn) error {
+	var errs []error
+	for _, conn := range conns {
+		if err := conn.connect(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) == len(conns) {
+		return errors.Join(errs...)
+	}
+	for _, err := range errs {
+		log.Printf("error connecting to inverter: %v", err)
+	}
+
+	return nil
+}
+
+func closeConns(conns []*modbusConn) error {
+	var errs []error
+	for _, conn := range conns {
+		if err := conn.close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
 		return fmt.Errorf("error closing modbus client: %v", err)
 	}
 
 	return nil
 }
 
+func (mp *modbusProvider) Open() error {
+	return openConns(mp.conns)
+}
+
+func (mp *modbusProvider) Close() error {
+	return closeConns(mp.conns)
+}
+
 func (mp *modbusProvider) Init() {
-	// Collect and log common inverter data
-	inverter, err := solaredge.ReadInverter(mp.c)
-	if err != nil {
-		log.Fatalf("%v", err)
+	var discovered bool
+	for _, u := range mp.units {
+		if err := mp.discover(u); err != nil {
+			log.Printf("inverter %s unavailable, retrying later: %v", u, err)
+			continue
+		}
+		discovered = true
 	}
+	if !discovered {
+		log.Fatalf("no inverter available")
+	}
+}
 
-	log.Printf("Inverter Manufacturer: %s", inverter.Manufacturer())
-	log.Printf("Inverter Model: %s", inverter.Model())
-	log.Printf("Inverter Version: %s", inverter.Version())
-	log.Printf("Inverter Serial: %s", inverter.SerialNumber())
-	log.Printf("Inverter device ID: %d", inverter.C_DeviceAddress)
+// discover collects and logs the inverter data and finds the connected
+// meters and batteries.
+func (mp *modbusProvider) discover(u *inverterUnit) error {
+	if err := u.use(); err != nil {
+		return err
+	}
 
-	meter, err := solaredge.ReadMeter(mp.c, 0)
+	inverter, err := solaredge.ReadInverter(u.conn.c)
 	if err != nil {
-		log.Fatalf("error reading meter registers: %s", err.Error())
+		return err
 	}
 
-	if meter.C_DeviceAddress != 0x8000 {
-		log.Printf("Meter Manufacturer: %s", meter.Manufacturer())
-		log.Printf("Meter Model: %s", meter.Model())
-		log.Printf("Meter Option: %s", meter.Option())
-		log.Printf("Meter Version: %s", meter.Version())
-		log.Printf("Meter Serial: %s", meter.SerialNumber())
-		log.Printf("Meter device ID: %d", meter.C_DeviceAddress)
+	log.Printf("Inverter %s Manufacturer: %s", u, inverter.Manufacturer())
+	log.Printf("Inverter %s Model: %s", u, inverter.Model())
+	log.Printf("Inverter %s Version: %s", u, inverter.Version())
+	log.Printf("Inverter %s Serial: %s", u, inverter.SerialNumber())
+	log.Printf("Inverter %s device ID: %d", u, inverter.C_DeviceAddress)
+
+	u.meters = nil
+	for i := 0; i < solaredge.MaxMeters; i++ {
+		meter, err := solaredge.ReadMeter(u.conn.c, i)
+		if err != nil {
+			if i == 0 {
+				return fmt.Errorf("error reading meter registers: %v", err)
+			}
+			// some inverters don't serve the registers of unused slots
+			log.Printf("error reading meter %d: %v", i+1, err)
+			break
+		}
+		u.meters = append(u.meters, meter)
+
+		if meter.Present() {
+			log.Printf("Meter %d Manufacturer: %s", i+1, meter.Manufacturer())
+			log.Printf("Meter %d Model: %s", i+1, meter.Model())
+			log.Printf("Meter %d Option: %s", i+1, meter.Option())
+			log.Printf("Meter %d Version: %s", i+1, meter.Version())
+			log.Printf("Meter %d Serial: %s", i+1, meter.SerialNumber())
+			log.Printf("Meter %d device ID: %d", i+1, meter.C_DeviceAddress)
+		}
 	}
 
-	battery, err := solaredge.ReadBatteryInfo(mp.c, 0)
-	if err != nil {
-		log.Fatalf("error reading battery registers: %s", err.Error())
+	u.batteries = nil
+	for i := 0; i < solaredge.MaxBatteries; i++ {
+		battery, err := solaredge.ReadBatteryInfo(u.conn.c, i)
+		if err != nil {
+			if i == 0 {
+				return fmt.Errorf("error reading battery registers: %v", err)
+			}
+			log.Printf("error reading battery %d: %v", i+1, err)
+			break
+		}
+		if !battery.Present() {
+			continue
+		}
+		u.batteries = append(u.batteries, i)
+
+		log.Printf("Battery %d Manufacturer: %s", i+1, battery.Manufacturer())
+		log.Printf("Battery %d Model: %s", i+1, battery.Model())
+		log.Printf("Battery %d Version: %s", i+1, battery.Version())
+		log.Printf("Battery %d Serial: %s", i+1, battery.SerialNumber())
+		log.Printf("Battery %d device ID: %d", i+1, battery.C_DeviceAddress)
+
+		log.Printf("Battery %d rated energy: %.0f W", i+1, battery.RatedEnergy)
+		log.Printf("Battery %d maximum charge continuous power: %.0f W", i+1, battery.MaximumChargeContinuousPower)
+		log.Printf("Battery %d maximum discharge continuous power: %.0f W", i+1, battery.MaximumDischargeContinuousPower)
+		log.Printf("Battery %d maximum charge peak power: %.0f W", i+1, battery.MaximumChargePeakPower)
+		log.Printf("Battery %d maximum discharge peak power: %.0f W", i+1, battery.MaximumDischargePeakPower)
 	}
 
-	mp.hasBattery = battery.C_DeviceAddress != 0xFF
-	if mp.hasBattery {
-		log.Printf("Battery Manufacturer: %s", battery.Manufacturer())
-		log.Printf("Battery Model: %s", battery.Model())
-		log.Printf("Battery Version: %s", battery.Version())
-		log.Printf("Battery Serial: %s", battery.SerialNumber())
-		log.Printf("Battery device ID: %d", battery.C_DeviceAddress)
+	u.discovered = true
+	mp.selectGridMeter()
 
-		log.Printf("Battery rated energy: %.0f W", battery.RatedEnergy)
-		log.Printf("Battery maximum charge continuous power: %.0f W", battery.MaximumChargeContinuousPower)
-		log.Printf("Battery maximum discharge continuous power: %.0f W", battery.MaximumDischargeContinuousPower)
-		log.Printf("Battery maximum charge peak power: %.0f W", battery.MaximumChargePeakPower)
-		log.Printf("Battery maximum discharge peak power: %.0f W", battery.MaximumDischargePeakPower)
+	return nil
+}
+
+// selectGridMeter selects the meter measuring the export to the grid among
+// all discovered inverters. SolarEdge identifies its function by the option,
+// e.g. "Export+Import" as opposed to "Consumption". If no meter is marked as
+// such, the first connected meter is used.
+func (mp *modbusProvider) selectGridMeter() {
+	unit, meter := mp.findGridMeter()
+	if unit == mp.meterUnit && meter == mp.meter {
+		return
 	}
+	mp.meterUnit, mp.meter = unit, meter
+	log.Printf("Using meter %d of inverter %s for the power export", meter+1, unit)
 }
 
-func (mp *modbusProvider) CurrentPowerExport() (float64, error) {
-	inverter, err := solaredge.ReadInverter(mp.c)
+func (mp *modbusProvider) findGridMeter() (*inverterUnit, int) {
+	var first *inverterUnit
+	var firstIndex int
+	for _, u := range mp.units {
+		for i, m := range u.meters {
+			if !m.Present() {
+				continue
+			}
+			if m.IsGridMeter() {
+				return u, i
+			}
+			if first == nil {
+				first, firstIndex = u, i
+			}
+		}
+	}
+	if first != nil {
+		log.Printf("no export+import meter found, falling back to meter %d of inverter %s", firstIndex+1, first)
+		return first, firstIndex
+	}
+
+	log.Printf("no meter found, the power export cannot be determined")
+	for _, u := range mp.units {
+		if u.discovered {
+			return u, 0
+		}
+	}
+
+	return nil, 0
+}
+
+// inverterReading holds the values read from a single inverter.
+type inverterReading struct {
+	dcPower, acPower float64
+	meterPower       float64
+	hasMeter         bool
+	batteryPower     float64
+}
+
+func (mp *modbusProvider) read(u *inverterUnit) (inverterReading, error) {
+	var r inverterReading
+
+	if !u.discovered {
+		if err := mp.discover(u); err != nil {
+			return r, err
+		}
+	}
+	if err := u.use(); err != nil {
+		return r, err
+	}
+
+	im, err := solaredge.ReadInverter(u.conn.c)
 	if err != nil {
 		log.Printf("error reading inverter registers: %s", err.Error())
-		return 0, err
+		return r, err
 	}
+	inverter := im.Decode()
 
 	if inverter.Status != solaredge.I_STATUS_MPPT && inverter.Status != solaredge.I_STATUS_THROTTLED {
 		log.Printf("current inverter status: %d\n", inverter.Status)
 		//return 0, nil
 	}
 
+	// The production is informational only and treated as zero if
+	// unavailable.
 	// inverter DC power = solar production
-	inverterDCPower := float64(inverter.DC_Power) * math.Pow(10.0, float64(inverter.DC_Power_SF))
-	log.Printf("Inverter DC Power: %f", inverterDCPower)
+	r.dcPower = inverter.DCPower.Or(0)
+	log.Printf("Inverter %s DC Power: %s", u, inverter.DCPower)
 
 	// inverter AC power = production after conversion to AC
-	inverterACPower := float64(inverter.AC_Power) * math.Pow(10.0, float64(inverter.AC_Power_SF))
-	log.Printf("Inverter AC Power: %f", inverterACPower)
+	r.acPower = inverter.ACPower.Or(0)
+	log.Printf("Inverter %s AC Power: %s", u, inverter.ACPower)
 
-	meter, err := solaredge.ReadMeter(mp.c, 0)
-	if err != nil {
-		log.Printf("error reading meter data: %s", err.Error())
-		return 0, err
+	if u == mp.meterUnit {
+		mm, err := solaredge.ReadMeter(u.conn.c, mp.meter)
+		if err != nil {
+			log.Printf("error reading meter data: %s", err.Error())
+			return r, err
+		}
+		meter := mm.Decode()
+
+		// meter AC power = balance of production and consumption
+		// positive values indicate a surplus -> export to grid
+		// negative values indicate a deficit -> import from grid
+		log.Printf("Meter AC Power: %s", meter.Power)
+		if !meter.Power.Valid {
+			return r, fmt.Errorf("%w: meter %d of inverter %s reports no AC power", errInvalidReading, mp.meter+1, u)
+		}
+		r.meterPower = meter.Power.Value
+		r.hasMeter = true
 	}
 
-	// meter AC power = balance of production and consumption
-	// positive values indicate a surplus -> export to grid
-	// negative values indicate a deficit -> import from grid
-	meterACPower := float64(meter.M_AC_Power) * math.Pow(10.0, float64(meter.M_AC_Power_SF))
-	log.Printf("Meter AC Power: %f", meterACPower)
+	for _, i := range u.batteries {
+		bm, err := solaredge.ReadBattery(u.conn.c, i)
+		if err != nil {
+			log.Printf("error reading battery data: %v", err)
+			return r, err
+		}
+		battery := bm.Decode()
+
+		log.Printf("Battery %d Power: %s", i+1, battery.Power)
+		if !battery.Power.Valid {
+			return r, fmt.Errorf("%w: battery %d of inverter %s reports no power", errInvalidReading, i+1, u)
+		}
+		r.batteryPower += battery.Power.Value
+	}
 
-	powerExport := meterACPower
+	return r, nil
+}
 
-	// If the system has a battery installed, consider the amount of energy flowing into it
-	// as surplus. That is, prioritize Miele appliances higher than the battery.
-	if mp.hasBattery {
-		battery, err := solaredge.ReadBattery(mp.c, 0)
+// errInvalidReading indicates that a value required to determine the power
+// export is not available. Acting on such a reading could start appliances
+// based on a bogus surplus.
+var errInvalidReading = errors.New("invalid reading")
+
+// isGatewayError reports whether a leader inverter answered on behalf of an
+// unavailable follower, in which case its connection remains usable.
+func isGatewayError(err error) bool {
+	return errors.Is(err, modbus.ErrGWTargetFailedToRespond) || errors.Is(err, modbus.ErrGWPathUnavailable)
+}
+
+// readInverters sums up the readings of all units. Units for which required
+// returns false (no meter or battery) may be asleep and are skipped when
+// unavailable. Errors on required units, and invalid readings on any unit,
+// fail the whole read so that e.g. a discharging battery isn't missed.
+func readInverters[U fmt.Stringer](units []U, read func(U) (inverterReading, error), required func(U) bool, conn func(U) *modbusConn) (inverterReading, error) {
+	var total inverterReading
+	var errs []error
+	for _, u := range units {
+		r, err := read(u)
 		if err != nil {
-			log.Printf("error reading battery data: %v", err)
-			return 0, err
+			if required(u) || errors.Is(err, errInvalidReading) {
+				return total, err
+			}
+			log.Printf("inverter %s unavailable: %v", u, err)
+			if !isGatewayError(err) {
+				_ = conn(u).close()
+			}
+			errs = append(errs, err)
+			continue
 		}
 
-		log.Printf("Battery Power: %f", battery.InstantaneousPower)
+		total.dcPower += r.dcPower
+		total.acPower += r.acPower
+		total.batteryPower += r.batteryPower
+		if r.hasMeter {
+			total.meterPower, total.hasMeter = r.meterPower, true
+		}
+	}
+	if !total.hasMeter {
+		return total, errors.Join(append([]error{errors.New("no meter available")}, errs...)...)
+	}
+
+	return total, nil
+}
 
-		powerExport += float64(battery.InstantaneousPower)
+func (mp *modbusProvider) CurrentPowerExport() (float64, error) {
+	total, err := readInverters(mp.units, mp.read,
+		func(u *inverterUnit) bool { return u == mp.meterUnit || len(u.batteries) > 0 },
+		func(u *inverterUnit) *modbusConn { return u.conn })
+	if err != nil {
+		return 0, err
 	}
 
+	// If the system has batteries installed, consider the amount of energy flowing into them
+	// as surplus. That is, prioritize Miele appliances higher than the batteries.
+	powerExport := total.meterPower + total.batteryPower
+
+	mp.last.Time = time.Now()
+	mp.last.PVPower = total.dcPower
+	mp.last.ACPower = total.acPower
+	mp.last.MeterPower = total.meterPower
+	mp.last.BatteryPower = total.batteryPower
+	mp.last.Export = powerExport
+
 	return powerExport, nil
 }
+
+func (mp *modbusProvider) LastReading() powerReading {
+	return mp.last
+}
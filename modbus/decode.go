@@ -0,0 +1,202 @@
+package solaredge
+
+import (
+	"math"
+	"strconv"
+)
+
+// SunSpec values denoting an unimplemented or unavailable register.
+const (
+	NotImplementedInt16  = -0x8000
+	NotImplementedUint16 = 0xFFFF
+	NotImplementedInt32  = -0x80000000
+	NotImplementedAcc32  = 0 // accumulators start at 1
+)
+
+// Value is a register value decoded to a float. Valid is false if the device
+// reported the register or its scale factor as not implemented.
+type Value struct {
+	Value float64
+	Valid bool
+}
+
+func (v Value) String() string {
+	if !v.Valid {
+		return "invalid"
+	}
+
+	return strconv.FormatFloat(v.Value, 'f', -1, 64)
+}
+
+// Or returns the value if it is valid and def otherwise.
+func (v Value) Or(def float64) float64 {
+	if !v.Valid {
+		return def
+	}
+
+	return v.Value
+}
+
+// scaled decodes a SunSpec value with its scale factor. Scale factors outside
+// of the range -10 to 10 permitted by SunSpec, including the not implemented
+// value 0x8000, are treated as invalid.
+func scaled[T int16 | uint16 | int32 | uint32](v T, sf int16) Value {
+	switch x := any(v).(type) {
+	case int16:
+		if x == NotImplementedInt16 {
+			return Value{}
+		}
+	case uint16:
+		if x == NotImplementedUint16 {
+			return Value{}
+		}
+	case int32:
+		if x == NotImplementedInt32 {
+			return Value{}
+		}
+	case uint32:
+		if x == NotImplementedAcc32 {
+			return Value{}
+		}
+	}
+	if sf < -10 || sf > 10 {
+		return Value{}
+	}
+
+	return Value{float64(v) * math.Pow(10, float64(sf)), true}
+}
+
+// float decodes a SunSpec float32 value, which is NaN if not implemented.
+func float(v float32) Value {
+	if math.IsNaN(float64(v)) {
+		return Value{}
+	}
+
+	return Value{float64(v), true}
+}
+
+// Inverter is the decoded view of an InverterModel.
+type Inverter struct {
+	ACCurrent, ACCurrentA, ACCurrentB, ACCurrentC Value // A
+	ACVoltageAB, ACVoltageBC, ACVoltageCA         Value // V
+	ACVoltageAN, ACVoltageBN, ACVoltageCN         Value // V
+	ACPower                                       Value // W
+	ACFrequency                                   Value // Hz
+	ACApparentPower                               Value // VA
+	ACReactivePower                               Value // var
+	ACPowerFactor                                 Value // %
+	ACEnergy                                      Value // lifetime production [Wh]
+	DCCurrent                                     Value // A
+	DCVoltage                                     Value // V
+	DCPower                                       Value // W
+	HeatSinkTemperature                           Value // °C
+	Status                                        uint16
+}
+
+// Decode applies the scale factors of the inverter registers.
+func (im InverterModel) Decode() Inverter {
+	return Inverter{
+		ACCurrent:           scaled(im.AC_Current, im.AC_Current_SF),
+		ACCurrentA:          scaled(im.AC_CurrentA, im.AC_Current_SF),
+		ACCurrentB:          scaled(im.AC_CurrentB, im.AC_Current_SF),
+		ACCurrentC:          scaled(im.AC_CurrentC, im.AC_Current_SF),
+		ACVoltageAB:         scaled(im.AC_VoltageAB, im.AC_Voltage_SF),
+		ACVoltageBC:         scaled(im.AC_VoltageBC, im.AC_Voltage_SF),
+		ACVoltageCA:         scaled(im.AC_VoltageCA, im.AC_Voltage_SF),
+		ACVoltageAN:         scaled(im.AC_VoltageAN, im.AC_Voltage_SF),
+		ACVoltageBN:         scaled(im.AC_VoltageBN, im.AC_Voltage_SF),
+		ACVoltageCN:         scaled(im.AC_VoltageCN, im.AC_Voltage_SF),
+		ACPower:             scaled(im.AC_Power, im.AC_Power_SF),
+		ACFrequency:         scaled(im.AC_Frequency, im.AC_Frequency_SF),
+		ACApparentPower:     scaled(im.AC_VA, im.AC_VA_SF),
+		ACReactivePower:     scaled(im.AC_VAR, im.AC_VAR_SF),
+		ACPowerFactor:       scaled(im.AC_PF, im.AC_PF_SF),
+		ACEnergy:            scaled(im.AC_Energy_WH, im.AC_Energy_WH_SF),
+		DCCurrent:           scaled(im.DC_Current, im.DC_Current_SF),
+		DCVoltage:           scaled(im.DC_Voltage, im.DC_Voltage_SF),
+		DCPower:             scaled(im.DC_Power, im.DC_Power_SF),
+		HeatSinkTemperature: scaled(im.Temp_Sink, im.Temp_SF),
+		Status:              im.Status,
+	}
+}
+
+// Meter is the decoded view of a MeterModel. Positive power values denote an
+// export to the grid.
+type Meter struct {
+	Current, CurrentA, CurrentB, CurrentC                 Value // A
+	VoltageLN, VoltageAN, VoltageBN, VoltageCN            Value // V
+	VoltageLL, VoltageAB, VoltageBC, VoltageCA            Value // V
+	Frequency                                             Value // Hz
+	Power, PowerA, PowerB, PowerC                         Value // W
+	ApparentPower, ApparentPowerA, ApparentPowerB         Value // VA
+	ApparentPowerC                                        Value // VA
+	ReactivePower, ReactivePowerA, ReactivePowerB         Value // var
+	ReactivePowerC                                        Value // var
+	PowerFactor, PowerFactorA, PowerFactorB, PowerFactorC Value // %
+	Exported, Imported                                    Value // lifetime energy [Wh]
+}
+
+// Decode applies the scale factors of the meter registers.
+func (mm MeterModel) Decode() Meter {
+	return Meter{
+		Current:        scaled(mm.M_AC_Current, mm.M_AC_Current_SF),
+		CurrentA:       scaled(mm.M_AC_CurrentA, mm.M_AC_Current_SF),
+		CurrentB:       scaled(mm.M_AC_CurrentB, mm.M_AC_Current_SF),
+		CurrentC:       scaled(mm.M_AC_CurrentC, mm.M_AC_Current_SF),
+		VoltageLN:      scaled(mm.M_AC_VoltageLN, mm.M_AC_Voltage_SF),
+		VoltageAN:      scaled(mm.M_AC_VoltageAN, mm.M_AC_Voltage_SF),
+		VoltageBN:      scaled(mm.M_AC_VoltageBN, mm.M_AC_Voltage_SF),
+		VoltageCN:      scaled(mm.M_AC_VoltageCN, mm.M_AC_Voltage_SF),
+		VoltageLL:      scaled(mm.M_AC_VoltageLL, mm.M_AC_Voltage_SF),
+		VoltageAB:      scaled(mm.M_AC_VoltageAB, mm.M_AC_Voltage_SF),
+		VoltageBC:      scaled(mm.M_AC_VoltageBC, mm.M_AC_Voltage_SF),
+		VoltageCA:      scaled(mm.M_AC_VoltageCA, mm.M_AC_Voltage_SF),
+		Frequency:      scaled(mm.M_AC_Frequency, mm.M_AC_Frequency_SF),
+		Power:          scaled(mm.M_AC_Power, mm.M_AC_Power_SF),
+		PowerA:         scaled(mm.M_AC_Power_A, mm.M_AC_Power_SF),
+		PowerB:         scaled(mm.M_AC_Power_B, mm.M_AC_Power_SF),
+		PowerC:         scaled(mm.M_AC_Power_C, mm.M_AC_Power_SF),
+		ApparentPower:  scaled(mm.M_AC_VA, mm.M_AC_VA_SF),
+		ApparentPowerA: scaled(mm.M_AC_VA_A, mm.M_AC_VA_SF),
+		ApparentPowerB: scaled(mm.M_AC_VA_B, mm.M_AC_VA_SF),
+		ApparentPowerC: scaled(mm.M_AC_VA_C, mm.M_AC_VA_SF),
+		ReactivePower:  scaled(mm.M_AC_VAR, mm.M_AC_VAR_SF),
+		ReactivePowerA: scaled(mm.M_AC_VAR_A, mm.M_AC_VAR_SF),
+		ReactivePowerB: scaled(mm.M_AC_VAR_B, mm.M_AC_VAR_SF),
+		ReactivePowerC: scaled(mm.M_AC_VAR_C, mm.M_AC_VAR_SF),
+		PowerFactor:    scaled(mm.M_AC_PF, mm.M_AC_PF_SF),
+		PowerFactorA:   scaled(mm.M_AC_PF_A, mm.M_AC_PF_SF),
+		PowerFactorB:   scaled(mm.M_AC_PF_B, mm.M_AC_PF_SF),
+		PowerFactorC:   scaled(mm.M_AC_PF_C, mm.M_AC_PF_SF),
+		Exported:       scaled(mm.M_Exported, mm.M_Energy_W_SF),
+		Imported:       scaled(mm.M_Imported, mm.M_Energy_W_SF),
+	}
+}
+
+// Battery is the decoded view of a BatteryModel. Positive power values
+// denote charging.
+type Battery struct {
+	AverageTemperature, MaximumTemperature Value // °C
+	Voltage                                Value // V
+	Current                                Value // A
+	Power                                  Value // W
+	MaximumEnergy, AvailableEnergy         Value // Wh
+	StateOfHealth, StateOfEnergy           Value // %
+	Status                                 uint32
+}
+
+// Decode checks the battery registers for unavailable values.
+func (bm BatteryModel) Decode() Battery {
+	return Battery{
+		AverageTemperature: float(bm.AverageTemperature),
+		MaximumTemperature: float(bm.MaximumTemperature),
+		Voltage:            float(bm.InstantaneousVoltage),
+		Current:            float(bm.InstantaneousCurrent),
+		Power:              float(bm.InstantaneousPower),
+		MaximumEnergy:      float(bm.MaximumEnergy),
+		AvailableEnergy:    float(bm.AvailableEnergy),
+		StateOfHealth:      float(bm.SoH),
+		StateOfEnergy:      float(bm.SoE),
+		Status:             bm.Status,
+	}
+}
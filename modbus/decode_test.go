@@ -0,0 +1,56 @@
+package solaredge
+
+import (
+	"math"
+	"testing"
+)
+
+func TestScaled(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		got  Value
+		want Value
+	}{
+		{"int16", scaled(int16(-1234), -1), Value{-123.4, true}},
+		{"uint16", scaled(uint16(5000), -2), Value{50, true}},
+		{"int32", scaled(int32(12), 3), Value{12000, true}},
+		{"acc32", scaled(uint32(123456), 0), Value{123456, true}},
+		{"int16 not implemented", scaled(int16(NotImplementedInt16), 0), Value{}},
+		{"uint16 not implemented", scaled(uint16(NotImplementedUint16), 0), Value{}},
+		{"int32 not implemented", scaled(int32(NotImplementedInt32), 0), Value{}},
+		{"acc32 not implemented", scaled(uint32(NotImplementedAcc32), 0), Value{}},
+		{"scale factor not implemented", scaled(int16(100), -0x8000), Value{}},
+		{"scale factor out of range", scaled(int16(100), 11), Value{}},
+		{"float", float(1500), Value{1500, true}},
+		{"float not implemented", float(float32(math.NaN())), Value{}},
+	} {
+		if math.Abs(tt.got.Value-tt.want.Value) > 1e-9 || tt.got.Valid != tt.want.Valid {
+			t.Errorf("%s: got %+v, want %+v", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	inverter := InverterModel{
+		AC_Power: 4500, AC_Power_SF: 0,
+		AC_Energy_WH: 1234, AC_Energy_WH_SF: 3,
+		DC_Power: -0x8000, DC_Power_SF: -0x8000,
+		Status: I_STATUS_MPPT,
+	}.Decode()
+	if inverter.ACPower != (Value{4500, true}) || inverter.ACEnergy != (Value{1234000, true}) || inverter.DCPower.Valid || inverter.Status != I_STATUS_MPPT {
+		t.Errorf("unexpected inverter %+v", inverter)
+	}
+
+	meter := MeterModel{M_AC_Power: -250, M_AC_Power_SF: 1, M_AC_VA: -0x8000, M_Exported: 0, M_Imported: 42}.Decode()
+	if meter.Power != (Value{-2500, true}) || meter.ApparentPower.Valid || meter.Exported.Valid || meter.Imported != (Value{42, true}) {
+		t.Errorf("unexpected meter %+v", meter)
+	}
+
+	battery := BatteryModel{InstantaneousPower: float32(math.NaN()), SoE: 55}.Decode()
+	if battery.Power.Valid || battery.StateOfEnergy != (Value{55, true}) {
+		t.Errorf("unexpected battery %+v", battery)
+	}
+	if got := battery.Power.String(); got != "invalid" {
+		t.Errorf("String() = %q, want invalid", got)
+	}
+}
@@ -0,0 +1,142 @@
+package simulator
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+// Sample describes the power flows of the simulated site at one point in time.
+type Sample struct {
+	Production  float64 `json:"production"`  // PV (DC) power [W]
+	Consumption float64 `json:"consumption"` // household consumption [W]
+	Battery     float64 `json:"battery"`     // battery charging power [W], negative when discharging
+}
+
+// Profile provides the power flows of the simulated site.
+type Profile interface {
+	// At returns the sample for the given time since the start of the simulation.
+	At(elapsed time.Duration) Sample
+}
+
+// ProfileFunc adapts an ordinary function to the Profile interface.
+type ProfileFunc func(elapsed time.Duration) Sample
+
+func (f ProfileFunc) At(elapsed time.Duration) Sample {
+	return f(elapsed)
+}
+
+// Step is a sample which is held for the given number of seconds.
+type Step struct {
+	Sample
+	Duration int `json:"duration"`
+}
+
+// ScriptedProfile replays a list of steps. The script restarts from the
+// beginning after the last step.
+type ScriptedProfile []Step
+
+// LoadProfile reads a scripted profile from a JSON file containing an array
+// of steps.
+func LoadProfile(name string) (ScriptedProfile, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var p ScriptedProfile
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("error parsing profile %s: %v", name, err)
+	}
+	if err := p.validate(); err != nil {
+		return nil, fmt.Errorf("invalid profile %s: %v", name, err)
+	}
+
+	return p, nil
+}
+
+func (p ScriptedProfile) validate() error {
+	if len(p) == 0 {
+		return fmt.Errorf("no steps")
+	}
+	for i, s := range p {
+		if s.Duration <= 0 {
+			return fmt.Errorf("step %d: duration must be positive", i)
+		}
+	}
+
+	return nil
+}
+
+func (p ScriptedProfile) At(elapsed time.Duration) Sample {
+	var total time.Duration
+	for _, s := range p {
+		total += time.Duration(s.Duration) * time.Second
+	}
+	if total <= 0 {
+		return Sample{}
+	}
+
+	elapsed %= total
+	for _, s := range p {
+		d := time.Duration(s.Duration) * time.Second
+		if elapsed < d {
+			return s.Sample
+		}
+		elapsed -= d
+	}
+
+	return p[len(p)-1].Sample
+}
+
+// RandomProfile simulates passing clouds and appliances switching on and off
+// using a random walk which advances once per second.
+type RandomProfile struct {
+	Peak      float64 // maximum PV power [W]
+	BaseLoad  float64 // minimum household consumption [W]
+	MaxCharge float64 // maximum battery charging and discharging power [W], 0 without a battery
+
+	mu      sync.Mutex
+	rnd     *rand.Rand
+	elapsed time.Duration
+	current Sample
+}
+
+// NewRandomProfile creates a randomized profile using the given seed.
+func NewRandomProfile(peak, baseLoad, maxCharge float64, seed int64) *RandomProfile {
+	return &RandomProfile{
+		Peak:      peak,
+		BaseLoad:  baseLoad,
+		MaxCharge: maxCharge,
+		rnd:       rand.New(rand.NewSource(seed)),
+		current:   Sample{Production: peak / 2, Consumption: baseLoad},
+	}
+}
+
+func (p *RandomProfile) At(elapsed time.Duration) Sample {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for ; p.elapsed < elapsed; p.elapsed += time.Second {
+		p.step()
+	}
+
+	return p.current
+}
+
+func (p *RandomProfile) step() {
+	s := &p.current
+	s.Production = math.Max(0, math.Min(p.Peak, s.Production+p.rnd.NormFloat64()*p.Peak*0.05))
+
+	// appliances occasionally switch on or off
+	if p.rnd.Float64() < 0.02 {
+		s.Consumption = p.BaseLoad + p.rnd.Float64()*p.Peak/2
+	}
+
+	// the battery absorbs the surplus and covers the deficit
+	s.Battery = math.Max(-p.MaxCharge, math.Min(p.MaxCharge, s.Production*Efficiency-s.Consumption))
+}
@@ -0,0 +1,394 @@
+// Package simulator serves the SunSpec register layout of a SolarEdge
+// inverter with an optional meter and battery over Modbus TCP. It allows
+// running mielesolar without access to a real inverter.
+package simulator
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	solaredge "github.com/ingmarstein/mielesolar/modbus"
+	"github.com/simonvetter/modbus"
+)
+
+const (
+	// Efficiency is the DC to AC conversion efficiency of the simulated inverter.
+	Efficiency = 0.97
+
+	meterSlots   = 3
+	batterySlots = 2
+	gridVoltage  = 230
+	endModel     = 0xFFFF // ID marking the end of the SunSpec model chain
+)
+
+// Config describes the simulated site.
+type Config struct {
+	UnitID           uint8   // Modbus unit ID of the inverter, defaults to 1
+	Meter            bool    // whether a meter is connected to the inverter
+	ConsumptionMeter bool    // whether a consumption meter precedes the export+import meter
+	Battery          bool    // whether a battery is connected to the inverter
+	Batteries        int     // number of batteries sharing the battery power, defaults to 1
+	BatteryCapacity  float64 // rated energy of each battery [Wh], defaults to 10 kWh
+}
+
+// Simulator implements a Modbus request handler serving the inverter, meter
+// and battery models defined in package solaredge.
+type Simulator struct {
+	config  Config
+	profile Profile
+	start   time.Time
+
+	mu      sync.Mutex
+	server  *modbus.ModbusServer
+	updated time.Time
+	energy  float64 // energy stored in the battery [Wh]
+}
+
+type region struct {
+	address   uint16
+	registers []uint16
+}
+
+// New creates a simulator driven by the given profile.
+func New(config Config, profile Profile) *Simulator {
+	if config.UnitID == 0 {
+		config.UnitID = 1
+	}
+	if config.BatteryCapacity <= 0 {
+		config.BatteryCapacity = 10000
+	}
+	config.Batteries = max(1, min(config.Batteries, batterySlots))
+
+	return &Simulator{
+		config:  config,
+		profile: profile,
+		start:   time.Now(),
+		energy:  config.BatteryCapacity * float64(config.Batteries) / 2,
+	}
+}
+
+// Start listens for Modbus TCP connections on address, e.g. "localhost:1502".
+func (s *Simulator) Start(address string) error {
+	server, err := modbus.NewServer(&modbus.ServerConfiguration{
+		URL:        "tcp://" + address,
+		Timeout:    time.Minute,
+		MaxClients: 10,
+	}, s)
+	if err != nil {
+		return fmt.Errorf("error creating server: %v", err)
+	}
+	if err := server.Start(); err != nil {
+		return fmt.Errorf("error starting server: %v", err)
+	}
+
+	s.mu.Lock()
+	s.server = server
+	s.mu.Unlock()
+
+	return nil
+}
+
+// Stop closes the listener and all client connections.
+func (s *Simulator) Stop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.server == nil {
+		return nil
+	}
+	err := s.server.Stop()
+	s.server = nil
+
+	return err
+}
+
+// Sample returns the current power flows of the simulated site.
+func (s *Simulator) Sample() Sample {
+	sample := s.profile.At(time.Since(s.start))
+	if !s.config.Battery {
+		sample.Battery = 0
+	}
+
+	return sample
+}
+
+func (s *Simulator) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest) ([]uint16, error) {
+	if req.UnitId != s.config.UnitID {
+		return nil, modbus.ErrGWTargetFailedToRespond
+	}
+	if req.IsWrite {
+		return nil, modbus.ErrIllegalFunction
+	}
+
+	for _, r := range s.regions() {
+		if req.Addr >= r.address && int(req.Addr)+int(req.Quantity) <= int(r.address)+len(r.registers) {
+			offset := int(req.Addr - r.address)
+			return r.registers[offset : offset+int(req.Quantity)], nil
+		}
+	}
+
+	return nil, modbus.ErrIllegalDataAddress
+}
+
+func (s *Simulator) HandleCoils(*modbus.CoilsRequest) ([]bool, error) {
+	return nil, modbus.ErrIllegalFunction
+}
+
+func (s *Simulator) HandleDiscreteInputs(*modbus.DiscreteInputsRequest) ([]bool, error) {
+	return nil, modbus.ErrIllegalFunction
+}
+
+func (s *Simulator) HandleInputRegisters(*modbus.InputRegistersRequest) ([]uint16, error) {
+	return nil, modbus.ErrIllegalFunction
+}
+
+// regions encodes the models for the current sample.
+func (s *Simulator) regions() []region {
+	sample := s.Sample()
+	soe := s.updateEnergy(sample.Battery)
+
+	// the inverter and meter regions are padded to the lengths announced in
+	// the SunSpec model headers
+	var meter solaredge.MeterModel
+	regions := []region{pad(encode(s.inverter(sample)), meter.BaseAddress()-solaredge.InverterModel{}.BaseAddress())}
+	var meters []solaredge.MeterModel
+	if s.config.ConsumptionMeter {
+		meters = append(meters, s.consumptionMeter(sample))
+	}
+	if s.config.Meter {
+		meters = append(meters, s.meter(sample))
+	}
+	for i := 0; i < meterSlots; i++ {
+		m := solaredge.MeterModel{C_DeviceAddress: solaredge.MeterAbsent}
+		switch {
+		case i < len(meters):
+			m = meters[i]
+			m.C_DeviceAddress = uint16(2 + i)
+		case i == len(meters):
+			m.C_SunSpec_DID = endModel
+		}
+		regions = append(regions, pad(encodeAt(m, i), m.Stride()))
+	}
+	if len(meters) == meterSlots {
+		regions = append(regions, region{uint16(meter.BaseAddress() + meterSlots*meter.Stride()), []uint16{endModel, 0}})
+	}
+	for i := 0; i < batterySlots; i++ {
+		info := solaredge.BatteryInfoModel{C_DeviceAddress: solaredge.BatteryAbsent}
+		var battery solaredge.BatteryModel
+		if s.config.Battery && i < s.config.Batteries {
+			info = s.batteryInfo(i)
+			battery = s.battery(sample.Battery/float64(s.config.Batteries), soe)
+		}
+		regions = append(regions, encodeAt(info, i), encodeAt(battery, i))
+	}
+
+	return regions
+}
+
+// updateEnergy integrates the battery power and returns the state of energy.
+func (s *Simulator) updateEnergy(power float64) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	capacity := s.config.BatteryCapacity * float64(s.config.Batteries)
+	if !s.updated.IsZero() {
+		s.energy += power * now.Sub(s.updated).Hours()
+		s.energy = math.Max(0, math.Min(capacity, s.energy))
+	}
+	s.updated = now
+
+	return s.energy / capacity
+}
+
+// acPower returns the AC power of the inverter.
+func acPower(sample Sample) float64 {
+	return sample.Production*Efficiency - sample.Battery
+}
+
+// scale returns v as a SunSpec value and scale factor using the highest
+// precision which fits into an int16.
+func scale(v float64) (int16, int16) {
+	sf := int16(-2)
+	for math.Abs(math.Round(v/math.Pow10(int(sf)))) > math.MaxInt16 {
+		sf++
+	}
+
+	return scaleTo(v, sf), sf
+}
+
+func setString(dst []byte, s string) {
+	copy(dst, s)
+}
+
+func (s *Simulator) inverter(sample Sample) solaredge.InverterModel {
+	m := solaredge.InverterModel{
+		C_SunSpec_ID:     [4]byte{'S', 'u', 'n', 'S'},
+		C_SunSpec_DID:    1,
+		C_SunSpec_Length: 65,
+		C_DeviceAddress:  uint16(s.config.UnitID),
+		SunSpec_DID:      103,
+		SunSpec_Length:   50,
+		AC_VoltageAN:     gridVoltage * 10,
+		AC_VoltageBN:     gridVoltage * 10,
+		AC_VoltageCN:     gridVoltage * 10,
+		AC_Voltage_SF:    -1,
+		AC_Frequency:     5000,
+		AC_Frequency_SF:  -2,
+		DC_Voltage:       7500,
+		DC_Voltage_SF:    -1,
+		Temp_Cabinet:     4200,
+		Temp_SF:          -2,
+		Status:           solaredge.I_STATUS_SLEEPING,
+	}
+	setString(m.C_Manufacturer[:], "SolarEdge")
+	setString(m.C_Model[:], "SE10K-SIM")
+	setString(m.C_Version[:], "0004.0020.0036")
+	setString(m.C_SerialNumber[:], "SIM00000001")
+
+	ac := acPower(sample)
+	if sample.Production > 0 {
+		m.Status = solaredge.I_STATUS_MPPT
+	}
+	m.AC_Power, m.AC_Power_SF = scale(ac)
+	m.AC_VA, m.AC_VA_SF = scale(math.Abs(ac))
+	m.DC_Power, m.DC_Power_SF = scale(sample.Production)
+	current := math.Abs(ac) / gridVoltage
+	m.AC_Current = uint16(math.Round(current * 100))
+	m.AC_CurrentA = uint16(math.Round(current / 3 * 100))
+	m.AC_CurrentB, m.AC_CurrentC = m.AC_CurrentA, m.AC_CurrentA
+	m.AC_Current_SF = -2
+	m.DC_Current = uint16(math.Round(sample.Production / 750 * 100))
+	m.DC_Current_SF = -2
+
+	return m
+}
+
+func (s *Simulator) meter(sample Sample) solaredge.MeterModel {
+	m := solaredge.MeterModel{
+		C_SunSpec_DID:     1,
+		C_SunSpec_Length:  65,
+		SunSpec_DID:       203,
+		SunSpec_Length:    105,
+		M_AC_VoltageLN:    gridVoltage * 10,
+		M_AC_VoltageAN:    gridVoltage * 10,
+		M_AC_VoltageBN:    gridVoltage * 10,
+		M_AC_VoltageCN:    gridVoltage * 10,
+		M_AC_Voltage_SF:   -1,
+		M_AC_Frequency:    5000,
+		M_AC_Frequency_SF: -2,
+	}
+	setString(m.C_Manufacturer[:], "WattNode")
+	setString(m.C_Model[:], "WNC-3Y-400-MB")
+	setString(m.C_Option[:], "Export+Import")
+	setString(m.C_Version[:], "31")
+	setString(m.C_SerialNumber[:], "SIM00000002")
+
+	// positive values indicate export to the grid
+	power := acPower(sample) - sample.Consumption
+	m.M_AC_Power, m.M_AC_Power_SF = scale(power)
+	m.M_AC_Power_A = scaleTo(power/3, m.M_AC_Power_SF)
+	m.M_AC_Power_B, m.M_AC_Power_C = m.M_AC_Power_A, m.M_AC_Power_A
+	m.M_AC_Current = uint16(math.Round(math.Abs(power) / gridVoltage * 100))
+	m.M_AC_Current_SF = -2
+
+	return m
+}
+
+// consumptionMeter returns a meter measuring the household consumption.
+func (s *Simulator) consumptionMeter(sample Sample) solaredge.MeterModel {
+	m := s.meter(sample)
+	m.C_Option = [16]byte{}
+	setString(m.C_Option[:], "Consumption")
+	setString(m.C_SerialNumber[:], "SIM00000004")
+
+	m.M_AC_Power, m.M_AC_Power_SF = scale(sample.Consumption)
+	m.M_AC_Power_A = scaleTo(sample.Consumption/3, m.M_AC_Power_SF)
+	m.M_AC_Power_B, m.M_AC_Power_C = m.M_AC_Power_A, m.M_AC_Power_A
+	m.M_AC_Current = uint16(math.Round(sample.Consumption / gridVoltage * 100))
+
+	return m
+}
+
+// scaleTo returns v as a SunSpec value using the given scale factor.
+func scaleTo(v float64, sf int16) int16 {
+	return int16(math.Round(v / math.Pow10(int(sf))))
+}
+
+func (s *Simulator) batteryInfo(index int) solaredge.BatteryInfoModel {
+	m := solaredge.BatteryInfoModel{
+		C_DeviceAddress:                 uint16(15 + index),
+		C_SunSpec_DID:                   803,
+		RatedEnergy:                     float32(s.config.BatteryCapacity),
+		MaximumChargeContinuousPower:    5000,
+		MaximumDischargeContinuousPower: 5000,
+		MaximumChargePeakPower:          7000,
+		MaximumDischargePeakPower:       7000,
+	}
+	setString(m.C_Manufacturer[:], "LGC")
+	setString(m.C_Model[:], "RESU10H-SIM")
+	setString(m.C_Version[:], "2.0")
+	setString(m.C_SerialNumber[:], fmt.Sprintf("SIM0000001%d", index))
+
+	return m
+}
+
+func (s *Simulator) battery(power float64, soe float64) solaredge.BatteryModel {
+	m := solaredge.BatteryModel{
+		AverageTemperature:   25,
+		MaximumTemperature:   27,
+		InstantaneousVoltage: 400,
+		InstantaneousCurrent: float32(power / 400),
+		InstantaneousPower:   float32(power),
+		MaximumEnergy:        float32(s.config.BatteryCapacity),
+		AvailableEnergy:      float32(soe * s.config.BatteryCapacity),
+		SoH:                  100,
+		SoE:                  float32(soe * 100),
+		Status:               solaredge.B_STATUS_HOLDING,
+	}
+	switch {
+	case power > 0:
+		m.Status = solaredge.B_STATUS_CHARGING
+	case power < 0:
+		m.Status = solaredge.B_STATUS_DISCHARGING
+	}
+
+	return m
+}
+
+// pad extends the region with zeros to n registers.
+func pad(r region, n int) region {
+	if len(r.registers) < n {
+		r.registers = append(r.registers, make([]uint16, n-len(r.registers))...)
+	}
+
+	return r
+}
+
+func encode[M solaredge.Model](m M) region {
+	return encodeAt(m, 0)
+}
+
+// encodeAt encodes the model using the byte and word order of SolarEdge
+// inverters at the address of the given device index.
+func encodeAt[M solaredge.Model](m M, index int) region {
+	var buf bytes.Buffer
+	// writing fixed-size values to a bytes.Buffer cannot fail
+	_ = binary.Write(&buf, solaredge.LittleBigEndian, m)
+
+	data := make([]byte, m.NumRegisters()*2)
+	copy(data, buf.Bytes())
+	registers := make([]uint16, m.NumRegisters())
+	for i := range registers {
+		registers[i] = binary.BigEndian.Uint16(data[2*i:])
+	}
+
+	return region{
+		address:   uint16(m.BaseAddress() + index*m.Stride()),
+		registers: registers,
+	}
+}
@@ -0,0 +1,191 @@
+package simulator
+
+import (
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	solaredge "github.com/ingmarstein/mielesolar/modbus"
+	"github.com/simonvetter/modbus"
+)
+
+func freeAddress(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	return ln.Addr().String()
+}
+
+func startSimulator(t *testing.T, config Config, profile Profile) *modbus.ModbusClient {
+	t.Helper()
+
+	address := freeAddress(t)
+	sim := New(config, profile)
+	if err := sim.Start(address); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = sim.Stop() })
+
+	c, err := modbus.NewClient(&modbus.ClientConfiguration{URL: "tcp://" + address, Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	if err := c.SetUnitId(sim.config.UnitID); err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+func value[T int16 | uint16](v T, sf int16) float64 {
+	return float64(v) * math.Pow10(int(sf))
+}
+
+func TestSimulator(t *testing.T) {
+	sample := Sample{Production: 5000, Consumption: 800, Battery: 1500}
+	c := startSimulator(t, Config{UnitID: 3, Meter: true, Battery: true}, ProfileFunc(func(time.Duration) Sample { return sample }))
+
+	inverter, err := solaredge.ReadInverter(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inverter.Manufacturer() != "SolarEdge" || inverter.C_DeviceAddress != 3 || inverter.Status != solaredge.I_STATUS_MPPT {
+		t.Errorf("unexpected inverter: %s, %d, %d", inverter.Manufacturer(), inverter.C_DeviceAddress, inverter.Status)
+	}
+	if got := value(inverter.DC_Power, inverter.DC_Power_SF); got != 5000 {
+		t.Errorf("DC power = %v, want 5000", got)
+	}
+	if got := value(inverter.AC_Power, inverter.AC_Power_SF); got != 5000*Efficiency-1500 {
+		t.Errorf("AC power = %v, want %v", got, 5000*Efficiency-1500)
+	}
+
+	meter, err := solaredge.ReadMeter(c, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meter.Option() != "Export+Import" {
+		t.Errorf("meter option = %q", meter.Option())
+	}
+	if got := value(meter.M_AC_Power, meter.M_AC_Power_SF); got != 5000*Efficiency-1500-800 {
+		t.Errorf("meter power = %v, want %v", got, 5000*Efficiency-1500-800)
+	}
+	if meter, err := solaredge.ReadMeter(c, 1); err != nil || meter.C_DeviceAddress != 0x8000 {
+		t.Errorf("ReadMeter(1) = %d, %v, want absent meter", meter.C_DeviceAddress, err)
+	}
+
+	info, err := solaredge.ReadBatteryInfo(c, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.C_DeviceAddress == 0xFF || info.RatedEnergy != 10000 {
+		t.Errorf("unexpected battery info: %d, %v", info.C_DeviceAddress, info.RatedEnergy)
+	}
+	battery, err := solaredge.ReadBattery(c, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if battery.InstantaneousPower != 1500 || battery.Status != solaredge.B_STATUS_CHARGING {
+		t.Errorf("unexpected battery: %v W, status %d", battery.InstantaneousPower, battery.Status)
+	}
+	if info, err := solaredge.ReadBatteryInfo(c, 1); err != nil || info.C_DeviceAddress != 0xFF {
+		t.Errorf("ReadBatteryInfo(1) = %d, %v, want absent battery", info.C_DeviceAddress, err)
+	}
+
+	if _, err := c.ReadRegisters(1000, 1, modbus.HOLDING_REGISTER); err == nil {
+		t.Error("expected error reading unmapped registers")
+	}
+	if err := c.WriteRegister(40000, 1); err == nil {
+		t.Error("expected error writing registers")
+	}
+}
+
+func TestSimulatorWithoutMeterAndBattery(t *testing.T) {
+	sample := Sample{Production: 40000, Consumption: 500, Battery: 1000}
+	c := startSimulator(t, Config{}, ProfileFunc(func(time.Duration) Sample { return sample }))
+
+	inverter, err := solaredge.ReadInverter(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the battery power of the profile is ignored without a battery
+	if got := value(inverter.AC_Power, inverter.AC_Power_SF); got != 40000*Efficiency {
+		t.Errorf("AC power = %v, want %v", got, 40000*Efficiency)
+	}
+	if meter, err := solaredge.ReadMeter(c, 0); err != nil || meter.C_DeviceAddress != 0x8000 {
+		t.Errorf("ReadMeter(0) = %d, %v, want absent meter", meter.C_DeviceAddress, err)
+	}
+	if info, err := solaredge.ReadBatteryInfo(c, 0); err != nil || info.C_DeviceAddress != 0xFF {
+		t.Errorf("ReadBatteryInfo(0) = %d, %v, want absent battery", info.C_DeviceAddress, err)
+	}
+
+	if err := c.SetUnitId(2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := solaredge.ReadInverter(c); err == nil {
+		t.Error("expected error for unknown unit ID")
+	}
+}
+
+func TestScriptedProfile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "profile.json")
+	script := `[{"duration":60,"production":1000,"consumption":200},{"duration":30,"production":3000,"consumption":500,"battery":-100}]`
+	if err := os.WriteFile(name, []byte(script), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := LoadProfile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		elapsed time.Duration
+		want    Sample
+	}{
+		{0, Sample{1000, 200, 0}},
+		{59 * time.Second, Sample{1000, 200, 0}},
+		{60 * time.Second, Sample{3000, 500, -100}},
+		{95 * time.Second, Sample{1000, 200, 0}},
+	} {
+		if got := p.At(tt.elapsed); got != tt.want {
+			t.Errorf("At(%v) = %+v, want %+v", tt.elapsed, got, tt.want)
+		}
+	}
+
+	if err := os.WriteFile(name, []byte(`[{"duration":0}]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadProfile(name); err == nil {
+		t.Error("expected error for step without duration")
+	}
+}
+
+func TestRandomProfile(t *testing.T) {
+	p := NewRandomProfile(5000, 300, 2000, 1)
+	for elapsed := time.Duration(0); elapsed < time.Hour; elapsed += time.Minute {
+		s := p.At(elapsed)
+		if s.Production < 0 || s.Production > 5000 || s.Consumption < 300 || math.Abs(s.Battery) > 2000 {
+			t.Fatalf("At(%v) = %+v out of range", elapsed, s)
+		}
+	}
+}
+
+func TestScale(t *testing.T) {
+	for _, v := range []float64{0, 1.25, -800, 32767, 250000, -99999} {
+		value, sf := scale(v)
+		if got := float64(value) * math.Pow10(int(sf)); math.Abs(got-v) > math.Pow10(int(sf)) {
+			t.Errorf("scale(%v) = %d, %d", v, value, sf)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"github.com/simonvetter/modbus"
+	"strings"
 )
 
 const (
@@ -24,6 +25,12 @@ const (
 	B_STATUS_FULL        = 5
 	B_STATUS_HOLDING     = 6
 	B_STATUS_TESTING     = 7
+
+	MaxMeters    = 3 // meters connected to an inverter
+	MaxBatteries = 2 // batteries connected to an inverter
+
+	MeterAbsent   = 0x8000 // C_DeviceAddress of an unused meter slot
+	BatteryAbsent = 0xFF   // C_DeviceAddress of an unused battery slot
 )
 
 func bytesToString(b []byte) string {
@@ -47,7 +54,7 @@ func readModel[M Model](mb *modbus.ModbusClient, index int) (M, error) {
 	address := m.BaseAddress() + index*m.Stride()
 	data, err := mb.ReadBytes(uint16(address), uint16(m.NumRegisters()*2), modbus.HOLDING_REGISTER)
 	if err != nil {
-		return *new(M), fmt.Errorf("error reading %s registers: %v", m.ModelName(), err)
+		return *new(M), fmt.Errorf("error reading %s registers: %w", m.ModelName(), err)
 	}
 
 	if len(data) != m.NumRegisters()*2 {
@@ -66,7 +73,7 @@ func readModel[M Model](mb *modbus.ModbusClient, index int) (M, error) {
 // from the implementation technical note:
 // https://www.solaredge.com/sites/default/files/sunspec-implementation-technical-note.pdf
 type InverterModel struct {
-	C_SunSpec_ID     uint32
+	C_SunSpec_ID     [4]byte // "SunS"
 	C_SunSpec_DID    uint16
 	C_SunSpec_Length uint16
 	C_Manufacturer   [32]byte
@@ -99,8 +106,8 @@ type InverterModel struct {
 	AC_VAR_SF        int16
 	AC_PF            int16
 	AC_PF_SF         int16
-	AC_Energy_WH     int32
-	AC_Energy_WH_SF  uint16
+	AC_Energy_WH     uint32 // acc32
+	AC_Energy_WH_SF  int16
 	DC_Current       uint16
 	DC_Current_SF    int16
 	DC_Voltage       uint16
@@ -191,20 +198,20 @@ type MeterModel struct {
 	M_AC_Power_B  int16
 	M_AC_Power_C  int16
 	M_AC_Power_SF int16
-	M_AC_VA       uint16
-	M_AC_VA_A     uint16
-	M_AC_VA_B     uint16
-	M_AC_VA_C     uint16
+	M_AC_VA       int16
+	M_AC_VA_A     int16
+	M_AC_VA_B     int16
+	M_AC_VA_C     int16
 	M_AC_VA_SF    int16
-	M_AC_VAR      uint16
-	M_AC_VAR_A    uint16
-	M_AC_VAR_B    uint16
-	M_AC_VAR_C    uint16
+	M_AC_VAR      int16
+	M_AC_VAR_A    int16
+	M_AC_VAR_B    int16
+	M_AC_VAR_C    int16
 	M_AC_VAR_SF   int16
-	M_AC_PF       uint16
-	M_AC_PF_A     uint16
-	M_AC_PF_B     uint16
-	M_AC_PF_C     uint16
+	M_AC_PF       int16
+	M_AC_PF_A     int16
+	M_AC_PF_B     int16
+	M_AC_PF_C     int16
 	M_AC_PF_SF    int16
 
 	// Accumulated Energy
@@ -255,6 +262,24 @@ func (mm MeterModel) SerialNumber() string {
 	return bytesToString(mm.C_SerialNumber[:])
 }
 
+// Present reports whether a meter is connected in this slot. Besides the
+// device address, the SunSpec DID must denote a single, split or three
+// phase meter (201-204, or 211-214 for the float variants).
+func (mm MeterModel) Present() bool {
+	if mm.C_DeviceAddress == MeterAbsent {
+		return false
+	}
+
+	return mm.SunSpec_DID >= 201 && mm.SunSpec_DID <= 204 || mm.SunSpec_DID >= 211 && mm.SunSpec_DID <= 214
+}
+
+// IsGridMeter reports whether the meter measures the export to and import
+// from the grid, as opposed to e.g. a consumption or production meter.
+func (mm MeterModel) IsGridMeter() bool {
+	option := strings.ToLower(mm.Option())
+	return strings.Contains(option, "export") && strings.Contains(option, "import")
+}
+
 type BatteryInfoModel struct {
 	C_Manufacturer  [32]byte
 	C_Model         [32]byte
@@ -330,6 +355,11 @@ func (bim BatteryInfoModel) SerialNumber() string {
 	return bytesToString(bim.C_SerialNumber[:])
 }
 
+// Present reports whether a battery is connected in this slot.
+func (bim BatteryInfoModel) Present() bool {
+	return bim.C_DeviceAddress != BatteryAbsent
+}
+
 func (BatteryInfoModel) NumRegisters() int {
 	return 76
 }
@@ -0,0 +1,253 @@
+package sunspec
+
+// Model IDs of the SunSpec information models known to this package.
+const (
+	ModelCommon = 1
+
+	ModelInverterSinglePhase      = 101
+	ModelInverterSplitPhase       = 102
+	ModelInverterThreePhase       = 103
+	ModelInverterSinglePhaseFloat = 111
+	ModelInverterSplitPhaseFloat  = 112
+	ModelInverterThreePhaseFloat  = 113
+
+	ModelMeterSinglePhase      = 201
+	ModelMeterSplitPhase       = 202
+	ModelMeterThreePhaseWye    = 203
+	ModelMeterThreePhaseDelta  = 204
+	ModelStorage               = 124
+	ModelLithiumIonBatteryBank = 802
+
+	ModelEnd = 0xFFFF // marks the end of the model chain
+)
+
+// Model IDs grouped by function.
+var (
+	InverterModels = []uint16{
+		ModelInverterSinglePhase, ModelInverterSplitPhase, ModelInverterThreePhase,
+		ModelInverterSinglePhaseFloat, ModelInverterSplitPhaseFloat, ModelInverterThreePhaseFloat,
+	}
+	MeterModels   = []uint16{ModelMeterSinglePhase, ModelMeterSplitPhase, ModelMeterThreePhaseWye, ModelMeterThreePhaseDelta}
+	StorageModels = []uint16{ModelStorage, ModelLithiumIonBatteryBank}
+)
+
+// Inverter operating states (point St of the inverter models).
+const (
+	StateOff          = 1
+	StateSleeping     = 2
+	StateStarting     = 3
+	StateMPPT         = 4
+	StateThrottled    = 5
+	StateShuttingDown = 6
+	StateFault        = 7
+	StateStandby      = 8
+)
+
+var commonModel = []Point{
+	{Name: "Mn", Offset: 0, Type: String, Size: 16},
+	{Name: "Md", Offset: 16, Type: String, Size: 16},
+	{Name: "Opt", Offset: 32, Type: String, Size: 8},
+	{Name: "Vr", Offset: 40, Type: String, Size: 8},
+	{Name: "SN", Offset: 48, Type: String, Size: 16},
+	{Name: "DA", Offset: 64, Type: Uint16},
+}
+
+// integerInverterModel lists the points of the inverter models 101-103.
+var integerInverterModel = []Point{
+	{Name: "A", Offset: 0, Type: Uint16, SF: "A_SF", Units: "A"},
+	{Name: "AphA", Offset: 1, Type: Uint16, SF: "A_SF", Units: "A"},
+	{Name: "AphB", Offset: 2, Type: Uint16, SF: "A_SF", Units: "A"},
+	{Name: "AphC", Offset: 3, Type: Uint16, SF: "A_SF", Units: "A"},
+	{Name: "A_SF", Offset: 4, Type: ScaleFactor},
+	{Name: "PPVphAB", Offset: 5, Type: Uint16, SF: "V_SF", Units: "V"},
+	{Name: "PPVphBC", Offset: 6, Type: Uint16, SF: "V_SF", Units: "V"},
+	{Name: "PPVphCA", Offset: 7, Type: Uint16, SF: "V_SF", Units: "V"},
+	{Name: "PhVphA", Offset: 8, Type: Uint16, SF: "V_SF", Units: "V"},
+	{Name: "PhVphB", Offset: 9, Type: Uint16, SF: "V_SF", Units: "V"},
+	{Name: "PhVphC", Offset: 10, Type: Uint16, SF: "V_SF", Units: "V"},
+	{Name: "V_SF", Offset: 11, Type: ScaleFactor},
+	{Name: "W", Offset: 12, Type: Int16, SF: "W_SF", Units: "W"},
+	{Name: "W_SF", Offset: 13, Type: ScaleFactor},
+	{Name: "Hz", Offset: 14, Type: Uint16, SF: "Hz_SF", Units: "Hz"},
+	{Name: "Hz_SF", Offset: 15, Type: ScaleFactor},
+	{Name: "VA", Offset: 16, Type: Int16, SF: "VA_SF", Units: "VA"},
+	{Name: "VA_SF", Offset: 17, Type: ScaleFactor},
+	{Name: "VAr", Offset: 18, Type: Int16, SF: "VAr_SF", Units: "var"},
+	{Name: "VAr_SF", Offset: 19, Type: ScaleFactor},
+	{Name: "PF", Offset: 20, Type: Int16, SF: "PF_SF", Units: "%"},
+	{Name: "PF_SF", Offset: 21, Type: ScaleFactor},
+	{Name: "WH", Offset: 22, Type: Acc32, SF: "WH_SF", Units: "Wh"},
+	{Name: "WH_SF", Offset: 24, Type: ScaleFactor},
+	{Name: "DCA", Offset: 25, Type: Uint16, SF: "DCA_SF", Units: "A"},
+	{Name: "DCA_SF", Offset: 26, Type: ScaleFactor},
+	{Name: "DCV", Offset: 27, Type: Uint16, SF: "DCV_SF", Units: "V"},
+	{Name: "DCV_SF", Offset: 28, Type: ScaleFactor},
+	{Name: "DCW", Offset: 29, Type: Int16, SF: "DCW_SF", Units: "W"},
+	{Name: "DCW_SF", Offset: 30, Type: ScaleFactor},
+	{Name: "TmpCab", Offset: 31, Type: Int16, SF: "Tmp_SF", Units: "C"},
+	{Name: "TmpSnk", Offset: 32, Type: Int16, SF: "Tmp_SF", Units: "C"},
+	{Name: "TmpTrns", Offset: 33, Type: Int16, SF: "Tmp_SF", Units: "C"},
+	{Name: "TmpOt", Offset: 34, Type: Int16, SF: "Tmp_SF", Units: "C"},
+	{Name: "Tmp_SF", Offset: 35, Type: ScaleFactor},
+	{Name: "St", Offset: 36, Type: Enum16},
+	{Name: "StVnd", Offset: 37, Type: Enum16},
+	{Name: "Evt1", Offset: 38, Type: Bitfield32},
+	{Name: "Evt2", Offset: 40, Type: Bitfield32},
+}
+
+// floatInverterModel lists the points of the inverter models 111-113.
+var floatInverterModel = []Point{
+	{Name: "A", Offset: 0, Type: Float32, Units: "A"},
+	{Name: "AphA", Offset: 2, Type: Float32, Units: "A"},
+	{Name: "AphB", Offset: 4, Type: Float32, Units: "A"},
+	{Name: "AphC", Offset: 6, Type: Float32, Units: "A"},
+	{Name: "PPVphAB", Offset: 8, Type: Float32, Units: "V"},
+	{Name: "PPVphBC", Offset: 10, Type: Float32, Units: "V"},
+	{Name: "PPVphCA", Offset: 12, Type: Float32, Units: "V"},
+	{Name: "PhVphA", Offset: 14, Type: Float32, Units: "V"},
+	{Name: "PhVphB", Offset: 16, Type: Float32, Units: "V"},
+	{Name: "PhVphC", Offset: 18, Type: Float32, Units: "V"},
+	{Name: "W", Offset: 20, Type: Float32, Units: "W"},
+	{Name: "Hz", Offset: 22, Type: Float32, Units: "Hz"},
+	{Name: "VA", Offset: 24, Type: Float32, Units: "VA"},
+	{Name: "VAr", Offset: 26, Type: Float32, Units: "var"},
+	{Name: "PF", Offset: 28, Type: Float32, Units: "%"},
+	{Name: "WH", Offset: 30, Type: Float32, Units: "Wh"},
+	{Name: "DCA", Offset: 32, Type: Float32, Units: "A"},
+	{Name: "DCV", Offset: 34, Type: Float32, Units: "V"},
+	{Name: "DCW", Offset: 36, Type: Float32, Units: "W"},
+	{Name: "TmpCab", Offset: 38, Type: Float32, Units: "C"},
+	{Name: "TmpSnk", Offset: 40, Type: Float32, Units: "C"},
+	{Name: "TmpTrns", Offset: 42, Type: Float32, Units: "C"},
+	{Name: "TmpOt", Offset: 44, Type: Float32, Units: "C"},
+	{Name: "St", Offset: 46, Type: Enum16},
+	{Name: "StVnd", Offset: 47, Type: Enum16},
+	{Name: "Evt1", Offset: 48, Type: Bitfield32},
+	{Name: "Evt2", Offset: 50, Type: Bitfield32},
+}
+
+// meterModel lists the points of the meter models 201-204. Phases which a
+// meter doesn't measure are reported as not implemented.
+var meterModel = []Point{
+	{Name: "A", Offset: 0, Type: Int16, SF: "A_SF", Units: "A"},
+	{Name: "AphA", Offset: 1, Type: Int16, SF: "A_SF", Units: "A"},
+	{Name: "AphB", Offset: 2, Type: Int16, SF: "A_SF", Units: "A"},
+	{Name: "AphC", Offset: 3, Type: Int16, SF: "A_SF", Units: "A"},
+	{Name: "A_SF", Offset: 4, Type: ScaleFactor},
+	{Name: "PhV", Offset: 5, Type: Int16, SF: "V_SF", Units: "V"},
+	{Name: "PhVphA", Offset: 6, Type: Int16, SF: "V_SF", Units: "V"},
+	{Name: "PhVphB", Offset: 7, Type: Int16, SF: "V_SF", Units: "V"},
+	{Name: "PhVphC", Offset: 8, Type: Int16, SF: "V_SF", Units: "V"},
+	{Name: "PPV", Offset: 9, Type: Int16, SF: "V_SF", Units: "V"},
+	{Name: "PPVphAB", Offset: 10, Type: Int16, SF: "V_SF", Units: "V"},
+	{Name: "PPVphBC", Offset: 11, Type: Int16, SF: "V_SF", Units: "V"},
+	{Name: "PPVphCA", Offset: 12, Type: Int16, SF: "V_SF", Units: "V"},
+	{Name: "V_SF", Offset: 13, Type: ScaleFactor},
+	{Name: "Hz", Offset: 14, Type: Int16, SF: "Hz_SF", Units: "Hz"},
+	{Name: "Hz_SF", Offset: 15, Type: ScaleFactor},
+	{Name: "W", Offset: 16, Type: Int16, SF: "W_SF", Units: "W"},
+	{Name: "WphA", Offset: 17, Type: Int16, SF: "W_SF", Units: "W"},
+	{Name: "WphB", Offset: 18, Type: Int16, SF: "W_SF", Units: "W"},
+	{Name: "WphC", Offset: 19, Type: Int16, SF: "W_SF", Units: "W"},
+	{Name: "W_SF", Offset: 20, Type: ScaleFactor},
+	{Name: "VA", Offset: 21, Type: Int16, SF: "VA_SF", Units: "VA"},
+	{Name: "VAphA", Offset: 22, Type: Int16, SF: "VA_SF", Units: "VA"},
+	{Name: "VAphB", Offset: 23, Type: Int16, SF: "VA_SF", Units: "VA"},
+	{Name: "VAphC", Offset: 24, Type: Int16, SF: "VA_SF", Units: "VA"},
+	{Name: "VA_SF", Offset: 25, Type: ScaleFactor},
+	{Name: "VAR", Offset: 26, Type: Int16, SF: "VAR_SF", Units: "var"},
+	{Name: "VARphA", Offset: 27, Type: Int16, SF: "VAR_SF", Units: "var"},
+	{Name: "VARphB", Offset: 28, Type: Int16, SF: "VAR_SF", Units: "var"},
+	{Name: "VARphC", Offset: 29, Type: Int16, SF: "VAR_SF", Units: "var"},
+	{Name: "VAR_SF", Offset: 30, Type: ScaleFactor},
+	{Name: "PF", Offset: 31, Type: Int16, SF: "PF_SF", Units: "%"},
+	{Name: "PFphA", Offset: 32, Type: Int16, SF: "PF_SF", Units: "%"},
+	{Name: "PFphB", Offset: 33, Type: Int16, SF: "PF_SF", Units: "%"},
+	{Name: "PFphC", Offset: 34, Type: Int16, SF: "PF_SF", Units: "%"},
+	{Name: "PF_SF", Offset: 35, Type: ScaleFactor},
+	{Name: "TotWhExp", Offset: 36, Type: Acc32, SF: "TotWh_SF", Units: "Wh"},
+	{Name: "TotWhExpPhA", Offset: 38, Type: Acc32, SF: "TotWh_SF", Units: "Wh"},
+	{Name: "TotWhExpPhB", Offset: 40, Type: Acc32, SF: "TotWh_SF", Units: "Wh"},
+	{Name: "TotWhExpPhC", Offset: 42, Type: Acc32, SF: "TotWh_SF", Units: "Wh"},
+	{Name: "TotWhImp", Offset: 44, Type: Acc32, SF: "TotWh_SF", Units: "Wh"},
+	{Name: "TotWhImpPhA", Offset: 46, Type: Acc32, SF: "TotWh_SF", Units: "Wh"},
+	{Name: "TotWhImpPhB", Offset: 48, Type: Acc32, SF: "TotWh_SF", Units: "Wh"},
+	{Name: "TotWhImpPhC", Offset: 50, Type: Acc32, SF: "TotWh_SF", Units: "Wh"},
+	{Name: "TotWh_SF", Offset: 52, Type: ScaleFactor},
+	{Name: "Evt", Offset: 103, Type: Bitfield32},
+}
+
+// storageModel lists the points of the basic storage controls model 124.
+var storageModel = []Point{
+	{Name: "WChaMax", Offset: 0, Type: Uint16, SF: "WChaMax_SF", Units: "W"},
+	{Name: "WChaGra", Offset: 1, Type: Uint16, SF: "WChaDisChaGra_SF", Units: "% WChaMax/sec"},
+	{Name: "WDisChaGra", Offset: 2, Type: Uint16, SF: "WChaDisChaGra_SF", Units: "% WChaMax/sec"},
+	{Name: "StorCtl_Mod", Offset: 3, Type: Bitfield16},
+	{Name: "VAChaMax", Offset: 4, Type: Uint16, SF: "VAChaMax_SF", Units: "VA"},
+	{Name: "MinRsvPct", Offset: 5, Type: Uint16, SF: "MinRsvPct_SF", Units: "% WChaMax"},
+	{Name: "ChaState", Offset: 6, Type: Uint16, SF: "ChaState_SF", Units: "% AhrRtg"},
+	{Name: "StorAval", Offset: 7, Type: Uint16, SF: "StorAval_SF", Units: "AH"},
+	{Name: "InBatV", Offset: 8, Type: Uint16, SF: "InBatV_SF", Units: "V"},
+	{Name: "ChaSt", Offset: 9, Type: Enum16},
+	{Name: "OutWRte", Offset: 10, Type: Int16, SF: "InOutWRte_SF", Units: "% WDisChaMax"},
+	{Name: "InWRte", Offset: 11, Type: Int16, SF: "InOutWRte_SF", Units: "% WChaMax"},
+	{Name: "WChaMax_SF", Offset: 16, Type: ScaleFactor},
+	{Name: "WChaDisChaGra_SF", Offset: 17, Type: ScaleFactor},
+	{Name: "VAChaMax_SF", Offset: 18, Type: ScaleFactor},
+	{Name: "MinRsvPct_SF", Offset: 19, Type: ScaleFactor},
+	{Name: "ChaState_SF", Offset: 20, Type: ScaleFactor},
+	{Name: "StorAval_SF", Offset: 21, Type: ScaleFactor},
+	{Name: "InBatV_SF", Offset: 22, Type: ScaleFactor},
+	{Name: "InOutWRte_SF", Offset: 23, Type: ScaleFactor},
+}
+
+// batteryModel lists the points of the lithium-ion battery bank model 802.
+// Positive power values denote discharging.
+var batteryModel = []Point{
+	{Name: "AHRtg", Offset: 0, Type: Uint16, SF: "AHRtg_SF", Units: "Ah"},
+	{Name: "WHRtg", Offset: 1, Type: Uint16, SF: "WHRtg_SF", Units: "Wh"},
+	{Name: "WChaRteMax", Offset: 2, Type: Uint16, SF: "WChaDisChaMax_SF", Units: "W"},
+	{Name: "WDisChaRteMax", Offset: 3, Type: Uint16, SF: "WChaDisChaMax_SF", Units: "W"},
+	{Name: "DisChaRte", Offset: 4, Type: Uint16, SF: "DisChaRte_SF", Units: "%WHRtg"},
+	{Name: "SoCMax", Offset: 5, Type: Uint16, SF: "SoC_SF", Units: "%WHRtg"},
+	{Name: "SoCMin", Offset: 6, Type: Uint16, SF: "SoC_SF", Units: "%WHRtg"},
+	{Name: "SoC", Offset: 9, Type: Uint16, SF: "SoC_SF", Units: "%WHRtg"},
+	{Name: "DoD", Offset: 10, Type: Uint16, SF: "DoD_SF", Units: "%"},
+	{Name: "SoH", Offset: 11, Type: Uint16, SF: "SoH_SF", Units: "%"},
+	{Name: "NCyc", Offset: 12, Type: Uint32},
+	{Name: "ChaSt", Offset: 14, Type: Enum16},
+	{Name: "Typ", Offset: 19, Type: Enum16},
+	{Name: "State", Offset: 20, Type: Enum16},
+	{Name: "Evt1", Offset: 24, Type: Bitfield32},
+	{Name: "Evt2", Offset: 26, Type: Bitfield32},
+	{Name: "V", Offset: 32, Type: Uint16, SF: "V_SF", Units: "V"},
+	{Name: "A", Offset: 42, Type: Int16, SF: "A_SF", Units: "A"},
+	{Name: "W", Offset: 45, Type: Int16, SF: "W_SF", Units: "W"},
+	{Name: "AHRtg_SF", Offset: 50, Type: ScaleFactor},
+	{Name: "WHRtg_SF", Offset: 51, Type: ScaleFactor},
+	{Name: "WChaDisChaMax_SF", Offset: 52, Type: ScaleFactor},
+	{Name: "DisChaRte_SF", Offset: 53, Type: ScaleFactor},
+	{Name: "SoC_SF", Offset: 54, Type: ScaleFactor},
+	{Name: "DoD_SF", Offset: 55, Type: ScaleFactor},
+	{Name: "SoH_SF", Offset: 56, Type: ScaleFactor},
+	{Name: "V_SF", Offset: 57, Type: ScaleFactor},
+	{Name: "A_SF", Offset: 59, Type: ScaleFactor},
+	{Name: "W_SF", Offset: 61, Type: ScaleFactor},
+}
+
+// Definitions holds the known models by ID.
+var Definitions = map[uint16]*Definition{
+	ModelCommon:                   {ModelCommon, "common", commonModel},
+	ModelInverterSinglePhase:      {ModelInverterSinglePhase, "inverter (single phase)", integerInverterModel},
+	ModelInverterSplitPhase:       {ModelInverterSplitPhase, "inverter (split phase)", integerInverterModel},
+	ModelInverterThreePhase:       {ModelInverterThreePhase, "inverter (three phase)", integerInverterModel},
+	ModelInverterSinglePhaseFloat: {ModelInverterSinglePhaseFloat, "inverter (single phase, float)", floatInverterModel},
+	ModelInverterSplitPhaseFloat:  {ModelInverterSplitPhaseFloat, "inverter (split phase, float)", floatInverterModel},
+	ModelInverterThreePhaseFloat:  {ModelInverterThreePhaseFloat, "inverter (three phase, float)", floatInverterModel},
+	ModelMeterSinglePhase:         {ModelMeterSinglePhase, "meter (single phase)", meterModel},
+	ModelMeterSplitPhase:          {ModelMeterSplitPhase, "meter (split phase)", meterModel},
+	ModelMeterThreePhaseWye:       {ModelMeterThreePhaseWye, "meter (three phase wye)", meterModel},
+	ModelMeterThreePhaseDelta:     {ModelMeterThreePhaseDelta, "meter (three phase delta)", meterModel},
+	ModelStorage:                  {ModelStorage, "storage", storageModel},
+	ModelLithiumIonBatteryBank:    {ModelLithiumIonBatteryBank, "lithium-ion battery bank", batteryModel},
+}
@@ -0,0 +1,341 @@
+// Package sunspec discovers and decodes the SunSpec information models of
+// MODBUS devices independent of the vendor.
+package sunspec
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+
+	solaredge "github.com/ingmarstein/mielesolar/modbus"
+	"github.com/simonvetter/modbus"
+)
+
+// BaseAddresses lists the addresses at which the "SunS" marker may be located.
+var BaseAddresses = []uint16{40000, 50000, 0}
+
+const (
+	marker0 = 0x5375 // "Su"
+	marker1 = 0x6E53 // "nS"
+
+	maxRead = 125 // maximum number of registers per read request
+)
+
+// Type is the type of a point.
+type Type int
+
+const (
+	Int16 Type = iota
+	Uint16
+	Int32
+	Uint32
+	Acc32
+	Enum16
+	Bitfield16
+	Bitfield32
+	ScaleFactor
+	Float32
+	String
+)
+
+// Point describes a value within a model. Offsets are relative to the first
+// register following the model header.
+type Point struct {
+	Name   string
+	Offset int
+	Type   Type
+	Size   int    // number of registers of strings
+	SF     string // name of the scale factor point, if any
+	Units  string
+}
+
+// size returns the number of registers occupied by the point.
+func (p Point) size() int {
+	switch p.Type {
+	case Int32, Uint32, Acc32, Bitfield32, Float32:
+		return 2
+	case String:
+		return p.Size
+	default:
+		return 1
+	}
+}
+
+// Definition describes a SunSpec model.
+type Definition struct {
+	ID     uint16
+	Name   string
+	Points []Point
+}
+
+func (d *Definition) point(name string) (Point, bool) {
+	for _, p := range d.Points {
+		if p.Name == name {
+			return p, true
+		}
+	}
+
+	return Point{}, false
+}
+
+// Reader reads holding registers from a device. It is implemented by
+// *modbus.ModbusClient.
+type Reader interface {
+	ReadRegisters(addr uint16, quantity uint16, regType modbus.RegType) ([]uint16, error)
+}
+
+// Model is an instance of a model found in the model chain of a device.
+type Model struct {
+	ID      uint16
+	Address uint16 // address of the model header
+	Length  uint16 // number of registers following the header
+	Regs    []uint16
+}
+
+// Definition returns the definition of the model or nil if the model is not
+// known.
+func (m *Model) Definition() *Definition {
+	return Definitions[m.ID]
+}
+
+// Name returns a description of the model.
+func (m *Model) Name() string {
+	if d := m.Definition(); d != nil {
+		return d.Name
+	}
+
+	return fmt.Sprintf("model %d", m.ID)
+}
+
+// Read reads the current values of the model from the device.
+func (m *Model) Read(r Reader) error {
+	regs, err := readRegisters(r, m.Address+2, m.Length)
+	if err != nil {
+		return fmt.Errorf("error reading %s registers: %w", m.Name(), err)
+	}
+	m.Regs = regs
+
+	return nil
+}
+
+// raw returns the registers of the named point if the model defines it and
+// the device provided them.
+func (m *Model) raw(name string) (Point, []uint16, bool) {
+	d := m.Definition()
+	if d == nil {
+		return Point{}, nil, false
+	}
+	p, ok := d.point(name)
+	if !ok || p.Offset+p.size() > len(m.Regs) {
+		return p, nil, false
+	}
+
+	return p, m.Regs[p.Offset : p.Offset+p.size()], true
+}
+
+// Value returns the named point with its scale factor applied. The value is
+// invalid if the model lacks the point or the device reports it as not
+// implemented.
+func (m *Model) Value(name string) solaredge.Value {
+	p, regs, ok := m.raw(name)
+	if !ok {
+		return solaredge.Value{}
+	}
+
+	var v solaredge.Value
+	switch p.Type {
+	case Int16, ScaleFactor:
+		if int16(regs[0]) == solaredge.NotImplementedInt16 {
+			return v
+		}
+		v = solaredge.Value{Value: float64(int16(regs[0])), Valid: true}
+	case Uint16, Enum16, Bitfield16:
+		if regs[0] == solaredge.NotImplementedUint16 {
+			return v
+		}
+		v = solaredge.Value{Value: float64(regs[0]), Valid: true}
+	case Int32:
+		x := int32(uint32(regs[0])<<16 | uint32(regs[1]))
+		if x == solaredge.NotImplementedInt32 {
+			return v
+		}
+		v = solaredge.Value{Value: float64(x), Valid: true}
+	case Uint32, Bitfield32:
+		x := uint32(regs[0])<<16 | uint32(regs[1])
+		if x == math.MaxUint32 {
+			return v
+		}
+		v = solaredge.Value{Value: float64(x), Valid: true}
+	case Acc32:
+		x := uint32(regs[0])<<16 | uint32(regs[1])
+		if x == solaredge.NotImplementedAcc32 {
+			return v
+		}
+		v = solaredge.Value{Value: float64(x), Valid: true}
+	case Float32:
+		x := math.Float32frombits(uint32(regs[0])<<16 | uint32(regs[1]))
+		if math.IsNaN(float64(x)) {
+			return v
+		}
+		v = solaredge.Value{Value: float64(x), Valid: true}
+	default:
+		return v
+	}
+
+	if p.SF != "" {
+		sf := m.Value(p.SF)
+		if !sf.Valid || sf.Value < -10 || sf.Value > 10 {
+			return solaredge.Value{}
+		}
+		v.Value *= math.Pow(10, sf.Value)
+	}
+
+	return v
+}
+
+// String returns the named string point without trailing NUL bytes and
+// whitespace.
+func (m *Model) String(name string) string {
+	p, regs, ok := m.raw(name)
+	if !ok || p.Type != String {
+		return ""
+	}
+
+	b := make([]byte, 0, 2*len(regs))
+	for _, r := range regs {
+		b = append(b, byte(r>>8), byte(r))
+	}
+	if n := bytes.IndexByte(b, 0); n != -1 {
+		b = b[:n]
+	}
+
+	return strings.TrimSpace(string(b))
+}
+
+// Device is a logical device within the model chain. Each device starts with
+// a common model, followed by the models it implements.
+type Device struct {
+	Common *Model
+	Models []*Model
+}
+
+func (d *Device) Manufacturer() string { return d.Common.String("Mn") }
+func (d *Device) DeviceModel() string  { return d.Common.String("Md") }
+func (d *Device) Options() string      { return d.Common.String("Opt") }
+func (d *Device) Version() string      { return d.Common.String("Vr") }
+func (d *Device) SerialNumber() string { return d.Common.String("SN") }
+
+// Find returns the first model with one of the given IDs or nil.
+func (d *Device) Find(ids ...uint16) *Model {
+	for _, m := range d.Models {
+		if slices.Contains(ids, m.ID) {
+			return m
+		}
+	}
+
+	return nil
+}
+
+func (d *Device) String() string {
+	s := strings.TrimSpace(d.Manufacturer() + " " + d.DeviceModel())
+	if sn := d.SerialNumber(); sn != "" {
+		s += " (" + sn + ")"
+	}
+
+	return s
+}
+
+// ErrNotFound is returned by Scan if no SunSpec marker was found.
+var ErrNotFound = errors.New("SunSpec marker not found")
+
+// Scan locates the SunSpec marker, walks the model chain and reads all models
+// found. The chain ends with the end model, a zero model ID or an illegal
+// data address.
+func Scan(r Reader) ([]*Device, error) {
+	base, err := findBase(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var devices []*Device
+	address := base + 2
+	for {
+		header, err := r.ReadRegisters(address, 2, modbus.HOLDING_REGISTER)
+		if errors.Is(err, modbus.ErrIllegalDataAddress) {
+			break
+		}
+		if err != nil {
+			return devices, fmt.Errorf("error reading model header at %d: %w", address, err)
+		}
+		if header[0] == ModelEnd || header[0] == 0 {
+			break
+		}
+
+		m := &Model{ID: header[0], Address: address, Length: header[1]}
+		// only models known to this package are read, the rest is skipped
+		if m.Definition() != nil {
+			if err := m.Read(r); err != nil {
+				return devices, err
+			}
+		}
+
+		switch {
+		case m.ID == ModelCommon:
+			devices = append(devices, &Device{Common: m})
+		case len(devices) == 0:
+			return devices, fmt.Errorf("%s at %d precedes the common model", m.Name(), address)
+		default:
+			d := devices[len(devices)-1]
+			d.Models = append(d.Models, m)
+		}
+
+		next := int(address) + 2 + int(m.Length)
+		if next > math.MaxUint16 {
+			break
+		}
+		address = uint16(next)
+	}
+
+	if len(devices) == 0 {
+		return nil, fmt.Errorf("no common model found at %d", base+2)
+	}
+
+	return devices, nil
+}
+
+func findBase(r Reader) (uint16, error) {
+	for _, base := range BaseAddresses {
+		regs, err := r.ReadRegisters(base, 2, modbus.HOLDING_REGISTER)
+		if err != nil {
+			if errors.Is(err, modbus.ErrIllegalDataAddress) || errors.Is(err, modbus.ErrIllegalFunction) {
+				continue
+			}
+			return 0, fmt.Errorf("error reading SunSpec marker at %d: %w", base, err)
+		}
+		if regs[0] == marker0 && regs[1] == marker1 {
+			return base, nil
+		}
+	}
+
+	return 0, ErrNotFound
+}
+
+// readRegisters reads quantity registers in chunks of at most maxRead.
+func readRegisters(r Reader, address, quantity uint16) ([]uint16, error) {
+	regs := make([]uint16, 0, quantity)
+	for quantity > 0 {
+		n := min(quantity, maxRead)
+		chunk, err := r.ReadRegisters(address, n, modbus.HOLDING_REGISTER)
+		if err != nil {
+			return nil, err
+		}
+		regs = append(regs, chunk...)
+		address += n
+		quantity -= n
+	}
+
+	return regs, nil
+}
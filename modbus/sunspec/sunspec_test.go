@@ -0,0 +1,232 @@
+package sunspec
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/ingmarstein/mielesolar/modbus/simulator"
+	"github.com/simonvetter/modbus"
+)
+
+// device serves a contiguous block of holding registers.
+type device struct {
+	base uint16
+	regs []uint16
+}
+
+func (d *device) ReadRegisters(addr uint16, quantity uint16, _ modbus.RegType) ([]uint16, error) {
+	if quantity > maxRead {
+		return nil, modbus.ErrIllegalDataValue
+	}
+	if addr < d.base || int(addr)+int(quantity) > int(d.base)+len(d.regs) {
+		return nil, modbus.ErrIllegalDataAddress
+	}
+
+	return d.regs[addr-d.base : int(addr-d.base)+int(quantity)], nil
+}
+
+// model appends a model with the given body, padded to length registers.
+func (d *device) model(id uint16, length int, body ...uint16) {
+	regs := make([]uint16, length)
+	copy(regs, body)
+	d.regs = append(d.regs, id, uint16(length))
+	d.regs = append(d.regs, regs...)
+}
+
+func (d *device) common(manufacturer, model, options string) {
+	body := make([]uint16, 66)
+	copy(body[0:], str(manufacturer, 16))
+	copy(body[16:], str(model, 16))
+	copy(body[32:], str(options, 8))
+	copy(body[48:], str("SN-"+model, 16))
+	d.model(ModelCommon, 66, body...)
+}
+
+func newDevice(base uint16) *device {
+	return &device{base: base, regs: []uint16{marker0, marker1}}
+}
+
+func str(s string, n int) []uint16 {
+	b := make([]byte, 2*n)
+	copy(b, s)
+	regs := make([]uint16, n)
+	for i := range regs {
+		regs[i] = uint16(b[2*i])<<8 | uint16(b[2*i+1])
+	}
+
+	return regs
+}
+
+func f32(v float32) []uint16 {
+	bits := math.Float32bits(v)
+	return []uint16{uint16(bits >> 16), uint16(bits)}
+}
+
+func at(body []uint16, offset int, regs ...uint16) []uint16 {
+	copy(body[offset:], regs)
+	return body
+}
+
+// simulatorReader adapts the simulator's request handler to a Reader.
+type simulatorReader struct {
+	sim *simulator.Simulator
+}
+
+func (r simulatorReader) ReadRegisters(addr uint16, quantity uint16, _ modbus.RegType) ([]uint16, error) {
+	return r.sim.HandleHoldingRegisters(&modbus.HoldingRegistersRequest{UnitId: 1, Addr: addr, Quantity: quantity})
+}
+
+func TestScanSimulator(t *testing.T) {
+	sample := simulator.Sample{Production: 5000, Consumption: 1000}
+	sim := simulator.New(simulator.Config{Meter: true, ConsumptionMeter: true}, simulator.ProfileFunc(func(time.Duration) simulator.Sample { return sample }))
+
+	devices, err := Scan(simulatorReader{sim})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 3 {
+		t.Fatalf("got %d devices, want 3", len(devices))
+	}
+
+	inverter := devices[0]
+	if inverter.Manufacturer() != "SolarEdge" || inverter.DeviceModel() != "SE10K-SIM" || inverter.SerialNumber() != "SIM00000001" {
+		t.Errorf("unexpected inverter %s", inverter)
+	}
+	m := inverter.Find(InverterModels...)
+	if m == nil || m.ID != ModelInverterThreePhase {
+		t.Fatalf("inverter model not found: %v", inverter.Models)
+	}
+	if v := m.Value("W"); !v.Valid || math.Abs(v.Value-5000*simulator.Efficiency) > 1 {
+		t.Errorf("AC power = %v, want %v", v, 5000*simulator.Efficiency)
+	}
+	if v := m.Value("PhVphA"); !v.Valid || v.Value != 230 {
+		t.Errorf("AC voltage = %v, want 230", v)
+	}
+	if v := m.Value("St"); v.Value != StateMPPT {
+		t.Errorf("state = %v, want %d", v, StateMPPT)
+	}
+
+	for i, want := range []struct {
+		options string
+		power   float64
+	}{
+		{"Consumption", 1000},
+		{"Export+Import", 5000*simulator.Efficiency - 1000},
+	} {
+		d := devices[i+1]
+		if d.Options() != want.options {
+			t.Errorf("meter %d options = %q, want %q", i, d.Options(), want.options)
+		}
+		m := d.Find(MeterModels...)
+		if m == nil {
+			t.Fatalf("meter %d model not found", i)
+		}
+		if v := m.Value("W"); !v.Valid || math.Abs(v.Value-want.power) > 10 {
+			t.Errorf("meter %d power = %v, want %v", i, v, want.power)
+		}
+	}
+}
+
+func TestScanGeneric(t *testing.T) {
+	d := newDevice(50000)
+	d.common("Fronius", "Symo GEN24 10.0", "")
+	inverter := make([]uint16, 60)
+	at(inverter, 20, f32(4321.5)...)
+	at(inverter, 22, f32(float32(math.NaN()))...)
+	at(inverter, 46, StateMPPT)
+	d.model(ModelInverterThreePhaseFloat, 60, inverter...)
+	// an unknown model is skipped
+	d.model(160, 48)
+	d.model(ModelStorage, 24)
+	d.common("Fronius", "Smart Meter TS 65A-3", "export+import")
+	meter := make([]uint16, 105)
+	at(meter, 16, uint16(0xFFFF&-1234)) // W
+	at(meter, 20, uint16(0xFFFF&-1))    // W_SF
+	at(meter, 36, 0x0001, 0x0000)       // TotWhExp
+	at(meter, 52, 1)                    // TotWh_SF
+	d.model(ModelMeterThreePhaseWye, 105, meter...)
+	d.model(ModelEnd, 0)
+
+	devices, err := Scan(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 2 {
+		t.Fatalf("got %d devices, want 2", len(devices))
+	}
+
+	if got := devices[0].String(); got != "Fronius Symo GEN24 10.0 (SN-Symo GEN24 10.0)" {
+		t.Errorf("device = %q", got)
+	}
+	if n := len(devices[0].Models); n != 3 {
+		t.Errorf("got %d models, want 3", n)
+	}
+	m := devices[0].Find(InverterModels...)
+	if v := m.Value("W"); v.Value != 4321.5 {
+		t.Errorf("AC power = %v, want 4321.5", v)
+	}
+	if v := m.Value("Hz"); v.Valid {
+		t.Errorf("frequency = %v, want invalid", v)
+	}
+	if v := m.Value("St"); v.Value != StateMPPT {
+		t.Errorf("state = %v, want %d", v, StateMPPT)
+	}
+	if m := devices[0].Find(160); m == nil || m.Regs != nil {
+		t.Errorf("unknown model should be listed but not read: %v", m)
+	}
+	if devices[0].Find(StorageModels...) == nil {
+		t.Error("storage model not found")
+	}
+
+	m = devices[1].Find(MeterModels...)
+	if v := m.Value("W"); v.Value != -123.4 {
+		t.Errorf("meter power = %v, want -123.4", v)
+	}
+	if v := m.Value("TotWhExp"); v.Value != 655360 {
+		t.Errorf("exported energy = %v, want 655360", v)
+	}
+	if v := m.Value("TotWhImp"); v.Valid {
+		t.Errorf("imported energy = %v, want invalid", v)
+	}
+	if v := m.Value("AphA"); !v.Valid || v.Value != 0 {
+		t.Errorf("current = %v, want 0", v)
+	}
+}
+
+func TestScanLargeModel(t *testing.T) {
+	d := newDevice(0)
+	d.common("Example", "Big", "")
+	d.model(ModelLithiumIonBatteryBank, 300, at(make([]uint16, 300), 45, 1500)...)
+
+	devices, err := Scan(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := devices[0].Find(ModelLithiumIonBatteryBank)
+	if m == nil || len(m.Regs) != 300 {
+		t.Fatalf("battery model not read completely: %v", m)
+	}
+	if v := m.Value("W"); v.Value != 1500 {
+		t.Errorf("battery power = %v, want 1500", v)
+	}
+}
+
+func TestScanErrors(t *testing.T) {
+	if _, err := Scan(&device{base: 40000, regs: make([]uint16, 10)}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v, want %v", err, ErrNotFound)
+	}
+
+	d := newDevice(40000)
+	d.model(ModelInverterThreePhase, 50)
+	if _, err := Scan(d); err == nil {
+		t.Error("expected an error for a model chain without common model")
+	}
+
+	d = newDevice(40000)
+	d.model(ModelEnd, 0)
+	if _, err := Scan(d); err == nil {
+		t.Error("expected an error for an empty model chain")
+	}
+}
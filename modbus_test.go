@@ -0,0 +1,463 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ingmarstein/mielesolar/modbus/simulator"
+	"github.com/simonvetter/modbus"
+)
+
+// testProfile is a simulator profile which can be changed by the test.
+type testProfile struct {
+	mu     sync.Mutex
+	sample simulator.Sample
+}
+
+func (p *testProfile) At(time.Duration) simulator.Sample {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.sample
+}
+
+func (p *testProfile) set(s simulator.Sample) {
+	p.mu.Lock()
+	p.sample = s
+	p.mu.Unlock()
+}
+
+func freeAddress(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	return ln.Addr().String()
+}
+
+func startSimulator(t *testing.T, address string, config simulator.Config, profile simulator.Profile) *simulator.Simulator {
+	t.Helper()
+
+	sim := simulator.New(config, profile)
+	if err := sim.Start(address); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = sim.Stop() })
+
+	return sim
+}
+
+func TestModbusProvider(t *testing.T) {
+	meter := simulator.Config{UnitID: 1, Meter: true}
+	battery := simulator.Config{UnitID: 1, Meter: true, Battery: true}
+	tests := []struct {
+		name      string
+		config    simulator.Config
+		meter     int
+		batteries int
+		sample    simulator.Sample
+		want      float64
+	}{
+		{"export", meter, 0, 0, simulator.Sample{Production: 4000, Consumption: 1000}, 4000*simulator.Efficiency - 1000},
+		{"import", meter, 0, 0, simulator.Sample{Production: 0, Consumption: 700}, -700},
+		{"battery charging", battery, 0, 1, simulator.Sample{Production: 4000, Consumption: 1000, Battery: 2000}, 4000*simulator.Efficiency - 1000},
+		{"battery discharging", battery, 0, 1, simulator.Sample{Production: 0, Consumption: 700, Battery: -700}, -700},
+		{"two batteries", simulator.Config{UnitID: 1, Meter: true, Battery: true, Batteries: 2}, 0, 2,
+			simulator.Sample{Production: 5000, Consumption: 1000, Battery: 3000}, 5000*simulator.Efficiency - 1000},
+		{"consumption meter", simulator.Config{UnitID: 1, Meter: true, ConsumptionMeter: true, Battery: true}, 1, 1,
+			simulator.Sample{Production: 4000, Consumption: 1500, Battery: 1000}, 4000*simulator.Efficiency - 1500},
+		{"only consumption meter", simulator.Config{UnitID: 1, ConsumptionMeter: true}, 0, 0,
+			simulator.Sample{Production: 0, Consumption: 700}, 700},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			address := freeAddress(t)
+			startSimulator(t, address, tt.config, simulator.ProfileFunc(func(time.Duration) simulator.Sample {
+				return tt.sample
+			}))
+
+			p, err := newModbusProvider(inverterTarget{Address: address, UnitID: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := p.Open(); err != nil {
+				t.Fatal(err)
+			}
+			defer p.Close()
+			p.Init()
+			if p.meter != tt.meter || len(p.units[0].batteries) != tt.batteries {
+				t.Errorf("meter = %d, batteries = %v; want meter %d and %d batteries", p.meter, p.units[0].batteries, tt.meter, tt.batteries)
+			}
+
+			got, err := p.CurrentPowerExport()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("CurrentPowerExport() = %v, want %v", got, tt.want)
+			}
+			if r := p.LastReading(); r.PVPower != tt.sample.Production || r.BatteryPower != tt.sample.Battery {
+				t.Errorf("LastReading() = %+v", r)
+			}
+		})
+	}
+}
+
+func TestModbusProviderReconnect(t *testing.T) {
+	address := freeAddress(t)
+	profile := &testProfile{sample: simulator.Sample{Production: 2000, Consumption: 500}}
+	config := simulator.Config{UnitID: 1, Meter: true}
+	sim := startSimulator(t, address, config, profile)
+
+	p, err := newModbusProvider(inverterTarget{Address: address, UnitID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	p.Init()
+
+	if got, err := p.CurrentPowerExport(); err != nil || got != 2000*simulator.Efficiency-500 {
+		t.Fatalf("CurrentPowerExport() = %v, %v", got, err)
+	}
+
+	// the inverter goes away, e.g. during a firmware update
+	if err := sim.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := p.CurrentPowerExport(); err == nil {
+		t.Fatalf("CurrentPowerExport() = %v, expected error while the inverter is unavailable", got)
+	}
+	_ = p.Close()
+	if err := p.Open(); err == nil {
+		t.Fatal("expected error connecting to unavailable inverter")
+	}
+
+	// reconnect the same way server.serve does once the inverter is back
+	profile.set(simulator.Sample{Production: 3000, Consumption: 400})
+	startSimulator(t, address, config, profile)
+	if err := p.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := p.CurrentPowerExport(); err != nil || got != 3000*simulator.Efficiency-400 {
+		t.Errorf("CurrentPowerExport() = %v, %v after reconnect", got, err)
+	}
+}
+
+func startHandler(t *testing.T, address string, handler modbus.RequestHandler) {
+	t.Helper()
+
+	server, err := modbus.NewServer(&modbus.ServerConfiguration{
+		URL:        "tcp://" + address,
+		Timeout:    time.Minute,
+		MaxClients: 10,
+	}, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = server.Stop() })
+}
+
+// unitMux serves several simulated inverters on one connection like a
+// leader inverter answering on behalf of its followers.
+type unitMux map[uint8]*simulator.Simulator
+
+func (m unitMux) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest) ([]uint16, error) {
+	sim := m[req.UnitId]
+	if sim == nil {
+		return nil, modbus.ErrGWTargetFailedToRespond
+	}
+
+	return sim.HandleHoldingRegisters(req)
+}
+
+func (m unitMux) HandleCoils(*modbus.CoilsRequest) ([]bool, error) {
+	return nil, modbus.ErrIllegalFunction
+}
+
+func (m unitMux) HandleDiscreteInputs(*modbus.DiscreteInputsRequest) ([]bool, error) {
+	return nil, modbus.ErrIllegalFunction
+}
+
+func (m unitMux) HandleInputRegisters(*modbus.InputRegistersRequest) ([]uint16, error) {
+	return nil, modbus.ErrIllegalFunction
+}
+
+func openModbusProvider(t *testing.T, targets ...inverterTarget) *modbusProvider {
+	t.Helper()
+
+	p, err := newModbusProvider(targets...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = p.Close() })
+	p.Init()
+
+	return p
+}
+
+func TestModbusProviderLeaderFollower(t *testing.T) {
+	leader := simulator.New(simulator.Config{UnitID: 1, Meter: true}, simulator.ProfileFunc(func(time.Duration) simulator.Sample {
+		return simulator.Sample{Production: 3000, Consumption: 1000}
+	}))
+	follower := simulator.New(simulator.Config{UnitID: 2}, simulator.ProfileFunc(func(time.Duration) simulator.Sample {
+		return simulator.Sample{Production: 2000}
+	}))
+	address := freeAddress(t)
+	startHandler(t, address, unitMux{1: leader, 2: follower})
+
+	// unit 3 is asleep and doesn't answer
+	p := openModbusProvider(t, inverterTarget{Address: address, UnitID: 1}, inverterTarget{Address: address, UnitID: 2}, inverterTarget{Address: address, UnitID: 3})
+	if len(p.conns) != 1 {
+		t.Errorf("got %d connections, want one shared connection", len(p.conns))
+	}
+	if p.meterUnit != p.units[0] {
+		t.Errorf("meter on inverter %v, want %v", p.meterUnit, p.units[0])
+	}
+
+	got, err := p.CurrentPowerExport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the leader's meter measures the export of the whole site
+	if want := 3000*simulator.Efficiency - 1000; got != want {
+		t.Errorf("CurrentPowerExport() = %v, want %v", got, want)
+	}
+	if r := p.LastReading(); r.PVPower != 5000 || r.ACPower != 5000*simulator.Efficiency {
+		t.Errorf("LastReading() = %+v, want the sum of both inverters", r)
+	}
+}
+
+func TestModbusProviderIndependent(t *testing.T) {
+	first, second := freeAddress(t), freeAddress(t)
+	sim := startSimulator(t, first, simulator.Config{UnitID: 1}, simulator.ProfileFunc(func(time.Duration) simulator.Sample {
+		return simulator.Sample{Production: 1000}
+	}))
+	meterSim := startSimulator(t, second, simulator.Config{UnitID: 1, Meter: true}, simulator.ProfileFunc(func(time.Duration) simulator.Sample {
+		return simulator.Sample{Production: 2000, Consumption: 500}
+	}))
+
+	p := openModbusProvider(t, inverterTarget{Address: first, UnitID: 1}, inverterTarget{Address: second, UnitID: 1})
+	if p.meterUnit != p.units[1] {
+		t.Fatalf("meter on inverter %v, want %v", p.meterUnit, p.units[1])
+	}
+	if got, err := p.CurrentPowerExport(); err != nil || got != 2000*simulator.Efficiency-500 {
+		t.Errorf("CurrentPowerExport() = %v, %v", got, err)
+	}
+	if r := p.LastReading(); r.PVPower != 3000 {
+		t.Errorf("LastReading() = %+v, want the sum of both inverters", r)
+	}
+
+	// the inverter without meter goes to sleep
+	if err := sim.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := p.CurrentPowerExport(); err != nil || got != 2000*simulator.Efficiency-500 {
+		t.Errorf("CurrentPowerExport() = %v, %v with one inverter asleep", got, err)
+	}
+	if r := p.LastReading(); r.PVPower != 2000 {
+		t.Errorf("LastReading() = %+v, want the production of the remaining inverter", r)
+	}
+
+	// without the meter, the export is unknown
+	if err := meterSim.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := p.CurrentPowerExport(); err == nil {
+		t.Errorf("CurrentPowerExport() = %v, expected error without meter", got)
+	}
+}
+
+func TestModbusProviderBatteryUnavailable(t *testing.T) {
+	first, second := freeAddress(t), freeAddress(t)
+	startSimulator(t, first, simulator.Config{UnitID: 1, Meter: true}, simulator.ProfileFunc(func(time.Duration) simulator.Sample {
+		return simulator.Sample{Production: 2000, Consumption: 500}
+	}))
+	batterySim := startSimulator(t, second, simulator.Config{UnitID: 1, Battery: true}, simulator.ProfileFunc(func(time.Duration) simulator.Sample {
+		return simulator.Sample{Production: 1000, Battery: -800}
+	}))
+
+	p := openModbusProvider(t, inverterTarget{Address: first, UnitID: 1}, inverterTarget{Address: second, UnitID: 1})
+	if len(p.units[1].batteries) != 1 {
+		t.Fatalf("found batteries %v, want one", p.units[1].batteries)
+	}
+	if _, err := p.CurrentPowerExport(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the discharging battery would be missed
+	if err := batterySim.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := p.CurrentPowerExport(); err == nil {
+		t.Errorf("CurrentPowerExport() = %v, expected error with the battery inverter unavailable", got)
+	}
+}
+
+// patchedRegisters serves a simulated inverter with some registers replaced,
+// e.g. by the values denoting "not implemented".
+type patchedRegisters struct {
+	*simulator.Simulator
+	registers map[uint16]uint16
+}
+
+func (h patchedRegisters) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest) ([]uint16, error) {
+	res, err := h.Simulator.HandleHoldingRegisters(req)
+	if err != nil {
+		return nil, err
+	}
+	res = slices.Clone(res)
+	for addr, v := range h.registers {
+		if addr >= req.Addr && int(addr) < int(req.Addr)+len(res) {
+			res[addr-req.Addr] = v
+		}
+	}
+
+	return res, nil
+}
+
+func TestModbusProviderInvalidReading(t *testing.T) {
+	const (
+		meterPower   = 40206 // M_AC_Power of the first meter
+		batteryPower = 57716 // InstantaneousPower of the first battery
+	)
+	sample := simulator.Sample{Production: 4000, Consumption: 1000, Battery: 1000}
+	for _, tt := range []struct {
+		name      string
+		registers map[uint16]uint16
+		ok        bool
+	}{
+		{"valid", nil, true},
+		{"meter power not implemented", map[uint16]uint16{meterPower: 0x8000}, false},
+		{"battery power NaN", map[uint16]uint16{batteryPower: 0x0000, batteryPower + 1: 0x7FC0}, false},
+		// DC power and its scale factor
+		{"production not implemented", map[uint16]uint16{40100: 0x8000, 40101: 0x8000}, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			address := freeAddress(t)
+			sim := simulator.New(simulator.Config{UnitID: 1, Meter: true, Battery: true}, simulator.ProfileFunc(func(time.Duration) simulator.Sample {
+				return sample
+			}))
+			startHandler(t, address, patchedRegisters{sim, tt.registers})
+
+			p := openModbusProvider(t, inverterTarget{Address: address, UnitID: 1})
+			got, err := p.CurrentPowerExport()
+			if !tt.ok {
+				if !errors.Is(err, errInvalidReading) {
+					t.Errorf("CurrentPowerExport() = %v, %v; want invalid reading", got, err)
+				}
+				return
+			}
+			if want := 4000*simulator.Efficiency - 1000; err != nil || got != want {
+				t.Errorf("CurrentPowerExport() = %v, %v; want %v", got, err, want)
+			}
+		})
+	}
+}
+
+// crc16 computes the MODBUS RTU checksum.
+func crc16(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for range 8 {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+
+	return crc
+}
+
+// serveRTU answers MODBUS RTU requests to read holding registers until rw is
+// closed. Like on an RS485 bus, requests to unknown units are not answered.
+func serveRTU(rw io.ReadWriter, handler modbus.RequestHandler) {
+	req := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(rw, req); err != nil {
+			return
+		}
+		if crc16(req[:6]) != binary.LittleEndian.Uint16(req[6:]) || req[1] != 0x03 {
+			continue
+		}
+
+		res := []byte{req[0], req[1]}
+		registers, err := handler.HandleHoldingRegisters(&modbus.HoldingRegistersRequest{
+			UnitId:   req[0],
+			Addr:     binary.BigEndian.Uint16(req[2:]),
+			Quantity: binary.BigEndian.Uint16(req[4:]),
+		})
+		switch {
+		case errors.Is(err, modbus.ErrGWTargetFailedToRespond):
+			continue
+		case errors.Is(err, modbus.ErrIllegalDataAddress):
+			res = append(res[:1], req[1]|0x80, 0x02)
+		case err != nil:
+			res = append(res[:1], req[1]|0x80, 0x04)
+		default:
+			res = append(res, byte(2*len(registers)))
+			for _, r := range registers {
+				res = binary.BigEndian.AppendUint16(res, r)
+			}
+		}
+		res = binary.LittleEndian.AppendUint16(res, crc16(res))
+		if _, err := rw.Write(res); err != nil {
+			return
+		}
+	}
+}
+
+func TestModbusProviderRTUOverTCP(t *testing.T) {
+	sim := simulator.New(simulator.Config{UnitID: 2, Meter: true, Battery: true}, simulator.ProfileFunc(func(time.Duration) simulator.Sample {
+		return simulator.Sample{Production: 3000, Consumption: 800, Battery: 500}
+	}))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serveRTU(conn, sim)
+			}()
+		}
+	}()
+
+	p := openModbusProvider(t, inverterTarget{
+		Transport: TransportRTUOverTCP,
+		Address:   ln.Addr().String(),
+		UnitID:    2,
+		Serial:    serialSettings{BaudRate: 115200, Parity: ParityNone, StopBits: 1},
+	})
+	if got, err := p.CurrentPowerExport(); err != nil || got != 3000*simulator.Efficiency-800 {
+		t.Errorf("CurrentPowerExport() = %v, %v", got, err)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const mqttConnectTimeout = 10 * time.Second
+
+// mqttProvider reads the power export from messages published on an MQTT
+// topic, e.g. by evcc, OpenDTU or a Tasmota SML reader.
+type mqttProvider struct {
+	c       mqtt.Client
+	broker  string
+	topic   string
+	path    []string
+	invert  bool
+	timeout time.Duration
+
+	// mu guards the fields below which are updated by the MQTT client.
+	mu      sync.Mutex
+	value   float64
+	updated time.Time
+}
+
+// newMQTTProvider creates a provider subscribing to topic on the given broker.
+// If path is not empty, the payload is parsed as JSON and the value is looked
+// up using the dot-separated path, e.g. "site.gridPower" or "meters.0.power".
+// Otherwise, the payload is expected to be a plain number. By default,
+// positive values indicate surplus power. Set invert if positive values
+// indicate power drawn from the grid instead.
+func newMQTTProvider(broker, username, password, topic, path string, invert bool, timeout time.Duration) *mqttProvider {
+	p := mqttProvider{
+		broker:  broker,
+		topic:   topic,
+		invert:  invert,
+		timeout: timeout,
+	}
+	if path != "" {
+		p.path = strings.Split(path, ".")
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(fmt.Sprintf("mielesolar-%d", time.Now().UnixNano())).
+		SetUsername(username).
+		SetPassword(password).
+		SetConnectTimeout(mqttConnectTimeout).
+		SetAutoReconnect(true).
+		SetOnConnectHandler(p.subscribe)
+	p.c = mqtt.NewClient(opts)
+
+	return &p
+}
+
+func (p *mqttProvider) subscribe(c mqtt.Client) {
+	token := c.Subscribe(p.topic, 0, p.handleMessage)
+	if !token.WaitTimeout(mqttConnectTimeout) {
+		log.Printf("timeout subscribing to MQTT topic %s", p.topic)
+		return
+	}
+	if err := token.Error(); err != nil {
+		log.Printf("error subscribing to MQTT topic %s: %v", p.topic, err)
+	}
+}
+
+func (p *mqttProvider) handleMessage(_ mqtt.Client, msg mqtt.Message) {
+	value, err := parseMQTTValue(msg.Payload(), p.path)
+	if err != nil {
+		log.Printf("error parsing MQTT message on %s: %v", msg.Topic(), err)
+		return
+	}
+	if p.invert {
+		value = -value
+	}
+
+	p.mu.Lock()
+	p.value = value
+	p.updated = time.Now()
+	p.mu.Unlock()
+}
+
+// parseMQTTValue extracts a number from the payload. The path selects a
+// value from a JSON document; an empty path expects a plain number.
+func parseMQTTValue(payload []byte, path []string) (float64, error) {
+	if len(path) == 0 {
+		return strconv.ParseFloat(strings.TrimSpace(string(payload)), 64)
+	}
+
+	var v any
+	if err := json.Unmarshal(payload, &v); err != nil {
+		return 0, err
+	}
+
+	for _, key := range path {
+		switch node := v.(type) {
+		case map[string]any:
+			var ok bool
+			if v, ok = node[key]; !ok {
+				return 0, fmt.Errorf("key %q not found", key)
+			}
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return 0, fmt.Errorf("invalid index %q", key)
+			}
+			v = node[i]
+		default:
+			return 0, fmt.Errorf("cannot look up %q in %T", key, v)
+		}
+	}
+
+	switch value := v.(type) {
+	case float64:
+		return value, nil
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(value), 64)
+	default:
+		return 0, fmt.Errorf("unexpected value type %T", v)
+	}
+}
+
+func (p *mqttProvider) Open() error {
+	token := p.c.Connect()
+	if !token.WaitTimeout(mqttConnectTimeout) {
+		return fmt.Errorf("timeout connecting to MQTT broker %s", p.broker)
+	}
+	if err := token.Error(); err != nil {
+		return fmt.Errorf("error connecting to MQTT broker %s: %v", p.broker, err)
+	}
+
+	return nil
+}
+
+func (p *mqttProvider) Close() error {
+	p.c.Disconnect(250)
+	return nil
+}
+
+func (p *mqttProvider) Init() {
+	log.Printf("Reading power export from MQTT topic %s on %s", p.topic, p.broker)
+}
+
+func (p *mqttProvider) CurrentPowerExport() (float64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.updated.IsZero() {
+		return 0, fmt.Errorf("no message received on MQTT topic %s", p.topic)
+	}
+	if age := time.Since(p.updated); age > p.timeout {
+		return 0, fmt.Errorf("last message on MQTT topic %s is too old (%v)", p.topic, age.Round(time.Second))
+	}
+
+	return p.value, nil
+}
+
+func (p *mqttProvider) LastReading() powerReading {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return powerReading{
+		Time:       p.updated,
+		MeterPower: p.value,
+		Export:     p.value,
+	}
+}
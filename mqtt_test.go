@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testBroker is a minimal in-process MQTT 3.1.1 broker supporting QoS 0.
+type testBroker struct {
+	t          *testing.T
+	ln         net.Listener
+	mu         sync.Mutex
+	subs       map[string][]net.Conn
+	subscribed chan string
+	messages   map[string][]byte // last message per topic
+}
+
+func newTestBroker(t *testing.T) *testBroker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &testBroker{
+		t:          t,
+		ln:         ln,
+		subs:       make(map[string][]net.Conn),
+		subscribed: make(chan string, 16),
+		messages:   make(map[string][]byte),
+	}
+	go b.accept()
+	t.Cleanup(func() { _ = ln.Close() })
+
+	return b
+}
+
+func (b *testBroker) url() string {
+	return "tcp://" + b.ln.Addr().String()
+}
+
+func (b *testBroker) accept() {
+	for {
+		conn, err := b.ln.Accept()
+		if err != nil {
+			return
+		}
+		go b.handle(conn)
+	}
+}
+
+func readPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+
+	return header, body, nil
+}
+
+func writePacket(w io.Writer, header byte, body []byte) error {
+	pkt := append([]byte{header}, binary.AppendUvarint(nil, uint64(len(body)))...)
+	_, err := w.Write(append(pkt, body...))
+	return err
+}
+
+func mqttString(s string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(s))), s...)
+}
+
+func (b *testBroker) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		header, body, err := readPacket(r)
+		if err != nil {
+			return
+		}
+		switch header >> 4 {
+		case 1: // CONNECT
+			_ = writePacket(conn, 0x20, []byte{0, 0})
+		case 3: // PUBLISH
+			n := binary.BigEndian.Uint16(body)
+			b.publish(string(body[2:2+n]), body[2+n:])
+		case 8: // SUBSCRIBE
+			id, payload := body[:2], body[2:]
+			var granted []byte
+			for len(payload) > 0 {
+				n := binary.BigEndian.Uint16(payload)
+				topic := string(payload[2 : 2+n])
+				payload = payload[3+n:]
+				b.mu.Lock()
+				b.subs[topic] = append(b.subs[topic], conn)
+				b.mu.Unlock()
+				b.subscribed <- topic
+				granted = append(granted, 0)
+			}
+			_ = writePacket(conn, 0x90, append(id, granted...))
+		case 12: // PINGREQ
+			_ = writePacket(conn, 0xd0, nil)
+		case 14: // DISCONNECT
+			return
+		}
+	}
+}
+
+// publish sends a message to all clients subscribed to the topic.
+func (b *testBroker) publish(topic string, payload []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.messages[topic] = payload
+	for filter, conns := range b.subs {
+		if !topicMatches(filter, topic) {
+			continue
+		}
+		for _, conn := range conns {
+			_ = writePacket(conn, 0x30, append(mqttString(topic), payload...))
+		}
+	}
+}
+
+func topicMatches(filter, topic string) bool {
+	f, t := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i := range f {
+		if f[i] == "#" {
+			return true
+		}
+		if i >= len(t) || (f[i] != "+" && f[i] != t[i]) {
+			return false
+		}
+	}
+
+	return len(f) == len(t)
+}
+
+// waitMessage waits for a message on the topic and returns its payload.
+func (b *testBroker) waitMessage(topic string) []byte {
+	b.t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		b.mu.Lock()
+		payload, ok := b.messages[topic]
+		b.mu.Unlock()
+		if ok {
+			return payload
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	b.t.Fatalf("no message on %s", topic)
+
+	return nil
+}
+
+func (b *testBroker) waitSubscribed(topic string) {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case t := <-b.subscribed:
+			if t == topic {
+				return
+			}
+		case <-timeout:
+			b.t.Fatalf("no subscription to %s", topic)
+		}
+	}
+}
+
+// waitForExport polls the provider until cond holds for its result.
+func waitForExport(t *testing.T, p PvProvider, cond func(float64, error) bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got, err := p.CurrentPowerExport()
+		if cond(got, err) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("CurrentPowerExport() = %v, %v", got, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// exportIs returns a condition for waitForExport matching a valid reading.
+func exportIs(want float64) func(float64, error) bool {
+	return func(got float64, err error) bool { return err == nil && got == want }
+}
+
+func TestMQTTProvider(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		invert  bool
+		payload string
+		want    float64
+	}{
+		{"plain", "", false, " 1234.5\n", 1234.5},
+		{"json", "site.gridPower", false, `{"site":{"gridPower":-800}}`, -800},
+		{"json array", "meters.1.power", false, `{"meters":[{"power":1},{"power":"42"}]}`, 42},
+		{"inverted", "", true, "300", -300},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			p := newMQTTProvider(b.url(), "", "", "power/grid", tt.path, tt.invert, time.Minute)
+			if err := p.Open(); err != nil {
+				t.Fatal(err)
+			}
+			defer p.Close()
+			b.waitSubscribed("power/grid")
+
+			if _, err := p.CurrentPowerExport(); err == nil {
+				t.Error("expected error before the first message")
+			}
+
+			b.publish("power/grid", []byte(tt.payload))
+			waitForExport(t, p, exportIs(tt.want))
+		})
+	}
+}
+
+func TestMQTTProviderStale(t *testing.T) {
+	b := newTestBroker(t)
+	p := newMQTTProvider(b.url(), "", "", "power/grid", "", false, 100*time.Millisecond)
+	if err := p.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	b.waitSubscribed("power/grid")
+
+	b.publish("power/grid", []byte("500"))
+	waitForExport(t, p, exportIs(500))
+
+	time.Sleep(200 * time.Millisecond)
+	if v, err := p.CurrentPowerExport(); err == nil {
+		t.Errorf("CurrentPowerExport() = %v, expected error for stale value", v)
+	}
+
+	// invalid messages must not refresh the value
+	b.publish("power/grid", []byte("n/a"))
+	time.Sleep(50 * time.Millisecond)
+	if v, err := p.CurrentPowerExport(); err == nil {
+		t.Errorf("CurrentPowerExport() = %v, expected error after invalid message", v)
+	}
+
+	b.publish("power/grid", []byte("600"))
+	waitForExport(t, p, exportIs(600))
+}
+
+func TestParseMQTTValue(t *testing.T) {
+	for _, tt := range []struct {
+		payload string
+		path    []string
+	}{
+		{`{"a":1}`, []string{"b"}},
+		{`{"a":[1]}`, []string{"a", "1"}},
+		{`{"a":true}`, []string{"a"}},
+		{`{"a":1}`, []string{"a", "b"}},
+		{`not json`, []string{"a"}},
+		{`abc`, nil},
+	} {
+		if v, err := parseMQTTValue([]byte(tt.payload), tt.path); err == nil {
+			t.Errorf("parseMQTTValue(%s, %v) = %v, expected error", tt.payload, tt.path, v)
+		}
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	NotifierWebhook  = "webhook"
+	NotifierNtfy     = "ntfy"
+	NotifierGotify   = "gotify"
+	NotifierTelegram = "telegram"
+
+	defaultRateLimit  = 15 // minutes
+	providerDownAfter = time.Hour
+	notifyTimeout     = 10 * time.Second
+	notifyQueueSize   = 100
+)
+
+const defaultWebhookTemplate = `{"event": {{json .Type}}, "device": {{json .Device}}, "name": {{json .Name}}, ` +
+	`"title": {{json .Title}}, "message": {{json .Message}}, "surplus": {{json .Surplus}}, "time": {{json .Time}}}`
+
+var defaultNotifyEvents = []string{EventStarted, EventStartFailed, EventProviderDown}
+
+var notifyEvents = []string{
+	EventWaiting, EventDelayed, EventStart, EventStarted, EventStartFailed, EventFinished,
+	EventProviderError, EventReconnect, EventProviderDown, EventProviderRestored,
+}
+
+// notifierConfig configures a notification backend.
+type notifierConfig struct {
+	Type     string   `json:"type"`
+	URL      string   `json:"url"`      // webhook URL, ntfy topic URL, Gotify server URL or Telegram Bot API URL
+	Token    string   `json:"token"`    // ntfy access token, Gotify application token or Telegram bot token
+	ChatID   string   `json:"chatId"`   // Telegram chat ID
+	Template string   `json:"template"` // body of webhook requests
+	Events   []string `json:"events"`   // defaults to defaultNotifyEvents
+	// RateLimit is the number of minutes between notifications of the same
+	// event and device. It defaults to defaultRateLimit, 0 disables it.
+	RateLimit *int `json:"rateLimit"`
+}
+
+// validate returns all problems with the notifier configuration.
+func (nc *notifierConfig) validate() []error {
+	var errs []error
+	switch nc.Type {
+	case NotifierWebhook:
+		if _, err := webhookTemplate(nc.Template); err != nil {
+			errs = append(errs, fmt.Errorf("invalid template: %v", err))
+		}
+		fallthrough
+	case NotifierNtfy, NotifierGotify:
+		if nc.URL == "" {
+			errs = append(errs, errors.New("url is required"))
+		}
+	case NotifierTelegram:
+		if nc.Token == "" || nc.ChatID == "" {
+			errs = append(errs, errors.New("token and chatId are required"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("invalid type %q", nc.Type))
+	}
+	for _, e := range nc.Events {
+		if !slices.Contains(notifyEvents, e) {
+			errs = append(errs, fmt.Errorf("invalid event %q", e))
+		}
+	}
+	if nc.RateLimit != nil && *nc.RateLimit < 0 {
+		errs = append(errs, errors.New("rateLimit must not be negative"))
+	}
+
+	return errs
+}
+
+// notifier sends a notification about an event.
+type notifier interface {
+	send(ctx context.Context, title, message string, e historyEvent) error
+}
+
+// post sends a request and checks the response status.
+func post(ctx context.Context, hc *http.Client, url, contentType string, body []byte, header http.Header) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return nil
+}
+
+func webhookTemplate(text string) (*template.Template, error) {
+	return template.New("webhook").Funcs(template.FuncMap{
+		"json": func(v any) (string, error) {
+			data, err := json.Marshal(v)
+			return string(data), err
+		},
+	}).Parse(cmp.Or(text, defaultWebhookTemplate))
+}
+
+// webhookNotifier posts the event as JSON rendered from a template.
+type webhookNotifier struct {
+	hc   *http.Client
+	url  string
+	tmpl *template.Template
+}
+
+func (n *webhookNotifier) send(ctx context.Context, title, message string, e historyEvent) error {
+	var body bytes.Buffer
+	data := struct {
+		historyEvent
+		Title, Message string
+	}{e, title, message}
+	if err := n.tmpl.Execute(&body, data); err != nil {
+		return err
+	}
+
+	return post(ctx, n.hc, n.url, "application/json", body.Bytes(), nil)
+}
+
+// ntfyNotifier publishes to a topic of an ntfy server, e.g.
+// https://ntfy.sh/mytopic.
+type ntfyNotifier struct {
+	hc    *http.Client
+	url   string
+	token string
+}
+
+func (n *ntfyNotifier) send(ctx context.Context, title, message string, e historyEvent) error {
+	header := http.Header{"Title": {title}}
+	if e.Error != "" {
+		header.Set("Tags", "warning")
+		header.Set("Priority", "high")
+	}
+	if n.token != "" {
+		header.Set("Authorization", "Bearer "+n.token)
+	}
+
+	return post(ctx, n.hc, n.url, "text/plain", []byte(message), header)
+}
+
+// gotifyNotifier sends messages to a Gotify server.
+type gotifyNotifier struct {
+	hc    *http.Client
+	url   string
+	token string
+}
+
+func (n *gotifyNotifier) send(ctx context.Context, title, message string, e historyEvent) error {
+	priority := 5
+	if e.Error != "" {
+		priority = 8
+	}
+	body, err := json.Marshal(map[string]any{"title": title, "message": message, "priority": priority})
+	if err != nil {
+		return err
+	}
+
+	return post(ctx, n.hc, strings.TrimSuffix(n.url, "/")+"/message", "application/json", body, http.Header{"X-Gotify-Key": {n.token}})
+}
+
+// telegramNotifier sends messages to a chat using the Telegram Bot API.
+type telegramNotifier struct {
+	hc     *http.Client
+	url    string
+	token  string
+	chatID string
+}
+
+func (n *telegramNotifier) send(ctx context.Context, title, message string, _ historyEvent) error {
+	body, err := json.Marshal(map[string]string{"chat_id": n.chatID, "text": title + "\n" + message})
+	if err != nil {
+		return err
+	}
+	url := cmp.Or(n.url, "https://api.telegram.org")
+	url = strings.TrimSuffix(url, "/") + "/bot" + n.token + "/sendMessage"
+
+	return post(ctx, n.hc, url, "application/json", body, nil)
+}
+
+// notificationText returns the title and message of a notification about
+// the event.
+func notificationText(e historyEvent) (string, string) {
+	var title, message string
+	device := fmt.Sprintf("%s (%s)", e.Name, e.Device)
+	switch e.Type {
+	case EventWaiting:
+		title, message = e.Name+" is waiting", device+" is waiting to be started"
+	case EventDelayed:
+		title, message = "Start of "+e.Name+" delayed", device+" is delayed"
+	case EventStart:
+		title, message = "Starting "+e.Name, "Starting "+device
+	case EventStarted:
+		title, message = "Started "+e.Name, fmt.Sprintf("Started %s with a surplus of %.0f W", device, e.Surplus)
+	case EventStartFailed:
+		title, message = "Failed to start "+e.Name, "Failed to start "+device
+	case EventFinished:
+		title, message = e.Name+" finished", device+" finished"
+	case EventProviderError:
+		title, message = "Error reading the power export", "Error reading the power export"
+	case EventReconnect:
+		title, message = "Reconnected to the inverter", "Reconnected to the inverter"
+		if e.Error != "" {
+			title, message = "Failed to reconnect to the inverter", "Failed to reconnect to the inverter"
+		}
+	case EventProviderDown:
+		title, message = "Power export unavailable", "The power export could not be read"
+	case EventProviderRestored:
+		title, message = "Power export available again", "The power export can be read again"
+	default:
+		title, message = e.Type, e.String()
+	}
+	if e.Reason != "" {
+		message += ": " + e.Reason
+	}
+	if e.Error != "" {
+		message += ": " + e.Error
+	}
+	if e.DryRun {
+		title += " (dry run)"
+	}
+
+	return title, message
+}
+
+// notifyTarget is a notifier together with the events to send and the state
+// of its rate limit.
+type notifyTarget struct {
+	name       string
+	notifier   notifier
+	events     []string
+	rateLimit  time.Duration
+	last       map[string]time.Time // last notification by event type and device
+	suppressed map[string]int
+}
+
+// allow reports whether a notification may be sent and returns the number
+// of notifications suppressed since the last one.
+func (t *notifyTarget) allow(e historyEvent) (bool, int) {
+	if !slices.Contains(t.events, e.Type) {
+		return false, 0
+	}
+
+	key := e.Type + "/" + e.Device
+	if last, ok := t.last[key]; ok && e.Time.Sub(last) < t.rateLimit {
+		t.suppressed[key]++
+		return false, 0
+	}
+	t.last[key] = e.Time
+	n := t.suppressed[key]
+	delete(t.suppressed, key)
+
+	return true, n
+}
+
+// notifiers delivers events to all configured notification backends in the
+// background.
+type notifiers struct {
+	targets []*notifyTarget
+	queue   chan historyEvent
+}
+
+func newNotifiers(configs []notifierConfig, hc *http.Client) (*notifiers, error) {
+	n := notifiers{queue: make(chan historyEvent, notifyQueueSize)}
+	for _, nc := range configs {
+		t := notifyTarget{
+			name:       nc.Type,
+			events:     nc.Events,
+			rateLimit:  defaultRateLimit * time.Minute,
+			last:       make(map[string]time.Time),
+			suppressed: make(map[string]int),
+		}
+		if len(t.events) == 0 {
+			t.events = defaultNotifyEvents
+		}
+		if nc.RateLimit != nil {
+			t.rateLimit = time.Duration(*nc.RateLimit) * time.Minute
+		}
+		switch nc.Type {
+		case NotifierWebhook:
+			tmpl, err := webhookTemplate(nc.Template)
+			if err != nil {
+				return nil, err
+			}
+			t.notifier = &webhookNotifier{hc: hc, url: nc.URL, tmpl: tmpl}
+		case NotifierNtfy:
+			t.notifier = &ntfyNotifier{hc: hc, url: nc.URL, token: nc.Token}
+		case NotifierGotify:
+			t.notifier = &gotifyNotifier{hc: hc, url: nc.URL, token: nc.Token}
+		case NotifierTelegram:
+			t.notifier = &telegramNotifier{hc: hc, url: nc.URL, token: nc.Token, chatID: nc.ChatID}
+		default:
+			return nil, fmt.Errorf("invalid notifier type %q", nc.Type)
+		}
+		n.targets = append(n.targets, &t)
+	}
+
+	return &n, nil
+}
+
+// notify queues an event without blocking. Events are dropped if the queue
+// is full, e.g. because a backend is unreachable.
+func (n *notifiers) notify(e historyEvent) {
+	select {
+	case n.queue <- e:
+	default:
+		log.Printf("notification queue full, dropping %s event", e.Type)
+	}
+}
+
+func (n *notifiers) run(ctx context.Context) {
+	for {
+		select {
+		case e := <-n.queue:
+			n.send(ctx, e)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (n *notifiers) send(ctx context.Context, e historyEvent) {
+	title, message := notificationText(e)
+	for _, t := range n.targets {
+		ok, suppressed := t.allow(e)
+		if !ok {
+			continue
+		}
+		msg := message
+		if suppressed > 0 {
+			msg += fmt.Sprintf(" (%d similar notifications suppressed)", suppressed)
+		}
+		ctx, cancel := context.WithTimeout(ctx, notifyTimeout)
+		if err := t.notifier.send(ctx, title, msg, e); err != nil {
+			log.Printf("error sending %s notification: %v", t.name, err)
+		}
+		cancel()
+	}
+}
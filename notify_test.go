@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ingmarstein/miele-go/miele"
+)
+
+type notifyRequest struct {
+	path   string
+	header http.Header
+	body   string
+}
+
+// notifyServer is a local stand-in for the notification services which
+// forwards all requests to a channel.
+func notifyServer(t *testing.T) (*httptest.Server, chan notifyRequest) {
+	t.Helper()
+
+	requests := make(chan notifyRequest, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(r.URL.Path, "fail") {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		}
+		requests <- notifyRequest{r.URL.Path, r.Header, string(body)}
+	}))
+	t.Cleanup(ts.Close)
+
+	return ts, requests
+}
+
+func receive(t *testing.T, requests chan notifyRequest) notifyRequest {
+	t.Helper()
+
+	select {
+	case r := <-requests:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification received")
+		return notifyRequest{}
+	}
+}
+
+func TestNotifiers(t *testing.T) {
+	ts, requests := notifyServer(t)
+	n, err := newNotifiers([]notifierConfig{
+		{Type: NotifierWebhook, URL: ts.URL + "/webhook"},
+		{Type: NotifierWebhook, URL: ts.URL + "/custom", Template: `{"text": {{json .Message}}, "power": {{.Power}}}`},
+		{Type: NotifierNtfy, URL: ts.URL + "/mielesolar", Token: "tk_ntfy"},
+		{Type: NotifierGotify, URL: ts.URL + "/", Token: "gotify-token"},
+		{Type: NotifierTelegram, URL: ts.URL, Token: "123:abc", ChatID: "42"},
+	}, ts.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n.send(context.Background(), historyEvent{
+		Time:    time.Now(),
+		Type:    EventStarted,
+		Device:  "000123",
+		Name:    "Dishwasher",
+		Power:   1000,
+		Surplus: 1200,
+		Reason:  "surplus: 1200.000000",
+	})
+
+	var webhook map[string]any
+	r := receive(t, requests)
+	if err := json.Unmarshal([]byte(r.body), &webhook); err != nil || r.path != "/webhook" {
+		t.Fatalf("invalid webhook request %+v: %v", r, err)
+	}
+	if webhook["event"] != EventStarted || webhook["device"] != "000123" || webhook["title"] != "Started Dishwasher" || webhook["surplus"] != 1200.0 {
+		t.Errorf("unexpected webhook payload %v", webhook)
+	}
+
+	r = receive(t, requests)
+	if want := `{"text": "Started Dishwasher (000123) with a surplus of 1200 W: surplus: 1200.000000", "power": 1000}`; r.path != "/custom" || r.body != want {
+		t.Errorf("custom webhook = %+v, want body %s", r, want)
+	}
+
+	r = receive(t, requests)
+	if r.path != "/mielesolar" || r.header.Get("Title") != "Started Dishwasher" || r.header.Get("Authorization") != "Bearer tk_ntfy" || !strings.HasPrefix(r.body, "Started Dishwasher (000123)") {
+		t.Errorf("unexpected ntfy request %+v", r)
+	}
+
+	r = receive(t, requests)
+	var gotify struct {
+		Title    string `json:"title"`
+		Message  string `json:"message"`
+		Priority int    `json:"priority"`
+	}
+	if err := json.Unmarshal([]byte(r.body), &gotify); err != nil || r.path != "/message" || r.header.Get("X-Gotify-Key") != "gotify-token" || gotify.Title != "Started Dishwasher" || gotify.Priority != 5 {
+		t.Errorf("unexpected gotify request %+v: %v", r, err)
+	}
+
+	r = receive(t, requests)
+	var telegram map[string]string
+	if err := json.Unmarshal([]byte(r.body), &telegram); err != nil || r.path != "/bot123:abc/sendMessage" || telegram["chat_id"] != "42" || !strings.HasPrefix(telegram["text"], "Started Dishwasher\n") {
+		t.Errorf("unexpected telegram request %+v: %v", r, err)
+	}
+}
+
+type fakeNotifier struct {
+	messages []string
+}
+
+func (n *fakeNotifier) send(_ context.Context, title, message string, _ historyEvent) error {
+	n.messages = append(n.messages, message)
+	return nil
+}
+
+func TestNotifyRateLimit(t *testing.T) {
+	fn := &fakeNotifier{}
+	n := notifiers{targets: []*notifyTarget{{
+		notifier:   fn,
+		events:     []string{EventReconnect, EventStarted},
+		rateLimit:  15 * time.Minute,
+		last:       make(map[string]time.Time),
+		suppressed: make(map[string]int),
+	}}}
+
+	start := time.Now()
+	for _, e := range []historyEvent{
+		{Time: start, Type: EventReconnect, Error: "timeout"},
+		{Time: start.Add(time.Minute), Type: EventReconnect, Error: "timeout"},
+		{Time: start.Add(2 * time.Minute), Type: EventReconnect, Error: "timeout"},
+		{Time: start.Add(2 * time.Minute), Type: EventProviderError, Error: "timeout"}, // not enabled
+		{Time: start.Add(3 * time.Minute), Type: EventStarted, Device: "1", Name: "Washer"},
+		{Time: start.Add(4 * time.Minute), Type: EventStarted, Device: "2", Name: "Dryer"},
+		{Time: start.Add(16 * time.Minute), Type: EventReconnect},
+	} {
+		n.send(context.Background(), e)
+	}
+
+	want := []string{
+		"Failed to reconnect to the inverter: timeout",
+		"Started Washer (1) with a surplus of 0 W",
+		"Started Dryer (2) with a surplus of 0 W",
+		"Reconnected to the inverter (2 similar notifications suppressed)",
+	}
+	if strings.Join(fn.messages, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got messages:\n%s\nwant:\n%s", strings.Join(fn.messages, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestNotifyRateLimitConfig(t *testing.T) {
+	zero, hour := 0, 60
+	n, err := newNotifiers([]notifierConfig{
+		{Type: NotifierNtfy, URL: "http://localhost/default"},
+		{Type: NotifierNtfy, URL: "http://localhost/disabled", RateLimit: &zero},
+		{Type: NotifierNtfy, URL: "http://localhost/hourly", RateLimit: &hour},
+	}, http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, want := range []time.Duration{defaultRateLimit * time.Minute, 0, time.Hour} {
+		if got := n.targets[i].rateLimit; got != want {
+			t.Errorf("notifier %d: rate limit %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestNotifyServerEvents(t *testing.T) {
+	f := newFakeMiele(t)
+	f.add("washer", "Washing Machine", miele.DEVICE_TYPE_WASHING_MACHINE, true)
+	ts, requests := notifyServer(t)
+
+	cfg := defaultConfig()
+	cfg.Devices = []device{{ID: "washer", Name: "Washing Machine", Power: 300}}
+	cfg.Notify = []notifierConfig{{Type: NotifierNtfy, URL: ts.URL + "/mielesolar", Events: []string{EventStartFailed, EventProviderDown, EventProviderRestored}}}
+	pp := &fakeProvider{power: 1000, err: errors.New("connection refused")}
+	srv := newServer(cfg, f.client(), pp)
+
+	// the provider has been unavailable for more than an hour
+	for range 2 {
+		if err := srv.refresh(); err == nil {
+			t.Fatal("expected provider error")
+		}
+		srv.mu.Lock()
+		srv.providerDown = srv.providerDown.Add(-providerDownAfter)
+		srv.mu.Unlock()
+	}
+	if r := receive(t, requests); r.header.Get("Title") != "Power export unavailable" || !strings.Contains(r.body, "connection refused") {
+		t.Errorf("unexpected notification %+v", r)
+	}
+
+	// the washer has been started elsewhere since the last refresh
+	pp.err = nil
+	if err := srv.mc.start("washer"); err != nil {
+		t.Fatal(err)
+	}
+	srv.mu.Lock()
+	if err := srv.startDevice(&srv.devices[0], "test", 0); err == nil {
+		t.Error("expected error starting a running device")
+	}
+	srv.mu.Unlock()
+	if r := receive(t, requests); r.header.Get("Title") != "Failed to start Washing Machine" || r.header.Get("Tags") != "warning" {
+		t.Errorf("unexpected notification %+v", r)
+	}
+
+	// the connection is restored
+	f.add("washer", "Washing Machine", miele.DEVICE_TYPE_WASHING_MACHINE, true)
+	refresh(t, srv)
+	if r := receive(t, requests); r.header.Get("Title") != "Power export available again" {
+		t.Errorf("unexpected notification %+v", r)
+	}
+}
+
+func TestNotifyConfigValidation(t *testing.T) {
+	name := writeConfig(t, `{`+testCredentials+`, "auto": 500, "notify": [
+		{"type": "ntfy"},
+		{"type": "telegram", "token": "123:abc"},
+		{"type": "webhook", "url": "http://localhost", "template": "{{"},
+		{"type": "pager", "events": ["started", "exploded"], "rateLimit": -1}
+	]}`)
+	_, err := testParseConfig([]string{"-config", name}, nil)
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	for _, want := range []string{
+		"notify[0] (ntfy): url is required",
+		"notify[1] (telegram): token and chatId are required",
+		"notify[2] (webhook): invalid template",
+		`notify[3] (pager): invalid type "pager"`,
+		`notify[3] (pager): invalid event "exploded"`,
+		"notify[3] (pager): rateLimit must not be negative",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("missing error %q in:\n%v", want, err)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/goburrow/serial"
+	"github.com/ingmarstein/mielesolar/dsmr"
+)
+
+// p1Provider reads the grid power from the P1 port of a DSMR smart meter,
+// either through a serial device or a TCP socket, e.g. of ser2net.
+type p1Provider struct {
+	stream *meterStream[*dsmr.Telegram]
+	last   powerReading
+}
+
+// newP1Provider creates a provider reading the P1 port at address. DSMR 4
+// and 5 meters use 115200 baud with 8N1, DSMR 2.2 and 3 meters 9600 baud
+// with 7E1.
+func newP1Provider(address string, baudRate int) *p1Provider {
+	settings := serial.Config{BaudRate: baudRate, DataBits: 8, StopBits: 1, Parity: "N"}
+	if baudRate == 9600 {
+		settings.DataBits, settings.Parity = 7, "E"
+	}
+	newReader := func(r io.Reader) meterReader[*dsmr.Telegram] { return dsmr.NewReader(r) }
+	invalid := func(err error) bool {
+		var parseErr *dsmr.ParseError
+		return errors.Is(err, dsmr.ErrChecksum) || errors.Is(err, dsmr.ErrTooLarge) || errors.As(err, &parseErr)
+	}
+
+	return &p1Provider{stream: newMeterStream("P1", address, settings, newReader, invalid)}
+}
+
+func (p *p1Provider) Open() error {
+	return p.stream.open()
+}
+
+func (p *p1Provider) Close() error {
+	return p.stream.close()
+}
+
+func (p *p1Provider) Init() {
+	telegram, _, err := p.stream.latest()
+	if err != nil {
+		log.Printf("%v, retrying later", err)
+		return
+	}
+
+	log.Printf("P1 meter: %s", telegram.Header)
+	if v := telegram.Version(); v != "" {
+		log.Printf("P1 version: %s", v)
+	}
+	if v, ok := telegram.Value(dsmr.OBISEquipmentID); ok {
+		// the equipment identifier is transmitted as hex encoded ASCII
+		id := v.Raw
+		if b, err := hex.DecodeString(id); err == nil {
+			id = string(b)
+		}
+		log.Printf("P1 equipment ID: %s", id)
+	}
+}
+
+func (p *p1Provider) CurrentPowerExport() (float64, error) {
+	telegram, received, err := p.stream.latest()
+	if err != nil {
+		return 0, err
+	}
+
+	imported, ok1 := telegram.Power(dsmr.OBISPowerDelivered)
+	exported, ok2 := telegram.Power(dsmr.OBISPowerReceived)
+	if !ok1 || !ok2 {
+		return 0, fmt.Errorf("%w: P1 telegram lacks %s or %s", errInvalidReading, dsmr.OBISPowerDelivered, dsmr.OBISPowerReceived)
+	}
+
+	// positive values indicate a surplus -> export to grid
+	meterPower := exported - imported
+	log.Printf("Meter AC Power: %f", meterPower)
+
+	p.last = powerReading{
+		Time:       received,
+		MeterPower: meterPower,
+		Export:     meterPower,
+		Phases:     p1Phases(telegram),
+	}
+
+	return meterPower, nil
+}
+
+// p1Phases returns the values of the phases reported in the telegram.
+func p1Phases(telegram *dsmr.Telegram) []phaseReading {
+	var phases []phaseReading
+	for i := range 3 {
+		delivered, ok1 := telegram.Power(dsmr.OBISPhasePowerDelivered[i])
+		received, ok2 := telegram.Power(dsmr.OBISPhasePowerReceived[i])
+		voltage, ok3 := telegram.Float(dsmr.OBISPhaseVoltage[i])
+		current, ok4 := telegram.Float(dsmr.OBISPhaseCurrent[i])
+		if !ok1 && !ok2 && !ok3 && !ok4 {
+			break
+		}
+		phases = append(phases, phaseReading{Power: received - delivered, Voltage: voltage, Current: current})
+	}
+
+	return phases
+}
+
+func (p *p1Provider) LastReading() powerReading {
+	return p.last
+}
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestP1ProviderSerial(t *testing.T) {
+	master, name := openPty(t)
+
+	p := newP1Provider(name, 115200)
+	if err := p.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	if _, err := master.Write(readP1Telegram(t, "dsmr5.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := p.CurrentPowerExport(); err != nil || got != 1234 {
+		t.Errorf("CurrentPowerExport() = %v, %v; want 1234", got, err)
+	}
+
+	// closing stops the reader waiting for the next telegram
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := master.Write(readP1Telegram(t, "dsmr4.txt")); err != nil {
+		t.Fatal(err)
+	}
+	waitForExport(t, p, exportIs(-870))
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func readP1Telegram(t *testing.T, name string) []byte {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("dsmr", "testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func TestP1Provider(t *testing.T) {
+	for _, tt := range []struct {
+		file   string
+		want   float64
+		phases []phaseReading
+	}{
+		{"dsmr5.txt", 1234, []phaseReading{{512, 231, 2}, {400, 230.5, 1}, {322, 229.8, 1}}},
+		{"dsmr4.txt", -870, []phaseReading{{-210, 0, 1}, {-350, 0, 2}, {-310, 0, 1}}},
+		{"fluvius.txt", 480, []phaseReading{{160, 234.6, 0.71}, {160, 233.9, 0.72}, {160, 235.1, 0.7}}},
+		{"dsmr22.txt", -540, nil},
+	} {
+		t.Run(tt.file, func(t *testing.T) {
+			address, conns := newFakeMeter(t)
+			p := newP1Provider(address, 115200)
+			if err := p.Open(); err != nil {
+				t.Fatal(err)
+			}
+			defer p.Close()
+
+			// the connection starts in the middle of a telegram
+			telegram := readP1Telegram(t, tt.file)
+			conn := acceptMeter(t, conns)
+			if _, err := conn.Write(slices.Concat(telegram[len(telegram)/2:], telegram)); err != nil {
+				t.Fatal(err)
+			}
+			p.Init()
+
+			got, err := p.CurrentPowerExport()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("CurrentPowerExport() = %v, want %v", got, tt.want)
+			}
+			r := p.LastReading()
+			if r.MeterPower != tt.want || r.Export != tt.want || len(r.Phases) != len(tt.phases) {
+				t.Fatalf("LastReading() = %+v", r)
+			}
+			for i, phase := range r.Phases {
+				want := tt.phases[i]
+				if !approxEqual(phase.Power, want.Power) || phase.Voltage != want.Voltage || phase.Current != want.Current {
+					t.Errorf("L%d = %+v, want %+v", i+1, phase, want)
+				}
+			}
+		})
+	}
+}
+
+func approxEqual(a, b float64) bool {
+	return a-b < 1e-9 && b-a < 1e-9
+}
+
+func TestP1ProviderInvalidTelegrams(t *testing.T) {
+	address, conns := newFakeMeter(t)
+	p := newP1Provider(address, 115200)
+	if err := p.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// telegrams with a wrong checksum are skipped
+	dsmr4, dsmr5 := readP1Telegram(t, "dsmr4.txt"), readP1Telegram(t, "dsmr5.txt")
+	corrupted := bytes.Replace(dsmr5, []byte("(01.234*kW)"), []byte("(09.234*kW)"), 1)
+	conn := acceptMeter(t, conns)
+	if _, err := conn.Write(slices.Concat(corrupted, dsmr4)); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := p.CurrentPowerExport(); err != nil || got != -870 {
+		t.Errorf("CurrentPowerExport() = %v, %v; want -870", got, err)
+	}
+
+	// a meter without the power values
+	if _, err := conn.Write([]byte("/ISk5\\2MT382-1004\r\n\r\n0-0:96.1.1(4B384547303034303436333935353037)\r\n!\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	waitForExport(t, p, func(_ float64, err error) bool { return errors.Is(err, errInvalidReading) })
+}
+
+func TestP1ProviderReconnect(t *testing.T) {
+	address, conns := newFakeMeter(t)
+	p := newP1Provider(address, 115200)
+	if err := p.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	conn := acceptMeter(t, conns)
+	if _, err := conn.Write(readP1Telegram(t, "dsmr5.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.CurrentPowerExport(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a lost connection is reported so that the server reconnects
+	_ = conn.Close()
+	waitForExport(t, p, func(_ float64, err error) bool { return err != nil && !errors.Is(err, errInvalidReading) })
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Open(); err != nil {
+		t.Fatal(err)
+	}
+	conn = acceptMeter(t, conns)
+	if _, err := conn.Write(readP1Telegram(t, "dsmr4.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := p.CurrentPowerExport(); err != nil || got != -870 {
+		t.Errorf("CurrentPowerExport() = %v, %v; want -870", got, err)
+	}
+}
+
+func TestP1ProviderNotOpen(t *testing.T) {
+	address, _ := newFakeMeter(t)
+	p := newP1Provider(address, 115200)
+
+	// without a connection, there is nothing to wait for
+	start := time.Now()
+	if _, err := p.CurrentPowerExport(); err == nil {
+		t.Error("expected error reading a closed port")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("CurrentPowerExport() took %v", d)
+	}
+}
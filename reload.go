@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"slices"
+	"time"
+)
+
+const configPollInterval = 5 * time.Second
+
+// applyConfig applies the scheduling settings and device list of cfg. The
+// runtime state of devices which remain configured is preserved. Settings of
+// the providers, MQTT and the HTTP API require a restart. The caller must hold
+// s.mu unless the server is not yet running.
+func (s *server) applyConfig(cfg *config) {
+	s.mode = cfg.mode()
+	s.autoPower = cfg.Auto
+	if delay := time.Duration(cfg.Delay) * time.Second; delay != s.startDelay {
+		s.startDelay = delay
+		// apply the new delay to the most recent start
+		var lastStart time.Time
+		for i := range s.devices {
+			if s.devices[i].lastStart.After(lastStart) {
+				lastStart = s.devices[i].lastStart
+			}
+		}
+		if !lastStart.IsZero() {
+			s.nextStart = lastStart.Add(delay)
+		}
+	}
+	s.sustain = time.Duration(cfg.Sustain) * time.Minute
+	s.deadline = cfg.Deadline
+	s.dryRun = cfg.DryRun
+
+	if s.mode != ManualMode {
+		// devices are discovered on the next refresh, which keeps their state
+		for i := range s.devices {
+			s.devices[i].Power = float64(s.autoPower)
+		}
+		return
+	}
+
+	devices := slices.Clone(cfg.Devices)
+	for i := range devices {
+		if prev := s.findDevice(devices[i].ID); prev != nil {
+			devices[i].waiting = prev.waiting
+			devices[i].deadline = prev.deadline
+			devices[i].lastStart = prev.lastStart
+			devices[i].skipUntil = prev.skipUntil
+		}
+	}
+	s.devices = devices
+}
+
+// reload loads the configuration and applies it. An invalid configuration is
+// rejected and the current one is kept.
+func (s *server) reload(load func() (*config, error)) {
+	cfg, err := load()
+	if err != nil {
+		log.Printf("error reloading configuration, keeping the current one:\n%v", err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.applyConfig(cfg)
+	log.Printf("reloaded configuration: %d devices, mode %s", len(cfg.Devices), s.mode)
+	s.publishState()
+	s.saveState()
+}
+
+// watchConfig reloads the configuration whenever the configuration file
+// changes or a value is received on trigger (e.g. SIGHUP).
+func (s *server) watchConfig(ctx context.Context, name string, interval time.Duration, trigger <-chan os.Signal, load func() (*config, error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last, _ := os.Stat(name)
+	for {
+		select {
+		case <-ticker.C:
+			fi, err := os.Stat(name)
+			if err != nil {
+				if last != nil {
+					log.Printf("error watching configuration file: %v", err)
+				}
+				last = nil
+				continue
+			}
+			if last != nil && fi.ModTime().Equal(last.ModTime()) && fi.Size() == last.Size() {
+				continue
+			}
+			last = fi
+			log.Printf("configuration file %s changed", name)
+		case sig := <-trigger:
+			log.Printf("received %v", sig)
+		case <-ctx.Done():
+			return
+		}
+		s.reload(load)
+	}
+}
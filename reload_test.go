@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ingmarstein/miele-go/miele"
+)
+
+func deviceIDs(s *server) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ids []string
+	for _, d := range s.devices {
+		ids = append(ids, d.ID)
+	}
+
+	return ids
+}
+
+func waitForDevices(t *testing.T, s *server, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if len(deviceIDs(s)) == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("got devices %v, want %d devices", deviceIDs(s), n)
+}
+
+func TestReloadConfig(t *testing.T) {
+	f := newFakeMiele(t)
+	f.add("washer", "Washing Machine", miele.DEVICE_TYPE_WASHING_MACHINE, true)
+	f.add("dryer", "Tumble Dryer", miele.DEVICE_TYPE_TUMBLE_DRYER, true)
+
+	name := writeConfig(t, `{`+testCredentials+`, "delay": 60, "devices": [{"id": "washer", "power": 300}]}`)
+	load := func() (*config, error) {
+		return parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", name}, func(string) string { return "" })
+	}
+	cfg, err := load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := newServer(cfg, f.client(), &fakeProvider{power: 1000})
+	refresh(t, srv)
+	checkStarted(t, f, "washer")
+	lastStart := srv.devices[0].lastStart
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	trigger := make(chan os.Signal)
+	go srv.watchConfig(ctx, name, 10*time.Millisecond, trigger, load)
+
+	// make sure the modification time changes on file systems with a coarse resolution
+	time.Sleep(20 * time.Millisecond)
+	future := time.Now().Add(time.Minute)
+	if err := os.WriteFile(name, []byte(`{`+testCredentials+`, "delay": 0, "devices": [{"id": "dryer", "power": 200}, {"id": "washer", "power": 100}]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(name, future, future); err != nil {
+		t.Fatal(err)
+	}
+	waitForDevices(t, srv, 2)
+
+	srv.mu.Lock()
+	if srv.startDelay != 0 {
+		t.Errorf("startDelay = %v, want 0", srv.startDelay)
+	}
+	if d := srv.findDevice("washer"); d.Power != 100 || !d.lastStart.Equal(lastStart) {
+		t.Errorf("washer = %+v, want updated power and preserved last start", d)
+	}
+	srv.mu.Unlock()
+
+	// invalid configurations are rejected
+	if err := os.WriteFile(name, []byte(`{`+testCredentials+`, "devices": [{"id": "dryer", "power": -1}]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	trigger <- syscall.SIGHUP
+	trigger <- syscall.SIGHUP // wait for the first reload to finish
+	if ids := deviceIDs(srv); len(ids) != 2 || ids[0] != "dryer" {
+		t.Errorf("got devices %v after invalid configuration", ids)
+	}
+
+	// the new priority order applies
+	if err := os.WriteFile(name, []byte(`{`+testCredentials+`, "delay": 0, "devices": [{"id": "dryer", "power": 200}]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	trigger <- syscall.SIGHUP
+	waitForDevices(t, srv, 1)
+	refresh(t, srv)
+	checkStarted(t, f, "washer", "dryer")
+}
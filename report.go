@@ -0,0 +1,173 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"time"
+)
+
+// deviceReport summarizes the starts of a device on one day.
+type deviceReport struct {
+	ID         string
+	Name       string
+	Starts     int
+	Surplus    float64       // sum of the surplus at start time
+	Runtime    time.Duration // of the finished starts
+	Energy     float64       // estimated self-consumed energy in Wh
+	Unfinished int           // starts without a finished event
+}
+
+// dayReport summarizes the history of one day.
+type dayReport struct {
+	Date           string
+	Devices        []*deviceReport
+	Failures       int
+	ProviderErrors int
+}
+
+func (r *dayReport) device(e historyEvent) *deviceReport {
+	for _, d := range r.Devices {
+		if d.ID == e.Device {
+			return d
+		}
+	}
+	d := &deviceReport{ID: e.Device, Name: e.Name}
+	r.Devices = append(r.Devices, d)
+
+	return d
+}
+
+// energy returns the estimated self-consumed energy of all devices in Wh.
+func (r *dayReport) energy() float64 {
+	var energy float64
+	for _, d := range r.Devices {
+		energy += d.Energy
+	}
+
+	return energy
+}
+
+// dailyReports summarizes events by day. The self-consumed energy of a start
+// is estimated as the part of the device power covered by the surplus at
+// start time, multiplied by the runtime until the device finished.
+func dailyReports(events []historyEvent) []*dayReport {
+	var reports []*dayReport
+	days := make(map[string]*dayReport)
+	pending := make(map[string]historyEvent) // started events by device
+
+	for _, e := range events {
+		date := e.Time.Local().Format(time.DateOnly)
+		r := days[date]
+		if r == nil {
+			r = &dayReport{Date: date}
+			days[date] = r
+			reports = append(reports, r)
+		}
+
+		switch e.Type {
+		case EventStarted:
+			d := r.device(e)
+			d.Starts++
+			d.Unfinished++
+			d.Surplus += e.Surplus
+			pending[e.Device] = e
+		case EventFinished:
+			start, ok := pending[e.Device]
+			if !ok {
+				continue
+			}
+			delete(pending, e.Device)
+			// attribute the energy to the day of the start
+			d := days[start.Time.Local().Format(time.DateOnly)].device(start)
+			d.Unfinished--
+			runtime := e.Time.Sub(start.Time)
+			d.Runtime += runtime
+			d.Energy += min(start.Power, max(start.Surplus, 0)) * runtime.Hours()
+		case EventStartFailed:
+			r.Failures++
+		case EventProviderError:
+			r.ProviderErrors++
+		}
+	}
+
+	for _, r := range reports {
+		slices.SortFunc(r.Devices, func(a, b *deviceReport) int { return cmp.Compare(a.Name, b.Name) })
+	}
+
+	return reports
+}
+
+func (r *dayReport) write(w io.Writer) {
+	var starts int
+	for _, d := range r.Devices {
+		starts += d.Starts
+	}
+	fmt.Fprintf(w, "%s: %d starts, %d failed, %d provider errors, estimated self-consumption %.2f kWh\n",
+		r.Date, starts, r.Failures, r.ProviderErrors, r.energy()/1000)
+	for _, d := range r.Devices {
+		fmt.Fprintf(w, "  %s (%s): %d starts, average surplus at start %.0f W, runtime %v, self-consumed %.2f kWh",
+			d.Name, d.ID, d.Starts, d.Surplus/float64(d.Starts), d.Runtime.Round(time.Minute), d.Energy/1000)
+		if d.Unfinished > 0 {
+			fmt.Fprintf(w, " (%d not finished)", d.Unfinished)
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// runHistory implements the "history" subcommand which prints the recorded
+// events or a daily report.
+func runHistory(args []string) {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	file := fs.String("file", cmp.Or(os.Getenv("HISTORY_FILE"), "history.jsonl"), "History file [$HISTORY_FILE]")
+	since := fs.Duration("since", 24*time.Hour, "Only show events of the given period, e.g. \"168h\". All events if 0")
+	id := fs.String("device", "", "Only show events of the device with the given ID")
+	report := fs.Bool("report", false, "Print a daily report instead of the events")
+	asJSON := fs.Bool("json", false, "Print the events as JSON lines")
+	_ = fs.Parse(args)
+
+	events, err := readHistory(*file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	events = filterHistory(events, *since, *id, time.Now())
+
+	if *report {
+		for _, r := range dailyReports(events) {
+			r.write(os.Stdout)
+		}
+		return
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	for _, e := range events {
+		if *asJSON {
+			_ = enc.Encode(e)
+		} else {
+			fmt.Println(e)
+		}
+	}
+}
+
+// filterHistory returns the events since the given period before now which
+// concern the device with the given ID. Device-independent events are kept
+// unless id is set.
+func filterHistory(events []historyEvent, since time.Duration, id string, now time.Time) []historyEvent {
+	var filtered []historyEvent
+	for _, e := range events {
+		if since > 0 && e.Time.Before(now.Add(-since)) {
+			continue
+		}
+		if id != "" && e.Device != id {
+			continue
+		}
+		filtered = append(filtered, e)
+	}
+
+	return filtered
+}
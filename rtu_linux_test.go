@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/ingmarstein/mielesolar/modbus/simulator"
+)
+
+// openPty returns the master side of a new pseudo terminal and the path of
+// its slave side, which stands in for a serial device.
+func openPty(t *testing.T) (*os.File, string) {
+	t.Helper()
+
+	fd, err := syscall.Open("/dev/ptmx", syscall.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		t.Skipf("pseudo terminals unavailable: %v", err)
+	}
+	master := os.NewFile(uintptr(fd), "/dev/ptmx")
+	t.Cleanup(func() { _ = master.Close() })
+
+	var unlock int32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); errno != 0 {
+		t.Fatalf("error unlocking pty: %v", errno)
+	}
+	var n uint32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); errno != 0 {
+		t.Fatalf("error getting pty number: %v", errno)
+	}
+	name := fmt.Sprintf("/dev/pts/%d", n)
+
+	// keep the slave side open so that the master doesn't hang up when the
+	// provider reconnects
+	slave, err := os.OpenFile(name, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = slave.Close() })
+
+	return master, name
+}
+
+func TestModbusProviderRTU(t *testing.T) {
+	master, device := openPty(t)
+	leader := simulator.New(simulator.Config{UnitID: 1, Meter: true}, simulator.ProfileFunc(func(time.Duration) simulator.Sample {
+		return simulator.Sample{Production: 3000, Consumption: 1000}
+	}))
+	follower := simulator.New(simulator.Config{UnitID: 2}, simulator.ProfileFunc(func(time.Duration) simulator.Sample {
+		return simulator.Sample{Production: 2000}
+	}))
+	go serveRTU(master, unitMux{1: leader, 2: follower})
+
+	serial := serialSettings{BaudRate: 115200, Parity: ParityEven, StopBits: 1}
+	p := openModbusProvider(t,
+		inverterTarget{Transport: TransportRTU, Address: device, UnitID: 1, Serial: serial},
+		inverterTarget{Transport: TransportRTU, Address: device, UnitID: 2, Serial: serial},
+	)
+	if len(p.conns) != 1 {
+		t.Errorf("got %d connections, want one for the bus", len(p.conns))
+	}
+
+	got, err := p.CurrentPowerExport()
+	if want := 3000*simulator.Efficiency - 1000; err != nil || got != want {
+		t.Errorf("CurrentPowerExport() = %v, %v; want %v", got, err, want)
+	}
+	if r := p.LastReading(); r.PVPower != 5000 {
+		t.Errorf("LastReading() = %+v, want the production of both inverters", r)
+	}
+
+	// reconnect as server.serve does after an error
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.CurrentPowerExport(); err != nil {
+		t.Errorf("CurrentPowerExport() = %v after reconnect", err)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	secretCommandTimeout = 10 * time.Second
+	redacted             = "[REDACTED]"
+)
+
+// secretOptions are the options holding secrets. Their values are redacted
+// from the log and can be obtained from an external command.
+var secretOptions = []string{"client-secret", "password", "solarmanager-password", "mqtt-password"}
+
+// lookupEnv returns the value of the option's environment variable. Instead
+// of the variable itself, <VAR>_FILE may name a file containing the value
+// (e.g. a Docker or Kubernetes secret) and for secrets, <VAR>_COMMAND may
+// specify a command printing the value.
+func lookupEnv(o *option, getenv func(string) string) (string, error) {
+	value, file, command := getenv(o.env), getenv(o.env+"_FILE"), ""
+	if slices.Contains(secretOptions, o.flag) {
+		command = getenv(o.env + "_COMMAND")
+	}
+	set := 0
+	for _, v := range []string{value, file, command} {
+		if v != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		return "", fmt.Errorf("only one of %s, %s_FILE and %s_COMMAND may be set", o.env, o.env, o.env)
+	}
+
+	switch {
+	case file != "":
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("error reading %s_FILE: %v", o.env, err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case command != "":
+		return runSecretCommand(command)
+	default:
+		return value, nil
+	}
+}
+
+// runSecretCommand runs a credential helper like "pass show miele" and
+// returns the first line of its output. The command is not run by a shell.
+func runSecretCommand(command string) (string, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return "", fmt.Errorf("empty command")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), secretCommandTimeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("error running %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+
+	secret, _, _ := strings.Cut(string(out), "\n")
+	return strings.TrimRight(secret, "\r"), nil
+}
+
+// secrets returns the configured secrets.
+func (c *config) secrets() []string {
+	var secrets []string
+	for _, name := range secretOptions {
+		if s := *findOption(name).value(c).(*string); s != "" {
+			secrets = append(secrets, s)
+		}
+	}
+	for _, n := range c.Notify {
+		if n.Token != "" {
+			secrets = append(secrets, n.Token)
+		}
+	}
+
+	return secrets
+}
+
+var tokenPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)(bearer\s+)[^\s"',]+`),
+	regexp.MustCompile(`("(?:access|refresh)_token"\s*:\s*")[^"]*`),
+	regexp.MustCompile(`((?:access|refresh)_token=)[^&\s]+`),
+}
+
+// redactingWriter replaces secrets and access tokens in everything written
+// to it, e.g. the log output including the HTTP dumps of miele-go in verbose
+// mode.
+type redactingWriter struct {
+	w io.Writer
+
+	mu       sync.Mutex
+	replacer *strings.Replacer
+	secrets  []string
+}
+
+func newRedactingWriter(w io.Writer) *redactingWriter {
+	return &redactingWriter{w: w}
+}
+
+// add registers secrets to redact. Their URL-encoded forms are redacted as
+// well as they appear in form bodies and query strings.
+func (r *redactingWriter) add(secrets ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, s := range secrets {
+		for _, v := range []string{s, url.QueryEscape(s), url.PathEscape(s)} {
+			if v != "" && !slices.Contains(r.secrets, v) {
+				r.secrets = append(r.secrets, v)
+			}
+		}
+	}
+
+	// replace longer secrets first in case one contains another
+	slices.SortFunc(r.secrets, func(a, b string) int { return len(b) - len(a) })
+	pairs := make([]string, 0, 2*len(r.secrets))
+	for _, s := range r.secrets {
+		pairs = append(pairs, s, redacted)
+	}
+	r.replacer = strings.NewReplacer(pairs...)
+}
+
+func (r *redactingWriter) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	s := string(p)
+	if r.replacer != nil {
+		s = r.replacer.Replace(s)
+	}
+	r.mu.Unlock()
+	for _, re := range tokenPatterns {
+		s = re.ReplaceAllString(s, "${1}"+redacted)
+	}
+
+	if _, err := io.WriteString(r.w, s); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSecretsFromFileAndCommand(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(file, []byte("from file\r\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := testParseConfig([]string{"-auto", "500", "-config", writeConfig(t, "{}")}, map[string]string{
+		"MIELE_CLIENT_ID":          "id",
+		"MIELE_CLIENT_SECRET_FILE": file,
+		"MIELE_USERNAME":           "user",
+		"MIELE_PASSWORD_COMMAND":   "echo from command\nignored",
+		"INVERTER_ADDRESS_FILE":    file,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Miele.ClientSecret != "from file" {
+		t.Errorf("client secret = %q, want %q", cfg.Miele.ClientSecret, "from file")
+	}
+	if cfg.Miele.Password != "from command ignored" {
+		t.Errorf("password = %q, want %q", cfg.Miele.Password, "from command ignored")
+	}
+	if cfg.Inverter.Address != "from file" {
+		t.Errorf("inverter address = %q, want %q", cfg.Inverter.Address, "from file")
+	}
+}
+
+func TestSecretsErrors(t *testing.T) {
+	base := map[string]string{
+		"MIELE_CLIENT_ID":     "id",
+		"MIELE_CLIENT_SECRET": "secret",
+		"MIELE_USERNAME":      "user",
+		"MIELE_PASSWORD":      "pass",
+	}
+	for _, tt := range []struct {
+		key, value, want string
+	}{
+		{"MIELE_PASSWORD_FILE", "/nonexistent", "only one of MIELE_PASSWORD, MIELE_PASSWORD_FILE and MIELE_PASSWORD_COMMAND"},
+		{"MQTT_PASSWORD_FILE", "/nonexistent", "error reading MQTT_PASSWORD_FILE"},
+		{"MQTT_PASSWORD_COMMAND", "false", "error running false"},
+	} {
+		env := map[string]string{tt.key: tt.value}
+		for k, v := range base {
+			env[k] = v
+		}
+		_, err := testParseConfig([]string{"-auto", "500", "-config", writeConfig(t, "{}")}, env)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want error containing %q", tt.key, err, tt.want)
+		}
+	}
+
+	// commands are only supported for secrets
+	o := findOption("inverter")
+	v, err := lookupEnv(o, func(key string) string {
+		if key == "INVERTER_ADDRESS_COMMAND" {
+			return "echo inverter.local"
+		}
+		return ""
+	})
+	if err != nil || v != "" {
+		t.Errorf("lookupEnv = %q, %v; want command to be ignored", v, err)
+	}
+}
+
+func TestRedactingWriter(t *testing.T) {
+	var buf bytes.Buffer
+	r := newRedactingWriter(&buf)
+	r.add("p@ss word", "", "s3cr3t")
+
+	for _, tt := range []struct {
+		in, want string
+	}{
+		{"password=p@ss word", "password=[REDACTED]"},
+		{"password=p%40ss+word&client_secret=s3cr3t", "password=[REDACTED]&client_secret=[REDACTED]"},
+		{"/login/p@ss%20word", "/login/[REDACTED]"},
+		{"Authorization: Bearer abc.def-123", "Authorization: Bearer [REDACTED]"},
+		{`{"access_token": "abc", "token_type": "Bearer", "refresh_token":"def"}`, `{"access_token": "[REDACTED]", "token_type": "Bearer", "refresh_token":"[REDACTED]"}`},
+		{"grant_type=refresh_token&refresh_token=abc&x=1", "grant_type=refresh_token&refresh_token=[REDACTED]&x=1"},
+		{"nothing to hide", "nothing to hide"},
+	} {
+		buf.Reset()
+		n, err := r.Write([]byte(tt.in))
+		if err != nil || n != len(tt.in) {
+			t.Errorf("Write(%q) = %d, %v", tt.in, n, err)
+		}
+		if got := buf.String(); got != tt.want {
+			t.Errorf("Write(%q) wrote %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
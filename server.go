@@ -1,7 +1,13 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"net/http"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/ingmarstein/miele-go/miele"
@@ -22,30 +28,114 @@ type PvProvider interface {
 	Close() error
 }
 
+// powerReading holds the values from which a PvProvider computed the last
+// power export.
+type powerReading struct {
+	Time         time.Time `json:"time"`
+	PVPower      float64   `json:"pvPower"`      // solar production
+	ACPower      float64   `json:"acPower"`      // production after conversion to AC
+	MeterPower   float64   `json:"meterPower"`   // positive values indicate export to the grid
+	BatteryPower float64   `json:"batteryPower"` // positive values indicate charging
+	Export       float64   `json:"export"`
+	// Phases holds the values of the individual phases of meters which
+	// report them, starting with L1.
+	Phases []phaseReading `json:"phases,omitempty"`
+}
+
+// phaseReading holds the grid meter values of a single phase. Values not
+// reported by the meter are zero.
+type phaseReading struct {
+	Power   float64 `json:"power"` // positive values indicate export to the grid
+	Voltage float64 `json:"voltage"`
+	Current float64 `json:"current"`
+}
+
+// readingProvider is implemented by PvProviders which expose the details of
+// their last reading.
+type readingProvider interface {
+	LastReading() powerReading
+}
+
+var (
+	errUnknownDevice = errors.New("unknown device")
+	errNotWaiting    = errors.New("device is not waiting to start")
+)
+
 type server struct {
-	mc         *miele.Client
-	pp         PvProvider
+	// The Miele API, the provider and the tracker are set up before the
+	// polling loop starts. The provider is only used by the polling loop.
+	mc      mieleAPI
+	pp      PvProvider
+	tracker *deviceTracker
+
+	// mu guards all fields below as they are shared between the polling
+	// loop and the HTTP API. It is not held while querying the Miele API or
+	// the provider.
+	mu sync.Mutex
+
 	devices    []device
 	mode       modeEnum
 	autoPower  int
 	verbose    bool
+	interval   time.Duration
 	startDelay time.Duration
 	nextStart  time.Time
+	sustain    time.Duration
+	surplus    surplusWindow
+	deadline   deadlinePolicy
+	paused     bool
+	available  float64
+	reading    *powerReading // details of the last reading if the provider reports them
+	lastUpdate time.Time
+	publisher  *mqttPublisher
+	dryRun     bool
+	simulated  map[string]bool // appliances started in dry-run mode
+	store      *stateStore
+	today      dailyStats
+	history    *historyLog
+	running    map[string]bool      // appliances which were running on the last refresh
+	delayed    map[string]time.Time // value of nextStart when a delayed start was last recorded
+	notifiers  *notifiers
+	// time of the first of consecutive provider errors and whether it
+	// has been reported
+	providerDown     time.Time
+	providerDownSent bool
+	providerFailed   time.Time // time of the last provider error
 }
 
-func newServer(mode modeEnum, autoPower int, devices []device, verbose bool, mieleClient *miele.Client, pvProvider PvProvider, startDelay time.Duration) *server {
+func newServer(cfg *config, mieleClient mieleAPI, pvProvider PvProvider) *server {
 	srv := server{
-		mc:         mieleClient,
-		pp:         pvProvider,
-		devices:    devices,
-		mode:       mode,
-		autoPower:  autoPower,
-		verbose:    verbose,
-		startDelay: startDelay,
-		nextStart:  time.Now(),
+		mc:        mieleClient,
+		pp:        pvProvider,
+		verbose:   cfg.Verbose,
+		interval:  cfg.interval(),
+		nextStart: time.Now(),
+	}
+	srv.applyConfig(cfg)
+
+	if cfg.State != "" {
+		srv.store = &stateStore{name: cfg.State}
+		if ps, err := srv.store.load(); err != nil {
+			log.Printf("error loading state, starting with an empty state: %v", err)
+		} else {
+			srv.restoreState(ps)
+		}
 	}
 
-	srv.mc.Verbose = verbose
+	if cfg.History != "" {
+		var err error
+		if srv.history, err = openHistory(cfg.History); err != nil {
+			log.Printf("error opening history, history disabled: %v", err)
+		}
+	}
+
+	if len(cfg.Notify) > 0 {
+		var err error
+		if srv.notifiers, err = newNotifiers(cfg.Notify, http.DefaultClient); err != nil {
+			log.Fatalf("error configuring notifications: %v", err)
+		}
+		go srv.notifiers.run(context.Background())
+	}
 
 	if err := srv.pp.Open(); err != nil {
 		log.Fatalf("error connecting to inverter: %v", err)
@@ -58,18 +148,38 @@ func (s *server) close() {
 	if err := s.pp.Close(); err != nil {
 		log.Print(err)
 	}
+	if s.history != nil {
+		if err := s.history.close(); err != nil {
+			log.Print(err)
+		}
+	}
 }
 
 func (s *server) serve() {
-	ticker := time.NewTicker(time.Duration(*pollInterval) * time.Second)
+	ticker := time.NewTicker(s.interval)
 
 	for {
 		<-ticker.C
-		if err := s.refresh(); err != nil {
+		start := time.Now()
+		err := s.refresh()
+		pollDuration.Observe(time.Since(start).Seconds())
+		s.mu.Lock()
+		s.publishState()
+		s.saveState()
+		s.mu.Unlock()
+		if err != nil {
 			log.Printf("attempting to reconnect")
 			_ = s.pp.Close()
+			reconnects.Inc()
 			time.Sleep(2 * time.Second)
 			err = s.pp.Open()
+			s.mu.Lock()
+			e := historyEvent{Type: EventReconnect, Surplus: s.available}
+			if err != nil {
+				e.Error = err.Error()
+			}
+			s.record(e)
+			s.mu.Unlock()
 			if err != nil {
 				log.Printf("error reconnecting: %v\n", err)
 			}
@@ -81,90 +191,301 @@ func (s *server) init() {
 	s.pp.Init()
 }
 
+// trackEvents keeps the state of all appliances up to date using the Miele
+// event stream instead of polling the Miele API on every refresh.
+func (s *server) trackEvents(hc *http.Client, baseURL string, resync time.Duration) {
+	// the tracker merges the appliances under its own lock
+	s.tracker = newDeviceTracker(hc, baseURL, resync, s.fetchAppliances)
+	go s.tracker.run(context.Background())
+}
+
+// refresh updates the appliances and starts them if enough surplus power is
+// available. The Miele API and the provider are queried without holding s.mu,
+// which is only locked to apply the results.
 func (s *server) refresh() error {
 	if s.verbose {
 		log.Println("starting refresh")
 	}
 
-	waiting := s.updateDevices()
+	q := s.queryAppliances()
+	s.mu.Lock()
+	waiting := s.updateDevices(q)
+	if !waiting {
+		s.surplus.reset()
+	}
+	s.mu.Unlock()
 	if !waiting {
 		return nil
 	}
 
 	available, err := s.pp.CurrentPowerExport()
+	var reading *powerReading
+	if rp, ok := s.pp.(readingProvider); ok && err == nil {
+		r := rp.LastReading()
+		reading = &r
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if err != nil {
+		readErrors.Inc()
+		s.surplus.reset()
+		s.record(historyEvent{Type: EventProviderError, Surplus: s.available, Error: err.Error()})
+		s.checkProviderDown(err)
 		return err
 	}
+	if s.providerDownSent {
+		s.record(historyEvent{Type: EventProviderRestored, Surplus: available, Reason: "unavailable since " + s.providerDown.Format(time.RFC1123)})
+	}
+	s.providerDown, s.providerDownSent = time.Time{}, false
+	s.reading = reading
+	if reading != nil {
+		recordReading(*reading)
+	} else {
+		exportGauge.Set(available)
+		lastReadingGauge.SetToCurrentTime()
+	}
 
+	now := time.Now()
+	if elapsed := now.Sub(s.lastUpdate); elapsed <= 2*s.interval {
+		// skip gaps, e.g. while no device was waiting
+		s.today.addSurplus(now, available, elapsed)
+	}
+	s.available = available
+	s.lastUpdate = now
+	s.surplus.add(s.lastUpdate, available, s.maxSustain())
+	if s.paused {
+		if s.verbose {
+			log.Println("automation is paused")
+		}
+		return nil
+	}
 	s.consumePower(available)
 
 	return nil
 }
 
-func (s *server) updateConfiguredDevices() bool {
+// checkProviderDown records an event once the power export could not be read
+// for providerDownAfter. Errors more than two intervals apart are not
+// considered consecutive.
+func (s *server) checkProviderDown(err error) {
+	now := time.Now()
+	// the provider is only read while devices are waiting, so it may have
+	// worked since an earlier error
+	if now.Sub(s.providerFailed) > 2*s.interval {
+		s.providerDown, s.providerDownSent = time.Time{}, false
+	}
+	s.providerFailed = now
+	if s.providerDown.IsZero() {
+		s.providerDown = now
+	}
+	if !s.providerDownSent && now.Sub(s.providerDown) >= providerDownAfter {
+		s.record(historyEvent{Type: EventProviderDown, Surplus: s.available, Reason: "unavailable since " + s.providerDown.Format(time.RFC1123), Error: err.Error()})
+		s.providerDownSent = true
+	}
+}
+
+// applianceQuery holds the state of the appliances queried for a refresh.
+type applianceQuery struct {
+	time       time.Time
+	appliances []appliance
+	err        error            // of listing all appliances
+	errs       map[string]error // of getting configured devices by ID
+}
+
+// queryAppliances queries the configured devices in manual mode and all
+// appliances otherwise. It must be called without holding s.mu.
+func (s *server) queryAppliances() applianceQuery {
+	s.mu.Lock()
+	manual := s.mode == ManualMode
+	ids := make([]string, 0, len(s.devices))
+	for i := range s.devices {
+		ids = append(ids, s.devices[i].ID)
+	}
+	s.mu.Unlock()
+
+	q := applianceQuery{time: time.Now()}
+	if !manual {
+		q.appliances, q.err = s.listAppliances()
+		return q
+	}
+	for _, id := range ids {
+		a, err := s.getAppliance(id)
+		if err != nil {
+			if q.errs == nil {
+				q.errs = make(map[string]error)
+			}
+			q.errs[id] = err
+			continue
+		}
+		q.appliances = append(q.appliances, a)
+	}
+
+	return q
+}
+
+// fetchAppliances queries the state of all appliances from the Miele API. It
+// doesn't require s.mu.
+func (s *server) fetchAppliances() ([]appliance, error) {
+	appliances, err := s.mc.list()
+	if err != nil {
+		mieleErrors.Inc()
+		return nil, err
+	}
+
+	return appliances, nil
+}
+
+// listAppliances returns the state of all appliances, either from the event
+// stream or by querying the Miele API.
+func (s *server) listAppliances() ([]appliance, error) {
+	if s.tracker != nil {
+		return s.tracker.list()
+	}
+
+	return s.fetchAppliances()
+}
+
+// getAppliance returns the state of the appliance with the given ID, either
+// from the event stream or by querying the Miele API.
+func (s *server) getAppliance(id string) (appliance, error) {
+	if s.tracker != nil {
+		return s.tracker.get(id)
+	}
+
+	a, err := s.mc.get(id)
+	if err != nil {
+		mieleErrors.Inc()
+		return appliance{}, err
+	}
+
+	return a, nil
+}
+
+// simulate applies the simulated state of appliances started in dry-run mode.
+// Such appliances are reported as running for as long as they are actually
+// waiting to start. Appliances started since they were queried at t aren't
+// reported as waiting anymore.
+func (s *server) simulate(a appliance, t time.Time) appliance {
+	if d := s.findDevice(a.ID); d != nil && d.lastStart.After(t) && a.waiting() {
+		a.Status = int(miele.DEVICE_STATUS_RUNNING)
+		return a
+	}
+	if !s.simulated[a.ID] {
+		return a
+	}
+	if !a.waiting() {
+		// the appliance has been started or reprogrammed elsewhere
+		delete(s.simulated, a.ID)
+		return a
+	}
+
+	a.Status = int(miele.DEVICE_STATUS_RUNNING)
+	return a
+}
+
+func (s *server) updateConfiguredDevices(q applianceQuery) bool {
 	var deviceWaiting bool
 	for i := 0; i < len(s.devices); i++ {
 		device := &s.devices[i]
+		wasWaiting := device.waiting
 		device.waiting = false
-		state, err := s.mc.GetDeviceState(device.ID, miele.GetDeviceStateRequest{})
-		if err != nil {
+		device.deadline = time.Time{}
+		if err := q.errs[device.ID]; err != nil {
 			log.Printf("error getting device state for %s (%s): %v", device.Name, device.ID, err)
 			continue
 		}
-		if state.Status.ValueRaw == miele.DEVICE_STATUS_PROGRAMMED_WAITING_TO_START && state.RemoteEnable.FullRemoteControl {
+		j := slices.IndexFunc(q.appliances, func(a appliance) bool { return a.ID == device.ID })
+		if j < 0 {
+			// configured after the query
+			continue
+		}
+		a := s.simulate(q.appliances[j], q.time)
+		s.trackAppliance(device, a, wasWaiting)
+		if a.waiting() {
 			deviceWaiting = true
 			device.waiting = true
+			device.deadline = startDeadline(time.Now(), a.StartTime)
 		}
 	}
 
 	return deviceWaiting
 }
 
-func (s *server) updateAutoDevices() bool {
-	resp, err := s.mc.ListDevices(miele.ListDevicesRequest{})
-	if err != nil {
-		log.Printf("error listing devices: %v", err)
+func (s *server) updateAutoDevices(q applianceQuery) bool {
+	if q.err != nil {
+		log.Printf("error listing devices: %v", q.err)
 		return false
 	}
 
-	s.devices = []device{}
+	devices := []device{}
 	var deviceWaiting bool
-	for _, r := range resp {
-		// https://www.miele.com/developer/swagger-ui/put_additional_info.html
-		if r.Ident.Typ.ValueRaw != miele.DEVICE_TYPE_WASHING_MACHINE &&
-			r.Ident.Typ.ValueRaw != miele.DEVICE_TYPE_TUMBLE_DRYER &&
-			r.Ident.Typ.ValueRaw != miele.DEVICE_TYPE_DISHWASHER &&
-			r.Ident.Typ.ValueRaw != miele.DEVICE_TYPE_WASHER_DRYER {
+	for _, a := range q.appliances {
+		if !a.supported() {
 			continue
 		}
+		a = s.simulate(a, q.time)
 
-		if r.State.Status.ValueRaw != miele.DEVICE_STATUS_PROGRAMMED_WAITING_TO_START || !r.State.RemoteEnable.FullRemoteControl {
-			continue
+		d := device{
+			ID:    a.ID,
+			Name:  a.Name,
+			Power: float64(s.autoPower),
 		}
-
-		s.devices = append(s.devices, device{
-			ID:      r.Ident.DeviceIdentLabel.FabNumber,
-			Name:    r.Ident.DeviceName,
-			Power:   float64(*autoPower),
-			waiting: true,
-		})
-		deviceWaiting = true
+		// keep the runtime state of devices which are already known
+		var wasWaiting bool
+		if prev := s.findDevice(d.ID); prev != nil {
+			d.lastStart = prev.lastStart
+			d.skipUntil = prev.skipUntil
+			wasWaiting = prev.waiting
+		}
+		s.trackAppliance(&d, a, wasWaiting)
+		if a.waiting() {
+			d.waiting = true
+			d.deadline = startDeadline(time.Now(), a.StartTime)
+			deviceWaiting = true
+		}
+		devices = append(devices, d)
 	}
+	s.devices = devices
 
 	return deviceWaiting
 }
 
+// findDevice returns the device with the given ID or nil if it is unknown.
+func (s *server) findDevice(id string) *device {
+	for i := range s.devices {
+		if s.devices[i].ID == id {
+			return &s.devices[i]
+		}
+	}
+
+	return nil
+}
+
+// maxSustain returns the longest period for which surplus readings need to
+// be retained.
+func (s *server) maxSustain() time.Duration {
+	d := s.sustain
+	for i := range s.devices {
+		d = max(d, s.devices[i].sustainDuration(s.sustain))
+	}
+
+	return d
+}
+
 // updateDevices updates all Miele appliances and returns whether one is waiting for SmartStart.
-func (s *server) updateDevices() bool {
+func (s *server) updateDevices(q applianceQuery) bool {
 	if s.mode == ManualMode {
-		return s.updateConfiguredDevices()
+		return s.updateConfiguredDevices(q)
 	}
 
-	return s.updateAutoDevices()
+	return s.updateAutoDevices(q)
 }
 
 // consumePower starts appliances in the given priority order to
-// consume the surplus power.
+// consume the surplus power. An appliance is only started once the
+// surplus has reached its threshold for the whole sustain period, unless
+// its deadline policy lowers the threshold or forces a start.
 //
 // See also:
 // https://github.com/demel42/IPSymconMieleAtHome
@@ -172,26 +493,151 @@ func (s *server) updateDevices() bool {
 func (s *server) consumePower(available float64) {
 	for i := 0; i < len(s.devices); i++ {
 		device := &s.devices[i]
-		if !device.waiting || device.Power > available {
+		now := time.Now()
+		if !device.waiting || now.Before(device.skipUntil) {
 			continue
 		}
-		if time.Now().Before(s.nextStart) {
+		required, force := device.Deadline.orDefault(s.deadline).requiredSurplus(device.threshold(), device.deadline, now)
+		if !force && required > available {
+			continue
+		}
+		sustain := device.sustainDuration(s.sustain)
+		if !force && !s.surplus.sustained(now, sustain, required) {
+			if s.verbose {
+				log.Printf("surplus for device %s (%s) not yet sustained for %v", device.Name, device.ID, sustain)
+			}
+			continue
+		}
+		if now.Before(s.nextStart) {
+			if !s.delayed[device.ID].Equal(s.nextStart) {
+				e := s.deviceEvent(EventDelayed, device)
+				e.Required = required
+				e.Reason = "next start after " + s.nextStart.Format(time.RFC1123)
+				s.record(e)
+				if s.delayed == nil {
+					s.delayed = make(map[string]time.Time)
+				}
+				s.delayed[device.ID] = s.nextStart
+			}
 			log.Printf("delaying start of device %s (%s). Next start after %v", device.Name, device.ID, s.nextStart.Format(time.RFC1123))
 			continue
 		}
-		log.Printf("starting device %s (%s)", device.Name, device.ID)
-		err := s.mc.DeviceAction(device.ID, miele.DeviceActionRequest{
-			ProcessAction: miele.ACTION_START,
-		})
-		if err != nil {
+		var reason string
+		if force {
+			reason = fmt.Sprintf("deadline at %v, surplus: %f", device.deadline.Format(time.Kitchen), available)
+		} else if required < device.threshold() {
+			reason = fmt.Sprintf("approaching deadline at %v, surplus: %f, required: %f", device.deadline.Format(time.Kitchen), available, required)
+		} else {
+			reason = fmt.Sprintf("surplus: %f", available)
+		}
+		if err := s.startDevice(device, reason, required); err != nil {
 			log.Printf("error starting device %s (%s): %v", device.Name, device.ID, err)
 			continue
 		}
 		if s.mode != AutoAllMode {
 			available -= device.Power
+			s.surplus.shift(-device.Power)
 		}
-		s.nextStart = time.Now().Add(s.startDelay)
 		log.Printf("started device %s (%s), remaining power: %f", device.Name, device.ID, available)
-		device.waiting = false
+	}
+}
+
+// startDevice starts the given device and delays the start of the next one.
+func (s *server) startDevice(device *device, reason string, required float64) error {
+	e := s.deviceEvent(EventStart, device)
+	e.Required = required
+	e.Reason = reason
+	s.record(e)
+
+	if s.dryRun {
+		log.Printf("dry run: would start device %s (%s), %s", device.Name, device.ID, reason)
+		if s.simulated == nil {
+			s.simulated = make(map[string]bool)
+		}
+		s.simulated[device.ID] = true
+		dryRunStarts.WithLabelValues(device.Name).Inc()
+	} else {
+		log.Printf("starting device %s (%s), %s", device.Name, device.ID, reason)
+		if err := s.mc.start(device.ID); err != nil {
+			mieleErrors.Inc()
+			e.Type = EventStartFailed
+			e.Error = err.Error()
+			s.record(e)
+			return err
+		}
+		deviceStarts.WithLabelValues(device.Name).Inc()
+	}
+
+	device.waiting = false
+	device.lastStart = time.Now()
+	s.nextStart = device.lastStart.Add(s.startDelay)
+	s.today.addStart(device.lastStart, device.ID)
+	s.saveState()
+	e.Type = EventStarted
+	s.record(e)
+
+	return nil
+}
+
+// forceStart starts a waiting device regardless of the available power.
+func (s *server) forceStart(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	device := s.findDevice(id)
+	if device == nil {
+		return errUnknownDevice
+	}
+	if !device.waiting {
+		return errNotWaiting
+	}
+
+	if err := s.startDevice(device, "manual start", 0); err != nil {
+		return err
+	}
+	s.publishState()
+
+	return nil
+}
+
+// skipDevice prevents a device from being started until the given time.
+func (s *server) skipDevice(id string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	device := s.findDevice(id)
+	if device == nil {
+		return errUnknownDevice
+	}
+	device.skipUntil = until
+	if until.IsZero() {
+		log.Printf("no longer skipping device %s (%s)", device.Name, device.ID)
+	} else {
+		log.Printf("skipping device %s (%s) until %v", device.Name, device.ID, until.Format(time.RFC1123))
+	}
+	s.publishState()
+	s.saveState()
+
+	return nil
+}
+
+// setPaused pauses or resumes the automatic start of devices.
+func (s *server) setPaused(paused bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if paused != s.paused {
+		log.Printf("automation paused: %v", paused)
+	}
+	s.paused = paused
+	s.publishState()
+	s.saveState()
+}
+
+// publishState publishes the current state to MQTT if enabled. The caller
+// must hold s.mu.
+func (s *server) publishState() {
+	if s.publisher != nil {
+		s.publisher.publishState(s)
 	}
 }
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/ingmarstein/miele-go/miele"
+)
+
+// fakeProvider reports a fixed power export or error.
+type fakeProvider struct {
+	power float64
+	err   error
+}
+
+func (p *fakeProvider) Init()        {}
+func (p *fakeProvider) Open() error  { return nil }
+func (p *fakeProvider) Close() error { return nil }
+
+func (p *fakeProvider) CurrentPowerExport() (float64, error) {
+	return p.power, p.err
+}
+
+func newTestServer(f *fakeMiele, mode modeEnum, autoPower int, devices []device, pp *fakeProvider, startDelay time.Duration) *server {
+	cfg := defaultConfig()
+	cfg.Devices = devices
+	cfg.Auto = autoPower
+	if mode == AutoAllMode {
+		cfg.AutoMode = "all"
+	}
+	cfg.Delay = int(startDelay / time.Second)
+
+	return newServer(cfg, f.client(), pp)
+}
+
+func refresh(t *testing.T, s *server) {
+	t.Helper()
+
+	if err := s.refresh(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkStarted(t *testing.T, f *fakeMiele, want ...string) {
+	t.Helper()
+
+	if got := f.started(); !slices.Equal(got, want) {
+		t.Errorf("started devices = %v, want %v", got, want)
+	}
+}
+
+func TestPriorityOrder(t *testing.T) {
+	f := newFakeMiele(t)
+	f.add("dryer", "Tumble Dryer", miele.DEVICE_TYPE_TUMBLE_DRYER, true)
+	f.add("washer", "Washing Machine", miele.DEVICE_TYPE_WASHING_MACHINE, true)
+	f.add("dishwasher", "Dishwasher", miele.DEVICE_TYPE_DISHWASHER, true)
+
+	pp := &fakeProvider{power: 800}
+	srv := newTestServer(f, ManualMode, 0, []device{
+		{ID: "dishwasher", Name: "Dishwasher", Power: 500},
+		{ID: "dryer", Name: "Tumble Dryer", Power: 300},
+		{ID: "washer", Name: "Washing Machine", Power: 200},
+	}, pp, 0)
+
+	// 800 W are enough for the first two devices only
+	refresh(t, srv)
+	checkStarted(t, f, "dishwasher", "dryer")
+
+	pp.power = 100
+	refresh(t, srv)
+	checkStarted(t, f, "dishwasher", "dryer")
+
+	pp.power = 200
+	refresh(t, srv)
+	checkStarted(t, f, "dishwasher", "dryer", "washer")
+}
+
+func TestPriorityOrderSkipsLargeDevices(t *testing.T) {
+	f := newFakeMiele(t)
+	f.add("dryer", "Tumble Dryer", miele.DEVICE_TYPE_TUMBLE_DRYER, true)
+	f.add("washer", "Washing Machine", miele.DEVICE_TYPE_WASHING_MACHINE, true)
+	f.add("dishwasher", "Dishwasher", miele.DEVICE_TYPE_DISHWASHER, false)
+
+	srv := newTestServer(f, ManualMode, 0, []device{
+		{ID: "dishwasher", Name: "Dishwasher", Power: 100},
+		{ID: "dryer", Name: "Tumble Dryer", Power: 1000},
+		{ID: "washer", Name: "Washing Machine", Power: 400},
+	}, &fakeProvider{power: 600}, 0)
+
+	// the dishwasher is not waiting and the dryer needs too much power
+	refresh(t, srv)
+	checkStarted(t, f, "washer")
+}
+
+func TestStartDelay(t *testing.T) {
+	f := newFakeMiele(t)
+	f.add("washer", "Washing Machine", miele.DEVICE_TYPE_WASHING_MACHINE, true)
+	f.add("dishwasher", "Dishwasher", miele.DEVICE_TYPE_DISHWASHER, true)
+
+	srv := newTestServer(f, ManualMode, 0, []device{
+		{ID: "washer", Name: "Washing Machine", Power: 300},
+		{ID: "dishwasher", Name: "Dishwasher", Power: 300},
+	}, &fakeProvider{power: 1000}, time.Hour)
+
+	refresh(t, srv)
+	checkStarted(t, f, "washer")
+	if want := srv.devices[0].lastStart.Add(time.Hour); !srv.nextStart.Equal(want) {
+		t.Errorf("nextStart = %v, want %v", srv.nextStart, want)
+	}
+
+	refresh(t, srv)
+	checkStarted(t, f, "washer")
+
+	// the delay has passed
+	srv.nextStart = time.Now().Add(-time.Second)
+	refresh(t, srv)
+	checkStarted(t, f, "washer", "dishwasher")
+}
+
+func TestAutoMode(t *testing.T) {
+	tests := []struct {
+		name   string
+		mode   modeEnum
+		starts int
+	}{
+		{"single", AutoSingleMode, 1},
+		{"all", AutoAllMode, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeMiele(t)
+			f.add("washer", "Washing Machine", miele.DEVICE_TYPE_WASHING_MACHINE, true)
+			f.add("dryer", "Tumble Dryer", miele.DEVICE_TYPE_TUMBLE_DRYER, true)
+			f.add("dishwasher", "Dishwasher", miele.DEVICE_TYPE_DISHWASHER, true)
+			f.add("washer-dryer", "Washer Dryer", miele.DEVICE_TYPE_WASHER_DRYER, false)
+			// unsupported device types are never started
+			f.add("oven", "Oven", miele.DeviceType(12), true)
+
+			srv := newTestServer(f, tt.mode, 500, nil, &fakeProvider{power: 600}, 0)
+			refresh(t, srv)
+
+			started := f.started()
+			if len(started) != tt.starts || slices.Contains(started, "oven") {
+				t.Errorf("started devices = %v, want %d supported devices", started, tt.starts)
+			}
+			if len(srv.devices) != 4 {
+				t.Errorf("got %d devices, want 4", len(srv.devices))
+			}
+			for _, d := range srv.devices {
+				if d.Power != 500 {
+					t.Errorf("device %s has power %v, want 500", d.ID, d.Power)
+				}
+				if d.waiting == slices.Contains(started, d.ID) && d.ID != "washer-dryer" {
+					t.Errorf("device %s waiting = %v", d.ID, d.waiting)
+				}
+			}
+		})
+	}
+}
+
+func TestStartFailure(t *testing.T) {
+	f := newFakeMiele(t)
+	f.add("washer", "Washing Machine", miele.DEVICE_TYPE_WASHING_MACHINE, true)
+
+	srv := newTestServer(f, ManualMode, 0, []device{
+		{ID: "washer", Name: "Washing Machine", Power: 300},
+		{ID: "unknown", Name: "Unknown", Power: 100},
+	}, &fakeProvider{power: 1000}, time.Hour)
+
+	// the appliance has been started elsewhere since the last refresh
+	q := srv.queryAppliances()
+	srv.mu.Lock()
+	srv.updateDevices(q)
+	srv.mu.Unlock()
+	if err := srv.mc.start("washer"); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.forceStart("washer"); err == nil {
+		t.Error("expected error starting a running device")
+	}
+	if !srv.devices[0].lastStart.IsZero() || srv.nextStart.After(time.Now()) {
+		t.Error("failed start must not delay other devices")
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	f := newFakeMiele(t)
+	f.add("dishwasher", "Dishwasher", miele.DEVICE_TYPE_DISHWASHER, true)
+	f.add("dryer", "Tumble Dryer", miele.DEVICE_TYPE_TUMBLE_DRYER, true)
+	f.add("washer", "Washing Machine", miele.DEVICE_TYPE_WASHING_MACHINE, true)
+
+	pp := &fakeProvider{power: 800}
+	srv := newTestServer(f, ManualMode, 0, []device{
+		{ID: "dishwasher", Name: "Dishwasher", Power: 500},
+		{ID: "dryer", Name: "Tumble Dryer", Power: 300},
+		{ID: "washer", Name: "Washing Machine", Power: 200},
+	}, pp, 0)
+	srv.dryRun = true
+
+	// the remaining surplus is reduced by the simulated starts
+	refresh(t, srv)
+	checkStarted(t, f)
+	for i, want := range []bool{true, true, false} {
+		if started := !srv.devices[i].lastStart.IsZero(); started != want {
+			t.Errorf("device %s started = %v, want %v", srv.devices[i].ID, started, want)
+		}
+	}
+
+	// devices started in dry-run mode are no longer considered waiting
+	pp.power = 500
+	refresh(t, srv)
+	if srv.devices[0].waiting || srv.devices[1].waiting || srv.devices[2].waiting {
+		t.Errorf("devices still waiting: %+v", srv.devices)
+	}
+	checkStarted(t, f)
+
+	// a device which finished and was programmed again waits to be started
+	f.add("dishwasher", "Dishwasher", miele.DEVICE_TYPE_DISHWASHER, false)
+	refresh(t, srv)
+	f.add("dishwasher", "Dishwasher", miele.DEVICE_TYPE_DISHWASHER, true)
+	srv.nextStart = time.Now().Add(time.Hour)
+	refresh(t, srv)
+	if !srv.devices[0].waiting {
+		t.Error("reprogrammed device is not waiting")
+	}
+	checkStarted(t, f)
+}
+
+func TestProviderDownAfterQuietPeriod(t *testing.T) {
+	f := newFakeMiele(t)
+	f.add("washer", "Washing Machine", miele.DEVICE_TYPE_WASHING_MACHINE, true)
+
+	pp := &fakeProvider{err: errors.New("timeout")}
+	srv := newTestServer(f, ManualMode, 0, []device{{ID: "washer", Name: "Washing Machine", Power: 300}}, pp, 0)
+
+	// a failed read in the morning
+	if err := srv.refresh(); err == nil {
+		t.Fatal("expected provider error")
+	}
+	morning := time.Now().Add(-4 * time.Hour)
+	srv.mu.Lock()
+	srv.providerDown, srv.providerFailed = morning, morning
+	srv.mu.Unlock()
+
+	// a quiet afternoon without waiting devices, during which the provider
+	// is not read
+	f.add("washer", "Washing Machine", miele.DEVICE_TYPE_WASHING_MACHINE, false)
+	if err := srv.refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	// another failed read in the evening starts a new outage
+	f.add("washer", "Washing Machine", miele.DEVICE_TYPE_WASHING_MACHINE, true)
+	if err := srv.refresh(); err == nil {
+		t.Fatal("expected provider error")
+	}
+	srv.mu.Lock()
+	if srv.providerDownSent {
+		t.Error("provider reported as down since the morning")
+	}
+	if srv.providerDown.Before(morning.Add(time.Hour)) {
+		t.Errorf("outage started at %v, want now", srv.providerDown)
+	}
+
+	// consecutive errors are still reported once they last long enough
+	srv.providerDown = srv.providerDown.Add(-providerDownAfter)
+	srv.mu.Unlock()
+	if err := srv.refresh(); err == nil {
+		t.Fatal("expected provider error")
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if !srv.providerDownSent {
+		t.Error("provider not reported as down")
+	}
+}
+
+func TestSustainedSurplus(t *testing.T) {
+	f := newFakeMiele(t)
+	f.add("washer", "Washing Machine", miele.DEVICE_TYPE_WASHING_MACHINE, true)
+
+	pp := &fakeProvider{power: 500}
+	srv := newTestServer(f, ManualMode, 0, []device{{ID: "washer", Name: "Washing Machine", Power: 300}}, pp, 0)
+	srv.sustain = 5 * time.Minute
+
+	// ages the recorded samples as if the readings had been taken earlier
+	age := func(d time.Duration) {
+		for i := range srv.surplus.samples {
+			srv.surplus.samples[i].time = srv.surplus.samples[i].time.Add(-d)
+		}
+	}
+
+	refresh(t, srv)
+	checkStarted(t, f)
+
+	// a dip below the threshold restarts the sustain period
+	age(3 * time.Minute)
+	pp.power = 200
+	refresh(t, srv)
+	age(3 * time.Minute)
+	pp.power = 500
+	refresh(t, srv)
+	checkStarted(t, f)
+
+	age(3 * time.Minute)
+	refresh(t, srv)
+	checkStarted(t, f)
+
+	// the surplus has held since the dip for the whole sustain period
+	age(3 * time.Minute)
+	refresh(t, srv)
+	checkStarted(t, f, "washer")
+}
+
+func TestDeadlineForcedStart(t *testing.T) {
+	f := newFakeMiele(t)
+	f.add("washer", "Washing Machine", miele.DEVICE_TYPE_WASHING_MACHINE, true)
+
+	pp := &fakeProvider{power: 0}
+	srv := newTestServer(f, ManualMode, 0, []device{
+		{ID: "washer", Name: "Washing Machine", Power: 300, Deadline: deadlinePolicy{Policy: DeadlineStart, Margin: 10}},
+	}, pp, 0)
+	srv.sustain = 5 * time.Minute
+
+	// the SmartStart window ends in eight hours
+	refresh(t, srv)
+	checkStarted(t, f)
+
+	// the latest start is within the margin, so neither the missing surplus
+	// nor the sustain period hold the device back
+	f.mu.Lock()
+	f.devices["washer"].State.StartTime = []int{0, 10}
+	f.mu.Unlock()
+	refresh(t, srv)
+	checkStarted(t, f, "washer")
+}
+
+// blockingMiele blocks listing the appliances until release is closed.
+type blockingMiele struct {
+	mieleAPI
+	listing chan struct{}
+	release chan struct{}
+}
+
+func (m *blockingMiele) list() ([]appliance, error) {
+	m.listing <- struct{}{}
+	<-m.release
+	return m.mieleAPI.list()
+}
+
+func TestTrackEventsResyncUnlocked(t *testing.T) {
+	f := newFakeMiele(t)
+	f.add("washer", "Washing Machine", miele.DEVICE_TYPE_WASHING_MACHINE, true)
+
+	cfg := defaultConfig()
+	cfg.Auto = 500
+	mc := &blockingMiele{mieleAPI: f.client(), listing: make(chan struct{}), release: make(chan struct{})}
+	defer close(mc.release)
+	srv := newServer(cfg, mc, &fakeProvider{power: 1000})
+	srv.trackEvents(f.Client(), f.URL, time.Hour)
+
+	// a hanging Miele API doesn't block the server while resyncing
+	<-mc.listing
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serveAPI(t, srv, http.MethodGet, "/api/status")
+		srv.setPaused(true)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server blocked by the resync")
+	}
+}
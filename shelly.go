@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// shellyNotifyTimeout is the maximum age of a WebSocket notification. If
+	// no notification is received within this period, the connection is
+	// reestablished and the status is polled meanwhile.
+	shellyNotifyTimeout = time.Minute
+	shellyRetryInterval = 10 * time.Second
+)
+
+// shellyProvider reads the grid power from a Shelly energy meter at the grid
+// connection point. Gen2+ devices (Pro 3EM, Pro EM) are read using the RPC
+// API, Gen1 devices (3EM, EM) using the /status endpoint. The power of all
+// phases or channels is summed up.
+type shellyProvider struct {
+	hc        *http.Client
+	baseURL   string
+	invert    bool
+	websocket bool
+
+	gen  int      // device generation, 0 until detected
+	em   []string // EM and EM1 components of Gen2+ devices, e.g. "em:0"
+	last powerReading
+
+	// mu guards the fields below which are updated by WebSocket notifications.
+	mu      sync.Mutex
+	status  map[string]*shellyEMStatus
+	updated time.Time
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// shellyDeviceInfo is the response of the /shelly endpoint of all
+// generations. Gen field is missing for Gen1 devices.
+type shellyDeviceInfo struct {
+	Gen   int    `json:"gen"`
+	ID    string `json:"id"`
+	Model string `json:"model"`
+	App   string `json:"app"`
+	Ver   string `json:"ver"`
+	Type  string `json:"type"` // Gen1
+	FW    string `json:"fw"`   // Gen1
+}
+
+// shellyEMStatus is the status of an EM (three phases) or EM1 (single
+// channel) component. Shelly reports power drawn from the grid as positive.
+type shellyEMStatus struct {
+	APower     *float64 `json:"a_act_power"`
+	BPower     *float64 `json:"b_act_power"`
+	CPower     *float64 `json:"c_act_power"`
+	TotalPower *float64 `json:"total_act_power"`
+	ActPower   *float64 `json:"act_power"` // EM1
+	Errors     []string `json:"errors"`
+}
+
+// power returns the total active power of the component.
+func (s *shellyEMStatus) power() (float64, bool) {
+	switch {
+	case s.TotalPower != nil:
+		return *s.TotalPower, true
+	case s.ActPower != nil:
+		return *s.ActPower, true
+	case s.APower != nil && s.BPower != nil && s.CPower != nil:
+		return *s.APower + *s.BPower + *s.CPower, true
+	default:
+		return 0, false
+	}
+}
+
+// shellyGen1Status is the subset of the Gen1 /status response used here.
+type shellyGen1Status struct {
+	EMeters []struct {
+		Power   float64 `json:"power"`
+		IsValid bool    `json:"is_valid"`
+	} `json:"emeters"`
+}
+
+// shellyRPCFrame is a response or notification received over the RPC
+// WebSocket.
+type shellyRPCFrame struct {
+	ID     int                        `json:"id"`
+	Method string                     `json:"method"`
+	Params map[string]json.RawMessage `json:"params"`
+	Result map[string]json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// newShellyProvider creates a provider reading from the Shelly at address.
+// Set invert if the meter reports an export as positive power, e.g. because
+// the current clamps are mounted in reverse. If useWebSocket is set, Gen2+
+// devices push status changes over a WebSocket connection and are only
+// polled if no recent notification is available.
+func newShellyProvider(address string, invert, useWebSocket bool) *shellyProvider {
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+
+	return &shellyProvider{
+		hc:        &http.Client{Timeout: 10 * time.Second},
+		baseURL:   strings.TrimSuffix(address, "/"),
+		invert:    invert,
+		websocket: useWebSocket,
+	}
+}
+
+func (p *shellyProvider) Open() error {
+	return nil
+}
+
+func (p *shellyProvider) Close() error {
+	if p.cancel != nil {
+		p.cancel()
+		<-p.done
+		p.cancel = nil
+	}
+	p.hc.CloseIdleConnections()
+
+	return nil
+}
+
+// get decodes the JSON response to a request.
+func (p *shellyProvider) get(path string, v any) error {
+	resp, err := p.hc.Get(p.baseURL + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error requesting %s: unexpected status: %s", path, resp.Status)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("error decoding %s: %v", path, err)
+	}
+
+	return nil
+}
+
+func (p *shellyProvider) Init() {
+	if err := p.detect(); err != nil {
+		log.Printf("failed to detect Shelly, retrying later: %v", err)
+	}
+}
+
+// detect determines the generation and the energy meter components of the
+// device.
+func (p *shellyProvider) detect() error {
+	var info shellyDeviceInfo
+	if err := p.get("/shelly", &info); err != nil {
+		return err
+	}
+
+	if info.Gen < 2 {
+		log.Printf("Shelly type: %s", info.Type)
+		log.Printf("Shelly firmware: %s", info.FW)
+		if p.websocket {
+			log.Printf("WebSocket notifications require a Gen2 or newer Shelly, polling instead")
+		}
+		p.gen = 1
+		return nil
+	}
+
+	log.Printf("Shelly ID: %s", info.ID)
+	log.Printf("Shelly model: %s (%s)", info.Model, info.App)
+	log.Printf("Shelly generation: %d", info.Gen)
+	log.Printf("Shelly firmware: %s", info.Ver)
+
+	var status map[string]json.RawMessage
+	if err := p.get("/rpc/Shelly.GetStatus", &status); err != nil {
+		return err
+	}
+	var em []string
+	for key := range status {
+		if isShellyEMComponent(key) {
+			em = append(em, key)
+		}
+	}
+	if len(em) == 0 {
+		return errors.New("no energy meter component found")
+	}
+	slices.Sort(em)
+	log.Printf("Shelly energy meters: %s", strings.Join(em, ", "))
+
+	p.gen, p.em = info.Gen, em
+	if p.websocket && p.cancel == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		p.cancel, p.done = cancel, make(chan struct{})
+		go p.listen(ctx)
+	}
+
+	return nil
+}
+
+func isShellyEMComponent(key string) bool {
+	return strings.HasPrefix(key, "em:") || strings.HasPrefix(key, "em1:")
+}
+
+// listen keeps a WebSocket connection open to receive status notifications
+// until the context is canceled.
+func (p *shellyProvider) listen(ctx context.Context) {
+	defer close(p.done)
+
+	for {
+		err := p.subscribe(ctx)
+		p.mu.Lock()
+		p.updated = time.Time{}
+		p.mu.Unlock()
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Shelly WebSocket connection lost, reconnecting in %v: %v", shellyRetryInterval, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(shellyRetryInterval):
+		}
+	}
+}
+
+// subscribe connects to the RPC WebSocket and processes notifications until
+// the connection fails.
+func (p *shellyProvider) subscribe(ctx context.Context) error {
+	url := "ws" + strings.TrimPrefix(p.baseURL, "http") + "/rpc"
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, url, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	// notifications are only sent to clients which identified themselves as
+	// the source of a request
+	req := map[string]any{"id": 1, "src": fmt.Sprintf("mielesolar-%d", time.Now().UnixNano()), "method": "Shelly.GetStatus"}
+	if err := conn.WriteJSON(req); err != nil {
+		return err
+	}
+	log.Printf("Receiving Shelly notifications from %s", url)
+
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(shellyNotifyTimeout)); err != nil {
+			return err
+		}
+		var frame shellyRPCFrame
+		if err := conn.ReadJSON(&frame); err != nil {
+			return err
+		}
+		if frame.Error != nil {
+			return fmt.Errorf("RPC error %d: %s", frame.Error.Code, frame.Error.Message)
+		}
+
+		switch {
+		case frame.Result != nil:
+			p.update(frame.Result)
+		case frame.Method == "NotifyStatus" || frame.Method == "NotifyFullStatus":
+			p.update(frame.Params)
+		}
+	}
+}
+
+// update merges the energy meter components of a status or notification.
+// Notifications only contain the changed values.
+func (p *shellyProvider) update(components map[string]json.RawMessage) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var updated bool
+	for key, data := range components {
+		if !isShellyEMComponent(key) {
+			continue
+		}
+		if p.status == nil {
+			p.status = make(map[string]*shellyEMStatus)
+		}
+		s := p.status[key]
+		if s == nil {
+			s = new(shellyEMStatus)
+			p.status[key] = s
+		}
+		if err := json.Unmarshal(data, s); err != nil {
+			log.Printf("error decoding Shelly notification for %s: %v", key, err)
+			continue
+		}
+		updated = true
+	}
+	if updated {
+		p.updated = time.Now()
+	}
+}
+
+// notified returns the power from the WebSocket notifications if they are
+// recent.
+func (p *shellyProvider) notified() (float64, bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.updated.IsZero() || time.Since(p.updated) > shellyNotifyTimeout {
+		return 0, false, nil
+	}
+
+	var total float64
+	for _, key := range p.em {
+		s := p.status[key]
+		if s == nil {
+			return 0, false, nil
+		}
+		power, ok := s.power()
+		if !ok {
+			return 0, false, fmt.Errorf("%w: Shelly %s reports no power", errInvalidReading, key)
+		}
+		total += power
+	}
+
+	return total, true, nil
+}
+
+// poll requests the status of all energy meter components.
+func (p *shellyProvider) poll() (float64, error) {
+	if p.gen == 1 {
+		var status shellyGen1Status
+		if err := p.get("/status", &status); err != nil {
+			return 0, err
+		}
+		if len(status.EMeters) == 0 {
+			return 0, errors.New("no energy meter found")
+		}
+
+		var total float64
+		for i, m := range status.EMeters {
+			if !m.IsValid {
+				return 0, fmt.Errorf("%w: Shelly meter %d reports no valid power", errInvalidReading, i)
+			}
+			total += m.Power
+		}
+
+		return total, nil
+	}
+
+	var total float64
+	for _, key := range p.em {
+		kind, id, _ := strings.Cut(key, ":")
+		method := "EM.GetStatus"
+		if kind == "em1" {
+			method = "EM1.GetStatus"
+		}
+		var s shellyEMStatus
+		if err := p.get("/rpc/"+method+"?id="+id, &s); err != nil {
+			return 0, err
+		}
+		if len(s.Errors) > 0 {
+			log.Printf("Shelly %s errors: %s", key, strings.Join(s.Errors, ", "))
+		}
+		power, ok := s.power()
+		if !ok {
+			return 0, fmt.Errorf("%w: Shelly %s reports no power", errInvalidReading, key)
+		}
+		total += power
+	}
+
+	return total, nil
+}
+
+func (p *shellyProvider) CurrentPowerExport() (float64, error) {
+	if p.gen == 0 {
+		if err := p.detect(); err != nil {
+			return 0, err
+		}
+	}
+
+	power, ok, err := p.notified()
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		if power, err = p.poll(); err != nil {
+			return 0, err
+		}
+	}
+
+	// Shelly reports power drawn from the grid as positive
+	// positive values indicate a surplus -> export to grid
+	meterPower := -power
+	if p.invert {
+		meterPower = power
+	}
+	log.Printf("Meter AC Power: %f", meterPower)
+
+	p.last = powerReading{
+		Time:       time.Now(),
+		MeterPower: meterPower,
+		Export:     meterPower,
+	}
+
+	return meterPower, nil
+}
+
+func (p *shellyProvider) LastReading() powerReading {
+	return p.last
+}
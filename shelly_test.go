@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShellyProvider(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		gen     int
+		em1     bool
+		phases  []float64
+		invert  bool
+		invalid bool
+		want    float64
+	}{
+		// Shelly reports power drawn from the grid as positive
+		{"Pro 3EM export", 2, false, []float64{100, -1500, 200}, false, false, 1200},
+		{"Pro 3EM import", 2, false, []float64{300, 250.5, 400}, false, false, -950.5},
+		{"Pro 3EM inverted", 2, false, []float64{100, -1500, 200}, true, false, -1200},
+		{"Pro EM", 2, true, []float64{-300, -200}, false, false, 500},
+		{"Gen3", 3, false, []float64{-10, -20, -30}, false, false, 60},
+		{"3EM", 1, false, []float64{-1000, 150, 50}, false, false, 800},
+		{"Pro 3EM invalid", 2, false, []float64{0, 0, 0}, false, true, 0},
+		{"Pro EM invalid", 2, true, []float64{0, 0}, false, true, 0},
+		{"3EM invalid", 1, false, []float64{0, 0, 0}, false, true, 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			fs, ts := newFakeShelly(t, tt.gen, tt.phases...)
+			fs.configure(func(fs *fakeShelly) { fs.em1, fs.invalid = tt.em1, tt.invalid })
+
+			p := newShellyProvider(strings.TrimPrefix(ts.URL, "http://"), tt.invert, false)
+			if err := p.Open(); err != nil {
+				t.Fatal(err)
+			}
+			defer p.Close()
+			p.Init()
+
+			got, err := p.CurrentPowerExport()
+			if tt.invalid {
+				if !errors.Is(err, errInvalidReading) {
+					t.Errorf("CurrentPowerExport() = %v, %v; want invalid reading", got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("CurrentPowerExport() = %v, want %v", got, tt.want)
+			}
+			if r := p.LastReading(); r.MeterPower != tt.want || r.Export != tt.want {
+				t.Errorf("LastReading() = %+v", r)
+			}
+		})
+	}
+}
+
+func TestShellyProviderUnavailable(t *testing.T) {
+	fs, ts := newFakeShelly(t, 2, -100, -100, -100)
+	fs.configure(func(fs *fakeShelly) { fs.down = true })
+
+	p := newShellyProvider(ts.URL, false, false)
+	p.Init()
+	if _, err := p.CurrentPowerExport(); err == nil {
+		t.Error("expected an error for an unavailable device")
+	}
+
+	// the device is detected once it becomes available
+	fs.configure(func(fs *fakeShelly) { fs.down = false })
+	if got, err := p.CurrentPowerExport(); err != nil || got != 300 {
+		t.Errorf("CurrentPowerExport() = %v, %v; want 300", got, err)
+	}
+}
+
+func TestShellyProviderWebSocket(t *testing.T) {
+	fs, ts := newFakeShelly(t, 2, -1000, -500, 300)
+
+	p := newShellyProvider(ts.URL, false, true)
+	p.Init()
+	defer p.Close()
+
+	select {
+	case <-fs.notify:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no WebSocket subscription")
+	}
+	waitForExport(t, p, exportIs(1200))
+
+	// notifications only contain the changed values
+	polls := fs.pollCount()
+	fs.set(-2000, -500, 300)
+	fs.notifyStatus(map[string]any{"em:0": map[string]any{"id": 0, "a_act_power": -2000, "total_act_power": -2200}})
+	waitForExport(t, p, exportIs(2200))
+	if n := fs.pollCount(); n != polls {
+		t.Errorf("polled %d times although notifications were received", n-polls)
+	}
+
+	// the provider polls while the connection is down
+	fs.closeConns()
+	fs.set(100, 100, 100)
+	waitForExport(t, p, exportIs(-300))
+	if fs.pollCount() == polls {
+		t.Error("not polled after the WebSocket connection was lost")
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/ingmarstein/mielesolar/modbus/simulator"
+)
+
+// runSimulator implements the "simulate" subcommand which serves a simulated
+// SolarEdge inverter over Modbus TCP.
+func runSimulator(args []string) {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	listen := fs.String("listen", "localhost:1502", "Modbus TCP listen address")
+	unitID := fs.Int("modbus-id", 1, "Inverter MODBUS device ID")
+	profile := fs.String("profile", "", "JSON file with a scripted production/consumption profile. Randomized if empty")
+	peak := fs.Float64("peak", 8000, "Peak PV power in W of the randomized profile")
+	baseLoad := fs.Float64("base-load", 300, "Base household consumption in W of the randomized profile")
+	seed := fs.Int64("seed", time.Now().UnixNano(), "Random seed of the randomized profile")
+	noMeter := fs.Bool("no-meter", false, "Simulate an inverter without a meter")
+	consumptionMeter := fs.Bool("consumption-meter", false, "Simulate a consumption meter in addition to the export+import meter")
+	battery := fs.Bool("battery", false, "Simulate a battery")
+	batteries := fs.Int("batteries", 1, "Number of simulated batteries sharing the battery power, at most 2")
+	_ = fs.Parse(args)
+
+	var p simulator.Profile
+	if *profile != "" {
+		var err error
+		if p, err = simulator.LoadProfile(*profile); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		var maxCharge float64
+		if *battery {
+			maxCharge = 5000
+		}
+		p = simulator.NewRandomProfile(*peak, *baseLoad, maxCharge, *seed)
+	}
+
+	sim := simulator.New(simulator.Config{
+		UnitID:           uint8(*unitID),
+		Meter:            !*noMeter,
+		ConsumptionMeter: *consumptionMeter,
+		Battery:          *battery,
+		Batteries:        *batteries,
+	}, p)
+	if err := sim.Start(*listen); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Simulating SolarEdge inverter on %s", *listen)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s := sim.Sample()
+			log.Printf("Production: %.0f W, consumption: %.0f W, battery: %.0f W", s.Production, s.Consumption, s.Battery)
+		case <-sig:
+			if err := sim.Stop(); err != nil {
+				log.Printf("error stopping simulator: %v", err)
+			}
+			return
+		}
+	}
+}
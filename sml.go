@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/goburrow/serial"
+	"github.com/ingmarstein/mielesolar/sml"
+)
+
+// smlProvider reads the grid power from a smart meter emitting SML, e.g. a
+// German "moderne Messeinrichtung" read by an optical head, which is attached
+// to a serial port or bridged to TCP.
+type smlProvider struct {
+	stream *meterStream[*sml.File]
+	last   powerReading
+}
+
+// newSMLProvider creates a provider reading the meter at address. Optical
+// heads use 9600 baud with 8N1.
+func newSMLProvider(address string, baudRate int) *smlProvider {
+	settings := serial.Config{BaudRate: baudRate, DataBits: 8, StopBits: 1, Parity: "N"}
+	newReader := func(r io.Reader) meterReader[*sml.File] { return sml.NewReader(r) }
+	invalid := func(err error) bool {
+		var parseErr *sml.ParseError
+		return errors.Is(err, sml.ErrChecksum) || errors.Is(err, sml.ErrTooLarge) || errors.As(err, &parseErr)
+	}
+
+	return &smlProvider{stream: newMeterStream("SML", address, settings, newReader, invalid)}
+}
+
+func (p *smlProvider) Open() error {
+	return p.stream.open()
+}
+
+func (p *smlProvider) Close() error {
+	return p.stream.close()
+}
+
+func (p *smlProvider) Init() {
+	file, _, err := p.stream.latest()
+	if err != nil {
+		log.Printf("%v, retrying later", err)
+		return
+	}
+
+	if m, ok := file.String(sml.OBISManufacturer); ok {
+		log.Printf("SML meter manufacturer: %s", m)
+	}
+	log.Printf("SML meter server ID: %s", hex.EncodeToString(file.ServerID))
+	if _, ok := file.Power(sml.OBISPower); !ok {
+		log.Printf("SML meter reports no power (%s), it may have to be unlocked with its PIN", sml.OBISPower)
+	}
+}
+
+func (p *smlProvider) CurrentPowerExport() (float64, error) {
+	file, received, err := p.stream.latest()
+	if err != nil {
+		return 0, err
+	}
+
+	power, ok := file.Power(sml.OBISPower)
+	if !ok {
+		return 0, fmt.Errorf("%w: SML meter reports no power (%s)", errInvalidReading, sml.OBISPower)
+	}
+
+	// the meter reports power drawn from the grid as positive, whereas
+	// positive values indicate a surplus -> export to grid
+	meterPower := -power
+	log.Printf("Meter AC Power: %f", meterPower)
+
+	p.last = powerReading{
+		Time:       received,
+		MeterPower: meterPower,
+		Export:     meterPower,
+		Phases:     smlPhases(file),
+	}
+
+	return meterPower, nil
+}
+
+// smlPhases returns the values of the phases reported by the meter.
+func smlPhases(file *sml.File) []phaseReading {
+	var phases []phaseReading
+	for i := range 3 {
+		power, ok1 := file.Power(sml.OBISPhasePower[i])
+		voltage, ok2 := file.Float(sml.OBISPhaseVoltage[i])
+		current, ok3 := file.Float(sml.OBISPhaseCurrent[i])
+		if !ok1 && !ok2 && !ok3 {
+			break
+		}
+		phase := phaseReading{Voltage: voltage, Current: current}
+		if ok1 {
+			phase.Power = -power
+		}
+		phases = append(phases, phase)
+	}
+
+	return phases
+}
+
+func (p *smlProvider) LastReading() powerReading {
+	return p.last
+}
@@ -0,0 +1,468 @@
+// Package sml parses the Smart Message Language 1.04 which German smart meters
+// ("moderne Messeinrichtung") emit on their optical interface. Only the
+// GetList responses carrying the meter readings are interpreted.
+package sml
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// OBIS identifies a value, e.g. 1-0:16.7.0*255 for the active power.
+type OBIS [6]byte
+
+func (o OBIS) String() string {
+	return fmt.Sprintf("%d-%d:%d.%d.%d*%d", o[0], o[1], o[2], o[3], o[4], o[5])
+}
+
+// OBIS codes of the values used by mielesolar.
+var (
+	OBISManufacturer = OBIS{129, 129, 199, 130, 3, 255}
+	OBISDeviceID     = OBIS{1, 0, 0, 0, 9, 255}
+	OBISEnergyImport = OBIS{1, 0, 1, 8, 0, 255}
+	OBISEnergyExport = OBIS{1, 0, 2, 8, 0, 255}
+	// OBISPower is the total active power. Bidirectional meters report power
+	// drawn from the grid as positive.
+	OBISPower = OBIS{1, 0, 16, 7, 0, 255}
+
+	// per-phase values of L1, L2 and L3
+	OBISPhasePower   = [3]OBIS{{1, 0, 36, 7, 0, 255}, {1, 0, 56, 7, 0, 255}, {1, 0, 76, 7, 0, 255}}
+	OBISPhaseVoltage = [3]OBIS{{1, 0, 32, 7, 0, 255}, {1, 0, 52, 7, 0, 255}, {1, 0, 72, 7, 0, 255}}
+	OBISPhaseCurrent = [3]OBIS{{1, 0, 31, 7, 0, 255}, {1, 0, 51, 7, 0, 255}, {1, 0, 71, 7, 0, 255}}
+)
+
+// Units of measurement as defined by DLMS.
+const (
+	UnitWatt       = 27
+	UnitWattHour   = 30
+	UnitAmpere     = 33
+	UnitVolt       = 35
+	unitNotPresent = 0
+)
+
+// MaxFrameSize limits the size of a transport frame. Larger frames are
+// discarded to cope with streams lacking the end of a frame.
+const MaxFrameSize = 8 * 1024
+
+// maxDepth limits the nesting of lists.
+const maxDepth = 16
+
+var (
+	ErrChecksum = errors.New("checksum mismatch")
+	ErrTooLarge = errors.New("frame too large")
+)
+
+var (
+	escape = []byte{0x1b, 0x1b, 0x1b, 0x1b}
+	start  = []byte{0x01, 0x01, 0x01, 0x01}
+)
+
+// message body tags
+const (
+	tagGetListResponse = 0x0701
+)
+
+// Entry is a value of a GetList response.
+type Entry struct {
+	OBIS   OBIS
+	Unit   uint8 // 0 if not present
+	Scaler int8
+	// Value is an int64, uint64, bool or []byte, or nil if not present.
+	Value any
+}
+
+// Float returns the numeric value with the scaler applied.
+func (e Entry) Float() (float64, bool) {
+	var f float64
+	switch v := e.Value.(type) {
+	case int64:
+		f = float64(v)
+	case uint64:
+		f = float64(v)
+	default:
+		return 0, false
+	}
+
+	return f * math.Pow10(int(e.Scaler)), true
+}
+
+// File holds the GetList responses of a transport frame.
+type File struct {
+	ServerID []byte // of the first GetList response
+	Entries  []Entry
+}
+
+// Entry returns the entry with the given OBIS code.
+func (f *File) Entry(obis OBIS) (Entry, bool) {
+	for _, e := range f.Entries {
+		if e.OBIS == obis {
+			return e, true
+		}
+	}
+
+	return Entry{}, false
+}
+
+// Float returns the numeric value of the given OBIS code.
+func (f *File) Float(obis OBIS) (float64, bool) {
+	e, ok := f.Entry(obis)
+	if !ok {
+		return 0, false
+	}
+
+	return e.Float()
+}
+
+// Power returns the power of the given OBIS code in W.
+func (f *File) Power(obis OBIS) (float64, bool) {
+	e, ok := f.Entry(obis)
+	if !ok || (e.Unit != UnitWatt && e.Unit != unitNotPresent) {
+		return 0, false
+	}
+
+	return e.Float()
+}
+
+// String returns the text of the given OBIS code, e.g. the manufacturer.
+func (f *File) String(obis OBIS) (string, bool) {
+	e, ok := f.Entry(obis)
+	if !ok {
+		return "", false
+	}
+	b, ok := e.Value.([]byte)
+
+	return string(b), ok
+}
+
+// ParseError describes a malformed frame.
+type ParseError struct {
+	Offset int // in the unescaped messages
+	Msg    string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("offset %d: %s", e.Offset, e.Msg)
+}
+
+// checksum computes the CRC16 of a frame (CRC-16/X-25, polynomial 0x8408
+// LSB first, initial value and final XOR 0xFFFF).
+func checksum(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for range 8 {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0x8408
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+
+	return crc ^ 0xFFFF
+}
+
+// Parse parses a complete transport frame from the escape sequence of the
+// start up to the checksum, which is transmitted least significant byte
+// first.
+func Parse(frame []byte) (*File, error) {
+	n := len(frame)
+	if n < 16 || len(frame)%4 != 0 || !bytes.Equal(frame[:4], escape) || !bytes.Equal(frame[4:8], start) {
+		return nil, &ParseError{0, "missing start of frame"}
+	}
+	if !bytes.Equal(frame[n-8:n-4], escape) || frame[n-4] != 0x1a {
+		return nil, &ParseError{0, "missing end of frame"}
+	}
+	if got, want := checksum(frame[:n-2]), uint16(frame[n-2])|uint16(frame[n-1])<<8; got != want {
+		return nil, fmt.Errorf("%w: got %04X, want %04X", ErrChecksum, got, want)
+	}
+
+	// escape sequences within the messages are doubled
+	var data []byte
+	for i := 8; i < n-8; i += 4 {
+		group := frame[i : i+4]
+		if bytes.Equal(group, escape) {
+			i += 4
+			if i >= n-8 || !bytes.Equal(frame[i:i+4], escape) {
+				return nil, &ParseError{len(data), "invalid escape sequence"}
+			}
+		}
+		data = append(data, group...)
+	}
+	padding := int(frame[n-3])
+	if padding > 3 || padding > len(data) || !allZero(data[len(data)-padding:]) {
+		return nil, &ParseError{len(data), fmt.Sprintf("invalid padding %d", padding)}
+	}
+	data = data[:len(data)-padding]
+
+	d := decoder{data: data}
+	f := File{}
+	for d.pos < len(d.data) {
+		if err := d.message(&f); err != nil {
+			return nil, err
+		}
+	}
+
+	return &f, nil
+}
+
+func allZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// decoder decodes the type-length encoded values of the messages.
+type decoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *decoder) errorf(format string, args ...any) error {
+	return &ParseError{d.pos, fmt.Sprintf(format, args...)}
+}
+
+// list is the value of a list.
+type list []any
+
+// endOfMessage marks the end of a message.
+type endOfMessage struct{}
+
+// value decodes the next value.
+func (d *decoder) value(depth int) (any, error) {
+	if depth > maxDepth {
+		return nil, d.errorf("lists nested too deeply")
+	}
+	offset := d.pos
+	if offset >= len(d.data) {
+		return nil, d.errorf("unexpected end of data")
+	}
+	if d.data[offset] == 0x00 {
+		d.pos++
+		return endOfMessage{}, nil
+	}
+
+	// the type-length field can span several bytes, each contributing four
+	// bits of the length
+	b := d.data[d.pos]
+	typ, length := b>>4&0x07, int(b&0x0f)
+	d.pos++
+	for b&0x80 != 0 {
+		if d.pos >= len(d.data) {
+			return nil, d.errorf("unexpected end of data")
+		}
+		b = d.data[d.pos]
+		if b&0x70 != 0 || length > MaxFrameSize {
+			return nil, &ParseError{offset, "invalid type-length field"}
+		}
+		length = length<<4 | int(b&0x0f)
+		d.pos++
+	}
+
+	if typ == 7 {
+		l := make(list, 0, min(length, len(d.data)-d.pos))
+		for range length {
+			v, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			l = append(l, v)
+		}
+		return l, nil
+	}
+
+	// the length of other values includes the type-length field
+	length -= d.pos - offset
+	if length < 0 || d.pos+length > len(d.data) {
+		return nil, &ParseError{offset, fmt.Sprintf("invalid length %d", length)}
+	}
+	content := d.data[d.pos : d.pos+length]
+	d.pos += length
+
+	switch typ {
+	case 0:
+		if length == 0 {
+			// optional value not present
+			return nil, nil
+		}
+		return content, nil
+	case 4:
+		if length != 1 {
+			return nil, &ParseError{offset, fmt.Sprintf("invalid boolean of %d bytes", length)}
+		}
+		return content[0] != 0, nil
+	case 5, 6:
+		if length == 0 || length > 8 {
+			return nil, &ParseError{offset, fmt.Sprintf("invalid integer of %d bytes", length)}
+		}
+		var u uint64
+		for _, c := range content {
+			u = u<<8 | uint64(c)
+		}
+		if typ == 6 {
+			return u, nil
+		}
+		// sign extension
+		shift := 64 - 8*length
+		return int64(u<<shift) >> shift, nil
+	default:
+		return nil, &ParseError{offset, fmt.Sprintf("invalid type %d", typ)}
+	}
+}
+
+// message decodes a message and adds the entries of a GetList response to f.
+// The checksum of the message is not verified as the frame is checksummed.
+func (d *decoder) message(f *File) error {
+	offset := d.pos
+	v, err := d.value(0)
+	if err != nil {
+		return err
+	}
+	if _, ok := v.(endOfMessage); ok {
+		// some meters pad with additional end of message markers
+		return nil
+	}
+	msg, ok := v.(list)
+	if !ok || len(msg) != 6 {
+		return &ParseError{offset, "invalid message"}
+	}
+	if _, ok := msg[5].(endOfMessage); !ok {
+		return &ParseError{offset, "missing end of message"}
+	}
+	body, ok := msg[3].(list)
+	if !ok || len(body) != 2 {
+		return &ParseError{offset, "invalid message body"}
+	}
+	if tag, ok := body[0].(uint64); !ok || tag != tagGetListResponse {
+		return nil
+	}
+
+	resp, ok := body[1].(list)
+	if !ok || len(resp) != 7 {
+		return &ParseError{offset, "invalid GetList response"}
+	}
+	if id, ok := resp[1].([]byte); ok && f.ServerID == nil {
+		f.ServerID = id
+	}
+	entries, ok := resp[4].(list)
+	if !ok {
+		return &ParseError{offset, "invalid value list"}
+	}
+	for _, v := range entries {
+		entry, ok := v.(list)
+		if !ok || len(entry) != 7 {
+			return &ParseError{offset, "invalid list entry"}
+		}
+		name, ok := entry[0].([]byte)
+		if !ok || len(name) != 6 {
+			return &ParseError{offset, "invalid OBIS code"}
+		}
+		e := Entry{OBIS: OBIS(name), Value: entry[5]}
+		if unit, ok := entry[3].(uint64); ok {
+			e.Unit = uint8(unit)
+		}
+		if scaler, ok := entry[4].(int64); ok {
+			e.Scaler = int8(scaler)
+		}
+		if _, ok := e.Value.(list); ok {
+			// e.g. a time, which is not used here
+			e.Value = nil
+		}
+		f.Entries = append(f.Entries, e)
+	}
+
+	return nil
+}
+
+// Reader reads transport frames from a stream, e.g. an optical head.
+type Reader struct {
+	r *bufio.Reader
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{bufio.NewReaderSize(r, 4096)}
+}
+
+// Read returns the content of the next frame. Data preceding the start of a
+// frame is skipped, so reading can start in the middle of the stream. If a
+// frame is interrupted by the start of another, the incomplete one is
+// discarded. Malformed frames are reported with a *ParseError, ErrChecksum or
+// ErrTooLarge, after which reading can continue. Other errors come from the
+// underlying reader.
+func (r *Reader) Read() (*File, error) {
+	frame, err := r.next()
+	if err != nil {
+		return nil, err
+	}
+
+	return Parse(frame)
+}
+
+// next returns the next frame. After the start sequence, frames consist of
+// groups of four bytes.
+func (r *Reader) next() ([]byte, error) {
+	if err := r.skip(); err != nil {
+		return nil, err
+	}
+
+	frame := append(append([]byte{}, escape...), start...)
+	var group [4]byte
+	for {
+		if len(frame) > MaxFrameSize {
+			return nil, ErrTooLarge
+		}
+		if _, err := io.ReadFull(r.r, group[:]); err != nil {
+			return nil, err
+		}
+		frame = append(frame, group[:]...)
+		if !bytes.Equal(group[:], escape) {
+			continue
+		}
+
+		if _, err := io.ReadFull(r.r, group[:]); err != nil {
+			return nil, err
+		}
+		switch {
+		case bytes.Equal(group[:], escape):
+			// escaped data
+			frame = append(frame, group[:]...)
+		case bytes.Equal(group[:], start):
+			// the start of another frame
+			frame = frame[:len(escape)+len(start)]
+		case group[0] == 0x1a:
+			return append(frame, group[:]...), nil
+		default:
+			return nil, &ParseError{len(frame), fmt.Sprintf("invalid escape sequence % x", group)}
+		}
+	}
+}
+
+// skip reads up to and including the start sequence.
+func (r *Reader) skip() error {
+	var n int // number of consecutive escape characters
+	for {
+		b, err := r.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b == 0x1b {
+			n++
+			continue
+		}
+		if n >= 4 && b == 0x01 {
+			if next, err := r.r.Peek(3); err == nil && bytes.Equal(next, start[1:]) {
+				_, _ = r.r.Discard(3)
+				return nil
+			}
+		}
+		n = 0
+	}
+}
@@ -0,0 +1,254 @@
+package sml
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var captures = []string{"iskra_mt175.bin", "ebz_dd3.bin", "emh_ehz.bin", "holley_dtz541.bin"}
+
+func readFrame(t testing.TB, name string) []byte {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func TestChecksum(t *testing.T) {
+	if got := checksum([]byte("123456789")); got != 0x906E {
+		t.Errorf("checksum = %04X, want 906E", got)
+	}
+}
+
+func TestOBISString(t *testing.T) {
+	if got := OBISPower.String(); got != "1-0:16.7.0*255" {
+		t.Errorf("String() = %q", got)
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, tt := range []struct {
+		file         string
+		manufacturer string
+		serverID     string
+		power        float64 // NaN if not available
+		phases       [3]float64
+		voltages     [3]float64
+		imported     float64
+	}{
+		{"iskra_mt175.bin", "ISK", "0a01495342000512d4a1", -1234, [3]float64{-500, -400, -334}, [3]float64{}, 12345678.9},
+		{"ebz_dd3.bin", "EBZ", "0645425a0100001234ab", 567.89, [3]float64{200, 167.89, 200}, [3]float64{230.1, 229.5, 231}, 45.67890123},
+		{"emh_ehz.bin", "EMH", "0901454d480000a1b2c3", -42, [3]float64{}, [3]float64{}, 765432.1},
+		{"holley_dtz541.bin", "HLY", "0a01484c5900004d2e11", math.NaN(), [3]float64{}, [3]float64{}, 2222333.3},
+	} {
+		t.Run(tt.file, func(t *testing.T) {
+			f, err := Parse(readFrame(t, tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m, _ := f.String(OBISManufacturer); m != tt.manufacturer {
+				t.Errorf("manufacturer = %q, want %q", m, tt.manufacturer)
+			}
+			if id := hex.EncodeToString(f.ServerID); id != tt.serverID {
+				t.Errorf("server ID = %s, want %s", id, tt.serverID)
+			}
+
+			power, ok := f.Power(OBISPower)
+			if math.IsNaN(tt.power) {
+				if ok {
+					t.Errorf("power = %v, want none", power)
+				}
+			} else if !ok || !approxEqual(power, tt.power) {
+				t.Errorf("power = %v, %v; want %v", power, ok, tt.power)
+			}
+			for i := range 3 {
+				if p, ok := f.Power(OBISPhasePower[i]); ok != (tt.phases[i] != 0) || !approxEqual(p, tt.phases[i]) {
+					t.Errorf("L%d power = %v, want %v", i+1, p, tt.phases[i])
+				}
+				if v, ok := f.Float(OBISPhaseVoltage[i]); ok != (tt.voltages[i] != 0) || !approxEqual(v, tt.voltages[i]) {
+					t.Errorf("L%d voltage = %v, want %v", i+1, v, tt.voltages[i])
+				}
+			}
+			if e, ok := f.Float(OBISEnergyImport); !ok || !approxEqual(e, tt.imported) {
+				t.Errorf("imported energy = %v, want %v", e, tt.imported)
+			}
+		})
+	}
+}
+
+func approxEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-6
+}
+
+func TestParseEscaped(t *testing.T) {
+	// the public key of the EMH meter contains an escape sequence, which is
+	// doubled in the frame
+	frame := readFrame(t, "emh_ehz.bin")
+	if !bytes.Contains(frame, bytes.Repeat(escape, 2)) {
+		t.Fatal("capture contains no escaped data")
+	}
+	f, err := Parse(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, ok := f.Entry(OBIS{129, 129, 199, 130, 5, 255})
+	if key, _ := e.Value.([]byte); !ok || !bytes.Contains(key, escape) || bytes.Contains(key, bytes.Repeat(escape, 2)) {
+		t.Errorf("public key = %x", e.Value)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	valid := readFrame(t, "iskra_mt175.bin")
+	modify := func(f func(b []byte) []byte) []byte {
+		return f(bytes.Clone(valid))
+	}
+	var parseErr *ParseError
+
+	for _, tt := range []struct {
+		name  string
+		frame []byte
+	}{
+		{"empty", nil},
+		{"no start", valid[8:]},
+		{"no end", valid[:len(valid)-8]},
+		{"unaligned", append(bytes.Clone(valid[:len(valid)-8]), valid[len(valid)-9:]...)},
+		{"padding", modify(func(b []byte) []byte { b[len(b)-3] = 4; return b })},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Parse(tt.frame); !errors.As(err, &parseErr) && !errors.Is(err, ErrChecksum) {
+				t.Errorf("Parse() = %v, want an error", err)
+			}
+		})
+	}
+
+	// a bit error in the power value
+	corrupted := modify(func(b []byte) []byte { b[bytes.Index(b, []byte{0xff, 0xff, 0xfb, 0x2e})+2] ^= 0x10; return b })
+	if _, err := Parse(corrupted); !errors.Is(err, ErrChecksum) {
+		t.Errorf("Parse() = %v, want %v", err, ErrChecksum)
+	}
+}
+
+func TestReader(t *testing.T) {
+	iskra, ebz, emh := readFrame(t, "iskra_mt175.bin"), readFrame(t, "ebz_dd3.bin"), readFrame(t, "emh_ehz.bin")
+	corrupted := bytes.Clone(ebz)
+	corrupted[len(corrupted)-1] ^= 0xff
+
+	var stream bytes.Buffer
+	// the reader starts in the middle of a frame
+	stream.Write(emh[len(emh)/2:])
+	stream.Write(iskra)
+	// noise between frames
+	stream.Write([]byte{0x1b, 0x1b, 0x1b, 0x01, 0x1b, 0x1b, 0x00})
+	// a frame is interrupted by the next one
+	stream.Write(ebz[:len(ebz)/2])
+	stream.Write(emh)
+	stream.Write(corrupted)
+	stream.Write(ebz)
+
+	r := NewReader(&stream)
+	for i, want := range []string{"ISK", "EMH", "", "EBZ"} {
+		f, err := r.Read()
+		if want == "" {
+			if !errors.Is(err, ErrChecksum) {
+				t.Errorf("frame %d: got %v, want %v", i, err, ErrChecksum)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if m, _ := f.String(OBISManufacturer); m != want {
+			t.Errorf("frame %d: manufacturer = %q, want %q", i, m, want)
+		}
+	}
+	if _, err := r.Read(); err != io.EOF {
+		t.Errorf("got %v, want EOF", err)
+	}
+}
+
+func TestReaderPartialFrame(t *testing.T) {
+	// the stream ends within a frame
+	iskra := readFrame(t, "iskra_mt175.bin")
+	r := NewReader(bytes.NewReader(iskra[:len(iskra)-5]))
+	if _, err := r.Read(); err != io.ErrUnexpectedEOF {
+		t.Errorf("got %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+
+	// a frame without an end is discarded
+	data := append(bytes.Clone(iskra[:len(iskra)-8]), bytes.Repeat([]byte{0x42}, MaxFrameSize)...)
+	r = NewReader(bytes.NewReader(append(data, iskra...)))
+	if _, err := r.Read(); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("got %v, want %v", err, ErrTooLarge)
+	}
+	if f, err := r.Read(); err != nil || len(f.Entries) == 0 {
+		t.Errorf("got %v, %v; want the following frame", f, err)
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	for _, name := range captures {
+		f.Add(readFrame(f, name))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		file, err := Parse(data)
+		if err != nil {
+			return
+		}
+		for _, e := range file.Entries {
+			e.Float()
+		}
+		file.Power(OBISPower)
+	})
+}
+
+// FuzzMessages bypasses the frame checksum to exercise the message decoder.
+func FuzzMessages(f *testing.F) {
+	for _, name := range captures {
+		frame := readFrame(f, name)
+		f.Add(frame[8 : len(frame)-8])
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		d := decoder{data: data}
+		var file File
+		for d.pos < len(d.data) {
+			pos := d.pos
+			if err := d.message(&file); err != nil {
+				return
+			}
+			if d.pos <= pos {
+				t.Fatal("decoder does not make progress")
+			}
+		}
+	})
+}
+
+func FuzzReader(f *testing.F) {
+	f.Add(append(readFrame(f, "iskra_mt175.bin"), readFrame(f, "emh_ehz.bin")...))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := NewReader(bytes.NewReader(data))
+		// every frame consumes at least its start sequence
+		for range len(data) + 1 {
+			file, err := r.Read()
+			if err == nil && file == nil {
+				t.Fatal("nil file without error")
+			}
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return
+			}
+		}
+		t.Fatal("reader does not make progress")
+	})
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func readSMLFrame(t *testing.T, name string) []byte {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("sml", "testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func TestSMLProvider(t *testing.T) {
+	for _, tt := range []struct {
+		file    string
+		want    float64
+		phases  []phaseReading
+		invalid bool
+	}{
+		{"iskra_mt175.bin", 1234, []phaseReading{{500, 0, 0}, {400, 0, 0}, {334, 0, 0}}, false},
+		{"ebz_dd3.bin", -567.89, []phaseReading{{-200, 230.1, 0.87}, {-167.89, 229.5, 0.73}, {-200, 231, 0.87}}, false},
+		{"emh_ehz.bin", 42, nil, false},
+		// the power is only available after entering the PIN
+		{"holley_dtz541.bin", 0, nil, true},
+	} {
+		t.Run(tt.file, func(t *testing.T) {
+			address, conns := newFakeMeter(t)
+			p := newSMLProvider(address, 9600)
+			if err := p.Open(); err != nil {
+				t.Fatal(err)
+			}
+			defer p.Close()
+
+			// the connection starts in the middle of a frame
+			frame := readSMLFrame(t, tt.file)
+			conn := acceptMeter(t, conns)
+			if _, err := conn.Write(slices.Concat(frame[len(frame)/2:], frame)); err != nil {
+				t.Fatal(err)
+			}
+			p.Init()
+
+			got, err := p.CurrentPowerExport()
+			if tt.invalid {
+				if !errors.Is(err, errInvalidReading) {
+					t.Errorf("CurrentPowerExport() = %v, %v; want invalid reading", got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !approxEqual(got, tt.want) {
+				t.Errorf("CurrentPowerExport() = %v, want %v", got, tt.want)
+			}
+			r := p.LastReading()
+			if r.MeterPower != got || r.Export != got || len(r.Phases) != len(tt.phases) {
+				t.Fatalf("LastReading() = %+v", r)
+			}
+			for i, phase := range r.Phases {
+				want := tt.phases[i]
+				if !approxEqual(phase.Power, want.Power) || !approxEqual(phase.Voltage, want.Voltage) || !approxEqual(phase.Current, want.Current) {
+					t.Errorf("L%d = %+v, want %+v", i+1, phase, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSMLProviderStream(t *testing.T) {
+	address, conns := newFakeMeter(t)
+	p := newSMLProvider(address, 9600)
+	if err := p.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// frames with a wrong checksum and interrupted frames are skipped
+	iskra, emh := readSMLFrame(t, "iskra_mt175.bin"), readSMLFrame(t, "emh_ehz.bin")
+	corrupted := bytes.Clone(iskra)
+	corrupted[len(corrupted)-20] ^= 0x01
+	conn := acceptMeter(t, conns)
+	if _, err := conn.Write(slices.Concat(corrupted, iskra[:100], emh)); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := p.CurrentPowerExport(); err != nil || got != 42 {
+		t.Errorf("CurrentPowerExport() = %v, %v; want 42", got, err)
+	}
+
+	// frames may arrive in several parts
+	for _, part := range [][]byte{iskra[:7], iskra[7:150], iskra[150:]} {
+		if _, err := conn.Write(part); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForExport(t, p, exportIs(1234))
+
+	// a lost connection is reported so that the server reconnects
+	_ = conn.Close()
+	waitForExport(t, p, func(_ float64, err error) bool { return err != nil && !errors.Is(err, errInvalidReading) })
+}
@@ -3,11 +3,13 @@ package main
 import (
 	"github.com/ingmarstein/solarmanager-go/solarmanager"
 	"log"
+	"time"
 )
 
 type solarManagerProvider struct {
-	c  *solarmanager.Client
-	id string
+	c    *solarmanager.Client
+	id   string
+	last powerReading
 }
 
 func newSolarManagerProvider(username string, password string, id string) *solarManagerProvider {
@@ -33,9 +35,22 @@ func (smp *solarManagerProvider) CurrentPowerExport() (float64, error) {
 
 	export := float64(gd.CurrentPvGeneration - gd.CurrentPowerConsumption + gd.CurrentBatteryChargeDischarge)
 
+	smp.last = powerReading{
+		Time:         time.Now(),
+		PVPower:      float64(gd.CurrentPvGeneration),
+		ACPower:      float64(gd.CurrentPvGeneration),
+		MeterPower:   float64(gd.CurrentPvGeneration - gd.CurrentPowerConsumption),
+		BatteryPower: float64(gd.CurrentBatteryChargeDischarge),
+		Export:       export,
+	}
+
 	return export, nil
 }
 
+func (smp *solarManagerProvider) LastReading() powerReading {
+	return smp.last
+}
+
 func (smp *solarManagerProvider) Init() {
 	info, err := smp.c.GetGatewayInfo(smp.id)
 	if err != nil {
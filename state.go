@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+)
+
+// stateSaveInterval limits how often the state is written only because the
+// surplus energy of the day increased, which happens on every refresh while
+// devices are waiting.
+const stateSaveInterval = 5 * time.Minute
+
+// persistedState is the runtime state which survives a restart, e.g. after
+// a crash or a container update.
+type persistedState struct {
+	NextStart time.Time              `json:"nextStart"`
+	Paused    bool                   `json:"paused"`
+	Devices   map[string]deviceState `json:"devices,omitempty"`
+	Today     dailyStats             `json:"today"`
+}
+
+type deviceState struct {
+	Name      string    `json:"name,omitempty"`
+	LastStart time.Time `json:"lastStart"`
+	SkipUntil time.Time `json:"skipUntil"`
+}
+
+// dailyStats counts the device starts and the surplus energy measured on a
+// single day.
+type dailyStats struct {
+	Date    string         `json:"date"`             // YYYY-MM-DD in the local time zone
+	Starts  map[string]int `json:"starts,omitempty"` // by device ID
+	Surplus float64        `json:"surplus"`          // Wh exported while devices were waiting
+}
+
+// rollover resets the counters if t is on another day.
+func (d *dailyStats) rollover(t time.Time) {
+	if date := t.Format(time.DateOnly); date != d.Date {
+		*d = dailyStats{Date: date}
+	}
+}
+
+func (d *dailyStats) addStart(t time.Time, id string) {
+	d.rollover(t)
+	if d.Starts == nil {
+		d.Starts = make(map[string]int)
+	}
+	d.Starts[id]++
+}
+
+// addSurplus adds the energy of a positive surplus measured for the given
+// duration.
+func (d *dailyStats) addSurplus(t time.Time, power float64, duration time.Duration) {
+	d.rollover(t)
+	if power > 0 {
+		d.Surplus += power * duration.Hours()
+	}
+}
+
+// stateStore reads and writes the persisted state as a JSON file.
+type stateStore struct {
+	name    string
+	last    []byte // content of the last successful write
+	saved   *persistedState
+	savedAt time.Time
+}
+
+// load returns the stored state. A missing file yields an empty state.
+func (st *stateStore) load() (*persistedState, error) {
+	var ps persistedState
+	data, err := os.ReadFile(st.name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &ps, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &ps); err != nil {
+		return nil, err
+	}
+	st.last = data
+	st.saved = ps.clone()
+
+	return &ps, nil
+}
+
+// changed reports whether ps differs from the state last written. An increase
+// of the surplus energy alone counts only every stateSaveInterval.
+func (st *stateStore) changed(ps *persistedState) bool {
+	if st.saved == nil || time.Since(st.savedAt) >= stateSaveInterval {
+		return true
+	}
+
+	prev := *st.saved
+	prev.Today.Surplus = ps.Today.Surplus
+	return !reflect.DeepEqual(&prev, ps)
+}
+
+// clone returns a copy of ps which doesn't share its maps.
+func (ps *persistedState) clone() *persistedState {
+	c := *ps
+	c.Devices = maps.Clone(ps.Devices)
+	c.Today.Starts = maps.Clone(ps.Today.Starts)
+
+	return &c
+}
+
+// save writes the state unless it is unchanged. The file is replaced
+// atomically so that a crash never leaves a partially written state behind.
+func (st *stateStore) save(ps *persistedState) error {
+	data, err := json.MarshalIndent(ps, "", "  ")
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(data, st.last) {
+		st.saved, st.savedAt = ps.clone(), time.Now()
+		return nil
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(st.name), filepath.Base(st.name)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(f.Name()) }()
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), st.name); err != nil {
+		return err
+	}
+	st.last = data
+	st.saved, st.savedAt = ps.clone(), time.Now()
+
+	return nil
+}
+
+// restoreState applies the persisted state. In auto mode, the restored
+// devices are merged with the appliances discovered on the next refresh.
+func (s *server) restoreState(ps *persistedState) {
+	if ps.NextStart.After(s.nextStart) {
+		s.nextStart = ps.NextStart
+	}
+	s.paused = ps.Paused
+	s.today = ps.Today
+
+	if s.mode == ManualMode {
+		for i := range s.devices {
+			if ds, ok := ps.Devices[s.devices[i].ID]; ok {
+				s.devices[i].lastStart = ds.LastStart
+				s.devices[i].skipUntil = ds.SkipUntil
+			}
+		}
+		return
+	}
+
+	for id, ds := range ps.Devices {
+		s.devices = append(s.devices, device{
+			ID:        id,
+			Name:      ds.Name,
+			Power:     float64(s.autoPower),
+			lastStart: ds.LastStart,
+			skipUntil: ds.SkipUntil,
+		})
+	}
+}
+
+// saveState writes the runtime state if a state file is configured and the
+// state changed. The caller must hold s.mu unless the server is not yet
+// running.
+func (s *server) saveState() {
+	if s.store == nil {
+		return
+	}
+
+	ps := persistedState{
+		NextStart: s.nextStart,
+		Paused:    s.paused,
+		Devices:   make(map[string]deviceState),
+		Today:     s.today,
+	}
+	for _, d := range s.devices {
+		if !d.lastStart.IsZero() || !d.skipUntil.IsZero() {
+			ps.Devices[d.ID] = deviceState{Name: d.Name, LastStart: d.lastStart, SkipUntil: d.skipUntil}
+		}
+	}
+	if !s.store.changed(&ps) {
+		return
+	}
+	if err := s.store.save(&ps); err != nil {
+		log.Printf("error saving state: %v", err)
+	}
+}
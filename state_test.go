@@ -0,0 +1,165 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ingmarstein/miele-go/miele"
+)
+
+func TestStatePersistence(t *testing.T) {
+	f := newFakeMiele(t)
+	f.add("washer", "Washing Machine", miele.DEVICE_TYPE_WASHING_MACHINE, true)
+	f.add("dryer", "Tumble Dryer", miele.DEVICE_TYPE_TUMBLE_DRYER, false)
+
+	dir := t.TempDir()
+	cfg := defaultConfig()
+	cfg.Devices = []device{{ID: "washer", Name: "Washing Machine", Power: 200}, {ID: "dryer", Name: "Tumble Dryer", Power: 200}}
+	cfg.Delay = 3600
+	cfg.State = filepath.Join(dir, "state.json")
+
+	srv := newServer(cfg, f.client(), &fakeProvider{power: 1000})
+	refresh(t, srv)
+	checkStarted(t, f, "washer")
+	srv.setPaused(true)
+	if err := srv.skipDevice("dryer", endOfDay(time.Now())); err != nil {
+		t.Fatal(err)
+	}
+	nextStart := srv.nextStart
+
+	// no temporary files are left behind
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 1 {
+		t.Errorf("unexpected files in state directory: %v, %v", entries, err)
+	}
+
+	// a restarted server does not start a second device before the delay has passed
+	f.add("dryer", "Tumble Dryer", miele.DEVICE_TYPE_TUMBLE_DRYER, true)
+	srv = newServer(cfg, f.client(), &fakeProvider{power: 1000})
+	if !srv.nextStart.Equal(nextStart) || !srv.paused {
+		t.Errorf("nextStart = %v, paused = %v; want %v, true", srv.nextStart, srv.paused, nextStart)
+	}
+	if d := srv.findDevice("washer"); d.lastStart.IsZero() {
+		t.Error("last start of washer not restored")
+	}
+	if d := srv.findDevice("dryer"); d.skipUntil.IsZero() {
+		t.Error("skip of dryer not restored")
+	}
+	if srv.today.Starts["washer"] != 1 {
+		t.Errorf("starts = %v, want 1 start of washer", srv.today.Starts)
+	}
+	srv.setPaused(false)
+	_ = srv.skipDevice("dryer", time.Time{})
+	refresh(t, srv)
+	checkStarted(t, f, "washer")
+}
+
+func TestStateAutoMode(t *testing.T) {
+	f := newFakeMiele(t)
+	f.add("washer", "Washing Machine", miele.DEVICE_TYPE_WASHING_MACHINE, true)
+
+	cfg := defaultConfig()
+	cfg.Auto = 500
+	cfg.State = filepath.Join(t.TempDir(), "state.json")
+
+	srv := newServer(cfg, f.client(), &fakeProvider{power: 1000})
+	refresh(t, srv)
+	checkStarted(t, f, "washer")
+	lastStart := srv.findDevice("washer").lastStart
+
+	srv = newServer(cfg, f.client(), &fakeProvider{power: 1000})
+	refresh(t, srv)
+	if d := srv.findDevice("washer"); d == nil || !d.lastStart.Equal(lastStart) || d.Name != "Washing Machine" {
+		t.Errorf("washer = %+v, want restored last start %v", d, lastStart)
+	}
+}
+
+func TestStateInvalidFile(t *testing.T) {
+	f := newFakeMiele(t)
+	f.add("washer", "Washing Machine", miele.DEVICE_TYPE_WASHING_MACHINE, true)
+
+	name := writeConfig(t, "{")
+	cfg := defaultConfig()
+	cfg.Auto = 500
+	cfg.State = name
+
+	// an unreadable state is replaced on the next change
+	srv := newServer(cfg, f.client(), &fakeProvider{power: 1000})
+	refresh(t, srv)
+	checkStarted(t, f, "washer")
+	ps, err := srv.store.load()
+	if err != nil || ps.Devices["washer"].LastStart.IsZero() {
+		t.Errorf("state = %+v, %v", ps, err)
+	}
+}
+
+func TestStateSavedOnChange(t *testing.T) {
+	f := newFakeMiele(t)
+	cfg := defaultConfig()
+	cfg.Devices = []device{{ID: "washer", Name: "Washing Machine", Power: 200}}
+	cfg.State = filepath.Join(t.TempDir(), "state.json")
+	srv := newServer(cfg, f.client(), &fakeProvider{})
+
+	srv.today.rollover(time.Now())
+	srv.saveState()
+	if _, err := os.Stat(cfg.State); err != nil {
+		t.Fatal(err)
+	}
+
+	// the removed file reveals whether the state is written again
+	saved := func() bool {
+		t.Helper()
+		_, err := os.Stat(cfg.State)
+		if err == nil {
+			if err := os.Remove(cfg.State); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return err == nil
+	}
+	_ = saved()
+	srv.saveState()
+	if saved() {
+		t.Error("unchanged state written")
+	}
+
+	// the surplus energy alone is only written periodically
+	srv.today.addSurplus(time.Now(), 1000, time.Minute)
+	srv.saveState()
+	if saved() {
+		t.Error("state written for the surplus energy")
+	}
+	srv.store.savedAt = srv.store.savedAt.Add(-stateSaveInterval)
+	srv.saveState()
+	if !saved() {
+		t.Error("surplus energy not written after the save interval")
+	}
+
+	srv.today.addStart(time.Now(), "washer")
+	srv.saveState()
+	if !saved() {
+		t.Error("start not written")
+	}
+	srv.paused = true
+	srv.saveState()
+	if !saved() {
+		t.Error("pause not written")
+	}
+}
+
+func TestDailyStats(t *testing.T) {
+	var d dailyStats
+	day := time.Date(2024, 6, 1, 12, 0, 0, 0, time.Local)
+	d.addStart(day, "washer")
+	d.addSurplus(day, 1200, 30*time.Minute)
+	d.addSurplus(day, -500, time.Hour)
+	if d.Date != "2024-06-01" || d.Starts["washer"] != 1 || d.Surplus != 600 {
+		t.Errorf("unexpected stats %+v", d)
+	}
+
+	d.addSurplus(day.Add(24*time.Hour), 100, time.Hour)
+	if d.Date != "2024-06-02" || len(d.Starts) != 0 || d.Surplus != 100 {
+		t.Errorf("counters not reset on the next day: %+v", d)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/goburrow/serial"
+)
+
+const (
+	// meterTimeout is the maximum age of a reading pushed by a smart meter.
+	// Meters send a reading every one to ten seconds.
+	meterTimeout = time.Minute
+	// meterFirstTimeout bounds the wait for the first reading after opening
+	// the stream, during which the polling loop waits. It exceeds the longest
+	// period of ten seconds so that the reconnect doesn't start over.
+	meterFirstTimeout = 12 * time.Second
+	meterDialTimeout  = 10 * time.Second
+	// meterReadTimeout limits serial reads so that the reader notices when
+	// the stream is closed.
+	meterReadTimeout = 500 * time.Millisecond
+)
+
+// meterReader is implemented by the readers of the dsmr and sml packages.
+type meterReader[T any] interface {
+	Read() (T, error)
+}
+
+// meterStream receives the readings which a smart meter pushes over a serial
+// device or a TCP socket, e.g. of ser2net, and keeps the latest one.
+type meterStream[T any] struct {
+	name      string // of the interface, e.g. "P1"
+	address   string // serial device or host:port
+	serial    serial.Config
+	newReader func(io.Reader) meterReader[T]
+	// invalid reports whether an error of the reader concerns a single
+	// reading, after which reading continues.
+	invalid func(error) bool
+
+	port    io.ReadWriteCloser
+	closing atomic.Bool
+	ready   chan struct{} // closed when the first reading was received
+	done    chan struct{} // closed when the reader stopped
+	waited  bool          // whether latest waited for the first reading
+
+	// mu guards the fields below which are updated by the reader.
+	mu       sync.Mutex
+	value    T
+	received time.Time
+	err      error // error which stopped the reader
+}
+
+// newMeterStream creates a stream reading from address. Addresses of the form
+// host:port are connected over TCP, anything else is opened as a serial device
+// with the given settings.
+func newMeterStream[T any](name, address string, settings serial.Config, newReader func(io.Reader) meterReader[T], invalid func(error) bool) *meterStream[T] {
+	settings.Address, settings.Timeout = address, meterReadTimeout
+	return &meterStream[T]{name: name, address: address, serial: settings, newReader: newReader, invalid: invalid}
+}
+
+// meterSerialReader retries reads which time out until the stream is closed.
+type meterSerialReader struct {
+	port    io.Reader
+	closing *atomic.Bool
+}
+
+func (r *meterSerialReader) Read(b []byte) (int, error) {
+	for {
+		n, err := r.port.Read(b)
+		if errors.Is(err, serial.ErrTimeout) && !r.closing.Load() {
+			continue
+		}
+		if err == nil && n == 0 {
+			return 0, io.EOF
+		}
+		return n, err
+	}
+}
+
+func (s *meterStream[T]) open() error {
+	var r io.Reader
+	if _, _, err := net.SplitHostPort(s.address); err == nil {
+		conn, err := net.DialTimeout("tcp", s.address, meterDialTimeout)
+		if err != nil {
+			return fmt.Errorf("error connecting to %s port %s: %v", s.name, s.address, err)
+		}
+		s.port, r = conn, conn
+	} else {
+		port, err := serial.Open(&s.serial)
+		if err != nil {
+			return fmt.Errorf("error opening %s port %s: %v", s.name, s.address, err)
+		}
+		s.port, r = port, &meterSerialReader{port, &s.closing}
+	}
+
+	s.closing.Store(false)
+	s.ready, s.done = make(chan struct{}), make(chan struct{})
+	s.waited = false
+	s.mu.Lock()
+	s.received, s.err = time.Time{}, nil
+	s.mu.Unlock()
+	go s.read(r)
+
+	return nil
+}
+
+func (s *meterStream[T]) close() error {
+	if s.port == nil {
+		return nil
+	}
+
+	s.closing.Store(true)
+	var err error
+	if conn, ok := s.port.(net.Conn); ok {
+		// unblocks the reader
+		err = conn.Close()
+		<-s.done
+	} else {
+		// the serial port must not be closed while it is being read
+		<-s.done
+		err = s.port.Close()
+	}
+	s.port = nil
+
+	return err
+}
+
+// read receives readings until the connection fails. Invalid readings are
+// skipped.
+func (s *meterStream[T]) read(r io.Reader) {
+	defer close(s.done)
+
+	mr := s.newReader(r)
+	for {
+		value, err := mr.Read()
+		switch {
+		case err == nil:
+			s.mu.Lock()
+			if s.received.IsZero() {
+				close(s.ready)
+			}
+			s.value, s.received = value, time.Now()
+			s.mu.Unlock()
+		case s.invalid(err):
+			log.Printf("invalid %s reading: %v", s.name, err)
+		default:
+			if s.closing.Load() {
+				err = net.ErrClosed
+			}
+			s.mu.Lock()
+			s.err = err
+			s.mu.Unlock()
+			return
+		}
+	}
+}
+
+// latest returns the latest reading and the time it was received. On the
+// first call after opening the stream, it waits up to meterFirstTimeout for
+// the first reading.
+func (s *meterStream[T]) latest() (T, time.Time, error) {
+	var zero T
+	if s.port == nil {
+		return zero, time.Time{}, fmt.Errorf("%s port %s is not open", s.name, s.address)
+	}
+
+	if !s.waited {
+		s.waited = true
+		timer := time.NewTimer(meterFirstTimeout)
+		defer timer.Stop()
+		select {
+		case <-s.ready:
+		case <-s.done:
+		case <-timer.C:
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case s.err != nil:
+		return zero, time.Time{}, fmt.Errorf("error reading %s port %s: %v", s.name, s.address, s.err)
+	case s.received.IsZero():
+		return zero, time.Time{}, fmt.Errorf("no %s reading received from %s", s.name, s.address)
+	case time.Since(s.received) > meterTimeout:
+		return zero, time.Time{}, fmt.Errorf("last %s reading is too old (%v)", s.name, time.Since(s.received).Round(time.Second))
+	}
+
+	return s.value, s.received, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// newFakeMeter accepts connections like ser2net and passes them to the test,
+// which writes the data of the meter to them.
+func newFakeMeter(t *testing.T) (string, chan net.Conn) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+		}
+	}()
+	t.Cleanup(func() {
+		_ = l.Close()
+		close(conns)
+		for conn := range conns {
+			_ = conn.Close()
+		}
+	})
+
+	return l.Addr().String(), conns
+}
+
+func acceptMeter(t *testing.T, conns chan net.Conn) net.Conn {
+	t.Helper()
+
+	select {
+	case conn := <-conns:
+		t.Cleanup(func() { _ = conn.Close() })
+		return conn
+	case <-time.After(5 * time.Second):
+		t.Fatal("no connection to the meter")
+		return nil
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/ingmarstein/mielesolar/modbus/sunspec"
+)
+
+// sunspecUnit holds the SunSpec devices discovered at an inverter target.
+type sunspecUnit struct {
+	inverterTarget
+	conn    *modbusConn
+	devices []*sunspec.Device
+	// exportPositive is set for SolarEdge inverters whose meters report an
+	// export as positive power unlike the SunSpec convention.
+	exportPositive bool
+	inverters      []*sunspec.Model
+	batteries      []*sunspec.Model
+}
+
+// sunspecProvider reads the power export from any inverter implementing the
+// SunSpec information models by walking its model chain instead of relying
+// on fixed register addresses.
+type sunspecProvider struct {
+	conns     []*modbusConn
+	units     []*sunspecUnit
+	meterUnit *sunspecUnit
+	meter     *sunspec.Model // meter at the grid connection point
+	last      powerReading
+}
+
+func newSunSpecProvider(targets ...inverterTarget) (*sunspecProvider, error) {
+	var p sunspecProvider
+
+	conns, err := newModbusConns(targets)
+	if err != nil {
+		return nil, err
+	}
+	for i, t := range targets {
+		p.units = append(p.units, &sunspecUnit{inverterTarget: t, conn: conns[i]})
+	}
+	p.conns = uniqueConns(conns)
+
+	return &p, nil
+}
+
+func (sp *sunspecProvider) Open() error {
+	return openConns(sp.conns)
+}
+
+func (sp *sunspecProvider) Close() error {
+	return closeConns(sp.conns)
+}
+
+func (sp *sunspecProvider) Init() {
+	var discovered bool
+	for _, u := range sp.units {
+		if err := sp.discover(u); err != nil {
+			log.Printf("inverter %s unavailable, retrying later: %v", u, err)
+			continue
+		}
+		discovered = true
+	}
+	if !discovered {
+		log.Fatalf("no inverter available")
+	}
+}
+
+// discover scans the model chain of the target and logs the devices found.
+func (sp *sunspecProvider) discover(u *sunspecUnit) error {
+	if err := u.conn.use(u.UnitID); err != nil {
+		return err
+	}
+
+	devices, err := sunspec.Scan(u.conn.c)
+	if err != nil {
+		return err
+	}
+
+	u.devices = devices
+	u.exportPositive = false
+	u.inverters, u.batteries = nil, nil
+	for i, d := range devices {
+		log.Printf("Device %d of %s Manufacturer: %s", i+1, u, d.Manufacturer())
+		log.Printf("Device %d of %s Model: %s", i+1, u, d.DeviceModel())
+		log.Printf("Device %d of %s Option: %s", i+1, u, d.Options())
+		log.Printf("Device %d of %s Version: %s", i+1, u, d.Version())
+		log.Printf("Device %d of %s Serial: %s", i+1, u, d.SerialNumber())
+		for _, m := range d.Models {
+			log.Printf("Device %d of %s implements %s (%d) at %d", i+1, u, m.Name(), m.ID, m.Address)
+		}
+
+		if strings.EqualFold(d.Manufacturer(), "SolarEdge") {
+			u.exportPositive = true
+		}
+		if m := d.Find(sunspec.InverterModels...); m != nil {
+			u.inverters = append(u.inverters, m)
+		}
+		if m := d.Find(sunspec.ModelLithiumIonBatteryBank); m != nil {
+			u.batteries = append(u.batteries, m)
+		} else if d.Find(sunspec.ModelStorage) != nil {
+			log.Printf("Device %d of %s provides no battery power, it is not taken into account", i+1, u)
+		}
+	}
+	if len(u.inverters) == 0 {
+		log.Printf("no inverter model found at %s", u)
+	}
+
+	sp.selectGridMeter()
+
+	return nil
+}
+
+// selectGridMeter selects the meter measuring the export to the grid. Meters
+// are identified by an option containing "export" and "import". If no meter
+// is marked as such, the first meter is used.
+func (sp *sunspecProvider) selectGridMeter() {
+	var first *sunspecUnit
+	var firstDevice *sunspec.Device
+	var firstMeter *sunspec.Model
+	for _, u := range sp.units {
+		for _, d := range u.devices {
+			m := d.Find(sunspec.MeterModels...)
+			if m == nil {
+				continue
+			}
+			opt := strings.ToLower(d.Options())
+			if strings.Contains(opt, "export") && strings.Contains(opt, "import") {
+				sp.useMeter(u, m, d)
+				return
+			}
+			if first == nil {
+				first, firstDevice, firstMeter = u, d, m
+			}
+		}
+	}
+	if first == nil {
+		log.Printf("no meter found, the power export cannot be determined")
+		return
+	}
+	if sp.meter != firstMeter {
+		log.Printf("no export+import meter found, falling back to the first meter")
+	}
+	sp.useMeter(first, firstMeter, firstDevice)
+}
+
+func (sp *sunspecProvider) useMeter(u *sunspecUnit, m *sunspec.Model, d *sunspec.Device) {
+	if sp.meter == m {
+		return
+	}
+	sp.meterUnit, sp.meter = u, m
+	log.Printf("Using meter %s of inverter %s for the power export", d, u)
+}
+
+func (sp *sunspecProvider) read(u *sunspecUnit) (inverterReading, error) {
+	var r inverterReading
+
+	if u.devices == nil {
+		if err := sp.discover(u); err != nil {
+			return r, err
+		}
+	}
+	if err := u.conn.use(u.UnitID); err != nil {
+		return r, err
+	}
+
+	for _, m := range u.inverters {
+		if err := m.Read(u.conn.c); err != nil {
+			log.Printf("error reading inverter registers: %v", err)
+			return r, err
+		}
+		if st := m.Value("St"); st.Value != sunspec.StateMPPT && st.Value != sunspec.StateThrottled {
+			log.Printf("current inverter status: %s", st)
+		}
+
+		// The production is informational only and treated as zero if
+		// unavailable.
+		dcPower, acPower := m.Value("DCW"), m.Value("W")
+		log.Printf("Inverter %s DC Power: %s", u, dcPower)
+		log.Printf("Inverter %s AC Power: %s", u, acPower)
+		r.dcPower += dcPower.Or(0)
+		r.acPower += acPower.Or(0)
+	}
+
+	if u == sp.meterUnit {
+		if err := sp.meter.Read(u.conn.c); err != nil {
+			log.Printf("error reading meter data: %v", err)
+			return r, err
+		}
+
+		power := sp.meter.Value("W")
+		if !power.Valid {
+			return r, fmt.Errorf("%w: meter of inverter %s reports no AC power", errInvalidReading, u)
+		}
+		// meter AC power = balance of production and consumption
+		// positive values indicate a surplus -> export to grid
+		r.meterPower = power.Value
+		if !u.exportPositive {
+			// SunSpec meters report an import as positive power
+			r.meterPower = -power.Value
+		}
+		log.Printf("Meter AC Power: %f", r.meterPower)
+		r.hasMeter = true
+	}
+
+	for i, m := range u.batteries {
+		if err := m.Read(u.conn.c); err != nil {
+			log.Printf("error reading battery data: %v", err)
+			return r, err
+		}
+
+		// positive values indicate discharging
+		power := m.Value("W")
+		if !power.Valid {
+			return r, fmt.Errorf("%w: battery %d of inverter %s reports no power", errInvalidReading, i+1, u)
+		}
+		log.Printf("Battery %d Power: %f", i+1, -power.Value)
+		r.batteryPower -= power.Value
+	}
+
+	return r, nil
+}
+
+func (sp *sunspecProvider) CurrentPowerExport() (float64, error) {
+	total, err := readInverters(sp.units, sp.read,
+		func(u *sunspecUnit) bool { return u == sp.meterUnit || len(u.batteries) > 0 },
+		func(u *sunspecUnit) *modbusConn { return u.conn })
+	if err != nil {
+		return 0, err
+	}
+
+	// If the system has batteries installed, consider the amount of energy flowing into them
+	// as surplus. That is, prioritize Miele appliances higher than the batteries.
+	powerExport := total.meterPower + total.batteryPower
+
+	sp.last = powerReading{
+		Time:         time.Now(),
+		PVPower:      total.dcPower,
+		ACPower:      total.acPower,
+		MeterPower:   total.meterPower,
+		BatteryPower: total.batteryPower,
+		Export:       powerExport,
+	}
+
+	return powerExport, nil
+}
+
+func (sp *sunspecProvider) LastReading() powerReading {
+	return sp.last
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/ingmarstein/mielesolar/modbus/simulator"
+	"github.com/ingmarstein/mielesolar/modbus/sunspec"
+	"github.com/simonvetter/modbus"
+)
+
+// sunspecDevice serves a SunSpec model chain in the standard big-endian
+// encoding at address 40000.
+type sunspecDevice struct {
+	regs []uint16
+}
+
+func newSunSpecDevice() *sunspecDevice {
+	return &sunspecDevice{regs: []uint16{0x5375, 0x6E53}} // "SunS"
+}
+
+// model appends a model of the given length with the values at the offsets.
+func (d *sunspecDevice) model(id uint16, length int, values map[int][]uint16) {
+	body := make([]uint16, length)
+	for offset, v := range values {
+		copy(body[offset:], v)
+	}
+	d.regs = append(d.regs, id, uint16(length))
+	d.regs = append(d.regs, body...)
+}
+
+func (d *sunspecDevice) common(manufacturer, options string) {
+	str := func(s string, n int) []uint16 {
+		b := make([]byte, 2*n)
+		copy(b, s)
+		regs := make([]uint16, n)
+		for i := range regs {
+			regs[i] = uint16(b[2*i])<<8 | uint16(b[2*i+1])
+		}
+		return regs
+	}
+	d.model(sunspec.ModelCommon, 66, map[int][]uint16{0: str(manufacturer, 16), 32: str(options, 8)})
+}
+
+func float32Regs(v float32) []uint16 {
+	bits := math.Float32bits(v)
+	return []uint16{uint16(bits >> 16), uint16(bits)}
+}
+
+func (d *sunspecDevice) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest) ([]uint16, error) {
+	const base = 40000
+	if req.IsWrite {
+		return nil, modbus.ErrIllegalFunction
+	}
+	if req.Addr < base || int(req.Addr)+int(req.Quantity) > base+len(d.regs) {
+		return nil, modbus.ErrIllegalDataAddress
+	}
+
+	return d.regs[req.Addr-base : int(req.Addr-base)+int(req.Quantity)], nil
+}
+
+func (d *sunspecDevice) HandleCoils(*modbus.CoilsRequest) ([]bool, error) {
+	return nil, modbus.ErrIllegalFunction
+}
+
+func (d *sunspecDevice) HandleDiscreteInputs(*modbus.DiscreteInputsRequest) ([]bool, error) {
+	return nil, modbus.ErrIllegalFunction
+}
+
+func (d *sunspecDevice) HandleInputRegisters(*modbus.InputRegistersRequest) ([]uint16, error) {
+	return nil, modbus.ErrIllegalFunction
+}
+
+func openSunSpecProvider(t *testing.T, targets ...inverterTarget) *sunspecProvider {
+	t.Helper()
+
+	p, err := newSunSpecProvider(targets...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = p.Close() })
+	p.Init()
+
+	return p
+}
+
+func TestSunSpecProviderSolarEdge(t *testing.T) {
+	address := freeAddress(t)
+	sample := simulator.Sample{Production: 4000, Consumption: 1500}
+	startSimulator(t, address, simulator.Config{UnitID: 1, Meter: true, ConsumptionMeter: true}, simulator.ProfileFunc(func(time.Duration) simulator.Sample {
+		return sample
+	}))
+
+	p := openSunSpecProvider(t, inverterTarget{Address: address, UnitID: 1})
+	if p.meter == nil || p.meter.Address != 40121+174+67 {
+		t.Fatalf("expected the export+import meter to be selected, got %+v", p.meter)
+	}
+
+	got, err := p.CurrentPowerExport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 4000*simulator.Efficiency - 1500; got != want {
+		t.Errorf("CurrentPowerExport() = %v, want %v", got, want)
+	}
+	if r := p.LastReading(); r.PVPower != sample.Production || r.ACPower != 4000*simulator.Efficiency {
+		t.Errorf("LastReading() = %+v", r)
+	}
+}
+
+func TestSunSpecProviderGeneric(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		meterPower uint16
+		want       float64
+		ok         bool
+	}{
+		// SunSpec meters report an import as positive power
+		{"export", uint16(0xFFFF & -1500), 1500 + 500, true},
+		{"import", 800, -800 + 500, true},
+		{"meter power not implemented", 0x8000, 0, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newSunSpecDevice()
+			d.common("Fronius", "")
+			d.model(sunspec.ModelInverterThreePhaseFloat, 60, map[int][]uint16{
+				20: float32Regs(3000), // W
+				36: float32Regs(3100), // DCW
+				46: {sunspec.StateMPPT},
+			})
+			d.common("Fronius", "Consumption")
+			d.model(sunspec.ModelMeterSinglePhase, 105, map[int][]uint16{16: {1000}})
+			d.common("Fronius", "Export+Import")
+			d.model(sunspec.ModelMeterThreePhaseWye, 105, map[int][]uint16{16: {tt.meterPower}})
+			d.common("BYD", "")
+			d.model(sunspec.ModelLithiumIonBatteryBank, 62, map[int][]uint16{45: {uint16(0xFFFF & -500)}}) // charging
+			d.model(sunspec.ModelEnd, 0, nil)
+
+			address := freeAddress(t)
+			startHandler(t, address, d)
+			p := openSunSpecProvider(t, inverterTarget{Address: address, UnitID: 1})
+
+			got, err := p.CurrentPowerExport()
+			if !tt.ok {
+				if !errors.Is(err, errInvalidReading) {
+					t.Errorf("CurrentPowerExport() = %v, %v; want invalid reading", got, err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("CurrentPowerExport() = %v, %v; want %v", got, err, tt.want)
+			}
+			if r := p.LastReading(); r.PVPower != 3100 || r.ACPower != 3000 || r.BatteryPower != 500 {
+				t.Errorf("LastReading() = %+v", r)
+			}
+		})
+	}
+}
+
+func TestSunSpecProviderUnavailable(t *testing.T) {
+	meterAddress, batteryAddress, sleepingAddress := freeAddress(t), freeAddress(t), freeAddress(t)
+	startSimulator(t, meterAddress, simulator.Config{UnitID: 1, Meter: true}, simulator.ProfileFunc(func(time.Duration) simulator.Sample {
+		return simulator.Sample{Production: 2000, Consumption: 500}
+	}))
+	d := newSunSpecDevice()
+	d.common("BYD", "")
+	d.model(sunspec.ModelLithiumIonBatteryBank, 62, map[int][]uint16{45: {300}}) // discharging
+	d.model(sunspec.ModelEnd, 0, nil)
+	batteryServer, err := modbus.NewServer(&modbus.ServerConfiguration{
+		URL:        "tcp://" + batteryAddress,
+		Timeout:    time.Minute,
+		MaxClients: 10,
+	}, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := batteryServer.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = batteryServer.Stop() })
+	sleeping := startSimulator(t, sleepingAddress, simulator.Config{UnitID: 1}, simulator.ProfileFunc(func(time.Duration) simulator.Sample {
+		return simulator.Sample{Production: 1000}
+	}))
+
+	p := openSunSpecProvider(t, inverterTarget{Address: meterAddress, UnitID: 1}, inverterTarget{Address: batteryAddress, UnitID: 1}, inverterTarget{Address: sleepingAddress, UnitID: 1})
+	want := 2000*simulator.Efficiency - 500 - 300
+	if got, err := p.CurrentPowerExport(); err != nil || got != want {
+		t.Fatalf("CurrentPowerExport() = %v, %v; want %v", got, err, want)
+	}
+
+	// the inverter without meter or batteries goes to sleep
+	if err := sleeping.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := p.CurrentPowerExport(); err != nil || got != want {
+		t.Errorf("CurrentPowerExport() = %v, %v with one inverter asleep; want %v", got, err, want)
+	}
+
+	// the discharging battery would be missed
+	if err := batteryServer.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := p.CurrentPowerExport(); err == nil {
+		t.Errorf("CurrentPowerExport() = %v, expected error with the battery unavailable", got)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import "time"
+
+type powerSample struct {
+	time  time.Time
+	power float64
+}
+
+// surplusWindow keeps a rolling history of surplus power readings. It is used
+// to decide whether a surplus has been available for long enough to start an
+// appliance instead of reacting to a single sunny sample between clouds.
+type surplusWindow struct {
+	samples []powerSample
+}
+
+// add records a reading and drops samples which are no longer needed to
+// evaluate windows of up to maxAge. The newest sample older than maxAge is
+// retained as it describes the surplus at the beginning of the window.
+func (w *surplusWindow) add(t time.Time, power float64, maxAge time.Duration) {
+	w.samples = append(w.samples, powerSample{time: t, power: power})
+
+	cutoff := t.Add(-maxAge)
+	n := 0
+	for n+1 < len(w.samples) && !w.samples[n+1].time.After(cutoff) {
+		n++
+	}
+	w.samples = w.samples[n:]
+}
+
+// reset discards all samples, e.g. after a failed reading or when the
+// history no longer reflects the current situation.
+func (w *surplusWindow) reset() {
+	w.samples = nil
+}
+
+// shift adjusts all recorded samples by delta. It is used to account for the
+// consumption of an appliance which has just been started.
+func (w *surplusWindow) shift(delta float64) {
+	for i := range w.samples {
+		w.samples[i].power += delta
+	}
+}
+
+// sustained reports whether the surplus did not drop below threshold during
+// the period d preceding now. It returns false if the history does not cover
+// the whole period yet. A zero period only considers the latest sample.
+func (w *surplusWindow) sustained(now time.Time, d time.Duration, threshold float64) bool {
+	if len(w.samples) == 0 {
+		return false
+	}
+
+	start := now.Add(-d)
+	if w.samples[0].time.After(start) {
+		return false
+	}
+
+	for i := len(w.samples) - 1; i >= 0; i-- {
+		if w.samples[i].power < threshold {
+			return false
+		}
+		if !w.samples[i].time.After(start) {
+			break
+		}
+	}
+
+	return true
+}
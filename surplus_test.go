@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSurplusWindowSustained(t *testing.T) {
+	t0 := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	minute := func(m int) time.Time { return t0.Add(time.Duration(m) * time.Minute) }
+
+	tests := []struct {
+		name      string
+		samples   []float64 // one per minute starting at t0
+		d         time.Duration
+		threshold float64
+		want      bool
+	}{
+		{"empty", nil, 5 * time.Minute, 500, false},
+		{"period not covered yet", []float64{600, 600, 600}, 5 * time.Minute, 500, false},
+		{"sustained", []float64{600, 600, 600, 600, 600, 600}, 5 * time.Minute, 500, true},
+		{"at threshold", []float64{500, 500, 500, 500, 500, 500}, 5 * time.Minute, 500, true},
+		{"dip", []float64{600, 600, 400, 600, 600, 600}, 5 * time.Minute, 500, false},
+		{"dip before period", []float64{400, 600, 600, 600, 600, 600, 600}, 5 * time.Minute, 500, true},
+		{"dip at start of period", []float64{600, 400, 600, 600, 600, 600, 600}, 5 * time.Minute, 500, false},
+		{"latest sample too low", []float64{600, 600, 600, 600, 600, 400}, 5 * time.Minute, 500, false},
+		{"zero period", []float64{400, 600}, 0, 500, true},
+		{"zero period below threshold", []float64{600, 400}, 0, 500, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var w surplusWindow
+			for i, p := range tt.samples {
+				w.add(minute(i), p, time.Hour)
+			}
+			now := minute(max(len(tt.samples)-1, 0))
+			if got := w.sustained(now, tt.d, tt.threshold); got != tt.want {
+				t.Errorf("sustained() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSurplusWindowGap(t *testing.T) {
+	t0 := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	// the surplus is assumed to persist between sparse samples
+	var w surplusWindow
+	w.add(t0, 600, 5*time.Minute)
+	w.add(t0.Add(10*time.Minute), 600, 5*time.Minute)
+	if !w.sustained(t0.Add(10*time.Minute), 5*time.Minute, 500) {
+		t.Error("surplus not sustained across gap")
+	}
+	if len(w.samples) != 2 {
+		t.Errorf("got %d samples, want the sample preceding the period retained", len(w.samples))
+	}
+
+	// a reset, e.g. while no device was waiting, starts over
+	w.reset()
+	w.add(t0.Add(20*time.Minute), 600, 5*time.Minute)
+	if w.sustained(t0.Add(20*time.Minute), 5*time.Minute, 500) {
+		t.Error("surplus sustained after reset")
+	}
+	if !w.sustained(t0.Add(20*time.Minute), 0, 500) {
+		t.Error("latest sample not considered for zero period")
+	}
+}
+
+func TestSurplusWindowAdd(t *testing.T) {
+	t0 := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	var w surplusWindow
+	for i := range 10 {
+		w.add(t0.Add(time.Duration(i)*time.Minute), float64(i), 3*time.Minute)
+	}
+	// the samples of the last three minutes plus the one before
+	if len(w.samples) != 4 || w.samples[0].power != 6 || w.samples[3].power != 9 {
+		t.Errorf("samples = %v, want 6 to 9", w.samples)
+	}
+}
+
+func TestSurplusWindowShift(t *testing.T) {
+	t0 := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	var w surplusWindow
+	for i := range 6 {
+		w.add(t0.Add(time.Duration(i)*time.Minute), 1000, time.Hour)
+	}
+	now := t0.Add(5 * time.Minute)
+	if !w.sustained(now, 5*time.Minute, 800) {
+		t.Fatal("surplus not sustained")
+	}
+
+	// a started appliance consumes part of the surplus
+	w.shift(-300)
+	if w.sustained(now, 5*time.Minute, 800) {
+		t.Error("surplus sustained after shift")
+	}
+	if !w.sustained(now, 5*time.Minute, 700) {
+		t.Error("remaining surplus not sustained")
+	}
+}